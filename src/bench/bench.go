@@ -0,0 +1,237 @@
+// Package bench runs db_bench-style workloads against a tree, and reports
+// throughput, latencies and amplification
+//
+// Workloads of a Bench run one after another on the same tree, so read
+// workloads usually follow a fill, e.g. fillrandom,readrandom. Writes go
+// straight to the tree, without a WAL.
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"bagh/config"
+	"bagh/segment"
+	"bagh/seqno"
+	"bagh/tree"
+	"bagh/vfs"
+)
+
+// Bench holds the tree the workloads run against
+type Bench struct {
+	opts  Options
+	tree  *tree.Tree
+	seqno *seqno.SequenceNumberCounter
+
+	// Random bytes values are cut from
+	values []byte
+
+	// Keys written and not removed, for the space amplification
+	live *liveSet
+
+	// Amount of keys, grows with the inserts of YCSB D and E
+	records atomic.Int64
+
+	rotateMutex sync.Mutex
+
+	flushed    chan struct{}
+	stop       chan struct{}
+	compactor  sync.WaitGroup
+	compactErr atomic.Pointer[error]
+}
+
+// Open creates the tree of a benchmark
+func Open(opts Options) (*Bench, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	fs := vfs.OrDefault(opts.FS)
+	if _, err := fs.Stat(opts.Path); !os.IsNotExist(err) {
+		return nil, fmt.Errorf("benchmark tree %s must not exist yet", opts.Path)
+	}
+
+	cfg := config.NewConfig(opts.Path).
+		SetFS(fs).
+		BlockSize(opts.BlockSize).
+		SetBlockCache(segment.NewBlockCache(opts.CacheSize)).
+		MaxMemtableSize(opts.MemtableSize)
+	t, err := tree.Open(*cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	rng := rand.New(rand.NewSource(opts.Seed))
+	values := make([]byte, max(1024*1024, 2*opts.ValueSize))
+	for i := range values {
+		// Printable, like db_bench's values
+		values[i] = byte(' ' + rng.Intn(95))
+	}
+
+	b := &Bench{
+		opts:    opts,
+		tree:    t,
+		seqno:   seqno.NewSequenceNumberCounter(0),
+		values:  values,
+		live:    &liveSet{},
+		flushed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	b.records.Store(int64(opts.Num))
+
+	if opts.CompactionTrigger > 0 {
+		b.compactor.Add(1)
+		go b.compact()
+	}
+	return b, nil
+}
+
+// Tree returns the tree of the benchmark
+func (b *Bench) Tree() *tree.Tree {
+	return b.tree
+}
+
+// Close stops compacting and closes the tree
+func (b *Bench) Close() error {
+	close(b.stop)
+	b.compactor.Wait()
+	return b.tree.Close()
+}
+
+// compact runs a major compaction whenever a flush makes L0 reach the trigger
+func (b *Bench) compact() {
+	defer b.compactor.Done()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-b.flushed:
+		}
+
+		if b.tree.FirstLevelSegmentCount() < b.opts.CompactionTrigger {
+			continue
+		}
+		if err := b.tree.MajorCompact(b.opts.TargetSegmentSize); err != nil && !errors.Is(err, tree.ErrClosed) {
+			b.compactErr.CompareAndSwap(nil, &err)
+			return
+		}
+	}
+}
+
+// write inserts or removes a key like the KvStore does, waiting for write
+// stalls and flushing full memtables
+func (b *Bench) write(index int, key []byte, val []byte, remove bool) error {
+	if err := b.compactionError(); err != nil {
+		return err
+	}
+	if err := b.tree.WriteController().Wait(false); err != nil {
+		return err
+	}
+
+	var size uint32
+	var err error
+	if remove {
+		_, size, err = b.tree.Remove(key, b.seqno.Next())
+	} else {
+		_, size, err = b.tree.Insert(key, val, b.seqno.Next())
+	}
+	if err != nil {
+		return err
+	}
+	b.live.set(index, !remove)
+
+	if maxSize := b.tree.MaxMemtableSize(); maxSize > 0 && size > maxSize {
+		b.rotate(maxSize)
+	}
+	return nil
+}
+
+func (b *Bench) rotate(minSize uint32) {
+	b.rotateMutex.Lock()
+	defer b.rotateMutex.Unlock()
+
+	// Another thread may have rotated the memtable in the meantime
+	if b.tree.ActiveMemtableSize() <= minSize {
+		return
+	}
+	b.tree.ScheduleFlush(func() {
+		select {
+		case b.flushed <- struct{}{}:
+		default:
+		}
+	})
+}
+
+func (b *Bench) compactionError() error {
+	if err := b.compactErr.Load(); err != nil {
+		return fmt.Errorf("compaction failed: %w", *err)
+	}
+	return nil
+}
+
+// key formats a key index as a zero-padded decimal of KeySize bytes, so
+// keys sort like their indexes
+func (b *Bench) key(index int) []byte {
+	return []byte(fmt.Sprintf("%0*d", b.opts.KeySize, index))
+}
+
+// value returns a value of ValueSize bytes at a random offset
+func (b *Bench) value(rng *rand.Rand) []byte {
+	offset := rng.Intn(len(b.values) - b.opts.ValueSize + 1)
+	return b.values[offset : offset+b.opts.ValueSize]
+}
+
+// liveSet is a growable bitmap of the keys that currently exist
+type liveSet struct {
+	mutex sync.RWMutex
+	words []atomic.Uint64
+	count atomic.Int64
+}
+
+func (s *liveSet) set(index int, live bool) {
+	s.mutex.RLock()
+	if index/64 >= len(s.words) {
+		s.mutex.RUnlock()
+		s.grow(index/64 + 1)
+		s.mutex.RLock()
+	}
+	defer s.mutex.RUnlock()
+
+	word, bit := &s.words[index/64], uint64(1)<<(index%64)
+	for {
+		old := word.Load()
+		updated := old &^ bit
+		if live {
+			updated = old | bit
+		}
+		if updated == old {
+			return
+		}
+		if word.CompareAndSwap(old, updated) {
+			if live {
+				s.count.Add(1)
+			} else {
+				s.count.Add(-1)
+			}
+			return
+		}
+	}
+}
+
+func (s *liveSet) grow(words int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if words <= len(s.words) {
+		return
+	}
+
+	grown := make([]atomic.Uint64, max(words, 2*len(s.words)))
+	for i := range s.words {
+		grown[i].Store(s.words[i].Load())
+	}
+	s.words = grown
+}
@@ -0,0 +1,95 @@
+package bench
+
+import (
+	"testing"
+
+	"bagh/vfs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openBench(t *testing.T, threads int) *Bench {
+	opts := DefaultOptions()
+	opts.Path = "/bench"
+	opts.FS = vfs.NewMemFS()
+	opts.Num = 2000
+	opts.Threads = threads
+	opts.BlockSize = 1024
+	opts.MemtableSize = 16 * 1024
+	opts.CompactionTrigger = 2
+
+	b, err := Open(opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, b.Close()) })
+	return b
+}
+
+func TestFillAndRead(t *testing.T) {
+	b := openBench(t, 4)
+
+	result, err := b.Run("fillseq")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2000), result.Ops)
+	assert.Equal(t, int64(2000*(16+100)), result.Bytes)
+	assert.Greater(t, result.WriteAmplification, 0.0)
+
+	for _, workload := range []string{"readrandom", "readseq", "readreverse", "seekrandom"} {
+		result, err := b.Run(workload)
+		require.NoError(t, err, workload)
+		assert.Equal(t, int64(2000), result.Ops, workload)
+		assert.Equal(t, int64(2000), result.Found, workload)
+		assert.Greater(t, result.SpaceAmplification, 0.0, workload)
+	}
+}
+
+func TestDeleteRandom(t *testing.T) {
+	b := openBench(t, 1)
+
+	_, err := b.Run("fillseq")
+	require.NoError(t, err)
+	_, err = b.Run("deleterandom")
+	require.NoError(t, err)
+
+	// Every key that is still live is scanned, and no other one
+	var count int64
+	iter := b.Tree().Iter().IntoIter()
+	for _, _, ok := iter.Next(); ok; _, _, ok = iter.Next() {
+		count++
+	}
+	assert.Equal(t, b.live.count.Load(), count)
+	assert.Less(t, count, int64(2000))
+}
+
+func TestAllWorkloads(t *testing.T) {
+	b := openBench(t, 2)
+
+	for _, workload := range Workloads {
+		result, err := b.Run(workload)
+		require.NoError(t, err, workload)
+		assert.GreaterOrEqual(t, result.Ops, int64(1000), workload)
+		assert.NotEmpty(t, result.String(), workload)
+	}
+
+	// YCSB D and E insert new keys
+	assert.Greater(t, b.records.Load(), int64(2000))
+}
+
+func TestUnknownWorkload(t *testing.T) {
+	b := openBench(t, 1)
+
+	_, err := b.Run("fillrandomly")
+	assert.Error(t, err)
+}
+
+func TestLiveSet(t *testing.T) {
+	var s liveSet
+	s.set(3, true)
+	s.set(3, true)
+	s.set(1000, true)
+	assert.Equal(t, int64(2), s.count.Load())
+
+	s.set(3, false)
+	s.set(4, false)
+	assert.Equal(t, int64(1), s.count.Load())
+}
@@ -0,0 +1,87 @@
+package bench
+
+import (
+	"fmt"
+
+	"bagh/vfs"
+)
+
+// Options configure a benchmark, all workloads of a Bench share them
+type Options struct {
+	// Directory of the tree, it must not exist yet
+	Path string
+
+	// Filesystem of the tree, the OS filesystem if nil
+	FS vfs.FS
+
+	// Keys are numbered from 0 to Num-1, write workloads run Num operations
+	Num int
+
+	// Operations of read and mixed workloads, Num if 0
+	Reads int
+
+	// Goroutines running every workload, they share its operations
+	Threads int
+
+	// Sizes of every key and value in bytes
+	KeySize   int
+	ValueSize int
+
+	BlockSize    uint32
+	CacheSize    uint64
+	MemtableSize uint32
+
+	// Amount of L0 segments that starts a major compaction, 0 disables compactions
+	CompactionTrigger int
+
+	// Size of the segments written by compactions
+	TargetSegmentSize uint64
+
+	Seed int64
+}
+
+// DefaultOptions creates options like db_bench's defaults, with a smaller Num
+func DefaultOptions() Options {
+	return Options{
+		Num:               100_000,
+		Threads:           1,
+		KeySize:           16,
+		ValueSize:         100,
+		BlockSize:         4 * 1024,
+		CacheSize:         8 * 1024 * 1024,
+		MemtableSize:      8 * 1024 * 1024,
+		CompactionTrigger: 4,
+		TargetSegmentSize: 64 * 1024 * 1024,
+		Seed:              301,
+	}
+}
+
+func (o *Options) validate() error {
+	switch {
+	case o.Path == "":
+		return fmt.Errorf("no path for the tree")
+	case o.Num < 1:
+		return fmt.Errorf("num must be at least 1")
+	case o.Reads < 0:
+		return fmt.Errorf("reads must not be negative")
+	case o.Threads < 1:
+		return fmt.Errorf("threads must be at least 1")
+	case o.KeySize < 8:
+		// Keys are zero-padded decimal indexes
+		return fmt.Errorf("key size must be at least 8 bytes")
+	case o.ValueSize < 0:
+		return fmt.Errorf("value size must not be negative")
+	case o.BlockSize < 1024:
+		return fmt.Errorf("block size must be at least 1024 bytes")
+	case o.CompactionTrigger < 0:
+		return fmt.Errorf("compaction trigger must not be negative")
+	}
+	return nil
+}
+
+func (o *Options) reads() int {
+	if o.Reads > 0 {
+		return o.Reads
+	}
+	return o.Num
+}
@@ -0,0 +1,418 @@
+package bench
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bagh/segment"
+	"bagh/stats"
+	"bagh/value"
+)
+
+// Workloads are the names Run accepts
+var Workloads = []string{
+	"fillseq", "fillrandom", "overwrite", "deleterandom",
+	"readrandom", "readseq", "readreverse", "seekrandom", "readwhilewriting",
+	"ycsba", "ycsbb", "ycsbc", "ycsbd", "ycsbe", "ycsbf",
+}
+
+// Result describes a finished workload
+type Result struct {
+	Workload string
+	Ops      int64
+	Duration time.Duration
+
+	// Reads that found their key, and user bytes written and read
+	Found int64
+	Bytes int64
+
+	Latency    stats.HistogramSnapshot
+	MaxLatency time.Duration
+
+	// Bytes written by flushes and compactions per user byte written
+	WriteAmplification float64
+
+	// Blocks read from disk (block cache misses) per read
+	ReadAmplification float64
+
+	// Size of the segments per byte of live keys and values, at the end
+	SpaceAmplification float64
+}
+
+// OpsPerSecond returns the throughput of the workload
+func (r *Result) OpsPerSecond() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Ops) / r.Duration.Seconds()
+}
+
+// String formats the result like db_bench, with latencies and amplification
+func (r *Result) String() string {
+	var sb strings.Builder
+	micros := 0.0
+	if r.Ops > 0 {
+		micros = float64(r.Duration.Microseconds()) / float64(r.Ops)
+	}
+	fmt.Fprintf(&sb, "%-16s : %11.3f micros/op %9.0f ops/sec", r.Workload, micros, r.OpsPerSecond())
+	if r.Bytes > 0 && r.Duration > 0 {
+		fmt.Fprintf(&sb, "; %6.1f MB/s", float64(r.Bytes)/(1024*1024)/r.Duration.Seconds())
+	}
+	fmt.Fprintf(&sb, " (%d ops", r.Ops)
+	if r.Found > 0 {
+		fmt.Fprintf(&sb, ", %d found", r.Found)
+	}
+	sb.WriteString(")\n")
+
+	fmt.Fprintf(&sb, "%-16s   latency p50 <= %v, p95 <= %v, p99 <= %v, p99.9 <= %v, max %v\n", "",
+		r.Latency.Quantile(0.5), r.Latency.Quantile(0.95), r.Latency.Quantile(0.99), r.Latency.Quantile(0.999),
+		r.MaxLatency.Round(time.Microsecond))
+	fmt.Fprintf(&sb, "%-16s   amplification write %.2f, read %.2f, space %.2f", "",
+		r.WriteAmplification, r.ReadAmplification, r.SpaceAmplification)
+	return sb.String()
+}
+
+// recorder collects the operations of the threads of a workload
+type recorder struct {
+	latency stats.Histogram
+	max     atomic.Int64
+	ops     atomic.Int64
+	found   atomic.Int64
+	bytes   atomic.Int64
+
+	// Point reads, seeks and items read by scans
+	reads atomic.Int64
+
+	// Operations handed out to the threads
+	next  atomic.Int64
+	total int64
+}
+
+// claim hands out the next operation, false once all are taken
+func (r *recorder) claim() (int, bool) {
+	i := r.next.Add(1) - 1
+	return int(i), i < r.total
+}
+
+// observe records an operation that started at start
+func (r *recorder) observe(start time.Time, bytes int) {
+	d := time.Since(start)
+	r.latency.Observe(d)
+	for {
+		old := r.max.Load()
+		if int64(d) <= old || r.max.CompareAndSwap(old, int64(d)) {
+			break
+		}
+	}
+	r.ops.Add(1)
+	r.bytes.Add(int64(bytes))
+}
+
+// thread runs the operations of a workload with a random generator of its own
+type thread struct {
+	id   int
+	b    *Bench
+	r    *recorder
+	rng  *rand.Rand
+	zipf *rand.Zipf
+}
+
+// Run runs a workload, see Workloads for the names
+func (b *Bench) Run(workload string) (*Result, error) {
+	run, total := b.workload(workload)
+	if run == nil {
+		return nil, fmt.Errorf("unknown workload %q", workload)
+	}
+
+	r := &recorder{total: int64(total)}
+	before := b.tree.Stats()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	errs := make([]error, b.opts.Threads)
+	for i := 0; i < b.opts.Threads; i++ {
+		rng := rand.New(rand.NewSource(b.opts.Seed + int64(i+1)*1_000_003 + int64(len(workload))))
+		th := &thread{id: i, b: b, r: r, rng: rng, zipf: rand.NewZipf(rng, 1.1, 1, uint64(b.opts.Num-1))}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = run(th)
+		}(i)
+	}
+	wg.Wait()
+
+	result := &Result{
+		Workload:   workload,
+		Ops:        r.ops.Load(),
+		Duration:   time.Since(start),
+		Found:      r.found.Load(),
+		Bytes:      r.bytes.Load(),
+		Latency:    r.latency.Snapshot(),
+		MaxLatency: time.Duration(r.max.Load()),
+	}
+	b.amplification(result, r.reads.Load(), before, b.tree.Stats())
+
+	for _, err := range errs {
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func (b *Bench) amplification(result *Result, reads int64, before, after stats.Stats) {
+	if written := after.BytesWritten - before.BytesWritten; written > 0 {
+		disk := after.FlushBytes + after.CompactionBytesWritten - before.FlushBytes - before.CompactionBytesWritten
+		result.WriteAmplification = float64(disk) / float64(written)
+	}
+	if reads > 0 {
+		result.ReadAmplification = float64(after.BlockCacheMisses-before.BlockCacheMisses) / float64(reads)
+	}
+	if live := b.live.count.Load() * int64(b.opts.KeySize+b.opts.ValueSize); live > 0 {
+		result.SpaceAmplification = float64(after.DiskBytes) / float64(live)
+	}
+}
+
+// workload returns the function every thread runs, and the amount of operations
+func (b *Bench) workload(name string) (func(*thread) error, int) {
+	num, reads := b.opts.Num, b.opts.reads()
+	switch name {
+	case "fillseq":
+		return (*thread).fillSeq, num
+	case "fillrandom", "overwrite":
+		return (*thread).fillRandom, num
+	case "deleterandom":
+		return (*thread).deleteRandom, num
+	case "readrandom":
+		return (*thread).readRandom, reads
+	case "readseq":
+		return func(th *thread) error { return th.readSeq(false) }, reads
+	case "readreverse":
+		return func(th *thread) error { return th.readSeq(true) }, reads
+	case "seekrandom":
+		return (*thread).seekRandom, reads
+	case "readwhilewriting":
+		return (*thread).readWhileWriting, reads
+	case "ycsba", "ycsbb", "ycsbc", "ycsbd", "ycsbe", "ycsbf":
+		mix := ycsbMixes[name[len(name)-1]]
+		return func(th *thread) error { return th.ycsb(mix) }, reads
+	}
+	return nil, 0
+}
+
+func (th *thread) put(index int) error {
+	key, val := th.b.key(index), th.b.value(th.rng)
+	start := time.Now()
+	if err := th.b.write(index, key, val, false); err != nil {
+		return err
+	}
+	th.r.observe(start, len(key)+len(val))
+	return nil
+}
+
+func (th *thread) get(index int) (value.UserValue, error) {
+	key := th.b.key(index)
+	start := time.Now()
+	val, err := th.b.tree.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	th.r.reads.Add(1)
+	if val != nil {
+		th.r.found.Add(1)
+	}
+	th.r.observe(start, len(key)+len(val))
+	return val, nil
+}
+
+func (th *thread) fillSeq() error {
+	for i, ok := th.r.claim(); ok; i, ok = th.r.claim() {
+		if err := th.put(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (th *thread) fillRandom() error {
+	for _, ok := th.r.claim(); ok; _, ok = th.r.claim() {
+		if err := th.put(th.rng.Intn(th.b.opts.Num)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (th *thread) deleteRandom() error {
+	for _, ok := th.r.claim(); ok; _, ok = th.r.claim() {
+		index := th.rng.Intn(th.b.opts.Num)
+		key := th.b.key(index)
+		start := time.Now()
+		if err := th.b.write(index, key, nil, true); err != nil {
+			return err
+		}
+		th.r.observe(start, len(key))
+	}
+	return nil
+}
+
+func (th *thread) readRandom() error {
+	for _, ok := th.r.claim(); ok; _, ok = th.r.claim() {
+		if _, err := th.get(th.rng.Intn(th.b.opts.Num)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSeq scans the tree, every item is an operation
+func (th *thread) readSeq(reverse bool) error {
+	iter := th.b.tree.Iter().IntoIter()
+	defer func() { iter.Close() }()
+	for _, ok := th.r.claim(); ok; _, ok = th.r.claim() {
+		start := time.Now()
+		next := iter.Next
+		if reverse {
+			next = iter.NextBack
+		}
+		key, val, ok := next()
+		if !ok {
+			if err := iter.Err(); err != nil {
+				return err
+			}
+			// Start over, like db_bench does once it reaches the end
+			iter = th.b.tree.Iter().IntoIter()
+			continue
+		}
+		th.r.reads.Add(1)
+		th.r.found.Add(1)
+		th.r.observe(start, len(*key)+len(*val))
+	}
+	return nil
+}
+
+// seekRandom seeks to a random key and reads the first item at or after it
+func (th *thread) seekRandom() error {
+	for _, ok := th.r.claim(); ok; _, ok = th.r.claim() {
+		if err := th.seek(th.rng.Intn(th.b.opts.Num), 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (th *thread) seek(index, items int) error {
+	key := value.UserKey(th.b.key(index))
+	start := time.Now()
+	iter := th.b.tree.CreateRange(&segment.Bound[value.UserKey]{Included: &key}, nil, nil, nil).IntoIter()
+
+	th.r.reads.Add(1)
+	bytes := 0
+	for i := 0; i < items; i++ {
+		key, val, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if i == 0 {
+			th.r.found.Add(1)
+		}
+		bytes += len(*key) + len(*val)
+	}
+	iter.Close()
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	th.r.observe(start, bytes)
+	return nil
+}
+
+// readWhileWriting runs random reads, the first thread overwrites random
+// keys as well until the reads are done, only the reads are reported
+func (th *thread) readWhileWriting() error {
+	if th.id != 0 {
+		return th.readRandom()
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	rng := rand.New(rand.NewSource(th.rng.Int63()))
+	go func() {
+		for {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			index := rng.Intn(th.b.opts.Num)
+			if err := th.b.write(index, th.b.key(index), th.b.value(rng), false); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	err := th.readRandom()
+	close(stop)
+	if writeErr := <-done; err == nil {
+		err = writeErr
+	}
+	return err
+}
+
+// ycsbMix is the operation mix of a YCSB workload, in percent
+type ycsbMix struct {
+	read, update, insert, scan, readModifyWrite int
+
+	// Reads favor the most recently inserted keys, instead of zipfian ones
+	latest bool
+}
+
+var ycsbMixes = map[byte]ycsbMix{
+	'a': {read: 50, update: 50},
+	'b': {read: 95, update: 5},
+	'c': {read: 100},
+	'd': {read: 95, insert: 5, latest: true},
+	'e': {scan: 95, insert: 5},
+	'f': {read: 50, readModifyWrite: 50},
+}
+
+// ycsbKey picks an existing key, zipfian with the hot keys spread over the key space
+func (th *thread) ycsbKey(latest bool) int {
+	records := int(th.b.records.Load())
+	rank := int(th.zipf.Uint64())
+	if latest {
+		return max(records-1-rank, 0)
+	}
+	return int(uint64(rank) * 0x9E3779B97F4A7C15 % uint64(records))
+}
+
+func (th *thread) ycsb(mix ycsbMix) error {
+	for _, ok := th.r.claim(); ok; _, ok = th.r.claim() {
+		var err error
+		switch pick := th.rng.Intn(100); {
+		case pick < mix.read:
+			_, err = th.get(th.ycsbKey(mix.latest))
+		case pick < mix.read+mix.update:
+			err = th.put(th.ycsbKey(false))
+		case pick < mix.read+mix.update+mix.insert:
+			err = th.put(int(th.b.records.Add(1) - 1))
+		case pick < mix.read+mix.update+mix.insert+mix.scan:
+			err = th.seek(th.ycsbKey(false), 1+th.rng.Intn(100))
+		default:
+			index := th.ycsbKey(false)
+			if _, err = th.get(index); err == nil {
+				err = th.put(index)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
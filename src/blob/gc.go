@@ -0,0 +1,132 @@
+package blob
+
+import "bagh/value"
+
+// LivenessFunc reports if a blob record is still referenced by the index tree
+type LivenessFunc func(record *Record) (bool, error)
+
+// Relocation maps a live value to its new position after garbage collection
+type Relocation struct {
+	Key     value.UserKey
+	SeqNo   value.SeqNo
+	Pointer ValuePointer
+}
+
+// GcReport describes a garbage collection run
+type GcReport struct {
+	// Stale ratio of every scanned blob file
+	StaleRatios map[string]float64
+
+	// Live values that were moved into a new blob file
+	Relocations []Relocation
+
+	// Blob files that were rewritten, and can be removed once no index
+	// entry points into them anymore
+	Obsolete []string
+
+	// Bytes that are freed once the obsolete files are removed
+	ReclaimableBytes uint64
+}
+
+// StaleRatio returns the fraction of bytes in a blob file that are no longer referenced
+func (m *Manager) StaleRatio(fileID string, isLive LivenessFunc) (float64, error) {
+	var total, stale uint64
+
+	err := m.Scan(fileID, func(record Record) error {
+		size := uint64(recordHeaderSize + len(record.Key) + len(record.Value))
+		total += size
+
+		live, err := isLive(&record)
+		if err != nil {
+			return err
+		}
+		if !live {
+			stale += size
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if total == 0 {
+		return 1, nil
+	}
+	return float64(stale) / float64(total), nil
+}
+
+// Collect rewrites every blob file whose stale ratio is at least staleThreshold
+//
+// Live values are copied into a single new blob file, files marked obsolete
+// are skipped. The caller has to write the returned relocations into the
+// index tree, make them durable and then mark the rewritten files obsolete.
+// An obsolete blob file may only be removed once no index entry points into
+// it anymore.
+func (m *Manager) Collect(staleThreshold float64, isLive LivenessFunc) (*GcReport, error) {
+	report := &GcReport{
+		StaleRatios: make(map[string]float64),
+	}
+
+	var writer *Writer
+
+	for _, info := range m.Files() {
+		if m.IsObsolete(info.ID) {
+			continue
+		}
+
+		ratio, err := m.StaleRatio(info.ID, isLive)
+		if err != nil {
+			return nil, err
+		}
+		report.StaleRatios[info.ID] = ratio
+
+		if ratio == 0 || ratio < staleThreshold {
+			continue
+		}
+
+		if writer == nil {
+			if writer, err = m.NewWriter(); err != nil {
+				return nil, err
+			}
+		}
+
+		var liveBytes uint64
+		err = m.Scan(info.ID, func(record Record) error {
+			live, err := isLive(&record)
+			if err != nil || !live {
+				return err
+			}
+
+			ptr, err := writer.Write(record.Key, record.SeqNo, record.Value)
+			if err != nil {
+				return err
+			}
+			liveBytes += uint64(recordHeaderSize + len(record.Key) + len(record.Value))
+
+			report.Relocations = append(report.Relocations, Relocation{
+				Key:     record.Key,
+				SeqNo:   record.SeqNo,
+				Pointer: ptr,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		report.Obsolete = append(report.Obsolete, info.ID)
+		report.ReclaimableBytes += info.Size - liveBytes
+	}
+
+	if writer != nil {
+		info, err := writer.Finish()
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			m.Register(info)
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,446 @@
+package blob
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"bagh/descriptor"
+	"bagh/file"
+	"bagh/id"
+	"bagh/value"
+	"bagh/vfs"
+)
+
+// tempSuffix marks blob files that are still being written
+const tempSuffix = ".tmp"
+
+// obsoleteSuffix marks blob files rewritten by garbage collection, an empty
+// file next to the blob file, so the mark survives restarts
+const obsoleteSuffix = ".obsolete"
+
+// FileInfo describes a finished (immutable) blob file
+type FileInfo struct {
+	ID        string
+	Path      string
+	ItemCount uint64
+	Size      uint64
+}
+
+// Record is a single value stored in a blob file
+type Record struct {
+	Key     value.UserKey
+	SeqNo   value.SeqNo
+	Value   value.UserValue
+	Pointer ValuePointer
+}
+
+// Manager keeps track of the blob files of a tree
+//
+// Blob files are append-only and immutable once finished, values are
+// only ever dropped by rewriting a file through garbage collection.
+type Manager struct {
+	folder          string
+	descriptorTable *descriptor.FileDescriptorTable
+
+	mutex sync.RWMutex
+	files map[string]*FileInfo
+
+	// Files rewritten by garbage collection, that index entries may still
+	// point into, see MarkObsolete
+	obsolete map[string]struct{}
+
+	// Set for read-only managers, see OpenReadOnly
+	readOnly bool
+}
+
+// fs returns the filesystem of the blob files, the one of the descriptor table
+func (m *Manager) fs() vfs.FS {
+	return m.descriptorTable.FS()
+}
+
+// NewManager creates a manager for an empty blob folder
+func NewManager(folder string, descriptorTable *descriptor.FileDescriptorTable) (*Manager, error) {
+	if err := file.MkdirAllSynced(descriptorTable.FS(), folder); err != nil {
+		return nil, err
+	}
+
+	return &Manager{
+		folder:          folder,
+		descriptorTable: descriptorTable,
+		files:           make(map[string]*FileInfo),
+		obsolete:        make(map[string]struct{}),
+	}, nil
+}
+
+// Recover loads the blob files of a folder, deleting unfinished ones
+func Recover(folder string, descriptorTable *descriptor.FileDescriptorTable) (*Manager, error) {
+	m, err := NewManager(folder, descriptorTable)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := m.fs().ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	var marks []string
+	for _, entry := range entries {
+		path := filepath.Join(folder, entry.Name())
+
+		if strings.HasSuffix(entry.Name(), tempSuffix) {
+			if err := m.fs().Remove(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), obsoleteSuffix) {
+			marks = append(marks, entry.Name())
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		m.Register(&FileInfo{
+			ID:   entry.Name(),
+			Path: path,
+			Size: uint64(info.Size()),
+		})
+	}
+
+	for _, mark := range marks {
+		fileID := strings.TrimSuffix(mark, obsoleteSuffix)
+		if _, ok := m.files[fileID]; ok {
+			m.obsolete[fileID] = struct{}{}
+			continue
+		}
+		// The blob file was removed before its mark
+		if err := m.fs().Remove(filepath.Join(folder, mark)); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// OpenReadOnly loads the blob files of a folder written by another process
+//
+// Unfinished files are skipped instead of deleted, and the descriptors of
+// all files are kept open, so they stay readable after being deleted.
+func OpenReadOnly(folder string, descriptorTable *descriptor.FileDescriptorTable) (*Manager, error) {
+	m := &Manager{
+		folder:          folder,
+		descriptorTable: descriptorTable,
+		files:           make(map[string]*FileInfo),
+		obsolete:        make(map[string]struct{}),
+		readOnly:        true,
+	}
+	if err := m.Refresh(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// Refresh loads blob files that were added to the folder of a read-only
+// manager since it was opened, files that are gone stay readable
+func (m *Manager) Refresh() error {
+	if !m.readOnly {
+		return fmt.Errorf("blob manager is not read-only")
+	}
+
+	entries, err := m.fs().ReadDir(m.folder)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), tempSuffix) || strings.HasSuffix(entry.Name(), obsoleteSuffix) {
+			continue
+		}
+		if _, ok := m.files[entry.Name()]; ok {
+			continue
+		}
+
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(m.folder, entry.Name())
+		if err := m.descriptorTable.InsertPinned(path, entry.Name()); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		m.files[entry.Name()] = &FileInfo{
+			ID:   entry.Name(),
+			Path: path,
+			Size: uint64(info.Size()),
+		}
+	}
+	return nil
+}
+
+// NewWriter starts a new blob file
+//
+// The file becomes readable once it is finished and registered.
+func (m *Manager) NewWriter() (*Writer, error) {
+	fileID := id.GenerateSegmentID()
+	return newWriter(m.fs(), fileID, filepath.Join(m.folder, fileID))
+}
+
+// Register makes a finished blob file readable
+func (m *Manager) Register(info *FileInfo) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.files[info.ID] = info
+	m.descriptorTable.Insert(info.Path, info.ID)
+}
+
+// Remove deletes a blob file
+//
+// Only call this once no pointer into the file is reachable anymore.
+func (m *Manager) Remove(fileID string) error {
+	m.mutex.Lock()
+	info, ok := m.files[fileID]
+	_, marked := m.obsolete[fileID]
+	delete(m.files, fileID)
+	delete(m.obsolete, fileID)
+	m.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	m.descriptorTable.Remove(fileID)
+	if err := m.fs().Remove(info.Path); err != nil {
+		return err
+	}
+	if marked {
+		return m.fs().Remove(info.Path + obsoleteSuffix)
+	}
+	return nil
+}
+
+// MarkObsolete marks a blob file whose live values were moved by garbage
+// collection, it stays readable until it is removed, and is not collected again
+func (m *Manager) MarkObsolete(fileID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	info, ok := m.files[fileID]
+	if !ok {
+		return nil
+	}
+	if _, ok := m.obsolete[fileID]; ok {
+		return nil
+	}
+
+	f, err := m.fs().Create(info.Path + obsoleteSuffix)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := m.fs().SyncDir(m.folder); err != nil {
+		return err
+	}
+	m.obsolete[fileID] = struct{}{}
+	return nil
+}
+
+// Obsolete returns the blob files marked obsolete, sorted by ID
+func (m *Manager) Obsolete() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	fileIDs := make([]string, 0, len(m.obsolete))
+	for fileID := range m.obsolete {
+		fileIDs = append(fileIDs, fileID)
+	}
+	sort.Strings(fileIDs)
+	return fileIDs
+}
+
+// IsObsolete reports if a blob file is marked obsolete
+func (m *Manager) IsObsolete(fileID string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, ok := m.obsolete[fileID]
+	return ok
+}
+
+// Close releases the open descriptors of all blob files
+func (m *Manager) Close() {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for fileID := range m.files {
+		m.descriptorTable.Remove(fileID)
+	}
+}
+
+// Files returns the registered blob files, oldest first
+func (m *Manager) Files() []*FileInfo {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	files := make([]*FileInfo, 0, len(m.files))
+	for _, info := range m.files {
+		files = append(files, info)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ID < files[j].ID
+	})
+	return files
+}
+
+// Len returns the amount of registered blob files
+func (m *Manager) Len() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.files)
+}
+
+// DiskSpace returns the size of all registered blob files
+func (m *Manager) DiskSpace() uint64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var total uint64
+	for _, info := range m.files {
+		total += info.Size
+	}
+	return total
+}
+
+// Get reads the value a pointer references
+func (m *Manager) Get(ptr *ValuePointer) (value.UserValue, error) {
+	m.mutex.RLock()
+	_, ok := m.files[ptr.FileID]
+	m.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("blob file %s not found", ptr.FileID)
+	}
+
+	fileGuard, err := m.descriptorTable.Access(ptr.FileID)
+	if err != nil {
+		return nil, err
+	}
+	if fileGuard == nil {
+		return nil, fmt.Errorf("blob file %s not found", ptr.FileID)
+	}
+	defer fileGuard.Release()
+
+	val := make(value.UserValue, ptr.Length)
+	if _, err := fileGuard.File().ReadAt(val, int64(ptr.Offset)); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// Scan reads all records of a blob file in order
+func (m *Manager) Scan(fileID string, fn func(Record) error) error {
+	m.mutex.RLock()
+	info, ok := m.files[fileID]
+	m.mutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("blob file %s not found", fileID)
+	}
+
+	f, err := m.fs().Open(info.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var pos uint64
+
+	for {
+		record, size, err := readRecord(reader, fileID, pos)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("blob file %s at offset %d: %w", fileID, pos, err)
+		}
+		if err := fn(*record); err != nil {
+			return err
+		}
+		pos += size
+	}
+}
+
+func readRecord(reader io.Reader, fileID string, pos uint64) (*Record, uint64, error) {
+	var crc uint32
+	if err := binary.Read(reader, binary.BigEndian, &crc); err != nil {
+		return nil, 0, err
+	}
+
+	hasher := crc32.NewIEEE()
+	body := io.TeeReader(reader, hasher)
+
+	var keyLen uint16
+	if err := binary.Read(body, binary.BigEndian, &keyLen); err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	key := make(value.UserKey, keyLen)
+	if _, err := io.ReadFull(body, key); err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	var seqno value.SeqNo
+	if err := binary.Read(body, binary.BigEndian, &seqno); err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	var valueLen uint32
+	if err := binary.Read(body, binary.BigEndian, &valueLen); err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	val := make(value.UserValue, valueLen)
+	if _, err := io.ReadFull(body, val); err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	if hasher.Sum32() != crc {
+		return nil, 0, fmt.Errorf("record checksum mismatch")
+	}
+
+	size := uint64(recordHeaderSize + int(keyLen) + int(valueLen))
+	return &Record{
+		Key:   key,
+		SeqNo: seqno,
+		Value: val,
+		Pointer: ValuePointer{
+			FileID: fileID,
+			Offset: pos + size - uint64(valueLen),
+			Length: valueLen,
+		},
+	}, size, nil
+}
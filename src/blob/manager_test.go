@@ -0,0 +1,107 @@
+package blob_test
+
+import (
+	"bagh/blob"
+	"bagh/descriptor"
+	"bagh/value"
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlobWriteAndGet(t *testing.T) {
+	manager, err := blob.NewManager(t.TempDir(), descriptor.NewFileDescriptorTable(16, 1))
+	assert.NoError(t, err)
+
+	writer, err := manager.NewWriter()
+	assert.NoError(t, err)
+
+	var pointers []blob.ValuePointer
+	for i := 0; i < 10; i++ {
+		ptr, err := writer.Write([]byte(fmt.Sprintf("key-%d", i)), value.SeqNo(i), bytes.Repeat([]byte{byte(i)}, 5000))
+		assert.NoError(t, err)
+		pointers = append(pointers, ptr)
+	}
+
+	info, err := writer.Finish()
+	assert.NoError(t, err)
+	manager.Register(info)
+
+	for i, ptr := range pointers {
+		decoded, err := blob.DecodeValuePointer(ptr.Encode())
+		assert.NoError(t, err)
+		assert.Equal(t, ptr, *decoded)
+
+		val, err := manager.Get(decoded)
+		assert.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 5000), []byte(val))
+	}
+}
+
+func TestBlobGarbageCollection(t *testing.T) {
+	folder := t.TempDir()
+	manager, err := blob.NewManager(folder, descriptor.NewFileDescriptorTable(16, 1))
+	assert.NoError(t, err)
+
+	writer, err := manager.NewWriter()
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := writer.Write([]byte(fmt.Sprintf("key-%d", i)), value.SeqNo(i), bytes.Repeat([]byte{byte(i)}, 1000))
+		assert.NoError(t, err)
+	}
+	info, err := writer.Finish()
+	assert.NoError(t, err)
+	manager.Register(info)
+
+	// Only even seqnos are still referenced
+	isLive := func(record *blob.Record) (bool, error) {
+		return record.SeqNo%2 == 0, nil
+	}
+
+	ratio, err := manager.StaleRatio(info.ID, isLive)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.5, ratio, 0.01)
+
+	report, err := manager.Collect(0.6, isLive)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Obsolete)
+
+	report, err = manager.Collect(0.5, isLive)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{info.ID}, report.Obsolete)
+	assert.Len(t, report.Relocations, 5)
+
+	for _, relocation := range report.Relocations {
+		val, err := manager.Get(&relocation.Pointer)
+		assert.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(relocation.SeqNo)}, 1000), []byte(val))
+	}
+
+	// Obsolete files stay readable, but are not collected again
+	assert.NoError(t, manager.MarkObsolete(info.ID))
+	assert.Equal(t, []string{info.ID}, manager.Obsolete())
+	report, err = manager.Collect(0.5, isLive)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Obsolete)
+
+	assert.NoError(t, manager.Remove(info.ID))
+	assert.Equal(t, 1, manager.Len())
+	assert.Empty(t, manager.Obsolete())
+
+	_, err = os.Stat(info.Path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(info.Path + ".obsolete")
+	assert.True(t, os.IsNotExist(err))
+
+	// Obsolete marks survive restarts
+	rewritten := manager.Files()[0].ID
+	assert.NoError(t, manager.MarkObsolete(rewritten))
+
+	recovered, err := blob.Recover(folder, descriptor.NewFileDescriptorTable(16, 1))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, recovered.Len())
+	assert.Equal(t, []string{rewritten}, recovered.Obsolete())
+}
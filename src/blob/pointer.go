@@ -0,0 +1,75 @@
+package blob
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ValuePointer references a value stored in a blob file
+//
+// # Disk representation
+//
+// \[file id length; 2 bytes] - \[file id; N bytes] - \[offset; 8 bytes] - \[length; 4 bytes]
+type ValuePointer struct {
+	// ID of the blob file
+	FileID string
+
+	// Position of the value in the blob file
+	Offset uint64
+
+	// Size of the value in bytes
+	Length uint32
+}
+
+func (vp ValuePointer) String() string {
+	return fmt.Sprintf("%s@%d+%d", vp.FileID, vp.Offset, vp.Length)
+}
+
+func (vp ValuePointer) Serialize(writer io.Writer) error {
+	if err := binary.Write(writer, binary.BigEndian, uint16(len(vp.FileID))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(writer, vp.FileID); err != nil {
+		return err
+	}
+	if err := binary.Write(writer, binary.BigEndian, vp.Offset); err != nil {
+		return err
+	}
+	return binary.Write(writer, binary.BigEndian, vp.Length)
+}
+
+func (vp *ValuePointer) Deserialize(reader io.Reader) error {
+	var idLen uint16
+	if err := binary.Read(reader, binary.BigEndian, &idLen); err != nil {
+		return err
+	}
+	id := make([]byte, idLen)
+	if _, err := io.ReadFull(reader, id); err != nil {
+		return err
+	}
+	vp.FileID = string(id)
+
+	if err := binary.Read(reader, binary.BigEndian, &vp.Offset); err != nil {
+		return err
+	}
+	return binary.Read(reader, binary.BigEndian, &vp.Length)
+}
+
+// Encode serializes the pointer, so it can be stored as the value of an indirection
+func (vp ValuePointer) Encode() []byte {
+	buf := new(bytes.Buffer)
+	// NOTE: Writing into a bytes.Buffer cannot fail
+	vp.Serialize(buf)
+	return buf.Bytes()
+}
+
+// DecodeValuePointer parses a pointer stored as the value of an indirection
+func DecodeValuePointer(b []byte) (*ValuePointer, error) {
+	vp := new(ValuePointer)
+	if err := vp.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, fmt.Errorf("invalid value pointer: %w", err)
+	}
+	return vp, nil
+}
@@ -0,0 +1,108 @@
+package blob
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	"bagh/value"
+	"bagh/vfs"
+)
+
+// recordHeaderSize is the size of a record without its key and value
+//
+// \[crc; 4 bytes] - \[key length; 2 bytes] - \[key] - \[seqno; 8 bytes] - \[value length; 4 bytes] - \[value]
+const recordHeaderSize = 4 + 2 + 8 + 4
+
+// Writer appends values to a new blob file
+type Writer struct {
+	ID   string
+	Path string
+
+	fs     vfs.FS
+	file   vfs.File
+	writer *bufio.Writer
+
+	FilePos   uint64
+	ItemCount uint64
+}
+
+func newWriter(fs vfs.FS, id, path string) (*Writer, error) {
+	f, err := fs.OpenFile(path+tempSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		ID:     id,
+		Path:   path,
+		fs:     fs,
+		file:   f,
+		writer: bufio.NewWriterSize(f, 512000),
+	}, nil
+}
+
+// Write appends a value to the blob file and returns a pointer to it
+func (w *Writer) Write(key value.UserKey, seqno value.SeqNo, val value.UserValue) (ValuePointer, error) {
+	record := new(bytes.Buffer)
+	binary.Write(record, binary.BigEndian, uint16(len(key)))
+	record.Write(key)
+	binary.Write(record, binary.BigEndian, seqno)
+	binary.Write(record, binary.BigEndian, uint32(len(val)))
+	record.Write(val)
+
+	if err := binary.Write(w.writer, binary.BigEndian, crc32.ChecksumIEEE(record.Bytes())); err != nil {
+		return ValuePointer{}, err
+	}
+	if _, err := w.writer.Write(record.Bytes()); err != nil {
+		return ValuePointer{}, err
+	}
+
+	recordSize := uint64(4 + record.Len())
+	ptr := ValuePointer{
+		FileID: w.ID,
+		Offset: w.FilePos + recordSize - uint64(len(val)),
+		Length: uint32(len(val)),
+	}
+
+	w.FilePos += recordSize
+	w.ItemCount++
+
+	return ptr, nil
+}
+
+// Finish flushes and fsyncs the blob file, then moves it to its final path
+//
+// Returns nil if nothing was written, in which case the file is removed.
+func (w *Writer) Finish() (*FileInfo, error) {
+	if err := w.writer.Flush(); err != nil {
+		return nil, err
+	}
+	if err := w.file.Sync(); err != nil {
+		return nil, err
+	}
+	if err := w.file.Close(); err != nil {
+		return nil, err
+	}
+
+	if w.ItemCount == 0 {
+		return nil, w.fs.Remove(w.Path + tempSuffix)
+	}
+
+	if err := w.fs.Rename(w.Path+tempSuffix, w.Path); err != nil {
+		return nil, err
+	}
+	if err := w.fs.SyncDir(filepath.Dir(w.Path)); err != nil {
+		return nil, err
+	}
+
+	return &FileInfo{
+		ID:        w.ID,
+		Path:      w.Path,
+		ItemCount: w.ItemCount,
+		Size:      w.FilePos,
+	}, nil
+}
@@ -0,0 +1,114 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+)
+
+// Hash is the (64-bit) hash of a key, both halves are used for double hashing
+type Hash uint64
+
+// HashKey hashes a key for insertion into, or lookup in, a filter
+func HashKey(key []byte) Hash {
+	h := fnv.New64a()
+	h.Write(key)
+	return Hash(h.Sum64())
+}
+
+// Builder collects key hashes, and builds a filter sized to them
+type Builder struct {
+	bitsPerKey int
+	hashes     []Hash
+}
+
+// NewBuilder creates a builder, aiming for bitsPerKey bits of filter per key
+//
+// 10 bits per key result in a false positive rate of about 1%.
+func NewBuilder(bitsPerKey int) *Builder {
+	return &Builder{bitsPerKey: bitsPerKey}
+}
+
+// Add adds a key hash to the filter
+func (b *Builder) Add(hash Hash) {
+	b.hashes = append(b.hashes, hash)
+}
+
+// Len returns the amount of added hashes
+func (b *Builder) Len() int {
+	return len(b.hashes)
+}
+
+// Build encodes the filter, and resets the builder
+//
+// # Disk representation
+//
+// \[hash count; 1 byte] - \[bits] - \[crc; 4 bytes]
+func (b *Builder) Build() []byte {
+	// k = ln(2) * bits per key minimizes the false positive rate
+	k := int(math.Round(float64(b.bitsPerKey) * math.Ln2))
+	k = min(max(k, 1), 30)
+
+	bitCount := max(len(b.hashes)*b.bitsPerKey, 64)
+	byteCount := (bitCount + 7) / 8
+	bitCount = byteCount * 8
+
+	buf := make([]byte, 1+byteCount, 1+byteCount+4)
+	buf[0] = byte(k)
+	bits := buf[1:]
+
+	for _, hash := range b.hashes {
+		h1, h2 := uint32(hash), uint32(hash>>32)
+		for i := 0; i < k; i++ {
+			pos := (h1 + uint32(i)*h2) % uint32(bitCount)
+			bits[pos/8] |= 1 << (pos % 8)
+		}
+	}
+
+	b.hashes = b.hashes[:0]
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// Filter is a decoded bloom filter
+type Filter struct {
+	k    int
+	bits []byte
+}
+
+// Decode parses a filter built by Builder.Build
+func Decode(raw []byte) (*Filter, error) {
+	if len(raw) < 6 {
+		return nil, fmt.Errorf("bloom filter too short: %d bytes", len(raw))
+	}
+
+	body, trailer := raw[:len(raw)-4], raw[len(raw)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(trailer) {
+		return nil, fmt.Errorf("bloom filter checksum mismatch")
+	}
+
+	return &Filter{
+		k:    int(body[0]),
+		bits: body[1:],
+	}, nil
+}
+
+// MayContain returns false if the key is definitely not in the filter
+func (f *Filter) MayContain(hash Hash) bool {
+	bitCount := uint32(len(f.bits) * 8)
+	h1, h2 := uint32(hash), uint32(hash>>32)
+
+	for i := 0; i < f.k; i++ {
+		pos := (h1 + uint32(i)*h2) % bitCount
+		if f.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Size returns the size of the filter in bytes
+func (f *Filter) Size() int {
+	return len(f.bits) + 1
+}
@@ -0,0 +1,42 @@
+package bloom_test
+
+import (
+	"bagh/bloom"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilter(t *testing.T) {
+	builder := bloom.NewBuilder(10)
+	for i := 0; i < 10_000; i++ {
+		builder.Add(bloom.HashKey([]byte(fmt.Sprintf("key-%d", i))))
+	}
+
+	filter, err := bloom.Decode(builder.Build())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, builder.Len())
+
+	for i := 0; i < 10_000; i++ {
+		assert.True(t, filter.MayContain(bloom.HashKey([]byte(fmt.Sprintf("key-%d", i)))))
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10_000; i++ {
+		if filter.MayContain(bloom.HashKey([]byte(fmt.Sprintf("other-%d", i)))) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 300)
+}
+
+func TestBloomFilterCorruption(t *testing.T) {
+	builder := bloom.NewBuilder(10)
+	builder.Add(bloom.HashKey([]byte("a")))
+	raw := builder.Build()
+	raw[3] ^= 0xff
+
+	_, err := bloom.Decode(raw)
+	assert.Error(t, err)
+}
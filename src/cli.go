@@ -0,0 +1,388 @@
+// Command bagh inspects and manipulates the store in a directory
+//
+//	bagh [-db DIR] [-key-encoding string|hex] [-value-encoding string|hex] COMMAND [ARGS]
+//
+// Keys and values given as arguments, and printed, use the encodings of
+// -key-encoding and -value-encoding. Writes stay in the WAL, only flush
+// writes the memtable to a segment.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bagh/codec"
+	"bagh/file"
+	"bagh/levels"
+	"bagh/prefix"
+	"bagh/segdump"
+	"bagh/segment"
+	"bagh/stats"
+	"bagh/value"
+	"bagh/vfs"
+)
+
+// cli runs a single command against the store in db
+type cli struct {
+	db     string
+	keys   codec.Encoding
+	values codec.Encoding
+	out    io.Writer
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(c *cli, args []string) error
+}
+
+var commands = []command{
+	{"get", "get KEY", (*cli).get},
+	{"put", "put KEY VALUE", (*cli).put},
+	{"delete", "delete KEY", (*cli).delete},
+	{"scan", "scan [-prefix P | -from KEY -to KEY] [-limit N] [-reverse]", (*cli).scan},
+	{"dump-segment", "dump-segment [-json] [-summary] ID", (*cli).dumpSegment},
+	{"manifest", "manifest", (*cli).manifest},
+	{"stats", "stats [-prometheus]", (*cli).stats},
+	{"compact", "compact [-target-size BYTES]", (*cli).compact},
+	{"flush", "flush", (*cli).flush},
+	{"verify", "verify", (*cli).verify},
+	{"checkpoint", "checkpoint DIR", (*cli).checkpoint},
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("bagh", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	db := flags.String("db", ".data", "directory of the store")
+	keyEncoding := flags.String("key-encoding", string(codec.String), "encoding of keys: string or hex")
+	valueEncoding := flags.String("value-encoding", string(codec.String), "encoding of values: string or hex")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: bagh [flags] COMMAND [ARGS]\n\ncommands:")
+		for _, cmd := range commands {
+			fmt.Fprintf(stderr, "  %s\n", cmd.usage)
+		}
+		fmt.Fprintln(stderr, "\nflags:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	keys, err := codec.Parse(*keyEncoding)
+	if err != nil {
+		return err
+	}
+	values, err := codec.Parse(*valueEncoding)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no command")
+	}
+	c := &cli{db: *db, keys: keys, values: values, out: stdout}
+	for _, cmd := range commands {
+		if cmd.name == flags.Arg(0) {
+			return cmd.run(c, flags.Args()[1:])
+		}
+	}
+	return fmt.Errorf("unknown command %q", flags.Arg(0))
+}
+
+// withStore opens the store, which has to exist unless create is set, and
+// closes it after fn, leaving the memtable in the WAL
+func (c *cli) withStore(create bool, fn func(kv *KvStore) error) error {
+	if !create {
+		if _, err := os.Stat(filepath.Join(c.db, file.LSMMarker)); err != nil {
+			return fmt.Errorf("no store in %s: %w", c.db, err)
+		}
+	}
+
+	kv, err := OpenKvStore(c.db)
+	if err != nil {
+		return err
+	}
+	err = fn(kv)
+	return errors.Join(err, kv.CloseWithOptions(context.Background(), CloseOptions{NoFlush: true}))
+}
+
+// parseArgs parses the flags of a command, and checks the amount of positional arguments
+func parseArgs(flags *flag.FlagSet, args []string, count int) error {
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%s: %w", flags.Name(), err)
+	}
+	if flags.NArg() != count {
+		return fmt.Errorf("%s takes %d arguments, got %d", flags.Name(), count, flags.NArg())
+	}
+	return nil
+}
+
+func (c *cli) get(args []string) error {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	if err := parseArgs(flags, args, 1); err != nil {
+		return err
+	}
+	key, err := c.keys.Decode(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	return c.withStore(false, func(kv *KvStore) error {
+		val, err := kv.tree.Get(key)
+		if err != nil {
+			return err
+		}
+		if val == nil {
+			return fmt.Errorf("key %s not found", flags.Arg(0))
+		}
+		fmt.Fprintln(c.out, c.values.Format(val))
+		return nil
+	})
+}
+
+func (c *cli) put(args []string) error {
+	flags := flag.NewFlagSet("put", flag.ContinueOnError)
+	if err := parseArgs(flags, args, 2); err != nil {
+		return err
+	}
+	key, err := c.keys.Decode(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	val, err := c.values.Decode(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	return c.withStore(true, func(kv *KvStore) error {
+		return kv.write(value.Value{Key: key, Value: val, ValueType: value.Record}, WriteOptions{})
+	})
+}
+
+func (c *cli) delete(args []string) error {
+	flags := flag.NewFlagSet("delete", flag.ContinueOnError)
+	if err := parseArgs(flags, args, 1); err != nil {
+		return err
+	}
+	key, err := c.keys.Decode(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	return c.withStore(false, func(kv *KvStore) error {
+		return kv.write(value.Value{Key: key, Value: []byte{}, ValueType: value.Tombstone}, WriteOptions{})
+	})
+}
+
+// scan prints the items of a prefix, or of the range [from, to)
+func (c *cli) scan(args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	pfix := flags.String("prefix", "", "only scan keys with this prefix")
+	from := flags.String("from", "", "first key of the range (inclusive)")
+	to := flags.String("to", "", "end of the range (exclusive)")
+	limit := flags.Int("limit", 0, "stop after this many items, 0 for no limit")
+	reverse := flags.Bool("reverse", false, "scan in descending key order")
+	if err := parseArgs(flags, args, 0); err != nil {
+		return err
+	}
+	if *pfix != "" && (*from != "" || *to != "") {
+		return fmt.Errorf("scan: -prefix cannot be combined with -from or -to")
+	}
+
+	var lo, hi *segment.Bound[value.UserKey]
+	if *from != "" {
+		key, err := c.keys.Decode(*from)
+		if err != nil {
+			return err
+		}
+		lo = &segment.Bound[value.UserKey]{Included: (*value.UserKey)(&key)}
+	}
+	if *to != "" {
+		key, err := c.keys.Decode(*to)
+		if err != nil {
+			return err
+		}
+		hi = &segment.Bound[value.UserKey]{Excluded: (*value.UserKey)(&key)}
+	}
+	prefixKey, err := c.keys.Decode(*pfix)
+	if err != nil {
+		return err
+	}
+
+	return c.withStore(false, func(kv *KvStore) error {
+		var next func() (*value.UserKey, *value.UserValue, error)
+		if len(prefixKey) > 0 {
+			p := kv.tree.Prefix(prefixKey)
+			iter := prefix.NewPrefixIterator(p, p.SeqNo)
+			defer iter.Close()
+			next = iter.Next
+			if *reverse {
+				next = iter.NextBack
+			}
+		} else {
+			iter := kv.tree.CreateRange(lo, hi, nil, nil).IntoIter()
+			defer iter.Close()
+			step := iter.Next
+			if *reverse {
+				step = iter.NextBack
+			}
+			next = func() (*value.UserKey, *value.UserValue, error) {
+				key, val, ok := step()
+				if !ok {
+					return nil, nil, iter.Err()
+				}
+				return key, val, nil
+			}
+		}
+
+		for count := 0; *limit == 0 || count < *limit; count++ {
+			key, val, err := next()
+			if err != nil {
+				return err
+			}
+			if key == nil {
+				break
+			}
+			fmt.Fprintf(c.out, "%s\t%s\n", c.keys.Format(*key), c.values.Format(*val))
+		}
+		return nil
+	})
+}
+
+// dumpSegment prints the metadata, index and blocks of a segment, reading
+// its files directly, so the store may be open elsewhere
+func (c *cli) dumpSegment(args []string) error {
+	flags := flag.NewFlagSet("dump-segment", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print a JSON document")
+	summary := flags.Bool("summary", false, "leave out the items of the blocks")
+	if err := parseArgs(flags, args, 1); err != nil {
+		return err
+	}
+
+	dump, err := segdump.Read(vfs.Default, filepath.Join(c.db, file.SegmentsFolder, flags.Arg(0)), nil)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return segdump.WriteJSON(c.out, dump, c.keys.Format, *summary)
+	}
+	return segdump.WriteText(c.out, dump, c.keys.Format, *summary)
+}
+
+// manifest prints the segments of every level, reading levels.json and the
+// metadata of the segments directly
+func (c *cli) manifest(args []string) error {
+	flags := flag.NewFlagSet("manifest", flag.ContinueOnError)
+	if err := parseArgs(flags, args, 0); err != nil {
+		return err
+	}
+
+	manifest, err := levels.ReadManifest(vfs.Default, filepath.Join(c.db, file.LevelsManifestFile))
+	if err != nil {
+		return err
+	}
+
+	for levelNo, level := range manifest {
+		fmt.Fprintf(c.out, "L%d: %d segments\n", levelNo, len(level.Segments))
+		for _, segmentID := range level.Segments {
+			metadataPath := filepath.Join(c.db, file.SegmentsFolder, segmentID, file.SegmentMetadataFile)
+			m, err := segment.MetadataFromDisk(vfs.Default, metadataPath)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(c.out, "  %s keys [%s, %s] seqnos [%d, %d] %d items %d bytes\n",
+				m.ID, c.keys.Format(m.KeyRange[0]), c.keys.Format(m.KeyRange[1]), m.Seqnos[0], m.Seqnos[1], m.ItemCount, m.FileSize)
+		}
+	}
+	return nil
+}
+
+func (c *cli) stats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	prometheus := flags.Bool("prometheus", false, "print in the Prometheus text format")
+	if err := parseArgs(flags, args, 0); err != nil {
+		return err
+	}
+
+	return c.withStore(false, func(kv *KvStore) error {
+		s := kv.Stats()
+		if *prometheus {
+			return stats.WritePrometheus(c.out, s)
+		}
+
+		perLevel := make([]string, len(s.SegmentsPerLevel))
+		for i, count := range s.SegmentsPerLevel {
+			perLevel[i] = fmt.Sprintf("L%d=%d", i, count)
+		}
+		fmt.Fprintf(c.out, "segments:         %s\n", strings.Join(perLevel, " "))
+		fmt.Fprintf(c.out, "disk bytes:       %d\n", s.DiskBytes)
+		fmt.Fprintf(c.out, "memtable bytes:   %d active, %d in %d sealed\n", s.ActiveMemtableBytes, s.SealedMemtableBytes, s.SealedMemtables)
+		fmt.Fprintf(c.out, "wal bytes:        %d\n", s.WalBytes)
+		fmt.Fprintf(c.out, "block cache:      %d bytes\n", s.BlockCacheBytes)
+		return nil
+	})
+}
+
+func (c *cli) compact(args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	targetSize := flags.Uint64("target-size", 64*1024*1024, "size of the segments written by the compaction")
+	if err := parseArgs(flags, args, 0); err != nil {
+		return err
+	}
+
+	return c.withStore(false, func(kv *KvStore) error {
+		return kv.tree.MajorCompact(*targetSize)
+	})
+}
+
+func (c *cli) flush(args []string) error {
+	flags := flag.NewFlagSet("flush", flag.ContinueOnError)
+	if err := parseArgs(flags, args, 0); err != nil {
+		return err
+	}
+
+	return c.withStore(false, func(kv *KvStore) error {
+		return kv.ForceFlush()
+	})
+}
+
+func (c *cli) verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	if err := parseArgs(flags, args, 0); err != nil {
+		return err
+	}
+
+	return c.withStore(false, func(kv *KvStore) error {
+		if err := kv.Verify(); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "verified %d segments\n", kv.tree.SegmentCount())
+		return nil
+	})
+}
+
+func (c *cli) checkpoint(args []string) error {
+	flags := flag.NewFlagSet("checkpoint", flag.ContinueOnError)
+	if err := parseArgs(flags, args, 1); err != nil {
+		return err
+	}
+
+	return c.withStore(false, func(kv *KvStore) error {
+		return kv.Checkpoint(flags.Arg(0))
+	})
+}
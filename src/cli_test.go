@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bagh/file"
+	"bagh/vfs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bagh runs the CLI against the store in db, and returns its output
+func bagh(t *testing.T, db string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := run(append([]string{"-db", db}, args...), &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func mustBagh(t *testing.T, db string, args ...string) string {
+	out, err := bagh(t, db, args...)
+	require.NoError(t, err, strings.Join(args, " "))
+	return out
+}
+
+func TestCliReadWrite(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "db")
+
+	_, err := bagh(t, db, "get", "a")
+	assert.Error(t, err, "the store does not exist yet")
+
+	for _, key := range []string{"a", "b1", "b2", "b3", "c"} {
+		mustBagh(t, db, "put", key, "value-"+key)
+	}
+	mustBagh(t, db, "delete", "b2")
+
+	assert.Equal(t, "value-a\n", mustBagh(t, db, "get", "a"))
+	_, err = bagh(t, db, "get", "b2")
+	assert.ErrorContains(t, err, "not found")
+
+	assert.Equal(t, "b1\tvalue-b1\nb3\tvalue-b3\n", mustBagh(t, db, "scan", "-prefix", "b"))
+	assert.Equal(t, "b3\tvalue-b3\nb1\tvalue-b1\n", mustBagh(t, db, "scan", "-prefix", "b", "-reverse"))
+	assert.Equal(t, "a\tvalue-a\nb1\tvalue-b1\n", mustBagh(t, db, "scan", "--from", "a", "--to", "b3"))
+	assert.Equal(t, "a\tvalue-a\n", mustBagh(t, db, "scan", "-limit", "1"))
+
+	// Hex keys and values
+	mustBagh(t, db, "-key-encoding", "hex", "-value-encoding", "hex", "put", "0001", "c3a9")
+	assert.Equal(t, "c3a9\n", mustBagh(t, db, "-key-encoding", "hex", "-value-encoding", "hex", "get", "0001"))
+	assert.Equal(t, "0001\té\n", mustBagh(t, db, "-key-encoding", "hex", "scan", "-to", "01"))
+
+	_, err = bagh(t, db, "-key-encoding", "base64", "get", "a")
+	assert.Error(t, err)
+	_, err = bagh(t, db, "scan", "-prefix", "b", "-from", "a")
+	assert.Error(t, err)
+	_, err = bagh(t, db, "frobnicate")
+	assert.Error(t, err)
+}
+
+func TestCliAdmin(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "db")
+
+	for round := 0; round < 2; round++ {
+		mustBagh(t, db, "put", "a", "1")
+		mustBagh(t, db, "put", "b", "2")
+		mustBagh(t, db, "flush")
+	}
+
+	manifest := mustBagh(t, db, "manifest")
+	assert.Contains(t, manifest, "L0: 2 segments")
+	assert.Contains(t, manifest, "keys [a, b]")
+
+	mustBagh(t, db, "compact")
+	assert.Contains(t, mustBagh(t, db, "stats"), "L0=0 L1=0")
+	assert.Contains(t, mustBagh(t, db, "stats", "-prometheus"), "# TYPE")
+	assert.Equal(t, "verified 1 segments\n", mustBagh(t, db, "verify"))
+
+	entries, err := vfs.Default.ReadDir(filepath.Join(db, file.SegmentsFolder))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	dump := mustBagh(t, db, "dump-segment", entries[0].Name())
+	assert.Contains(t, dump, "2 items, 2 keys, 0 tombstones")
+	assert.Contains(t, dump, "a @2 record, 1 bytes")
+	assert.Contains(t, mustBagh(t, db, "dump-segment", "-json", entries[0].Name()), `"item_count": 2`)
+
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	mustBagh(t, db, "put", "c", "3")
+	mustBagh(t, db, "checkpoint", checkpoint)
+	assert.Equal(t, "a\t1\nb\t2\nc\t3\n", mustBagh(t, checkpoint, "scan"))
+	mustBagh(t, checkpoint, "verify")
+}
+
+func TestCliScanError(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "db")
+	mustBagh(t, db, "put", "a", "1")
+	mustBagh(t, db, "flush")
+
+	// Corrupt the data block of the only segment
+	folders, err := vfs.Default.ReadDir(filepath.Join(db, file.SegmentsFolder))
+	require.NoError(t, err)
+	require.Len(t, folders, 1)
+	blocks := filepath.Join(db, file.SegmentsFolder, folders[0].Name(), file.BlocksFile)
+	data, err := vfs.ReadFile(vfs.Default, blocks)
+	require.NoError(t, err)
+	data[len(data)/4] ^= 0xff
+	require.NoError(t, os.WriteFile(blocks, data, 0644))
+
+	_, err = bagh(t, db, "scan")
+	assert.Error(t, err)
+}
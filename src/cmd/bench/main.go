@@ -0,0 +1,92 @@
+// Command bench runs db_bench-style workloads against a new tree
+//
+// Workloads run in the given order on the same tree, e.g.
+//
+//	bench -benchmarks fillrandom,readrandom,ycsba -num 1000000 -threads 4
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"bagh/bench"
+	"bagh/vfs"
+)
+
+func main() {
+	defaults := bench.DefaultOptions()
+
+	benchmarks := flag.String("benchmarks", "fillseq,fillrandom,overwrite,readrandom,readseq,readreverse,seekrandom",
+		"comma-separated workloads: "+strings.Join(bench.Workloads, ", "))
+	num := flag.Int("num", defaults.Num, "number of keys, and operations of write workloads")
+	reads := flag.Int("reads", 0, "operations of read and mixed workloads, -num if 0")
+	threads := flag.Int("threads", defaults.Threads, "concurrent goroutines per workload")
+	keySize := flag.Int("key-size", defaults.KeySize, "key size in bytes")
+	valueSize := flag.Int("value-size", defaults.ValueSize, "value size in bytes")
+	blockSize := flag.Uint("block-size", uint(defaults.BlockSize), "block size in bytes")
+	cacheSize := flag.Uint64("cache-size", defaults.CacheSize, "block cache size in bytes")
+	memtableSize := flag.Uint("memtable-size", uint(defaults.MemtableSize), "memtable size in bytes")
+	compactionTrigger := flag.Int("compaction-trigger", defaults.CompactionTrigger, "L0 segments that start a major compaction, 0 disables compactions")
+	seed := flag.Int64("seed", defaults.Seed, "seed of the random keys and values")
+	db := flag.String("db", "", "directory of the tree, must not exist, a temporary directory if empty")
+	mem := flag.Bool("mem", false, "keep the tree in memory")
+	flag.Parse()
+
+	opts := defaults
+	opts.Num = *num
+	opts.Reads = *reads
+	opts.Threads = *threads
+	opts.KeySize = *keySize
+	opts.ValueSize = *valueSize
+	opts.BlockSize = uint32(*blockSize)
+	opts.CacheSize = *cacheSize
+	opts.MemtableSize = uint32(*memtableSize)
+	opts.CompactionTrigger = *compactionTrigger
+	opts.Seed = *seed
+	opts.Path = *db
+
+	switch {
+	case *mem:
+		opts.FS = vfs.NewMemFS()
+		opts.Path = "/bench"
+	case opts.Path == "":
+		dir, err := os.MkdirTemp("", "bagh-bench-")
+		if err != nil {
+			fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		opts.Path = dir + "/tree"
+	}
+
+	b, err := bench.Open(opts)
+	if err != nil {
+		fatal(err)
+	}
+
+	fmt.Printf("Keys:       %d bytes each\n", opts.KeySize)
+	fmt.Printf("Values:     %d bytes each\n", opts.ValueSize)
+	fmt.Printf("Entries:    %d\n", opts.Num)
+	fmt.Printf("Threads:    %d\n", opts.Threads)
+	fmt.Printf("Block size: %d, cache: %d, memtable: %d\n", opts.BlockSize, opts.CacheSize, opts.MemtableSize)
+	fmt.Println(strings.Repeat("-", 48))
+
+	for _, name := range strings.Split(*benchmarks, ",") {
+		result, err := b.Run(strings.TrimSpace(name))
+		if err != nil {
+			b.Close()
+			fatal(err)
+		}
+		fmt.Println(result)
+	}
+
+	if err := b.Close(); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,94 @@
+// Command segdump decodes segment folders offline
+//
+// It prints the metadata, the index partitions and every block of a
+// segment, or the logical differences between two segments, e.g.
+//
+//	segdump -json .data/segments/<id>
+//	segdump -diff .data/segments/<id> checkpoint/segments/<id>
+//
+// With -diff, the exit status is 1 if the segments differ. Segments written
+// with a custom comparator can only be read by builds registering it, see
+// comparator.Register.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"bagh/codec"
+	"bagh/comparator"
+	"bagh/segdump"
+	"bagh/vfs"
+)
+
+func main() {
+	asJSON := flag.Bool("json", false, "print a JSON document")
+	summary := flag.Bool("summary", false, "leave out the items of the blocks")
+	diff := flag.Bool("diff", false, "compare the items of two segments")
+	keyEncoding := flag.String("key-encoding", "string", "encoding of printed keys: string or hex")
+	cmpName := flag.String("comparator", "", "name of the comparator ordering the keys, defaults to the one the segment records")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: segdump [flags] SEGMENT_DIR\n       segdump -diff [flags] SEGMENT_DIR SEGMENT_DIR")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	keys, err := codec.Parse(*keyEncoding)
+	if err != nil {
+		fatal(err)
+	}
+	var cmp comparator.Comparator
+	if *cmpName != "" {
+		var ok bool
+		if cmp, ok = comparator.Lookup(*cmpName); !ok {
+			fatal(fmt.Errorf("unknown comparator %q", *cmpName))
+		}
+	}
+
+	if *diff {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		left, err := segdump.Read(vfs.Default, flag.Arg(0), cmp)
+		if err != nil {
+			fatal(err)
+		}
+		right, err := segdump.Read(vfs.Default, flag.Arg(1), cmp)
+		if err != nil {
+			fatal(err)
+		}
+
+		diffs := segdump.Diff(left, right, cmp)
+		if err := segdump.WriteDiff(os.Stdout, diffs, keys.Format); err != nil {
+			fatal(err)
+		}
+		if len(diffs) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dump, err := segdump.Read(vfs.Default, flag.Arg(0), cmp)
+	if err != nil {
+		fatal(err)
+	}
+
+	write := segdump.WriteText
+	if *asJSON {
+		write = segdump.WriteJSON
+	}
+	if err := write(os.Stdout, dump, keys.Format, *summary); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,116 @@
+// Command stress runs randomized workloads against a tree, checking every
+// read against a model of the written data
+//
+// Failing runs are saved to the failure directory, and replayed with
+// -replay <file>.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bagh/stress"
+)
+
+func main() {
+	defaults := stress.DefaultOptions()
+
+	seed := flag.Int64("seed", defaults.Seed, "seed of the workload")
+	runs := flag.Int("runs", 1, "number of runs, each with the next seed")
+	workers := flag.Int("workers", defaults.Workers, "concurrent workers")
+	ops := flag.Int("ops", defaults.OpsPerWorker, "operations per worker")
+	serial := flag.Bool("serial", false, "run one operation at a time, deterministically")
+	keys := flag.Int("keys", defaults.KeyCount, "number of distinct keys")
+	distribution := flag.String("distribution", string(defaults.Distribution), "key distribution: uniform, zipf or latest")
+	minValue := flag.Int("min-value", defaults.MinValueSize, "minimum value size in bytes")
+	maxValue := flag.Int("max-value", defaults.MaxValueSize, "maximum value size in bytes")
+	weights := flag.String("weights", "", "operation weights, e.g. insert=10,get=10,range=0 (defaults for the rest)")
+	dir := flag.String("dir", "", "directory of the tree, in memory if empty")
+	failures := flag.String("failures", "stress-failures", "directory failing runs are saved to")
+	replay := flag.String("replay", "", "replay a failing run saved to the failure directory")
+	flag.Parse()
+
+	opts := defaults
+	if *replay != "" {
+		loaded, err := stress.LoadFailure(*replay)
+		if err != nil {
+			fatal(err)
+		}
+		opts = loaded
+		// Replays of serial runs are exact, serial replays of concurrent runs may help as well
+		opts.Serial = opts.Serial || *serial
+		*runs = 1
+	} else {
+		opts.Seed = *seed
+		opts.Workers = *workers
+		opts.OpsPerWorker = *ops
+		opts.Serial = *serial
+		opts.KeyCount = *keys
+		opts.Distribution = stress.Distribution(*distribution)
+		opts.MinValueSize = *minValue
+		opts.MaxValueSize = *maxValue
+		opts.Path = *dir
+		if err := parseWeights(opts.Weights, *weights); err != nil {
+			fatal(err)
+		}
+	}
+	opts.FailureDir = *failures
+
+	for run := 0; run < *runs; run++ {
+		report, err := stress.Run(opts)
+
+		var failure *stress.Failure
+		if errors.As(err, &failure) {
+			fmt.Fprintf(os.Stderr, "FAIL %v\n", failure)
+			if report.FailurePath != "" {
+				fmt.Fprintf(os.Stderr, "replay with: stress -replay %s\n", report.FailurePath)
+			}
+			os.Exit(1)
+		}
+		if err != nil {
+			fatal(err)
+		}
+
+		fmt.Printf("ok seed %d in %v: %s\n", opts.Seed, report.Duration.Round(time.Millisecond), formatOps(report.Ops))
+		opts.Seed++
+	}
+}
+
+// parseWeights overrides weights with a list like insert=10,range=0
+func parseWeights(weights map[stress.Op]int, list string) error {
+	if list == "" {
+		return nil
+	}
+	for _, pair := range strings.Split(list, ",") {
+		op, weight, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid weight %q, want op=weight", pair)
+		}
+		n, err := strconv.Atoi(weight)
+		if err != nil {
+			return fmt.Errorf("invalid weight %q: %w", pair, err)
+		}
+		weights[stress.Op(op)] = n
+	}
+	return nil
+}
+
+func formatOps(ops map[stress.Op]int64) string {
+	parts := make([]string, 0, len(ops))
+	for op, count := range ops {
+		parts = append(parts, fmt.Sprintf("%s=%d", op, count))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,81 @@
+// Command waldump prints the records of WAL files, and where recovery would
+// stop reading them, or replays them into a new tree
+//
+// Arguments are WAL files or folders, a folder stands for all of its WAL
+// files, oldest first, e.g.
+//
+//	waldump -prefix user: -min-seqno 1000 .data
+//	waldump -max-seqno 5000 -replay /tmp/recovered .data
+//
+// The exit status is 1 if a file stops before its end.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"bagh/codec"
+	"bagh/value"
+	"bagh/vfs"
+	"bagh/waldump"
+)
+
+func main() {
+	minSeqNo := flag.Uint64("min-seqno", 0, "only select records with at least this seqno")
+	maxSeqNo := flag.Uint64("max-seqno", 0, "only select records with at most this seqno, 0 for no limit")
+	prefix := flag.String("prefix", "", "only select records whose key has this prefix")
+	keyEncoding := flag.String("key-encoding", "string", "encoding of -prefix and printed keys: string or hex")
+	replay := flag.String("replay", "", "write the selected records into a new tree in this directory")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: waldump [flags] WAL_FILE_OR_DIR...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	keys, err := codec.Parse(*keyEncoding)
+	if err != nil {
+		fatal(err)
+	}
+	filter := waldump.Filter{
+		MinSeqNo: value.SeqNo(*minSeqNo),
+		MaxSeqNo: value.SeqNo(*maxSeqNo),
+	}
+	if filter.Prefix, err = keys.Decode(*prefix); err != nil {
+		fatal(err)
+	}
+
+	paths, err := waldump.Paths(vfs.Default, flag.Args())
+	if err != nil {
+		fatal(err)
+	}
+
+	var summary *waldump.Summary
+	if *replay != "" {
+		summary, err = waldump.Replay(vfs.Default, paths, filter, *replay)
+		if err == nil {
+			fmt.Printf("replayed %d of %d records into %s\n", summary.Matched, summary.Records, *replay)
+			for _, corruption := range summary.Corruptions {
+				fmt.Println(corruption)
+			}
+		}
+	} else {
+		summary, err = waldump.Write(os.Stdout, vfs.Default, paths, filter, keys.Format)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if len(summary.Corruptions) > 0 {
+		os.Exit(1)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
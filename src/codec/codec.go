@@ -0,0 +1,58 @@
+// Package codec converts keys and values given on the command line, and
+// formats them for printing, shared by the command line tools
+package codec
+
+import (
+	"bagh/value"
+	"encoding/hex"
+	"fmt"
+)
+
+// Encoding is the textual representation of keys or values
+type Encoding string
+
+const (
+	String Encoding = "string"
+	Hex    Encoding = "hex"
+)
+
+// Parse returns the encoding of a name, string or hex
+func Parse(name string) (Encoding, error) {
+	switch e := Encoding(name); e {
+	case String, Hex:
+		return e, nil
+	}
+	return "", fmt.Errorf("unknown encoding %q, use string or hex", name)
+}
+
+// Decode converts text in the encoding to bytes
+func (e Encoding) Decode(s string) ([]byte, error) {
+	if e == Hex {
+		return hex.DecodeString(s)
+	}
+	return []byte(s), nil
+}
+
+// Format converts bytes to text in the encoding
+func (e Encoding) Format(b []byte) string {
+	if e == Hex {
+		return hex.EncodeToString(b)
+	}
+	return string(b)
+}
+
+// KeyFormat formats keys for printing, e.g. Encoding.Format
+type KeyFormat func([]byte) string
+
+// TypeName returns the name of a value type
+func TypeName(t value.ValueType) string {
+	switch t {
+	case value.Record:
+		return "record"
+	case value.Tombstone:
+		return "tombstone"
+	case value.Indirection:
+		return "indirection"
+	}
+	return fmt.Sprintf("type(%d)", t)
+}
@@ -0,0 +1,35 @@
+package codec
+
+import (
+	"bagh/value"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncoding(t *testing.T) {
+	hex, err := Parse("hex")
+	require.NoError(t, err)
+	b, err := hex.Decode("00ff")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0xff}, b)
+	assert.Equal(t, "00ff", hex.Format(b))
+
+	_, err = hex.Decode("zz")
+	assert.Error(t, err)
+
+	b, err = String.Decode("key")
+	require.NoError(t, err)
+	assert.Equal(t, "key", String.Format(b))
+
+	_, err = Parse("base64")
+	assert.Error(t, err)
+}
+
+func TestTypeName(t *testing.T) {
+	assert.Equal(t, "record", TypeName(value.Record))
+	assert.Equal(t, "tombstone", TypeName(value.Tombstone))
+	assert.Equal(t, "indirection", TypeName(value.Indirection))
+	assert.Equal(t, "type(9)", TypeName(value.ValueType(9)))
+}
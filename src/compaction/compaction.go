@@ -0,0 +1,163 @@
+package compaction
+
+import (
+	"bagh/comparator"
+	"bagh/config"
+	"bagh/levels"
+	"bagh/segment"
+	"bagh/value"
+)
+
+// Input describes segments to be merged into a level
+type Input struct {
+	SegmentIDs []string
+	DestLevel  uint8
+
+	// Maximum size of a segment written by the compaction
+	TargetSize uint64
+}
+
+// Choice is the decision of a compaction strategy
+//
+// An empty choice means there is nothing to do.
+type Choice struct {
+	// Segments to merge and rewrite, nil if none
+	Merge *Input
+
+	// Segments to delete without rewriting them
+	Drop []string
+}
+
+// IsEmpty returns true if the choice does not require any work
+func (c Choice) IsEmpty() bool {
+	return c.Merge == nil && len(c.Drop) == 0
+}
+
+// Strategy picks the segments to compact
+//
+// Choose is called with the levels locked, and should not block.
+// Segments that are currently being compacted (see Levels.HiddenSet)
+// must not be chosen.
+type Strategy interface {
+	Choose(lvl *levels.Levels, config *config.PersistedConfig) Choice
+}
+
+// visibleSegments returns the segments not being compacted, that the filter accepts
+//
+// The second result is false if any segment is currently being compacted.
+func visibleSegments(lvl *levels.Levels, filter segment.SegmentFilter) ([]string, bool) {
+	var ids []string
+	for _, level := range lvl.Levels {
+		for _, segmentID := range level.Segments {
+			if lvl.HiddenSet.Contains(segmentID) {
+				return nil, false
+			}
+			if filter == nil || filter(lvl.Segments[segmentID]) {
+				ids = append(ids, segmentID)
+			}
+		}
+	}
+	return ids, true
+}
+
+// Major merges all segments into the last level
+type Major struct {
+	TargetSize uint64
+
+	// Segments the filter rejects are left as they are, if set, unless their
+	// key range intersects the one of the merged segments, as they could
+	// hold older versions of merged keys
+	Filter segment.SegmentFilter
+}
+
+// NewMajor creates a major compaction strategy, writing segments of targetSize
+func NewMajor(targetSize uint64) *Major {
+	return &Major{TargetSize: targetSize}
+}
+
+func (m *Major) Choose(lvl *levels.Levels, _ *config.PersistedConfig) Choice {
+	ids, ok := visibleSegments(lvl, nil)
+	if !ok {
+		return Choice{}
+	}
+	if m.Filter != nil {
+		ids = withOverlapping(lvl, ids, m.Filter)
+	}
+	if len(ids) == 0 {
+		return Choice{}
+	}
+
+	return Choice{
+		Merge: &Input{
+			SegmentIDs: ids,
+			DestLevel:  lvl.LastLevelIndex(),
+			TargetSize: m.TargetSize,
+		},
+	}
+}
+
+// withOverlapping returns the segments the filter accepts, plus the rejected
+// ones intersecting the key range they span, until no other one does
+func withOverlapping(lvl *levels.Levels, ids []string, filter segment.SegmentFilter) []string {
+	cmp := comparator.OrDefault(lvl.Comparator)
+
+	var merged, rejected []string
+	var lo, hi value.UserKey
+	include := func(segmentID string) {
+		keyRange := lvl.Segments[segmentID].Metadata.KeyRange
+		if merged == nil || cmp.Compare(keyRange[0], lo) < 0 {
+			lo = keyRange[0]
+		}
+		if merged == nil || cmp.Compare(keyRange[1], hi) > 0 {
+			hi = keyRange[1]
+		}
+		merged = append(merged, segmentID)
+	}
+
+	for _, segmentID := range ids {
+		if filter(lvl.Segments[segmentID]) {
+			include(segmentID)
+		} else {
+			rejected = append(rejected, segmentID)
+		}
+	}
+
+	for changed := merged != nil; changed; {
+		changed = false
+		kept := rejected[:0]
+		for _, segmentID := range rejected {
+			keyRange := lvl.Segments[segmentID].Metadata.KeyRange
+			if cmp.Compare(keyRange[0], hi) <= 0 && cmp.Compare(keyRange[1], lo) >= 0 {
+				include(segmentID)
+				changed = true
+			} else {
+				kept = append(kept, segmentID)
+			}
+		}
+		rejected = kept
+	}
+	return merged
+}
+
+// Drop deletes whole segments the filter rejects, without rewriting any data
+//
+// This is useful for time-series like data, e.g. dropping segments whose
+// (collected) maximum timestamp is older than a retention period.
+type Drop struct {
+	Filter segment.SegmentFilter
+}
+
+func (d *Drop) Choose(lvl *levels.Levels, _ *config.PersistedConfig) Choice {
+	ids, ok := visibleSegments(lvl, nil)
+	if !ok {
+		return Choice{}
+	}
+
+	var drop []string
+	for _, segmentID := range ids {
+		if !d.Filter(lvl.Segments[segmentID]) {
+			drop = append(drop, segmentID)
+		}
+	}
+	return Choice{Drop: drop}
+}
@@ -0,0 +1,66 @@
+package compaction_test
+
+import (
+	"bagh/compaction"
+	"bagh/config"
+	"bagh/levels"
+	"bagh/segment"
+	"bagh/value"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fixtureLevels() *levels.Levels {
+	lvl := &levels.Levels{
+		Segments:  map[string]*segment.Segment{},
+		Levels:    []*levels.Level{{}, {}, {}},
+		HiddenSet: &levels.HiddenSet{Set: map[string]struct{}{}},
+	}
+	keyRanges := [][2]value.UserKey{
+		{value.UserKey("a"), value.UserKey("c")},
+		{value.UserKey("x"), value.UserKey("z")},
+		{value.UserKey("d"), value.UserKey("f")},
+	}
+	for i, id := range []string{"a", "b", "c"} {
+		lvl.InsertIntoLevel(uint8(i), &segment.Segment{Metadata: &segment.Metadata{
+			ID:         id,
+			KeyRange:   keyRanges[i],
+			Seqnos:     [2]value.SeqNo{value.SeqNo(i), value.SeqNo(i)},
+			Properties: segment.Properties{"tag.keep": id},
+		}})
+	}
+	return lvl
+}
+
+func keepTagged(s *segment.Segment) bool {
+	tag, _ := s.Properties().Get("tag", "keep")
+	return tag != "b"
+}
+
+func TestMajorStrategy(t *testing.T) {
+	lvl := fixtureLevels()
+
+	choice := compaction.NewMajor(1024).Choose(lvl, config.DefaultPersistedConfig())
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, choice.Merge.SegmentIDs)
+	assert.Equal(t, uint8(2), choice.Merge.DestLevel)
+
+	strategy := compaction.NewMajor(1024)
+	strategy.Filter = keepTagged
+	choice = strategy.Choose(lvl, config.DefaultPersistedConfig())
+	assert.ElementsMatch(t, []string{"a", "c"}, choice.Merge.SegmentIDs)
+
+	// Rejected segments overlapping the merged ones could hold older versions of their keys
+	lvl.Segments["b"].Metadata.KeyRange = [2]value.UserKey{value.UserKey("e"), value.UserKey("x")}
+	choice = strategy.Choose(lvl, config.DefaultPersistedConfig())
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, choice.Merge.SegmentIDs)
+
+	lvl.HideSegments([]string{"a"})
+	assert.True(t, strategy.Choose(lvl, config.DefaultPersistedConfig()).IsEmpty())
+}
+
+func TestDropStrategy(t *testing.T) {
+	choice := (&compaction.Drop{Filter: keepTagged}).Choose(fixtureLevels(), config.DefaultPersistedConfig())
+	assert.Nil(t, choice.Merge)
+	assert.Equal(t, []string{"b"}, choice.Drop)
+}
@@ -0,0 +1,115 @@
+// Package comparator defines the order of keys in a tree
+//
+// The order is used by the memtables, the segments and their indexes, the
+// levels and every merge of sorted sources, so a tree has to be opened with
+// the comparator it was created with. Its name is persisted to check that.
+package comparator
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Comparator is a total order of keys
+//
+// Keys comparing equal are versions of the same key, even if their bytes
+// differ. Bloom filters hash the bytes of keys though, so segments are
+// neither written nor read with bloom filters unless the order is bytewise.
+type Comparator interface {
+	// Compare returns a negative number if a < b, 0 if a == b, and a
+	// positive number if a > b
+	Compare(a, b []byte) int
+
+	// Name identifies the order, it is persisted with the tree and has to
+	// change whenever the order does
+	Name() string
+}
+
+// Shortener is optionally implemented by comparators that can shorten keys
+// used as boundaries, like LevelDB's comparators. Segments then index their
+// blocks by short separators instead of full keys.
+type Shortener interface {
+	// FindShortestSeparator returns a short key k with start <= k < limit,
+	// or start if there is none
+	FindShortestSeparator(start, limit []byte) []byte
+}
+
+// Bytewise orders keys lexicographically by their bytes, it is the default
+var Bytewise Comparator = bytewise{}
+
+// BytewiseName is the name of Bytewise, trees created before comparators
+// could be configured use it
+const BytewiseName = "bagh.BytewiseComparator"
+
+// OrDefault returns c, or Bytewise if c is nil
+func OrDefault(c Comparator) Comparator {
+	if c == nil {
+		return Bytewise
+	}
+	return c
+}
+
+// IsBytewise reports whether c orders keys like Bytewise (nil does), only
+// then keys with a common prefix are contiguous, and keys comparing equal
+// have equal bytes
+func IsBytewise(c Comparator) bool {
+	return c == nil || c.Name() == BytewiseName
+}
+
+// NameOrDefault returns name, or the name of Bytewise if name is empty
+func NameOrDefault(name string) string {
+	if name == "" {
+		return BytewiseName
+	}
+	return name
+}
+
+var (
+	registryMutex sync.RWMutex
+	registry      = map[string]Comparator{BytewiseName: Bytewise}
+)
+
+// Register makes a comparator known by its name, so offline tools like
+// segdump can read segments ordered by it, e.g. from an init function
+func Register(c Comparator) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[c.Name()] = c
+}
+
+// Lookup returns the registered comparator with the given name
+func Lookup(name string) (Comparator, bool) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	c, ok := registry[NameOrDefault(name)]
+	return c, ok
+}
+
+type bytewise struct{}
+
+func (bytewise) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (bytewise) Name() string {
+	return BytewiseName
+}
+
+func (bytewise) FindShortestSeparator(start, limit []byte) []byte {
+	// Length of the common prefix
+	n := 0
+	for n < len(start) && n < len(limit) && start[n] == limit[n] {
+		n++
+	}
+	if n >= len(start) || n >= len(limit) {
+		// One key is a prefix of the other
+		return start
+	}
+
+	if c := start[n]; c < 0xff && c+1 < limit[n] {
+		separator := append([]byte(nil), start[:n+1]...)
+		separator[n]++
+		return separator
+	}
+	return start
+}
@@ -0,0 +1,53 @@
+package comparator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBytewise(t *testing.T) {
+	assert.Negative(t, Bytewise.Compare([]byte("a"), []byte("b")))
+	assert.Zero(t, Bytewise.Compare([]byte("a"), []byte("a")))
+	assert.Positive(t, Bytewise.Compare([]byte("ab"), []byte("a")))
+
+	assert.Equal(t, Bytewise, OrDefault(nil))
+	assert.Equal(t, BytewiseName, NameOrDefault(""))
+	assert.Equal(t, "other", NameOrDefault("other"))
+}
+
+func TestBytewiseShortener(t *testing.T) {
+	s := Bytewise.(Shortener)
+
+	for _, tc := range []struct{ start, limit, expected string }{
+		{"abcdef", "abzz", "abd"},
+		{"abc", "abd", "abc"},
+		{"abc", "abcdef", "abc"},
+		{"ab\xff", "ac", "ab\xff"},
+	} {
+		separator := s.FindShortestSeparator([]byte(tc.start), []byte(tc.limit))
+		assert.Equal(t, tc.expected, string(separator), tc)
+		assert.LessOrEqual(t, tc.start, string(separator))
+		if tc.start != tc.limit {
+			assert.Less(t, string(separator), tc.limit)
+		}
+	}
+}
+
+type reverse struct{}
+
+func (reverse) Compare(a, b []byte) int { return Bytewise.Compare(b, a) }
+func (reverse) Name() string            { return "test.Reverse" }
+
+func TestRegistry(t *testing.T) {
+	c, ok := Lookup("")
+	assert.True(t, ok)
+	assert.Equal(t, Bytewise, c)
+
+	_, ok = Lookup("test.Reverse")
+	assert.False(t, ok)
+	Register(reverse{})
+	c, ok = Lookup("test.Reverse")
+	assert.True(t, ok)
+	assert.Equal(t, reverse{}, c)
+}
@@ -1,8 +1,16 @@
 package config
 
 import (
+	"bagh/comparator"
 	"bagh/descriptor"
+	"bagh/event"
+	"bagh/logging"
+	"bagh/memtable"
 	"bagh/segment"
+	"bagh/stall"
+	"bagh/vfs"
+	"log/slog"
+	"time"
 )
 
 // TreeType represents the type of the tree
@@ -19,6 +27,16 @@ type PersistedConfig struct {
 	LevelCount uint8    `json:"level_count"`
 	LevelRatio uint8    `json:"level_ratio"`
 	Type       TreeType `json:"type"`
+
+	// Values larger than this are stored in blob files, 0 disables key-value separation
+	BlobThreshold uint32 `json:"blob_threshold"`
+
+	// Bits of bloom filter per key in every segment, 0 disables bloom filters
+	BloomBitsPerKey int `json:"bloom_bits_per_key"`
+
+	// Name of the comparator ordering the keys, a tree can only be opened
+	// with the comparator it was created with
+	Comparator string `json:"comparator"`
 }
 
 const DEFAULT_FILE_FOLDER = ".lsm.data"
@@ -31,6 +49,9 @@ func DefaultPersistedConfig() *PersistedConfig {
 		LevelCount: 7,
 		LevelRatio: 8,
 		Type:       Standard,
+
+		BloomBitsPerKey: 10,
+		Comparator:      comparator.BytewiseName,
 	}
 }
 
@@ -39,14 +60,55 @@ type Config struct {
 	Inner           *PersistedConfig
 	BlockCache      *segment.BlockCache
 	DescriptorTable *descriptor.FileDescriptorTable
+
+	// Run over every segment written by flushes and compactions
+	PropertiesCollectors []segment.PropertiesCollectorFactory
+
+	// Keep the index and filter blocks of L0 and L1 segments in the block cache
+	PinIndexAndFilterBlocks bool
+
+	// Amount of goroutines flushing sealed memtables
+	FlushWorkerCount int
+
+	// Amount of sealed memtables that can wait for a flush worker,
+	// before rotating the active memtable blocks
+	FlushQueueCapacity int
+
+	// Memtables larger than this are sealed and flushed
+	MaxMemtableBytes uint32
+
+	// Limits of the write controller, see stall.Options
+	WriteStall stall.Options
+
+	// Caps memtable memory across trees, nil means no cap
+	WriteBufferManager *memtable.WriteBufferManager
+
+	// Receives all internal logging, discards it by default
+	Logger *slog.Logger
+
+	// Notified about flushes, compactions, stalls and background errors
+	EventListeners []event.Listener
+
+	// Filesystem all files of the tree are stored in
+	FS vfs.FS
+
+	// Order of the keys
+	Comparator comparator.Comparator
 }
 
 // NewDefaultConfig creates a new Config with default values
 func DefaultConfig() *Config {
 	return &Config{
-		Inner:           DefaultPersistedConfig(),
-		BlockCache:      segment.NewBlockCache(8 * 1024 * 1024),
-		DescriptorTable: descriptor.NewFileDescriptorTable(960, 4),
+		Inner:              DefaultPersistedConfig(),
+		BlockCache:         segment.NewBlockCache(8 * 1024 * 1024),
+		DescriptorTable:    descriptor.NewFileDescriptorTable(960, 4),
+		FlushWorkerCount:   1,
+		FlushQueueCapacity: 4,
+		MaxMemtableBytes:   8 * 1024 * 1024,
+		WriteStall:         stall.DefaultOptions(),
+		Logger:             logging.Discard(),
+		FS:                 vfs.Default,
+		Comparator:         comparator.Bytewise,
 	}
 }
 
@@ -103,6 +165,15 @@ func (c *Config) BlockSize(blockSize uint32) *Config {
 	return c
 }
 
+// BlobThreshold sets the value size (in bytes) above which values
+// are separated from their keys and written to blob files.
+//
+// Defaults to 0, which keeps all values inline.
+func (c *Config) BlobThreshold(n uint32) *Config {
+	c.Inner.BlobThreshold = n
+	return c
+}
+
 // / Sets the block cache.
 // /
 // / You can create a global [`BlockCache`] and share it between multiple
@@ -114,8 +185,192 @@ func (c *Config) SetBlockCache(blockCache *segment.BlockCache) *Config {
 	return c
 }
 
-// SetDescriptorTable sets the descriptor table
+// / Sets the write buffer manager.
+// /
+// / Share a single [`WriteBufferManager`] between multiple trees to cap
+// / the memory of their memtables, the largest memtable is flushed once
+// / the cap is reached.
+// /
+// / Defaults to none, memtables are only flushed once they reach `MaxMemtableSize`.
+func (c *Config) SetWriteBufferManager(manager *memtable.WriteBufferManager) *Config {
+	c.WriteBufferManager = manager
+	return c
+}
+
+// SetLogger sets the logger receiving all internal logging of the tree.
+//
+// Records carry structured fields like segment ID, level, seqno and path,
+// see the logging package for their keys.
+//
+// Defaults to a logger discarding everything.
+func (c *Config) SetLogger(logger *slog.Logger) *Config {
+	c.Logger = logging.OrDiscard(logger)
+	return c
+}
+
+// AddEventListener registers a listener notified about flushes,
+// compactions, deleted segments, write stalls and background errors.
+//
+// Listeners are called in the order they were added.
+func (c *Config) AddEventListener(listener event.Listener) *Config {
+	c.EventListeners = append(c.EventListeners, listener)
+	return c
+}
+
+// BloomBitsPerKey sets the bits of bloom filter per key of newly written segments.
+//
+// Filters are partitioned like the block index, so only the partition
+// covering a key needs to be read for a point read.
+//
+// Defaults to 10 (about 1% false positives), 0 disables bloom filters.
+// Filters hash the bytes of keys, so they are not used with comparators
+// other than bytewise.
+func (c *Config) BloomBitsPerKey(n int) *Config {
+	if n < 0 {
+		panic("bloom bits per key must not be negative")
+	}
+	c.Inner.BloomBitsPerKey = n
+	return c
+}
+
+// PinL0L1IndexAndFilter pins the top-level index and filter blocks of
+// segments in the first two levels in the block cache, so they are never
+// evicted. Those segments are read most often, and are the most recent.
+//
+// Defaults to false.
+func (c *Config) PinL0L1IndexAndFilter(pin bool) *Config {
+	c.PinIndexAndFilterBlocks = pin
+	return c
+}
+
+// FlushWorkers sets the amount of goroutines flushing sealed memtables to segments.
+//
+// Segments are always registered in the order the memtables were sealed,
+// no matter which worker finishes first.
+//
+// Defaults to 1.
+func (c *Config) FlushWorkers(n int) *Config {
+	if n < 1 {
+		panic("there must be at least one flush worker")
+	}
+	c.FlushWorkerCount = n
+	return c
+}
+
+// FlushQueueSize sets the amount of sealed memtables that can wait for a flush
+// worker. Once the queue is full, rotating the active memtable blocks until a
+// worker picks up the oldest one.
+//
+// Defaults to 4.
+func (c *Config) FlushQueueSize(n int) *Config {
+	if n < 1 {
+		panic("flush queue size must be at least 1")
+	}
+	c.FlushQueueCapacity = n
+	return c
+}
+
+// MaxMemtableSize sets the size in bytes at which the active memtable
+// is sealed and queued for flushing.
+//
+// Defaults to 8 MiB.
+func (c *Config) MaxMemtableSize(bytes uint32) *Config {
+	if bytes == 0 {
+		panic("max memtable size must be greater than 0")
+	}
+	c.MaxMemtableBytes = bytes
+	return c
+}
+
+// L0SlowdownTrigger sets the amount of L0 segments at which writes
+// are delayed, 0 disables it.
+//
+// Defaults to 16.
+func (c *Config) L0SlowdownTrigger(n int) *Config {
+	c.WriteStall.L0SlowdownTrigger = n
+	return c
+}
+
+// L0StopTrigger sets the amount of L0 segments at which writes
+// are stopped until compactions catch up, 0 disables it.
+//
+// Defaults to 20.
+func (c *Config) L0StopTrigger(n int) *Config {
+	c.WriteStall.L0StopTrigger = n
+	return c
+}
+
+// MaxSealedMemtables sets the amount of memtables waiting to be flushed
+// at which writes are stopped, writes are delayed one memtable earlier.
+// 0 disables it.
+//
+// Defaults to 4.
+func (c *Config) MaxSealedMemtables(n int) *Config {
+	c.WriteStall.MaxSealedMemtables = n
+	return c
+}
+
+// PendingCompactionBytesLimits sets the estimated bytes waiting to be
+// compacted at which writes are delayed (soft) and stopped (hard).
+// 0 disables the limit.
+//
+// Defaults to 64 GiB and 256 GiB.
+func (c *Config) PendingCompactionBytesLimits(soft, hard uint64) *Config {
+	if hard > 0 && soft > hard {
+		panic("soft pending compaction bytes limit must not exceed the hard limit")
+	}
+	c.WriteStall.SoftPendingCompactionBytes = soft
+	c.WriteStall.HardPendingCompactionBytes = hard
+	return c
+}
+
+// MaxWriteDelay sets how long a single write is delayed at most, the delay
+// grows in proportion to the write debt, until writes are stopped.
+//
+// Defaults to 1ms.
+func (c *Config) MaxWriteDelay(delay time.Duration) *Config {
+	c.WriteStall.MaxDelay = delay
+	return c
+}
+
+// SetDescriptorTable sets the descriptor table, it opens files through
+// the filesystem of the config
 func (c *Config) SetDescriptorTable(descriptorTable *descriptor.FileDescriptorTable) *Config {
+	descriptorTable.SetFS(c.FS)
 	c.DescriptorTable = descriptorTable
 	return c
 }
+
+// SetFS sets the filesystem the files of the tree are stored in,
+// e.g. a vfs.MemFS to run the tree in memory.
+//
+// Defaults to the filesystem of the OS.
+func (c *Config) SetFS(fs vfs.FS) *Config {
+	c.FS = vfs.OrDefault(fs)
+	c.DescriptorTable.SetFS(c.FS)
+	return c
+}
+
+// PropertiesCollector registers a collector of custom segment statistics.
+//
+// A new collector is created for every segment written, its output can be
+// read through `Segment.Properties()`. Collectors are not persisted, so they
+// have to be registered again every time the tree is opened.
+func (c *Config) PropertiesCollector(factory segment.PropertiesCollectorFactory) *Config {
+	c.PropertiesCollectors = append(c.PropertiesCollectors, factory)
+	return c
+}
+
+// SetComparator sets the order of the keys, its name is persisted and the
+// tree refuses to open with a comparator of another name.
+//
+// Prefix scans require the comparator to keep keys with a common prefix
+// together.
+//
+// Defaults to comparator.Bytewise.
+func (c *Config) SetComparator(cmp comparator.Comparator) *Config {
+	cmp = comparator.OrDefault(cmp)
+	c.Comparator = cmp
+	c.Inner.Comparator = cmp.Name()
+	return c
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bagh/config"
+	"bagh/vfs"
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const crashKeyCount = 40
+
+// crashOp is a write of the workload, an empty value removes the key
+type crashOp struct {
+	key   string
+	value string
+}
+
+// crashModel tracks the writes of a crash test
+//
+// A store may lose writes that were not synced yet, but only a suffix of
+// them, so the recovered state has to match the writes up to some point
+// at or after the last known sync.
+type crashModel struct {
+	ops     []crashOp
+	durable int
+}
+
+// state returns the values of the keys after the first n writes
+func (m *crashModel) state(n int) map[string]string {
+	state := make(map[string]string, crashKeyCount)
+	for _, op := range m.ops[:n] {
+		if op.value == "" {
+			delete(state, op.key)
+		} else {
+			state[op.key] = op.value
+		}
+	}
+	return state
+}
+
+// match returns how many writes the recovered state reflects, or -1
+func (m *crashModel) match(recovered map[string]string) int {
+	for n := len(m.ops); n >= m.durable; n-- {
+		if assert.ObjectsAreEqual(m.state(n), recovered) {
+			return n
+		}
+	}
+	return -1
+}
+
+// crashRound writes to a store on fs, until the workload ends or a
+// write fails, and crashes fs
+func crashRound(t *testing.T, rng *rand.Rand, fs *vfs.FaultFS, path string, model *crashModel, round int) {
+	// Nothing compacts in the background, so L0 must not stop writes
+	cfg := config.NewConfig(path).MaxMemtableSize(2 * 1024).L0SlowdownTrigger(0).L0StopTrigger(0).SetFS(fs)
+	kv, err := OpenKvStoreWithConfig(cfg)
+	require.NoError(t, err)
+
+	// Faults hit the workload as well as background flushes
+	switch rng.Intn(4) {
+	case 0:
+		fs.FailNth(vfs.Op(rng.Intn(3)), rng.Int63n(100)+1)
+	case 1:
+		fs.TearNthWrite(rng.Int63n(100) + 1)
+	}
+
+	for i := rng.Intn(300); i > 0; i-- {
+		op := crashOp{key: fmt.Sprintf("key-%02d", rng.Intn(crashKeyCount))}
+
+		var err error
+		switch n := rng.Intn(100); {
+		case n < 2:
+			if err = kv.ForceFlush(); err == nil {
+				model.durable = len(model.ops)
+			}
+		case n < 3:
+			err = kv.tree.MajorCompact(64 * 1024 * 1024)
+		case n < 5:
+			// Like the periodic sync of the WAL
+			if err = kv.wal.Sync(); err == nil {
+				model.durable = len(model.ops)
+			}
+		case n < 20:
+			model.ops = append(model.ops, op)
+			err = kv.Remove(op.key)
+		default:
+			op.value = fmt.Sprintf("value-%d-%d", round, i)
+			model.ops = append(model.ops, op)
+			err = kv.Insert(op.key, op.value)
+		}
+		if err != nil {
+			// The process dies with the failed write, which may or may not survive
+			break
+		}
+	}
+
+	assert.NoError(t, fs.Crash(vfs.CrashOptions{TornWrites: rng.Intn(2) == 0}))
+	// Stops the background work of the dead store, nothing reaches fs anymore
+	kv.Close(context.Background())
+}
+
+// recoverState opens the store like after a restart, and reads all keys
+// through point reads, which a full scan has to agree with
+func recoverState(t *testing.T, fs vfs.FS, path string) map[string]string {
+	kv, err := OpenKvStoreWithConfig(config.NewConfig(path).SetFS(fs))
+	require.NoError(t, err)
+	defer kv.Close(context.Background())
+
+	state := make(map[string]string, crashKeyCount)
+	for i := 0; i < crashKeyCount; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		val, ok, err := kv.Get(key)
+		require.NoError(t, err)
+		if ok {
+			state[key] = val
+		}
+	}
+
+	scanned := make(map[string]string, len(state))
+	iter := kv.tree.Iter().IntoIter()
+	for key, val, ok := iter.Next(); ok; key, val, ok = iter.Next() {
+		scanned[string(*key)] = string(*val)
+	}
+	require.NoError(t, iter.Err())
+	require.Equal(t, state, scanned)
+	return state
+}
+
+func runCrashTest(t *testing.T, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	mem := vfs.NewMemFS()
+	path := "/db"
+	model := &crashModel{}
+
+	for round := 0; round < 5; round++ {
+		crashRound(t, rng, vfs.NewFaultFS(mem, rng.Int63()), path, model, round)
+
+		recovered := recoverState(t, mem, path)
+		n := model.match(recovered)
+		require.GreaterOrEqual(t, n, 0, "round %d: recovered state matches no prefix of the %d writes (%d durable)", round, len(model.ops), model.durable)
+
+		// Lost writes are gone for good
+		model.ops = model.ops[:n]
+		model.durable = n
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	seeds := int64(50)
+	if testing.Short() {
+		seeds = 5
+	}
+	for seed := int64(1); seed <= seeds; seed++ {
+		t.Run(fmt.Sprintf("seed-%d", seed), func(t *testing.T) {
+			runCrashTest(t, seed)
+		})
+	}
+}
@@ -1,7 +1,7 @@
 package descriptor
 
 import (
-	"os"
+	"bagh/vfs"
 	"sync"
 	"sync/atomic"
 
@@ -12,7 +12,7 @@ type FileGuard struct {
 	wrapper *FileDescriptorWrapper
 }
 
-func (fg *FileGuard) File() *os.File {
+func (fg *FileGuard) File() vfs.File {
 	fg.wrapper.fileMutex.Lock()
 	defer fg.wrapper.fileMutex.Unlock()
 	return fg.wrapper.file
@@ -26,7 +26,7 @@ func (fg *FileGuard) Release() {
 // and tells if this descriptor is being used or not
 type FileDescriptorWrapper struct {
 	// descriptor wrapper provided by golang
-	file      *os.File
+	file      vfs.File
 	fileMutex sync.Mutex
 	isUsed    atomic.Uint32
 }
@@ -37,6 +37,8 @@ type FileHandle struct {
 	descriptors      []*FileDescriptorWrapper
 	descriptorsMutex sync.RWMutex
 	path             string
+	// pinned descriptors are opened on insert and never evicted
+	pinned bool
 }
 
 type FileDescriptorTableInner struct {
@@ -56,9 +58,16 @@ type FileDescriptorTable struct {
 	concurrency int
 	// lru size
 	limit int
+	// files are opened through this
+	fs vfs.FS
 }
 
 func NewFileDescriptorTable(limit, concurrency int) *FileDescriptorTable {
+	return NewFileDescriptorTableFS(vfs.Default, limit, concurrency)
+}
+
+// NewFileDescriptorTableFS creates a table opening files through the given FS
+func NewFileDescriptorTableFS(fs vfs.FS, limit, concurrency int) *FileDescriptorTable {
 	return &FileDescriptorTable{
 		inner: &FileDescriptorTableInner{
 			table: make(map[string]*FileHandle, 100),
@@ -67,9 +76,21 @@ func NewFileDescriptorTable(limit, concurrency int) *FileDescriptorTable {
 		},
 		concurrency: concurrency,
 		limit:       limit,
+		fs:          fs,
 	}
 }
 
+// FS returns the filesystem the table opens files through
+func (fdt *FileDescriptorTable) FS() vfs.FS {
+	return fdt.fs
+}
+
+// SetFS replaces the filesystem files are opened through, only
+// call this before inserting any file
+func (fdt *FileDescriptorTable) SetFS(fs vfs.FS) {
+	fdt.fs = vfs.OrDefault(fs)
+}
+
 func (fdt *FileDescriptorTable) Clear() {
 	fdt.innerMutex.Lock()
 	defer fdt.innerMutex.Unlock()
@@ -120,7 +141,7 @@ func (fdt *FileDescriptorTable) Access(segmentId string) (*FileGuard, error) {
 
 		// creates file descriptors
 		for i := 0; i < fdt.concurrency; i++ {
-			file, err := os.Open(item.path)
+			file, err := fdt.fs.Open(item.path)
 			if err != nil {
 				return nil, err
 			}
@@ -139,7 +160,7 @@ func (fdt *FileDescriptorTable) Access(segmentId string) (*FileGuard, error) {
 		// adds to lru until limit is reached
 		if newSize > int64(fdt.limit) {
 			if oldest, ok := fdt.inner.lru.GetLeastRecentlyUsed(); oldest != segmentId && ok {
-				if oldestItem, ok := fdt.inner.table[oldest]; ok {
+				if oldestItem, ok := fdt.inner.table[oldest]; ok && !oldestItem.pinned {
 					oldestItem.descriptorsMutex.Lock()
 					// Decrease the size by the number of descriptors in the oldest item
 					fdt.inner.size.Add(-int64(len(oldestItem.descriptors)))
@@ -183,6 +204,31 @@ func (fdt *FileDescriptorTable) Insert(path string, id string) {
 	fdt.inner.lru.Refresh(id)
 }
 
+// InsertPinned opens the descriptors of a file right away, and keeps them open
+// until Remove, so the file stays readable even if it is deleted in the meantime
+func (fdt *FileDescriptorTable) InsertPinned(path string, id string) error {
+	handle := &FileHandle{path: path, pinned: true}
+	for i := 0; i < fdt.concurrency; i++ {
+		file, err := fdt.fs.Open(path)
+		if err != nil {
+			for _, desc := range handle.descriptors {
+				desc.file.Close()
+			}
+			return err
+		}
+		handle.descriptors = append(handle.descriptors, &FileDescriptorWrapper{file: file})
+	}
+
+	fdt.Remove(id)
+
+	fdt.innerMutex.Lock()
+	defer fdt.innerMutex.Unlock()
+
+	fdt.inner.table[id] = handle
+	fdt.inner.size.Add(int64(len(handle.descriptors)))
+	return nil
+}
+
 func (fdt *FileDescriptorTable) Remove(id string) {
 	fdt.innerMutex.Lock()
 	defer fdt.innerMutex.Unlock()
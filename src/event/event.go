@@ -0,0 +1,100 @@
+package event
+
+import (
+	"bagh/segment"
+	"bagh/stall"
+	"time"
+)
+
+// Listener is notified about the background work of a tree
+//
+// Callbacks are invoked synchronously from the goroutine doing the work,
+// without holding any tree locks, so they should return quickly. Embed
+// NopListener to only implement the callbacks of interest.
+//
+//	type flushLogger struct{ event.NopListener }
+//
+//	func (flushLogger) OnFlushCompleted(info event.FlushInfo) {
+//		fmt.Println("flushed", info.Segment.ID)
+//	}
+//
+//	tree, err := tree.Open(*config.NewConfig(folder).AddEventListener(flushLogger{}))
+type Listener interface {
+	// OnFlushCompleted is called once a flushed segment is registered in the tree
+	OnFlushCompleted(info FlushInfo)
+
+	// OnCompactionBegin is called before the input segments are merged or dropped
+	OnCompactionBegin(info CompactionInfo)
+
+	// OnCompactionCompleted is called after a compaction, whether it failed or not
+	OnCompactionCompleted(info CompactionInfo)
+
+	// OnSegmentDeleted is called after the files of an obsolete segment are deleted
+	OnSegmentDeleted(info SegmentDeletedInfo)
+
+	// OnWriteStallChanged is called when writes start or stop being delayed or stopped
+	OnWriteStallChanged(info stall.Event)
+
+	// OnBackgroundError is called when a flush, compaction or manifest
+	// write fails, the tree is read-only afterwards
+	OnBackgroundError(info BackgroundErrorInfo)
+}
+
+// FlushInfo describes a completed flush
+type FlushInfo struct {
+	Segment *segment.Metadata
+
+	// Amount of items of the flushed memtable
+	ItemCount int
+
+	Duration time.Duration
+}
+
+// CompactionInfo describes a compaction
+type CompactionInfo struct {
+	// Level the output segments are written to, 0 if the input
+	// segments are dropped
+	DestLevel uint8
+
+	Inputs []*segment.Metadata
+
+	// Output segments, empty when the compaction begins or if the input
+	// segments are dropped without being merged
+	Outputs []*segment.Metadata
+
+	// Set once the compaction completed
+	Duration time.Duration
+	Err      error
+}
+
+// SegmentDeletedInfo describes a deleted segment
+type SegmentDeletedInfo struct {
+	SegmentID string
+	Path      string
+	Err       error
+}
+
+// BackgroundErrorReason names the background work that failed
+type BackgroundErrorReason string
+
+const (
+	ReasonFlush      BackgroundErrorReason = "flush"
+	ReasonCompaction BackgroundErrorReason = "compaction"
+	ReasonManifest   BackgroundErrorReason = "manifest"
+)
+
+// BackgroundErrorInfo describes an error of background work
+type BackgroundErrorInfo struct {
+	Reason BackgroundErrorReason
+	Err    error
+}
+
+// NopListener implements Listener with callbacks doing nothing
+type NopListener struct{}
+
+func (NopListener) OnFlushCompleted(FlushInfo)            {}
+func (NopListener) OnCompactionBegin(CompactionInfo)      {}
+func (NopListener) OnCompactionCompleted(CompactionInfo)  {}
+func (NopListener) OnSegmentDeleted(SegmentDeletedInfo)   {}
+func (NopListener) OnWriteStallChanged(stall.Event)       {}
+func (NopListener) OnBackgroundError(BackgroundErrorInfo) {}
@@ -1,6 +1,7 @@
 package file
 
 import (
+	"bagh/vfs"
 	"os"
 	"path/filepath"
 )
@@ -15,28 +16,29 @@ const (
 	IndexBlocksFile     = "index_blocks"
 	TopLevelIndexFile   = "index"
 	SegmentMetadataFile = "meta.json"
+	BlobsFolder         = "blobs"
+	BloomFilterFile     = "bloom"
 )
 
-// future optimization
-// const BloomFilterFile = "bloom"
-
 // RewriteAtomic atomically rewrites a file
-// @TODO: check if works
-func RewriteAtomic(path string, content []byte) error {
+func RewriteAtomic(fs vfs.FS, path string, content []byte) error {
 	dir := filepath.Dir(path)
+	tempPath := filepath.Join(dir, "temp-"+filepath.Base(path))
 
-	tempFile, err := os.CreateTemp(dir, "temp-*")
+	tempFile, err := fs.Create(tempPath)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tempFile.Name())
+	defer fs.Remove(tempPath)
 
 	if _, err := tempFile.Write(content); err != nil {
+		tempFile.Close()
 		return err
 	}
 
 	// TODO: Not sure if the fsync is really required, but just for the sake of it...
 	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
 		return err
 	}
 
@@ -44,22 +46,31 @@ func RewriteAtomic(path string, content []byte) error {
 		return err
 	}
 
-	if err := os.Rename(tempFile.Name(), path); err != nil {
+	if err := fs.Rename(tempPath, path); err != nil {
 		return err
 	}
 
-	// On non-Windows systems, we might want to sync the directory as well
-	if os.PathSeparator != '\\' { // Check if not Windows
-		dir, err := os.Open(filepath.Dir(path))
-		if err != nil {
-			return err
+	return fs.SyncDir(dir)
+}
+
+// MkdirAllSynced creates a directory with its missing parents, and syncs
+// the parent of every created directory, so none of them is lost in a crash
+func MkdirAllSynced(fs vfs.FS, path string) error {
+	var created []string
+	for dir := filepath.Clean(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, err := fs.Stat(dir); !os.IsNotExist(err) {
+			break
 		}
-		defer dir.Close()
-		// TODO: Not sure if the fsync is really required, but just for the sake of it...
-		if err := dir.Sync(); err != nil {
+		created = append(created, dir)
+	}
+
+	if err := fs.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	for _, dir := range created {
+		if err := fs.SyncDir(filepath.Dir(dir)); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
@@ -2,6 +2,7 @@ package file_test
 
 import (
 	"bagh/file"
+	"bagh/vfs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -23,7 +24,7 @@ func TestAtomicRewrite(t *testing.T) {
 	}
 
 	// Rewrite file atomically
-	if err := file.RewriteAtomic(path, []byte("newcontent")); err != nil {
+	if err := file.RewriteAtomic(vfs.Default, path, []byte("newcontent")); err != nil {
 		t.Fatalf("Failed to rewrite file atomically: %v", err)
 	}
 
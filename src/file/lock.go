@@ -0,0 +1,85 @@
+package file
+
+import (
+	"bagh/vfs"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LockFile is held by the process that opened the tree, it contains its PID
+const LockFile = "LOCK"
+
+// ErrLocked is returned if the directory is locked by another process (or tree)
+var ErrLocked = errors.New("directory is locked")
+
+// DirLock is an exclusive lock of a tree directory
+type DirLock struct {
+	file vfs.File
+	path string
+}
+
+// LockDir takes the exclusive lock of a directory, and writes the
+// PID of the current process into the lock file
+//
+// Fails with an error wrapping ErrLocked (including the holder's PID) if
+// the lock is already held, even by the same process.
+func LockDir(fs vfs.FS, dir string) (*DirLock, error) {
+	path := filepath.Join(dir, LockFile)
+
+	f, err := fs.Lock(path)
+	if err != nil {
+		if errors.Is(err, vfs.ErrLocked) {
+			return nil, lockedError(fs, path)
+		}
+		return nil, err
+	}
+
+	if err := writePID(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &DirLock{file: f, path: path}, nil
+}
+
+// Unlock releases the lock, the lock file is left in place
+func (l *DirLock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Path returns the path of the lock file
+func (l *DirLock) Path() string {
+	return l.path
+}
+
+func writePID(f vfs.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// lockedError describes who holds the lock, as far as the lock file tells
+func lockedError(fs vfs.FS, path string) error {
+	content, err := vfs.ReadFile(fs, path)
+	if err != nil {
+		return fmt.Errorf("%w: %s is held by another process", ErrLocked, path)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return fmt.Errorf("%w: %s is held by another process", ErrLocked, path)
+	}
+	return fmt.Errorf("%w: %s is held by process %d", ErrLocked, path, pid)
+}
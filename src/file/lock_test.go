@@ -0,0 +1,47 @@
+package file_test
+
+import (
+	"bagh/file"
+	"bagh/vfs"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLockDir(t *testing.T) {
+	dir := t.TempDir()
+
+	lock, err := file.LockDir(vfs.Default, dir)
+	if err != nil {
+		t.Fatalf("Failed to lock directory: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, file.LockFile))
+	if err != nil {
+		t.Fatalf("Failed to read lock file: %v", err)
+	}
+	if strings.TrimSpace(string(content)) != fmt.Sprint(os.Getpid()) {
+		t.Errorf("Expected PID %d in lock file, got %q", os.Getpid(), content)
+	}
+
+	_, err = file.LockDir(vfs.Default, dir)
+	if !errors.Is(err, file.ErrLocked) {
+		t.Fatalf("Expected ErrLocked, got %v", err)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("process %d", os.Getpid())) {
+		t.Errorf("Expected holder PID in error, got %v", err)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Failed to unlock directory: %v", err)
+	}
+
+	lock, err = file.LockDir(vfs.Default, dir)
+	if err != nil {
+		t.Fatalf("Failed to lock directory again: %v", err)
+	}
+	lock.Unlock()
+}
@@ -1,11 +1,14 @@
 package flush
 
 import (
-	"log"
+	"log/slog"
 	"path/filepath"
+	"sort"
 
+	"bagh/blob"
 	"bagh/descriptor"
 	"bagh/file"
+	"bagh/logging"
 	"bagh/memtable"
 	"bagh/segment"
 	"bagh/value"
@@ -31,30 +34,87 @@ type Options struct {
 
 	// Descriptor table
 	DescriptorTable *descriptor.FileDescriptorTable
+
+	// Blob files of the tree, values larger than BlobThreshold are moved there
+	Blobs         *blob.Manager
+	BlobThreshold uint32
+
+	// Properties collectors run over the written segment
+	Collectors []segment.PropertiesCollectorFactory
+
+	// Bits of bloom filter per key, 0 disables bloom filters
+	BloomBitsPerKey int
+
+	// Logger, may be nil
+	Logger *slog.Logger
 }
 
 // flushToSegment flushes a memtable, creating a segment in the given folder.
 func FlushToSegment(opts Options) (*segment.Segment, error) {
 	segmentFolder := filepath.Join(opts.Folder, opts.SegmentID)
-	log.Printf("Flushing segment to %s", segmentFolder)
+	logger := logging.OrDiscard(opts.Logger).With(logging.SegmentID(opts.SegmentID), logging.Path(segmentFolder))
+	logger.Debug("Flushing segment")
+
+	// Segments are written to the filesystem they are read from
+	fs := opts.DescriptorTable.FS()
+	cmp := opts.MemTable.Comparator()
 
 	segmentWriter, err := segment.NewWriter(segment.Options{
 		Path:            segmentFolder,
 		EvictTombstones: false,
 		BlockSize:       opts.BlockSize,
+		Collectors:      opts.Collectors,
+		BloomBitsPerKey: opts.BloomBitsPerKey,
+		FS:              fs,
+		Comparator:      cmp,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	for k, v := range opts.MemTable.Items {
-		err := segmentWriter.Write(value.Value{
-			Key:   []byte(k),
-			Value: v,
-		})
+	items, err := opts.MemTable.Iter()
+	if err != nil {
+		return nil, err
+	}
+
+	// Data blocks are searched by their restart points, so items need to be sorted
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].LessBy(cmp, items[j])
+	})
+
+	var blobWriter *blob.Writer
+
+	for _, item := range items {
+		if opts.Blobs != nil && opts.BlobThreshold > 0 &&
+			item.ValueType == value.Record && len(item.Value) > int(opts.BlobThreshold) {
+			if blobWriter == nil {
+				if blobWriter, err = opts.Blobs.NewWriter(); err != nil {
+					return nil, err
+				}
+			}
+
+			ptr, err := blobWriter.Write(item.Key, item.SeqNo, item.Value)
+			if err != nil {
+				return nil, err
+			}
+			item.Value = ptr.Encode()
+			item.ValueType = value.Indirection
+		}
+
+		if err := segmentWriter.Write(item); err != nil {
+			return nil, err
+		}
+	}
+
+	// Values need to be durable before the segment pointing to them
+	if blobWriter != nil {
+		info, err := blobWriter.Finish()
 		if err != nil {
 			return nil, err
 		}
+		if info != nil {
+			opts.Blobs.Register(info)
+		}
 	}
 
 	if err := segmentWriter.Finish(); err != nil {
@@ -65,12 +125,12 @@ func FlushToSegment(opts Options) (*segment.Segment, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := metadata.WriteToFile(); err != nil {
+	if err := metadata.WriteToFile(fs); err != nil {
 		return nil, err
 	}
 
-	log.Printf("Finalized segment write at %s", segmentFolder)
-	blockIndex := new(segment.BlockIndex)
+	logger.Debug("Finalized segment write")
+	blockIndex := new(segment.BlockIndex).WithComparator(cmp)
 	err = blockIndex.FromFile(
 		opts.SegmentID,
 		opts.DescriptorTable,
@@ -93,7 +153,7 @@ func FlushToSegment(opts Options) (*segment.Segment, error) {
 		metadata.ID,
 	)
 
-	log.Printf("Flushed segment to %s", segmentFolder)
+	logger.Info("Flushed segment", slog.Uint64("items", metadata.ItemCount), slog.Uint64("bytes", metadata.FileSize))
 
 	return createdSegment, nil
 }
@@ -1,7 +1,12 @@
 package flush_test
 
 import (
+	"bagh/descriptor"
+	"bagh/file"
 	"bagh/flush"
+	"bagh/memtable"
+	"bagh/segment"
+	"bagh/value"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -17,17 +22,22 @@ func TestFlushToSegment(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	memtable := NewMemTable()
-	blockCache := NewBlockCache()
-	descriptorTable := NewFileDescriptorTable()
+	memtable := memtable.NewMemTable()
+	for i := 0; i < 100; i++ {
+		key := []byte{'k', byte(i)}
+		memtable.Insert(*value.NewValue(key, []byte("value"), value.SeqNo(i), value.Record))
+	}
+	blockCache := segment.NewBlockCache(1024 * 1024)
+	descriptorTable := descriptor.NewFileDescriptorTable(16, 1)
 
 	opts := flush.Options{
-		Memtable:        memtable,
+		MemTable:        memtable,
 		SegmentID:       "test_segment",
 		Folder:          tempDir,
 		BlockSize:       4096,
 		BlockCache:      blockCache,
 		DescriptorTable: descriptorTable,
+		BloomBitsPerKey: 10,
 	}
 
 	// Test
@@ -54,11 +64,11 @@ func TestFlushToSegment(t *testing.T) {
 	}
 
 	// Check if files were created
-	if _, err := os.Stat(filepath.Join(tempDir, opts.SegmentID, BlocksFile)); os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(tempDir, opts.SegmentID, file.BlocksFile)); os.IsNotExist(err) {
 		t.Error("Blocks file was not created")
 	}
 
-	if _, err := os.Stat(filepath.Join(tempDir, opts.SegmentID, BloomFilterFile)); os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(tempDir, opts.SegmentID, file.BloomFilterFile)); os.IsNotExist(err) {
 		t.Error("Bloom filter file was not created")
 	}
 
@@ -3,14 +3,13 @@ module bagh
 go 1.22.1
 
 require (
-	github.com/google/uuid v1.6.0
 	github.com/pierrec/lz4/v4 v4.1.21
+	github.com/stretchr/testify v1.9.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.9.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
@@ -2,137 +2,320 @@ package main
 
 import (
 	"bagh/config"
+	"bagh/logging"
 	"bagh/seqno"
+	"bagh/stats"
 	"bagh/tree"
 	"bagh/value"
+	"bagh/vfs"
 	"bagh/wal"
-	"fmt"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/google/uuid"
 )
 
 type KvStore struct {
 	tree  *tree.Tree
 	wal   *wal.Wal
 	seqno *seqno.SequenceNumberCounter
+	fs    vfs.FS
+
+	// Writes hold the read lock while writing to the WAL and the memtable,
+	// rotation holds the write lock, so a WAL file always covers exactly one memtable
+	rotationMutex sync.RWMutex
+
+	// Stops the WAL sync goroutine, which closes syncDone on exit
+	stopSync chan struct{}
+	syncDone chan struct{}
+	closed   atomic.Bool
+
+	logger *slog.Logger
+}
+
+// WriteOptions control a single write
+type WriteOptions struct {
+	// Return stall.ErrWriteStalled instead of waiting, if writes
+	// are currently delayed or stopped
+	NoSlowdown bool
+}
+
+// CloseOptions control closing the store
+type CloseOptions struct {
+	// Keep the active memtable in the WAL instead of flushing it to a segment
+	NoFlush bool
 }
 
 func OpenKvStore(path string) (*KvStore, error) {
+	return OpenKvStoreWithConfig(config.NewConfig(path))
+}
+
+func OpenKvStoreWithConfig(cfg *config.Config) (*KvStore, error) {
+	path := cfg.Inner.Path
+	fs := vfs.OrDefault(cfg.FS)
+	logger := logging.OrDiscard(cfg.Logger)
 	start := time.Now()
-	cfg := config.NewConfig(path)
 	tree, err := tree.Open(*cfg)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("Recovered LSM-tree in %fs\n", time.Since(start).Seconds())
+	logger.Info("Recovered LSM-tree", logging.Path(path), slog.Duration("took", time.Since(start)))
 
 	start = time.Now()
-	wal, memtable, err := wal.OpenWal(path)
+	wal, memtable, err := wal.OpenWal(fs, path, logger, cfg.Comparator)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("Recovered WAL + memtable in %fs\n", time.Since(start).Seconds())
+	logger.Info("Recovered WAL + memtable", logging.Path(path), slog.Duration("took", time.Since(start)))
 	lsn, err := memtable.GetLSN()
 	if err != nil {
 		return nil, err
 	}
-	seqno := seqno.NewSequenceNumberCounter(*lsn)
+	// Continue after the highest seqno of the WAL and the segments
+	var next value.SeqNo
+	if !memtable.IsEmpty() || tree.SegmentCount() > 0 {
+		next = max(*lsn, tree.GetSegmentLSN()) + 1
+	}
+	seqno := seqno.NewSequenceNumberCounter(next)
 
 	tree.SetActiveMemtable(memtable)
 
 	kv := &KvStore{
-		tree:  tree,
-		wal:   wal,
-		seqno: seqno,
+		tree:     tree,
+		wal:      wal,
+		seqno:    seqno,
+		fs:       fs,
+		stopSync: make(chan struct{}),
+		syncDone: make(chan struct{}),
+		logger:   logger,
 	}
 
-	go func() {
-		for {
-			time.Sleep(time.Second)
-			err := kv.wal.Sync()
-			if err != nil {
-				fmt.Printf("WAL sync error: %v\n", err)
-			}
+	// Flushes requested by the write buffer manager need to rotate the WAL as well
+	tree.SetFlushHandler(func() {
+		if _, err := kv.rotate(0); err != nil {
+			logger.Error("Failed to flush memtable", logging.Err(err))
 		}
-	}()
+	})
+
+	go kv.syncWal(time.Second)
 
 	return kv, nil
 }
 
-func (kv *KvStore) Insert(key, v string) error {
-	keyBytes := []byte(key)
-	valueBytes := []byte(v)
-	seqno := kv.seqno.Next()
-
-	err := kv.wal.Write(value.Value{
-		Key:       keyBytes,
-		Value:     valueBytes,
-		SeqNo:     seqno,
-		ValueType: value.Record,
-	})
-	if err != nil {
-		return err
+// syncWal fsyncs the WAL periodically, until Close is called
+func (kv *KvStore) syncWal(interval time.Duration) {
+	defer close(kv.syncDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-kv.stopSync:
+			return
+		case <-ticker.C:
+			if err := kv.wal.Sync(); err != nil {
+				kv.logger.Error("Failed to sync WAL", logging.Err(err))
+			}
+		}
 	}
+}
 
-	_, memtableSize, err := kv.tree.Insert(keyBytes, valueBytes, seqno)
-	if err != nil {
-		return err
+// Close flushes the active memtable, waits for queued flushes and running
+// compactions, and closes the WAL and the tree, see CloseWithOptions
+func (kv *KvStore) Close(ctx context.Context) error {
+	return kv.CloseWithOptions(ctx, CloseOptions{})
+}
+
+// CloseWithOptions closes the store, later calls return tree.ErrClosed
+//
+// Once ctx is done, running compactions are cancelled instead of waited
+// for, and the memtable is left to the WAL. The WAL is always synced and
+// closed, so no acknowledged write is lost.
+func (kv *KvStore) CloseWithOptions(ctx context.Context, opts CloseOptions) error {
+	if !kv.closed.CompareAndSwap(false, true) {
+		return tree.ErrClosed
 	}
+	kv.logger.Info("Closing KvStore")
 
-	return kv.maintenance(memtableSize)
+	close(kv.stopSync)
+	<-kv.syncDone
+
+	var errs []error
+	if !opts.NoFlush {
+		if err := kv.flush(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- kv.tree.Close() }()
+	select {
+	case err := <-closed:
+		errs = append(errs, err)
+	case <-ctx.Done():
+		kv.tree.CancelBackgroundWork()
+		errs = append(errs, ctx.Err(), <-closed)
+	}
+
+	// Waits for writes that got past the closed check
+	kv.rotationMutex.Lock()
+	errs = append(errs, kv.wal.Close())
+	kv.rotationMutex.Unlock()
+
+	return errors.Join(errs...)
+}
+
+func (kv *KvStore) Insert(key, v string) error {
+	return kv.InsertWithOptions(key, v, WriteOptions{})
+}
+
+func (kv *KvStore) InsertWithOptions(key, v string, opts WriteOptions) error {
+	return kv.write(value.Value{
+		Key:       []byte(key),
+		Value:     []byte(v),
+		ValueType: value.Record,
+	}, opts)
 }
 
 func (kv *KvStore) Remove(key string) error {
-	keyBytes := []byte(key)
-	seqno := kv.seqno.Next()
+	return kv.RemoveWithOptions(key, WriteOptions{})
+}
 
-	err := kv.wal.Write(value.Value{
-		Key:       keyBytes,
+func (kv *KvStore) RemoveWithOptions(key string, opts WriteOptions) error {
+	return kv.write(value.Value{
+		Key:       []byte(key),
 		Value:     []byte{},
-		SeqNo:     seqno,
 		ValueType: value.Tombstone,
-	})
-	if err != nil {
+	}, opts)
+}
+
+// write appends an item to the WAL and the active memtable
+func (kv *KvStore) write(item value.Value, opts WriteOptions) error {
+	if kv.closed.Load() {
+		return tree.ErrClosed
+	}
+	// Nothing reaches the WAL while the tree is read-only
+	if err := kv.tree.BackgroundError(); err != nil {
+		return err
+	}
+	if err := kv.tree.WriteController().Wait(opts.NoSlowdown); err != nil {
 		return err
 	}
 
-	_, memtableSize, err := kv.tree.Remove(keyBytes, seqno)
+	kv.rotationMutex.RLock()
+
+	item.SeqNo = kv.seqno.Next()
+
+	if err := kv.wal.Write(item); err != nil {
+		kv.rotationMutex.RUnlock()
+		return err
+	}
+
+	var memtableSize uint32
+	var err error
+	if item.ValueType == value.Tombstone {
+		_, memtableSize, err = kv.tree.Remove(item.Key, item.SeqNo)
+	} else {
+		_, memtableSize, err = kv.tree.Insert(item.Key, item.Value, item.SeqNo)
+	}
+	kv.rotationMutex.RUnlock()
+
 	if err != nil {
 		return err
 	}
 	return kv.maintenance(memtableSize)
 }
 
+// Resume makes the store writable again after a background error,
+// see Tree.Resume
+func (kv *KvStore) Resume() error {
+	return kv.tree.Resume()
+}
+
+// ForceFlush flushes the active memtable, and waits until the segment is durable
 func (kv *KvStore) ForceFlush() error {
-	fmt.Println("Flushing memtable")
-	_, err := kv.tree.FlushActiveMemtable()
-	return err
+	if kv.closed.Load() {
+		return tree.ErrClosed
+	}
+	return kv.flush(context.Background())
 }
 
-func (kv *KvStore) maintenance(memtableSize uint32) error {
-	if memtableSize > 8*1024*1024 {
-		err := kv.ForceFlush()
-		if err != nil {
-			return err
-		}
+// flush flushes the active memtable, and waits until the segment is durable or ctx is done
+func (kv *KvStore) flush(ctx context.Context) error {
+	kv.logger.Debug("Flushing memtable")
+	task, err := kv.rotate(0)
+	if err != nil || task == nil {
+		return err
+	}
 
-		err = kv.wal.Truncate()
-		if err != nil {
-			return err
-		}
+	select {
+	case <-task.Done():
+		_, err = task.Wait()
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	if kv.tree.FirstLevelSegmentCount() > 16 {
-		fmt.Println("Stalling writes...")
-		time.Sleep(100 * time.Millisecond)
+// rotate seals the active memtable together with its WAL, if it is larger
+// than minSize, and queues it for flushing
+//
+// The sealed WAL files are removed once the memtable's segment is durable.
+func (kv *KvStore) rotate(minSize uint32) (*tree.PendingFlush, error) {
+	kv.rotationMutex.Lock()
+	defer kv.rotationMutex.Unlock()
+
+	// Another writer may have rotated the memtable in the meantime
+	if minSize > 0 && kv.tree.ActiveMemtableSize() <= minSize {
+		return nil, nil
 	}
 
-	for kv.tree.FirstLevelSegmentCount() > 20 {
-		fmt.Println("Halting writes until L0 is cleared up...")
-		time.Sleep(100 * time.Millisecond)
+	sealedWal, err := kv.wal.Rotate()
+	if err != nil {
+		return nil, err
 	}
 
+	task := kv.tree.ScheduleFlush(func() {
+		if err := wal.Remove(kv.fs, sealedWal); err != nil {
+			kv.logger.Error("Failed to remove flushed WAL files", slog.Any("paths", sealedWal), logging.Err(err))
+		}
+	})
+	if task == nil {
+		// Nothing was written to the sealed WAL files
+		return nil, wal.Remove(kv.fs, sealedWal)
+	}
+	return task, nil
+}
+
+// IngestSegments loads segments built with segment.SegmentBuilder,
+// all of their items become visible at once
+//
+// The memtable is flushed together with its WAL first, so replaying the
+// WAL after a restart cannot shadow the ingested items.
+func (kv *KvStore) IngestSegments(paths []string) error {
+	task, err := kv.rotate(0)
+	if err != nil {
+		return err
+	}
+	if task != nil {
+		if _, err := task.Wait(); err != nil {
+			return err
+		}
+	}
+	return kv.tree.IngestSegments(paths, kv.seqno.Next())
+}
+
+func (kv *KvStore) maintenance(memtableSize uint32) error {
+	maxSize := kv.tree.MaxMemtableSize()
+	if maxSize > 0 && memtableSize > maxSize {
+		if _, err := kv.rotate(maxSize); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -159,123 +342,33 @@ func (kv *KvStore) Len() (int, error) {
 	return kv.tree.Len()
 }
 
-const ITEM_COUNT = 1_000_000
-
-func main() {
-	kv, err := OpenKvStore(".data")
-	if err != nil {
-		fmt.Printf("Error opening KvStore: %v\n", err)
-		return
-	}
-
-	fmt.Println("Counting items")
-	count, err := kv.Len()
-	if err != nil {
-		fmt.Printf("Error getting length: %v\n", err)
-		return
-	}
-	fmt.Printf("Recovered LSM-tree with %d items\n", count)
-
-	keys := []string{"my-key-1", "my-key-2", "my-key-3"}
-	for _, key := range keys {
-		exists, err := kv.ContainsKey(key)
-		if err != nil {
-			fmt.Printf("Error checking key existence: %v\n", err)
-			return
-		}
-		if !exists {
-			err = kv.Insert(key, "my-value-"+key[7:])
-			if err != nil {
-				fmt.Printf("Error inserting: %v\n", err)
-				return
-			}
-		}
-	}
-
-	fmt.Println("Getting items")
-	for _, key := range keys {
-		value, exists, err := kv.Get(key)
-		if err != nil {
-			fmt.Printf("Error getting value: %v\n", err)
-			return
-		}
-		if !exists {
-			fmt.Printf("Key %s not found\n", key)
-		} else {
-			fmt.Printf("%s: %s\n", key, value)
-		}
-	}
-
-	fmt.Println("Remove 3 items")
-	for _, key := range keys {
-		err = kv.Remove(key)
-		if err != nil {
-			fmt.Printf("Error removing: %v\n", err)
-			return
-		}
-	}
-
-	for _, key := range keys {
-		exists, err := kv.ContainsKey(key)
-		if err != nil {
-			fmt.Printf("Error checking key existence: %v\n", err)
-			return
-		}
-		if exists {
-			fmt.Printf("Key %s still exists\n", key)
-		}
-	}
-
-	fmt.Println("Counting items")
-	count, err = kv.Len()
-	if err != nil {
-		fmt.Printf("Error getting length: %v\n", err)
-		return
-	}
-	remainingItemCount := ITEM_COUNT - count
-
-	fmt.Printf("Bulk loading %d items\n", remainingItemCount)
-	start := time.Now()
-
-	for i := 0; i < remainingItemCount; i++ {
-		err = kv.Insert(uuid.New().String(), uuid.New().String())
-		if err != nil {
-			fmt.Printf("Error inserting: %v\n", err)
-			return
-		}
-
-		if i%1_000_000 == 0 {
-			fmt.Printf("Written %d items\n", i)
-		}
-	}
-	fmt.Printf("Took: %fs\n", time.Since(start).Seconds())
-
-	fmt.Println("Counting items")
-	count, err = kv.Len()
-	if err != nil {
-		fmt.Printf("Error getting length: %v\n", err)
-		return
-	}
-	if count != ITEM_COUNT {
-		fmt.Printf("Expected %d items, but got %d\n", ITEM_COUNT, count)
-		return
+// Stats returns the statistics of the tree, including the WAL size
+func (kv *KvStore) Stats() stats.Stats {
+	s := kv.tree.Stats()
+	if size, err := kv.wal.Size(); err == nil {
+		s.WalBytes = size
 	}
+	return s
+}
 
-	for kv.tree.IsCompacting() {
-		fmt.Println("Waiting for compaction...")
-		time.Sleep(time.Second)
-	}
+// Verify checks the checksums and the order of the items of all
+// segments, see Tree.Verify
+func (kv *KvStore) Verify() error {
+	return kv.tree.Verify()
+}
 
-	fmt.Println("Counting items")
-	count, err = kv.Len()
-	if err != nil {
-		fmt.Printf("Error getting length: %v\n", err)
-		return
-	}
-	if count != ITEM_COUNT {
-		fmt.Printf("Expected %d items, but got %d\n", ITEM_COUNT, count)
-		return
+// Checkpoint flushes the active memtable, and creates a checkpoint of the
+// tree in dir, which can be opened as a store of its own
+//
+// Writes that happen while the checkpoint is created may be missing from it.
+func (kv *KvStore) Checkpoint(dir string) error {
+	if err := kv.ForceFlush(); err != nil {
+		return err
 	}
+	return kv.tree.Checkpoint(dir)
+}
 
-	fmt.Println("All good")
+// StatsHandler serves the statistics in the Prometheus text format
+func (kv *KvStore) StatsHandler() http.Handler {
+	return stats.Handler(kv.Stats)
 }
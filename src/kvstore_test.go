@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bagh/config"
+	"bagh/segment"
+	"bagh/tree"
+	"bagh/vfs"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKvStoreClose(t *testing.T) {
+	folder := t.TempDir()
+	kv, err := OpenKvStoreWithConfig(config.NewConfig(folder))
+	assert.NoError(t, err)
+
+	assert.NoError(t, kv.Insert("a", "1"))
+	assert.NoError(t, kv.Insert("b", "2"))
+	assert.NoError(t, kv.Close(context.Background()))
+
+	assert.ErrorIs(t, kv.Insert("c", "3"), tree.ErrClosed)
+	assert.ErrorIs(t, kv.Close(context.Background()), tree.ErrClosed)
+
+	// The memtable was flushed, seqnos continue after the segment's
+	kv, err = OpenKvStoreWithConfig(config.NewConfig(folder))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, kv.tree.SegmentCount())
+	assert.Equal(t, uint64(2), uint64(kv.seqno.Get()))
+
+	assert.NoError(t, kv.Insert("a", "3"))
+	val, ok, err := kv.Get("a")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "3", val)
+	assert.NoError(t, kv.CloseWithOptions(context.Background(), CloseOptions{NoFlush: true}))
+
+	// Unflushed writes are recovered from the WAL
+	kv, err = OpenKvStoreWithConfig(config.NewConfig(folder))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, kv.tree.SegmentCount())
+	assert.Equal(t, uint64(3), uint64(kv.seqno.Get()))
+	val, _, err = kv.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "3", val)
+	assert.NoError(t, kv.Close(context.Background()))
+}
+
+func TestKvStoreMemFS(t *testing.T) {
+	fs := vfs.NewMemFS()
+	folder := filepath.Join(t.TempDir(), "store")
+
+	kv, err := OpenKvStoreWithConfig(config.NewConfig(folder).SetFS(fs))
+	assert.NoError(t, err)
+	assert.NoError(t, kv.Insert("a", "1"))
+	assert.NoError(t, kv.Insert("b", "2"))
+	assert.NoError(t, kv.Close(context.Background()))
+
+	kv, err = OpenKvStoreWithConfig(config.NewConfig(folder).SetFS(fs))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, kv.tree.SegmentCount())
+	assert.NoError(t, kv.Insert("a", "3"))
+	assert.NoError(t, kv.CloseWithOptions(context.Background(), CloseOptions{NoFlush: true}))
+
+	kv, err = OpenKvStoreWithConfig(config.NewConfig(folder).SetFS(fs))
+	assert.NoError(t, err)
+	val, ok, err := kv.Get("a")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "3", val)
+	assert.NoError(t, kv.Close(context.Background()))
+
+	// Nothing was written to the disk
+	_, err = os.Stat(folder)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestKvStoreIngestSegments(t *testing.T) {
+	fs := vfs.NewMemFS()
+	cfg := config.NewConfig("/store").SetFS(fs)
+
+	kv, err := OpenKvStoreWithConfig(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, kv.Insert("k", "old"))
+
+	builder, err := segment.NewSegmentBuilderFS(fs, "/in", 4096)
+	assert.NoError(t, err)
+	assert.NoError(t, builder.Put([]byte("k"), []byte("new")))
+	_, err = builder.Finish()
+	assert.NoError(t, err)
+
+	assert.NoError(t, kv.IngestSegments([]string{"/in"}))
+	assert.NoError(t, kv.CloseWithOptions(context.Background(), CloseOptions{NoFlush: true}))
+
+	// Replaying the WAL does not shadow the ingested key
+	kv, err = OpenKvStoreWithConfig(cfg)
+	assert.NoError(t, err)
+	val, _, err := kv.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", val)
+	assert.NoError(t, kv.Close(context.Background()))
+}
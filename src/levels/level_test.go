@@ -5,6 +5,7 @@ import (
 	"bagh/levels"
 	"bagh/segment"
 	"bagh/value"
+	"bagh/vfs"
 	"math"
 	"testing"
 
@@ -36,3 +37,27 @@ func TestLevelOverlaps(t *testing.T) {
 
 	assert.Equal(t, []string{"1", "2"}, level.GetOverlappingSegments([]byte("f"), []byte("x")))
 }
+
+func TestSegmentContaining(t *testing.T) {
+	lvl, err := levels.NewLevels(vfs.NewMemFS(), 2, "/levels")
+	assert.NoError(t, err)
+
+	for id, keyRange := range map[string][2]value.UserKey{
+		"1": {[]byte("m"), []byte("r")},
+		"2": {[]byte("c"), []byte("f")},
+		"3": {[]byte("s"), []byte("z")},
+	} {
+		lvl.InsertIntoLevel(1, fixtureSegment(id, keyRange))
+	}
+	assert.Equal(t, []string{"2", "1", "3"}, lvl.Levels[1].Segments)
+
+	for key, id := range map[string]string{"c": "2", "d": "2", "f": "2", "m": "1", "r": "1", "t": "3", "z": "3"} {
+		sg := lvl.SegmentContaining(1, []byte(key))
+		if assert.NotNil(t, sg, key) {
+			assert.Equal(t, id, sg.Metadata.ID, key)
+		}
+	}
+	for _, key := range []string{"a", "g", "rr", "zz"} {
+		assert.Nil(t, lvl.SegmentContaining(1, []byte(key)), key)
+	}
+}
@@ -1,10 +1,13 @@
 package levels
 
 import (
+	"bagh/comparator"
+	"bagh/file"
 	"bagh/segment"
+	"bagh/value"
+	"bagh/vfs"
 	"encoding/json"
 	"fmt"
-	"os"
 	"sort"
 )
 
@@ -31,14 +34,18 @@ type ResolvedView struct {
 
 type Levels struct {
 	Path string
+	FS   vfs.FS
 
 	Segments  map[string]*segment.Segment
 	Levels    []*Level
 	HiddenSet *HiddenSet
+
+	// Order of the keys of all segments, nil orders them bytewise
+	Comparator comparator.Comparator
 	// segmentHistory *segment.SegmentHistoryWriter
 }
 
-func NewLevels(levelCount uint8, path string) (*Levels, error) {
+func NewLevels(fs vfs.FS, levelCount uint8, path string) (*Levels, error) {
 	if levelCount == 0 {
 		return nil, fmt.Errorf("level_count should be >= 1")
 	}
@@ -50,6 +57,7 @@ func NewLevels(levelCount uint8, path string) (*Levels, error) {
 
 	l := &Levels{
 		Path:      path,
+		FS:        fs,
 		Segments:  make(map[string]*segment.Segment, 100),
 		Levels:    levels,
 		HiddenSet: &HiddenSet{Set: make(map[string]struct{}, 10)},
@@ -70,8 +78,9 @@ func (l *Levels) IsCompacting() bool {
 	return len(l.HiddenSet.Set) > 0
 }
 
-func (l *Levels) RecoverIds(path string) ([]string, error) {
-	manifest, err := os.ReadFile(path)
+// ReadManifest reads the segment IDs of each level from the manifest at path
+func ReadManifest(fs vfs.FS, path string) ([]*Level, error) {
+	manifest, err := vfs.ReadFile(fs, path)
 	if err != nil {
 		return nil, err
 	}
@@ -80,39 +89,33 @@ func (l *Levels) RecoverIds(path string) ([]string, error) {
 	if err := json.Unmarshal(manifest, &levels); err != nil {
 		return nil, err
 	}
+	return levels, nil
+}
 
+// SegmentIDs returns the IDs of all segments of a manifest
+func SegmentIDs(levels []*Level) []string {
 	var ids []string
 	for _, level := range levels {
 		ids = append(ids, level.Segments...)
 	}
-	return ids, nil
+	return ids
 }
 
-func (l *Levels) Recover(path string, segments []*segment.Segment) (*Levels, error) {
-	manifest, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-
-	var levels []*Level
-	if err := json.Unmarshal(manifest, &levels); err != nil {
-		return nil, err
-	}
-
+// FromManifest creates the levels of a manifest read by ReadManifest
+func FromManifest(fs vfs.FS, path string, levels []*Level, segments []*segment.Segment) *Levels {
 	segmentMap := make(map[string]*segment.Segment, len(segments))
 	for _, segment := range segments {
 		segmentMap[segment.Metadata.ID] = segment
 	}
 
-	level := &Levels{
+	return &Levels{
 		Segments:  segmentMap,
 		Levels:    levels,
 		HiddenSet: &HiddenSet{Set: make(map[string]struct{}, 10)},
 		Path:      path,
+		FS:        fs,
 		// SegmentHistory: NewSegmentHistoryWriter(),
 	}
-
-	return level, nil
 }
 
 func (l *Levels) WriteToDisk() error {
@@ -121,32 +124,53 @@ func (l *Levels) WriteToDisk() error {
 		return err
 	}
 
-	// Rewrite the file atomically
-	tempPath := l.Path + ".tmp"
-	if err := os.WriteFile(tempPath, manifest, 0644); err != nil {
-		return err
-	}
-	if err := os.Rename(tempPath, l.Path); err != nil {
-		return err
-	}
-
-	return nil
+	return file.RewriteAtomic(vfs.OrDefault(l.FS), l.Path, manifest)
 }
 
 func (l *Levels) Add(segment *segment.Segment) {
 	l.InsertIntoLevel(0, segment)
 }
 
+// SortLevels sorts the first level by ascending max seqno, and the deeper
+// levels, whose segments do not overlap, by key range
 func (l *Levels) SortLevels() {
-	for _, level := range l.Levels {
+	cmp := comparator.OrDefault(l.Comparator)
+	for levelNo, level := range l.Levels {
 		sort.Slice(level.Segments, func(i, j int) bool {
 			segA := l.Segments[level.Segments[i]]
 			segB := l.Segments[level.Segments[j]]
-			return segB.Metadata.Seqnos[1] > segA.Metadata.Seqnos[1]
+			if levelNo == 0 {
+				return segB.Metadata.Seqnos[1] > segA.Metadata.Seqnos[1]
+			}
+			return cmp.Compare(segA.Metadata.KeyRange[0], segB.Metadata.KeyRange[0]) < 0
 		})
 	}
 }
 
+// SegmentContaining returns the segment of a deeper level whose key range
+// contains the key, nil if there is none
+//
+// The segments of the level have to be sorted by key range and must not
+// overlap, so at most one of them can contain the key.
+func (l *Levels) SegmentContaining(levelNo uint8, key value.UserKey) *segment.Segment {
+	cmp := comparator.OrDefault(l.Comparator)
+	ids := l.Levels[levelNo].Segments
+
+	// The first segment starting after the key, the one before may contain it
+	idx := sort.Search(len(ids), func(i int) bool {
+		return cmp.Compare(l.Segments[ids[i]].Metadata.KeyRange[0], key) > 0
+	})
+	if idx == 0 {
+		return nil
+	}
+
+	sg := l.Segments[ids[idx-1]]
+	if cmp.Compare(key, sg.Metadata.KeyRange[1]) > 0 {
+		return nil
+	}
+	return sg
+}
+
 func (l *Levels) InsertIntoLevel(levelNo uint8, segment *segment.Segment) {
 	lastLevelIndex := len(l.Levels) - 1
 	index := int(clamp(levelNo, 0, uint8(lastLevelIndex)))
@@ -221,6 +245,36 @@ func (l *Levels) Size() uint64 {
 	return totalSize
 }
 
+// LevelSize returns the size of all segments in a level in bytes
+func (l *Levels) LevelSize(levelNo uint8) uint64 {
+	var size uint64
+	for _, segmentID := range l.Levels[levelNo].Segments {
+		size += l.Segments[segmentID].Metadata.FileSize
+	}
+	return size
+}
+
+// PendingCompactionBytes estimates how many bytes need to be compacted
+// until the tree is back in shape
+//
+// All of L0 counts, and for deeper levels the bytes exceeding the level's
+// target size, which is the last level's size divided by ratio per level.
+func (l *Levels) PendingCompactionBytes(ratio uint8) uint64 {
+	last := l.LastLevelIndex()
+	pending := l.LevelSize(0)
+
+	target := l.LevelSize(last)
+	for levelNo := int(last) - 1; levelNo >= 1; levelNo-- {
+		if ratio > 1 {
+			target /= uint64(ratio)
+		}
+		if size := l.LevelSize(uint8(levelNo)); size > target {
+			pending += size - target
+		}
+	}
+	return pending
+}
+
 func (l *Levels) BusyLevels() map[uint8]struct{} {
 	busyLevels := make(map[uint8]struct{})
 	for i, level := range l.Levels {
@@ -275,6 +329,20 @@ func (l *Levels) GetSegments() map[string]*segment.Segment {
 	return segments
 }
 
+// LevelOverlaps checks if any segment of a level (including ones being
+// compacted) overlaps the key range [lo, hi]
+func (l *Levels) LevelOverlaps(levelNo uint8, lo, hi value.UserKey) bool {
+	st := segment.Bound[value.UserKey]{Included: &lo}
+	ed := segment.Bound[value.UserKey]{Included: &hi}
+
+	for _, segmentID := range l.Levels[levelNo].Segments {
+		if l.Segments[segmentID].CheckKeyRangeOverlap(st, ed) {
+			return true
+		}
+	}
+	return false
+}
+
 func (l *Levels) ShowSegments(keys []string) {
 	for _, key := range keys {
 		l.HiddenSet.Remove(key)
@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Keys of the structured fields attached to log records
+const (
+	KeySegmentID = "segment_id"
+	KeyLevel     = "level"
+	KeySeqNo     = "seqno"
+	KeyPath      = "path"
+	KeyError     = "error"
+)
+
+// SegmentID returns the field of a segment ID
+func SegmentID(id string) slog.Attr {
+	return slog.String(KeySegmentID, id)
+}
+
+// Level returns the field of a level number
+func Level(level uint8) slog.Attr {
+	return slog.Int(KeyLevel, int(level))
+}
+
+// SeqNo returns the field of a sequence number
+func SeqNo[T ~uint64](seqno T) slog.Attr {
+	return slog.Uint64(KeySeqNo, uint64(seqno))
+}
+
+// Path returns the field of a file or folder path
+func Path(path string) slog.Attr {
+	return slog.String(KeyPath, path)
+}
+
+// Err returns the field of an error
+func Err(err error) slog.Attr {
+	return slog.Any(KeyError, err)
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// Discard returns a logger that drops everything, the default for library use
+func Discard() *slog.Logger {
+	return slog.New(discardHandler{})
+}
+
+// OrDiscard returns the logger, or a discarding logger if it is nil
+func OrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return Discard()
+	}
+	return logger
+}
@@ -1,167 +1,177 @@
 package memtable
 
 import (
+	"bagh/comparator"
+	"bagh/segment"
 	"bagh/value"
-	"encoding/json"
+	"bytes"
+	"math"
+	"sync"
 	"sync/atomic"
 )
 
+// MemTable is the in-memory write buffer of the tree
+//
+// Items are kept sorted by key, newest version first. Once a memtable is
+// sealed it is never written to again, so it can be flushed while the
+// tree keeps writing into a fresh active memtable.
 type MemTable struct {
-	// @p2: use a skiplist here instead :)
-	Items map[string]value.UserValue
-	// Items           *sync.Map
+	items *skipList
+	mutex sync.RWMutex
+
 	ApproximateSize atomic.Uint32
+	highestSeqNo    atomic.Uint64
 }
 
-// NewMemTable creates a new MemTable.
+// NewMemTable creates a new MemTable, ordering keys bytewise.
 func NewMemTable() *MemTable {
+	return NewMemTableWithComparator(comparator.Bytewise)
+}
+
+// NewMemTableWithComparator creates a new MemTable ordering keys by cmp,
+// nil orders them bytewise.
+func NewMemTableWithComparator(cmp comparator.Comparator) *MemTable {
 	return &MemTable{
-		Items: *new(map[string]value.UserValue),
+		items: newSkipList(comparator.OrDefault(cmp)),
 	}
 }
 
-// Get returns the item with the highest sequence number for the specified key.
-// @P2: seqno
-func (m *MemTable) Get(key []byte, seqno *value.SeqNo) *value.Value {
+// Comparator returns the order of the keys in the memtable.
+func (m *MemTable) Comparator() comparator.Comparator {
+	return m.items.cmp
+}
 
-	parsedKey := &value.ParsedInternalKey{
-		UserKey:   key,
-		ValueType: value.Record,
-		SeqNo:     *seqno,
+// Get returns the newest version of the key that is visible at the given
+// snapshot seqno (seqno < snapshot), or the newest version if seqno is nil.
+func (m *MemTable) Get(key []byte, seqno *value.SeqNo) *value.Value {
+	upper := value.SeqNo(math.MaxUint64)
+	if seqno != nil {
+		if *seqno == 0 {
+			return nil
+		}
+		upper = *seqno - 1
 	}
 
-	v, _ := m.Items[parsedKey.String()]
-	userValue := (value.UserValue)(v)
-	foundValue := &value.Value{
-		Key:       parsedKey.UserKey,
-		Value:     userValue,
-		ValueType: parsedKey.ValueType,
-		SeqNo:     parsedKey.SeqNo,
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	node := m.items.seek(key, upper, nil)
+	if node == nil || m.items.cmp.Compare(node.item.Key, key) != 0 {
+		return nil
 	}
-	return foundValue
+
+	item := node.item
+	return &item
 }
 
-// Iter returns all Items in the memtable as a slice of Value.
+// Iter returns all Items in the memtable as a sorted slice of Value.
 func (m *MemTable) Iter() ([]value.Value, error) {
-	var result []value.Value
-	for k, v := range m.Items {
-		var parsedKey value.ParsedInternalKey
-		if err := json.Unmarshal([]byte(k), &parsedKey); err != nil {
-			return nil, err
-		}
-		result = append(result, value.Value{
-			Key:       parsedKey.UserKey,
-			Value:     value.UserValue(v),
-			ValueType: parsedKey.ValueType,
-			SeqNo:     parsedKey.SeqNo,
-		})
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	result := make([]value.Value, 0, m.items.len)
+	for node := m.items.first(); node != nil; node = node.next[0] {
+		result = append(result, node.item)
 	}
 	return result, nil
 }
 
-// Range returns Items in the specified range. @TODO:
-// func (m *MemTable) Range(lowerBound, upperBound segment.Bound[value.ParsedInternalKey]) ([]value.Value, error) {
-// 	var result []value.Value
-// 	for k, v := range m.Items {
-// 		var parsedKey value.ParsedInternalKey
-// 		if err := json.Unmarshal([]byte(k), &parsedKey); err != nil {
-// 			return nil, err
-// 		}
-// 		if bytes.Compare(parsedKey.UserKey, lowerBound.UserKey) >= 0 && bytes.Compare(parsedKey.UserKey, upperBound.UserKey) < 0 {
-// 			result = append(result, value.Value{
-// 				Key:       parsedKey.UserKey,
-// 				Value:     value.UserValue(v),
-// 				ValueType: parsedKey.ValueType,
-// 			})
-// 		}
-// 	}
-// 	return result, nil
-// }
-/**
-segmentLo := s.Metadata.KeyRange[0]
-segmentHi := s.Metadata.KeyRange[1]
-
-// If both bounds are unbounded, the range overlaps with everything
-if lo.Unbounded == true && hi.Unbounded == true {
-	return true
-}
-
-// If upper bound is unbounded
-if hi.Unbounded == true {
-	if lo.Unbounded == true {
-		panic("Invalid key range check")
+// Prefix returns all Items whose key starts with the prefix, sorted. Other
+// comparators than bytewise may scatter keys with the prefix, so all Items
+// are filtered then.
+func (m *MemTable) Prefix(prefix []byte) []value.Value {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	contiguous := comparator.IsBytewise(m.items.cmp)
+	node := m.items.first()
+	if contiguous {
+		node = m.items.seek(prefix, math.MaxUint64, nil)
 	}
-	if lo.Included != nil {
-		return bytes.Compare(*lo.Included, segmentHi) <= 0
-	}
-	return bytes.Compare(*lo.Excluded, segmentHi) < 0
-}
 
-// If lower bound is unbounded
-if lo.Unbounded == true {
-	if hi.Unbounded == true {
-		panic("Invalid key range check")
-	}
-	if hi.Included != nil {
-		return bytes.Compare(*hi.Included, segmentLo) >= 0
+	var result []value.Value
+	for ; node != nil; node = node.next[0] {
+		if !bytes.HasPrefix(node.item.Key, prefix) {
+			if contiguous {
+				break
+			}
+			continue
+		}
+		result = append(result, node.item)
 	}
-	return bytes.Compare(*hi.Excluded, segmentLo) > 0
-}
-
-// Both bounds are bounded
-loIncluded := false
-if lo.Included != nil {
-	loIncluded = bytes.Compare(*lo.Included, segmentHi) <= 0
-} else {
-	loIncluded = bytes.Compare(*lo.Excluded, segmentHi) < 0
+	return result
 }
 
-hiIncluded := false
-if hi.Included != nil {
-	hiIncluded = bytes.Compare(*hi.Included, segmentLo) >= 0
-} else {
-	hiIncluded = bytes.Compare(*hi.Excluded, segmentLo) > 0
+// Range returns an iterator over the Items whose key is within the bounds.
+func (m *MemTable) Range(lo, hi segment.Bound[value.UserKey]) *RangeIterator {
+	return &RangeIterator{memtable: m, lo: lo, hi: hi}
 }
 
-return loIncluded && hiIncluded
-
-*/
+// RangeIterator reads the Items of a range lazily when iterating forwards,
+// iterating backwards reads the whole range on the first call
+type RangeIterator struct {
+	memtable *MemTable
+	lo, hi   segment.Bound[value.UserKey]
 
-// func (m *MemTable) Range(start, end segment.Bound[value.ParsedInternalKey]) *ranger.RangeIterator {
+	node    *skipNode
+	started bool
 
-// 	keys := make([]string, 0, len(m.Items))
-// 	for k := range m.Items {
-// 		var parsedKey value.ParsedInternalKey
-// 		if err := json.Unmarshal([]byte(k), &parsedKey); err != nil {
-// 			return nil
-// 		}
+	backwards []value.Value
+	reversed  bool
+}
 
-// 		if k >= start.UserKey && k <= end.UserKey {
-// 			keys = append(keys, k)
-// 		}
-// 	}
-// 	sort.Strings(keys)
+func (it *RangeIterator) Next() (*value.Value, error) {
+	it.memtable.mutex.RLock()
+	defer it.memtable.mutex.RUnlock()
+
+	if !it.started {
+		it.started = true
+		it.node = it.memtable.items.first()
+		switch {
+		case it.lo.Included != nil:
+			it.node = it.memtable.items.seek(*it.lo.Included, math.MaxUint64, nil)
+		case it.lo.Excluded != nil:
+			it.node = it.memtable.items.seek(*it.lo.Excluded, 0, nil)
+			for it.node != nil && it.memtable.items.cmp.Compare(it.node.item.Key, *it.lo.Excluded) == 0 {
+				it.node = it.node.next[0]
+			}
+		}
+	} else if it.node != nil {
+		it.node = it.node.next[0]
+	}
 
-// 	return &merge.Iterator{
-// 		m:          m,
-// 		keys:       keys,
-// 		start:      start.UserKey,
-// 		end:        end.UserKey,
-// 		includeEnd: true, // Adjust this if you need to exclude the end key
-// 	}
-// }
+	if it.node == nil || it.pastHi(it.node.item.Key) {
+		it.node = nil
+		return nil, nil
+	}
+	item := it.node.item
+	return &item, nil
+}
 
-// func (m *MemTable) RangeFrom(start segment.Bound[value.ParsedInternalKey]) *ranger.RangeIterator {
-// 	return m.Range(start, segment.Bound[value.ParsedInternalKey]{
-// 		Included: &value.ParsedInternalKey{
-// 			UserKey: "\xff\xff\xff\xff",
-// 		},
-// 	}) // Max possible key
-// }
+func (it *RangeIterator) NextBack() (*value.Value, error) {
+	if !it.reversed {
+		it.reversed = true
+		for {
+			item, err := it.Next()
+			if err != nil || item == nil {
+				break
+			}
+			it.backwards = append(it.backwards, *item)
+		}
+	}
+	if len(it.backwards) == 0 {
+		return nil, nil
+	}
+	item := it.backwards[len(it.backwards)-1]
+	it.backwards = it.backwards[:len(it.backwards)-1]
+	return &item, nil
+}
 
-// func (m *MemTable) RangeFull() *ranger.RangeIterator {
-// 	return m.Range(ParsedInternalKey{UserKey: ""}, ParsedInternalKey{UserKey: "\xff\xff\xff\xff"})
-// }
+func (it *RangeIterator) pastHi(key []byte) bool {
+	cmp := it.memtable.items.cmp
+	return it.hi.Included != nil && cmp.Compare(key, *it.hi.Included) > 0 ||
+		it.hi.Excluded != nil && cmp.Compare(key, *it.hi.Excluded) >= 0
+}
 
 // Size returns the approximate size of the memtable in bytes.
 func (m *MemTable) Size() uint32 {
@@ -170,72 +180,37 @@ func (m *MemTable) Size() uint32 {
 
 // Len returns the number of Items in the memtable.
 func (m *MemTable) Len() int {
-	return len(m.Items)
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.items.len
 }
 
 // IsEmpty checks whether the memtable is empty.
 func (m *MemTable) IsEmpty() bool {
-	return len(m.Items) == 0
+	return m.Len() == 0
 }
 
-// Insert adds an item to the memtable and returns the new and old sizes.
+// Insert adds an item to the memtable and returns the item size and the memtable size after the insert.
 func (m *MemTable) Insert(v value.Value) (uint32, uint32, error) {
 	itemSize := uint32(len(v.Key) + len(v.Value))
-	sizeAfter := m.ApproximateSize.Add(itemSize)
-	key := &value.ParsedInternalKey{UserKey: v.Key, ValueType: v.ValueType, SeqNo: v.SeqNo}
-	parsedKey, err := json.Marshal(key)
-	if err != nil {
-		return 0, 0, err
+
+	m.mutex.Lock()
+	m.items.insert(v)
+	m.mutex.Unlock()
+
+	for {
+		highest := m.highestSeqNo.Load()
+		if uint64(v.SeqNo) <= highest || m.highestSeqNo.CompareAndSwap(highest, uint64(v.SeqNo)) {
+			break
+		}
 	}
-	m.Items[string(parsedKey)] = v.Value
+
+	sizeAfter := m.ApproximateSize.Add(itemSize)
 	return itemSize, sizeAfter, nil
 }
 
+// GetLSN returns the highest seqno in the memtable, 0 if it is empty.
 func (m *MemTable) GetLSN() (*value.SeqNo, error) {
-	var maxSeqNo value.SeqNo
-	// m.Items.Range(func(k, _ interface{}) bool {
-	// 	parsedKey := k.(ParsedInternalKey)
-	// 	if parsedKey.SeqNo > maxSeqNo {
-	// 		maxSeqNo = parsedKey.SeqNo
-	// 	}
-	// 	return true
-	// })
-	for k, _ := range m.Items {
-		var parsedKey value.ParsedInternalKey
-		if err := json.Unmarshal([]byte(k), &parsedKey); err != nil {
-			return nil, err
-		}
-		if parsedKey.SeqNo > maxSeqNo {
-			maxSeqNo = parsedKey.SeqNo
-		}
-	}
+	maxSeqNo := value.SeqNo(m.highestSeqNo.Load())
 	return &maxSeqNo, nil
 }
-
-func (m *MemTable) Clone() (*MemTable, error) {
-	newMemTable := NewMemTable()
-	// @TODO: lmao copy by value here
-	newMemTable.ApproximateSize = m.ApproximateSize
-
-	for k, v := range m.Items {
-		var parsedOldKey value.ParsedInternalKey
-		if err := json.Unmarshal([]byte(k), &parsedOldKey); err != nil {
-			return nil, err
-		}
-		newKey := value.ParsedInternalKey{
-			UserKey:   parsedOldKey.UserKey,
-			SeqNo:     parsedOldKey.SeqNo,
-			ValueType: parsedOldKey.ValueType,
-		}
-		parsedKey, err := json.Marshal(newKey)
-		if err != nil {
-			return nil, err
-		}
-
-		newValue := make(value.UserValue, len(v))
-		copy(newValue, v)
-		newMemTable.Items[string(parsedKey)] = newValue
-	}
-
-	return newMemTable, nil
-}
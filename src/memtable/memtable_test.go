@@ -2,7 +2,9 @@ package memtable_test
 
 import (
 	"bagh/memtable"
+	"bagh/segment"
 	"bagh/value"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,7 +17,7 @@ func TestMemtableGet(t *testing.T) {
 
 	memtable.Insert(*val)
 
-	assert.Equal(t, &val, memtable.Get([]byte("abc"), nil))
+	assert.Equal(t, val, memtable.Get([]byte("abc"), nil))
 }
 
 func TestMemtableGetHighestSeqno(t *testing.T) {
@@ -26,7 +28,7 @@ func TestMemtableGetHighestSeqno(t *testing.T) {
 	}
 
 	expected := value.NewValue([]byte("abc"), []byte("abc"), 4, value.Record)
-	assert.Equal(t, &expected, memtable.Get([]byte("abc"), nil))
+	assert.Equal(t, expected, memtable.Get([]byte("abc"), nil))
 }
 
 func TestMemtableGetPrefix(t *testing.T) {
@@ -36,10 +38,10 @@ func TestMemtableGetPrefix(t *testing.T) {
 	memtable.Insert(*value.NewValue([]byte("abc"), []byte("abc"), 255, value.Record))
 
 	expected1 := value.NewValue([]byte("abc"), []byte("abc"), 255, value.Record)
-	assert.Equal(t, &expected1, memtable.Get([]byte("abc"), nil))
+	assert.Equal(t, expected1, memtable.Get([]byte("abc"), nil))
 
 	expected2 := value.NewValue([]byte("abc0"), []byte("abc"), 0, value.Record)
-	assert.Equal(t, &expected2, memtable.Get([]byte("abc0"), nil))
+	assert.Equal(t, expected2, memtable.Get([]byte("abc0"), nil))
 }
 
 func TestMemtableGetOldVersion(t *testing.T) {
@@ -50,13 +52,53 @@ func TestMemtableGetOldVersion(t *testing.T) {
 	memtable.Insert(*value.NewValue([]byte("abc"), []byte("abc"), 255, value.Record))
 
 	expected1 := value.NewValue([]byte("abc"), []byte("abc"), 255, value.Record)
-	assert.Equal(t, &expected1, memtable.Get([]byte("abc"), nil))
+	assert.Equal(t, expected1, memtable.Get([]byte("abc"), nil))
 
 	seqNo100 := value.SeqNo(100)
 	expected2 := value.NewValue([]byte("abc"), []byte("abc"), 99, value.Record)
-	assert.Equal(t, &expected2, memtable.Get([]byte("abc"), &seqNo100))
+	assert.Equal(t, expected2, memtable.Get([]byte("abc"), &seqNo100))
 
 	seqNo50 := value.SeqNo(50)
 	expected3 := value.NewValue([]byte("abc"), []byte("abc"), 0, value.Record)
-	assert.Equal(t, &expected3, memtable.Get([]byte("abc"), &seqNo50))
+	assert.Equal(t, expected3, memtable.Get([]byte("abc"), &seqNo50))
+}
+
+func TestMemtableRange(t *testing.T) {
+	memtable := memtable.NewMemTable()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		memtable.Insert(*value.NewValue([]byte(key), []byte(key), 0, value.Record))
+		memtable.Insert(*value.NewValue([]byte(key), []byte(key), 1, value.Record))
+	}
+
+	keys := func(next func() (*value.Value, error)) (keys []string) {
+		for item, _ := next(); item != nil; item, _ = next() {
+			keys = append(keys, string(item.Key))
+		}
+		return keys
+	}
+
+	b, c := value.UserKey("b"), value.UserKey("c")
+	assert.Equal(t, []string{"b", "b", "c", "c"}, keys(memtable.Range(
+		segment.Bound[value.UserKey]{Included: &b},
+		segment.Bound[value.UserKey]{Included: &c},
+	).Next))
+	assert.Equal(t, []string{"c", "c", "d", "d"}, keys(memtable.Range(
+		segment.Bound[value.UserKey]{Excluded: &b},
+		segment.Bound[value.UserKey]{Unbounded: true},
+	).Next))
+	assert.Equal(t, []string{"a", "a", "b", "b"}, keys(memtable.Range(
+		segment.Bound[value.UserKey]{Unbounded: true},
+		segment.Bound[value.UserKey]{Excluded: &c},
+	).Next))
+
+	iter := memtable.Range(
+		segment.Bound[value.UserKey]{Included: &b},
+		segment.Bound[value.UserKey]{Unbounded: true},
+	)
+	var backwards []string
+	for item, _ := iter.NextBack(); item != nil; item, _ = iter.NextBack() {
+		backwards = append(backwards, fmt.Sprintf("%s@%d", item.Key, item.SeqNo))
+	}
+	assert.Equal(t, []string{"d@0", "d@1", "c@0", "c@1", "b@0", "b@1"}, backwards)
 }
@@ -0,0 +1,89 @@
+package memtable
+
+import (
+	"bagh/comparator"
+	"bagh/value"
+	"math/rand"
+)
+
+const maxHeight = 12
+
+type skipNode struct {
+	item value.Value
+	next [maxHeight]*skipNode
+}
+
+// skipList keeps items sorted by key ascending, then seqno descending,
+// so the newest version of a key comes first. It is not thread-safe.
+type skipList struct {
+	head   skipNode
+	height int
+	len    int
+	rng    *rand.Rand
+	cmp    comparator.Comparator
+}
+
+func newSkipList(cmp comparator.Comparator) *skipList {
+	return &skipList{height: 1, rng: rand.New(rand.NewSource(rand.Int63())), cmp: cmp}
+}
+
+func (s *skipList) randomHeight() int {
+	h := 1
+	for h < maxHeight && s.rng.Intn(4) == 0 {
+		h++
+	}
+	return h
+}
+
+// less orders by (key asc, seqno desc)
+func (s *skipList) less(item *value.Value, key []byte, seqno value.SeqNo) bool {
+	if cmp := s.cmp.Compare(item.Key, key); cmp != 0 {
+		return cmp < 0
+	}
+	return item.SeqNo > seqno
+}
+
+// seek returns the first node not less than (key, seqno), filling prev
+// with the last node before it on every level if prev is not nil
+func (s *skipList) seek(key []byte, seqno value.SeqNo, prev *[maxHeight]*skipNode) *skipNode {
+	node := &s.head
+	for level := s.height - 1; level >= 0; level-- {
+		for next := node.next[level]; next != nil && s.less(&next.item, key, seqno); next = node.next[level] {
+			node = next
+		}
+		if prev != nil {
+			prev[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+// insert adds an item, replacing an existing item with the same key and seqno
+func (s *skipList) insert(item value.Value) {
+	var prev [maxHeight]*skipNode
+	found := s.seek(item.Key, item.SeqNo, &prev)
+	if found != nil && found.item.SeqNo == item.SeqNo && s.cmp.Compare(found.item.Key, item.Key) == 0 {
+		found.item = item
+		return
+	}
+
+	height := s.randomHeight()
+	for level := s.height; level < height; level++ {
+		prev[level] = &s.head
+	}
+	if height > s.height {
+		s.height = height
+	}
+
+	node := &skipNode{item: item}
+	for level := 0; level < height; level++ {
+		node.next[level] = prev[level].next[level]
+		prev[level].next[level] = node
+	}
+	s.len++
+}
+
+// first returns the first node, or nil if the list is empty
+func (s *skipList) first() *skipNode {
+	return s.head.next[0]
+}
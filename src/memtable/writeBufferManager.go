@@ -0,0 +1,158 @@
+package memtable
+
+import (
+	"bagh/segment"
+	"sync"
+	"sync/atomic"
+)
+
+// Memory is charged against the block cache in chunks of this size,
+// so not every insert has to take the cache lock
+const cacheChargeChunk = 256 * 1024
+
+// WriteBuffer is a tree whose memtables are accounted by a WriteBufferManager
+type WriteBuffer interface {
+	// ActiveMemtableSize returns the size of the memtable that is written to
+	ActiveMemtableSize() uint32
+
+	// RequestFlush seals the active memtable and queues it for flushing
+	RequestFlush()
+}
+
+// WriteBufferManager caps the memory of active and sealed memtables of all
+// trees sharing it
+//
+// Once the cap is reached, the largest active memtable is flushed. The
+// memory can optionally be charged against a block cache, so memtables and
+// cached blocks share a single budget.
+//
+//	manager := memtable.NewWriteBufferManager(64*1024*1024, nil)
+//
+//	tree1, err := tree.Open(*config.NewConfig(folder1).SetWriteBufferManager(manager))
+//	tree2, err := tree.Open(*config.NewConfig(folder2).SetWriteBufferManager(manager))
+type WriteBufferManager struct {
+	capacity uint64
+	usage    atomic.Uint64
+
+	cache       *segment.BlockCache
+	chargeMutex sync.Mutex
+	charged     uint64
+
+	mutex    sync.Mutex
+	buffers  map[WriteBuffer]struct{}
+	flushing atomic.Bool
+}
+
+// NewWriteBufferManager creates a manager capping memtable memory at
+// capacity bytes, cache (may be nil) is charged with the used memory
+func NewWriteBufferManager(capacity uint64, cache *segment.BlockCache) *WriteBufferManager {
+	return &WriteBufferManager{
+		capacity: capacity,
+		cache:    cache,
+		buffers:  make(map[WriteBuffer]struct{}),
+	}
+}
+
+// Capacity returns the memtable memory cap in bytes
+func (m *WriteBufferManager) Capacity() uint64 {
+	return m.capacity
+}
+
+// Usage returns the memory of all accounted memtables in bytes
+func (m *WriteBufferManager) Usage() uint64 {
+	return m.usage.Load()
+}
+
+// ShouldFlush returns true if the memtables use more memory than the cap
+func (m *WriteBufferManager) ShouldFlush() bool {
+	return m.capacity > 0 && m.Usage() > m.capacity
+}
+
+// Register adds a tree that may be asked to flush
+func (m *WriteBufferManager) Register(buffer WriteBuffer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.buffers[buffer] = struct{}{}
+}
+
+// Unregister removes a tree, its memory has to be freed separately
+func (m *WriteBufferManager) Unregister(buffer WriteBuffer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.buffers, buffer)
+}
+
+// Reserve accounts memory written into a memtable, and triggers a flush of
+// the largest memtable in the background if the cap is exceeded
+func (m *WriteBufferManager) Reserve(bytes uint64) {
+	m.usage.Add(bytes)
+	m.chargeCache()
+	m.maybeFlush()
+}
+
+// maybeFlush flushes the largest memtable if the cap is exceeded, unless a
+// flush triggered before has not freed its memory yet
+//
+// Sealed memtables still count until they are flushed, so triggering again
+// before then would only flush the small memtables written in the meantime.
+func (m *WriteBufferManager) maybeFlush() {
+	if m.ShouldFlush() && m.flushing.CompareAndSwap(false, true) {
+		go m.flushLargest()
+	}
+}
+
+// Free gives back the memory of a flushed memtable, and flushes the next
+// one if the memtables still use more memory than the cap
+func (m *WriteBufferManager) Free(bytes uint64) {
+	for {
+		usage := m.usage.Load()
+		if bytes > usage {
+			bytes = usage
+		}
+		if m.usage.CompareAndSwap(usage, usage-bytes) {
+			break
+		}
+	}
+	m.chargeCache()
+
+	m.flushing.Store(false)
+	m.maybeFlush()
+}
+
+// chargeCache adjusts the block cache reservation to the current usage
+func (m *WriteBufferManager) chargeCache() {
+	if m.cache == nil {
+		return
+	}
+
+	m.chargeMutex.Lock()
+	defer m.chargeMutex.Unlock()
+
+	target := (m.Usage() + cacheChargeChunk - 1) / cacheChargeChunk * cacheChargeChunk
+	if target > m.charged {
+		m.cache.Reserve(target - m.charged)
+	} else if target < m.charged {
+		m.cache.Release(m.charged - target)
+	}
+	m.charged = target
+}
+
+// flushLargest asks the tree with the largest active memtable to flush it
+func (m *WriteBufferManager) flushLargest() {
+	m.mutex.Lock()
+	var largest WriteBuffer
+	var largestSize uint32
+	for buffer := range m.buffers {
+		if size := buffer.ActiveMemtableSize(); size > largestSize {
+			largest, largestSize = buffer, size
+		}
+	}
+	m.mutex.Unlock()
+
+	if largest == nil {
+		// Nothing to flush, the memory is held by sealed memtables
+		m.flushing.Store(false)
+		return
+	}
+	largest.RequestFlush()
+}
@@ -0,0 +1,71 @@
+package memtable_test
+
+import (
+	"bagh/memtable"
+	"bagh/segment"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeBuffer struct {
+	size    uint32
+	flushes atomic.Int32
+}
+
+func (b *fakeBuffer) ActiveMemtableSize() uint32 { return b.size }
+func (b *fakeBuffer) RequestFlush()              { b.flushes.Add(1) }
+
+func TestWriteBufferManagerFlushesLargest(t *testing.T) {
+	manager := memtable.NewWriteBufferManager(1000, nil)
+
+	small := &fakeBuffer{size: 100}
+	large := &fakeBuffer{size: 900}
+	manager.Register(small)
+	manager.Register(large)
+
+	manager.Reserve(1000)
+	assert.False(t, manager.ShouldFlush())
+
+	manager.Reserve(1)
+	assert.True(t, manager.ShouldFlush())
+
+	assert.Eventually(t, func() bool { return large.flushes.Load() == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, int32(0), small.flushes.Load())
+
+	// The sealed memtable counts until it is flushed, writes in the
+	// meantime do not flush again
+	for i := 0; i < 10; i++ {
+		manager.Reserve(10)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), large.flushes.Load())
+
+	// Still over the cap once the flush is done
+	manager.Free(50)
+	assert.Eventually(t, func() bool { return large.flushes.Load() == 2 }, time.Second, time.Millisecond)
+
+	manager.Free(550)
+	assert.Equal(t, uint64(501), manager.Usage())
+	assert.False(t, manager.ShouldFlush())
+
+	// Usage never underflows
+	manager.Free(10_000)
+	assert.Equal(t, uint64(0), manager.Usage())
+}
+
+func TestWriteBufferManagerChargesBlockCache(t *testing.T) {
+	cache := segment.NewBlockCache(4 * 1024 * 1024)
+	manager := memtable.NewWriteBufferManager(0, cache)
+
+	manager.Reserve(1)
+	assert.Equal(t, uint64(256*1024), cache.ReservedSize())
+
+	manager.Reserve(300 * 1024)
+	assert.Equal(t, uint64(512*1024), cache.ReservedSize())
+
+	manager.Free(300*1024 + 1)
+	assert.Equal(t, uint64(0), cache.ReservedSize())
+}
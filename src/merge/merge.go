@@ -1,312 +1,255 @@
-// @TODO: check if Iterators work as expected
-
 package merge
 
 import (
+	"bagh/comparator"
 	"bagh/value"
-	"bytes"
 	"container/heap"
-	"errors"
 )
 
-// @TODO: bro check these
-type IteratorIndex int
-type MinMaxHeap struct {
-	minHeap *minHeap
-	maxHeap *maxHeap
-}
-
-func NewMinMaxHeap() *MinMaxHeap {
-	return &MinMaxHeap{
-		minHeap: &minHeap{},
-		maxHeap: &maxHeap{},
-	}
-}
-
-func (h *MinMaxHeap) Push(x IteratorValue) {
-	heap.Push(h.minHeap, x)
-	heap.Push(h.maxHeap, x)
-}
-
-func (h *MinMaxHeap) PopMin() IteratorValue {
-	min := heap.Pop(h.minHeap).(IteratorValue)
-	h.maxHeap.remove(min)
-	return min
-}
-
-func (h *MinMaxHeap) PopMax() IteratorValue {
-	max := heap.Pop(h.maxHeap).(IteratorValue)
-	h.minHeap.remove(max)
-	return max
-}
-
-func (h *MinMaxHeap) Len() int {
-	return h.minHeap.Len()
+// Iterator is a sorted stream of items, Next returns them by key ascending
+// (newest version first), NextBack by key descending
+//
+// Both return nil once the iterator is exhausted.
+type Iterator interface {
+	Next() (*value.Value, error)
+	NextBack() (*value.Value, error)
 }
 
-type minHeap []IteratorValue
-
-func (h minHeap) Len() int           { return len(h) }
-func (h minHeap) Less(i, j int) bool { return bytes.Compare(h[i].Value.Key, h[j].Value.Key) < 0 }
-func (h minHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
-
-func (h *minHeap) Push(x interface{}) {
-	*h = append(*h, x.(IteratorValue))
+// head is the current item of one of the merged iterators
+type head struct {
+	index int
+	item  *value.Value
 }
 
-func (h *minHeap) Pop() interface{} {
-	old := *h
-	n := len(old)
-	x := old[n-1]
-	*h = old[0 : n-1]
-	return x
+// forwardHeap orders by key ascending, then seqno descending, then by
+// iterator index
+type forwardHeap struct {
+	heads []head
+	cmp   comparator.Comparator
 }
 
-func (h *minHeap) remove(x IteratorValue) {
-	for i, v := range *h {
-		if v.Index == x.Index {
-			heap.Remove(h, i)
-			return
-		}
+func (h *forwardHeap) Len() int { return len(h.heads) }
+func (h *forwardHeap) Less(i, j int) bool {
+	if cmp := h.cmp.Compare(h.heads[i].item.Key, h.heads[j].item.Key); cmp != 0 {
+		return cmp < 0
 	}
-}
-
-type maxHeap []IteratorValue
-
-func (h maxHeap) Len() int           { return len(h) }
-func (h maxHeap) Less(i, j int) bool { return bytes.Compare(h[i].Value.Key, h[j].Value.Key) > 0 }
-func (h maxHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
-
-func (h *maxHeap) Push(x interface{}) {
-	*h = append(*h, x.(IteratorValue))
-}
-
-func (h *maxHeap) Pop() interface{} {
-	old := *h
-	n := len(old)
-	x := old[n-1]
-	*h = old[0 : n-1]
-	return x
-}
-
-// @TODO: check if remove works
-func (h *maxHeap) remove(x IteratorValue) {
-	for i, v := range *h {
-		if v.Index == x.Index {
-			heap.Remove(h, i)
-			return
-		}
+	if h.heads[i].item.SeqNo != h.heads[j].item.SeqNo {
+		return h.heads[i].item.SeqNo > h.heads[j].item.SeqNo
 	}
+	return h.heads[i].index < h.heads[j].index
 }
-
-type Iterator interface {
-	Next() (*value.Value, error)
-	NextBack() (*value.Value, error)
+func (h *forwardHeap) Swap(i, j int)      { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+func (h *forwardHeap) Push(x interface{}) { h.heads = append(h.heads, x.(head)) }
+func (h *forwardHeap) Pop() interface{} {
+	x := h.heads[len(h.heads)-1]
+	h.heads = h.heads[:len(h.heads)-1]
+	return x
 }
 
-type IteratorValue struct {
-	Index int
-	Value value.Value
-}
+// backwardHeap orders by key descending, then seqno ascending, then by
+// iterator index
+type backwardHeap struct{ forwardHeap }
 
-func (v *IteratorValue) Less(other *value.Value) bool {
-	return string(v.Value.Key) < string(other.Key)
+func (h *backwardHeap) Less(i, j int) bool {
+	a, b := h.heads[i], h.heads[j]
+	if a.item.SeqNo == b.item.SeqNo && h.cmp.Compare(a.item.Key, b.item.Key) == 0 {
+		return a.index < b.index
+	}
+	return h.forwardHeap.Less(j, i)
 }
 
-// type BoxedIterator struct {
-// 	data []value.Value
-// 	pos  int
-// }
-
-// func NewBoxedIterator(values []value.Value) *BoxedIterator {
-// 	return &BoxedIterator{data: values, pos: 0}
-// }
-
-// func (it *BoxedIterator) Next() (*value.Value, error) {
-// 	if it.pos >= len(it.data) {
-// 		return nil, errors.New("out of range")
-// 	}
-// 	value := it.data[it.pos]
-// 	it.pos++
-// 	return &value, nil
-// }
-
-// func (it *BoxedIterator) NextBack() (*value.Value, error) {
-// 	if it.pos <= 0 {
-// 		return nil, errors.New("out of range")
-// 	}
-// 	it.pos--
-// 	value := it.data[it.pos]
-// 	return &value, nil
-// }
-
+// MergeIterator merges sorted iterators into a single sorted iterator
+//
+// An iterator is consumed either with Next or with NextBack, mixing both
+// returns items twice. Items with the same key and seqno (relocated blob
+// pointers) are returned in the order of their iterators, so the first
+// one wins when old versions are evicted.
 type MergeIterator struct {
 	Iterators        []Iterator
-	Heap             MinMaxHeap
 	EvictOldVersions bool
 	SnapshotSeqNo    *value.SeqNo
+
+	// Order of the keys of all iterators, nil orders them bytewise
+	Comparator comparator.Comparator
+
+	forward  *forwardHeap
+	backward *backwardHeap
 }
 
 func NewMergeIterator(Iterators []Iterator) *MergeIterator {
 	return &MergeIterator{
 		Iterators:        Iterators,
-		Heap:             MinMaxHeap{},
 		EvictOldVersions: false,
 		SnapshotSeqNo:    nil,
 	}
 }
 
+// EvictOldVersion only returns the newest (visible) version of every key
 func (it *MergeIterator) EvictOldVersion(v bool) *MergeIterator {
 	it.EvictOldVersions = v
 	return it
 }
 
-func (it *MergeIterator) SnapshotSeq(v value.SeqNo) *MergeIterator {
-	it.SnapshotSeqNo = &v
+// WithComparator sets the order of the keys of the iterators
+func (it *MergeIterator) WithComparator(c comparator.Comparator) *MergeIterator {
+	it.Comparator = c
 	return it
 }
 
-// check @TODO:
-func (it *MergeIterator) advanceIter(idx int) error {
-	value, err := it.Iterators[idx].Next()
-	if err != nil {
-		return err
-	}
-	// @TODO: ?? why u using global heap here
-	// heap.Push(&IteratorValue{Index: idx, Value: *value})
-	it.Heap.Push(IteratorValue{Index: idx, Value: *value})
-	return nil
+// SnapshotSeq hides items with a seqno >= v
+func (it *MergeIterator) SnapshotSeq(v value.SeqNo) *MergeIterator {
+	it.SnapshotSeqNo = &v
+	return it
 }
 
-// @TODO: do this
-func (it *MergeIterator) advanceIterBackwards(idx int) error {
-	value, err := it.Iterators[idx].NextBack()
-	if err != nil {
-		return err
-	}
-	it.Heap.Push(IteratorValue{Index: idx, Value: *value})
-	return nil
+func (it *MergeIterator) visible(item *value.Value) bool {
+	return it.SnapshotSeqNo == nil || item.SeqNo < *it.SnapshotSeqNo
 }
 
-func (it *MergeIterator) pushNext() error {
-	for idx := range it.Iterators {
-		if err := it.advanceIter(idx); err != nil {
-			return err
-		}
+// advance pushes the next item of an iterator, if it has one
+func (it *MergeIterator) advance(h heap.Interface, index int, backwards bool) error {
+	var item *value.Value
+	var err error
+	if backwards {
+		item, err = it.Iterators[index].NextBack()
+	} else {
+		item, err = it.Iterators[index].Next()
 	}
-	return nil
-}
-
-func (it *MergeIterator) pushNextBack() error {
-	for idx := range it.Iterators {
-		if err := it.advanceIterBackwards(idx); err != nil {
-			return err
-		}
+	if err != nil || item == nil {
+		return err
 	}
+	copied := *item
+	heap.Push(h, head{index: index, item: &copied})
 	return nil
 }
 
 func (it *MergeIterator) Next() (*value.Value, error) {
-	// @TODO: lengths can diverge
-	if it.Heap.minHeap.Len() == 0 {
-		if err := it.pushNext(); err != nil {
-			return nil, err
+	if it.forward == nil {
+		it.forward = &forwardHeap{cmp: comparator.OrDefault(it.Comparator)}
+		for index := range it.Iterators {
+			if err := it.advance(it.forward, index, false); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	for it.Heap.minHeap.Len() > 0 {
-		head := it.Heap.PopMax()
-		idx := head.Index
-		if err := it.advanceIter(idx); err != nil {
+	for it.forward.Len() > 0 {
+		top := heap.Pop(it.forward).(head)
+		if err := it.advance(it.forward, top.index, false); err != nil {
 			return nil, err
 		}
+		if !it.visible(top.item) {
+			continue
+		}
 
-		if head.Value.IsTombstone() || it.EvictOldVersions {
-			//does this cache like js? @TODO: check if len updates on pop
-			for it.Heap.minHeap.Len() > 0 {
-				next := it.Heap.PopMin()
-				if string(next.Value.Key) == string(head.Value.Key) {
-					if err := it.advanceIter(next.Index); err != nil {
-						return nil, err
-					}
-
-					if it.SnapshotSeqNo != nil && head.Value.SeqNo >= *it.SnapshotSeqNo {
-						head = next
-					}
-				} else {
-					it.Heap.Push(next)
-					break
+		// Versions come newest first, so the rest of the key is older
+		if it.EvictOldVersions {
+			for it.forward.Len() > 0 && it.forward.cmp.Compare(it.forward.heads[0].item.Key, top.item.Key) == 0 {
+				older := heap.Pop(it.forward).(head)
+				if err := it.advance(it.forward, older.index, false); err != nil {
+					return nil, err
 				}
 			}
 		}
-
-		if it.SnapshotSeqNo != nil && head.Value.SeqNo >= *it.SnapshotSeqNo {
-			continue
-		}
-
-		return &head.Value, nil
+		return top.item, nil
 	}
-
-	return nil, errors.New("iterator exhausted")
+	return nil, nil
 }
 
 func (it *MergeIterator) NextBack() (*value.Value, error) {
-	if it.Heap.maxHeap.Len() == 0 {
-		if err := it.pushNextBack(); err != nil {
-			return nil, err
+	if it.backward == nil {
+		it.backward = &backwardHeap{forwardHeap{cmp: comparator.OrDefault(it.Comparator)}}
+		for index := range it.Iterators {
+			if err := it.advance(it.backward, index, true); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	for it.Heap.maxHeap.Len() > 0 {
-		head := it.Heap.PopMax()
-		if err := it.advanceIterBackwards(head.Index); err != nil {
-			return nil, err
+	for it.backward.Len() > 0 {
+		if !it.EvictOldVersions {
+			top := heap.Pop(it.backward).(head)
+			if err := it.advance(it.backward, top.index, true); err != nil {
+				return nil, err
+			}
+			if it.visible(top.item) {
+				return top.item, nil
+			}
+			continue
+		}
+
+		// Versions come oldest first, so the newest visible one is only
+		// known once the whole key is consumed
+		var newest *value.Value
+		key := it.backward.heads[0].item.Key
+		for it.backward.Len() > 0 && it.backward.cmp.Compare(it.backward.heads[0].item.Key, key) == 0 {
+			top := heap.Pop(it.backward).(head)
+			if err := it.advance(it.backward, top.index, true); err != nil {
+				return nil, err
+			}
+			if it.visible(top.item) && (newest == nil || top.item.SeqNo > newest.SeqNo) {
+				newest = top.item
+			}
 		}
+		if newest != nil {
+			return newest, nil
+		}
+	}
+	return nil, nil
+}
 
-		reachedTombstone := false
+// SliceIterator iterates over sorted items
+type SliceIterator struct {
+	items []value.Value
+	lo    int
+	hi    int
+}
 
-		if head.Value.IsTombstone() || it.EvictOldVersions {
-			next := it.Heap.PopMax()
-			for it.Heap.maxHeap.Len() > 0 && bytes.Equal(next.Value.Key, head.Value.Key) {
-				if reachedTombstone {
-					continue
-				}
+func NewSliceIterator(items []value.Value) *SliceIterator {
+	return &SliceIterator{items: items, hi: len(items)}
+}
 
-				next := it.Heap.PopMax()
-				if err := it.advanceIterBackwards(next.Index); err != nil {
-					return nil, err
-				}
+func (it *SliceIterator) Next() (*value.Value, error) {
+	if it.lo >= it.hi {
+		return nil, nil
+	}
+	item := &it.items[it.lo]
+	it.lo++
+	return item, nil
+}
 
-				if next.Value.ValueType == value.Tombstone {
-					if it.SnapshotSeqNo != nil {
-						if next.Value.SeqNo < *it.SnapshotSeqNo {
-							reachedTombstone = true
-						}
-					} else {
-						reachedTombstone = true
-					}
-				}
+func (it *SliceIterator) NextBack() (*value.Value, error) {
+	if it.lo >= it.hi {
+		return nil, nil
+	}
+	it.hi--
+	return &it.items[it.hi], nil
+}
 
-				if it.SnapshotSeqNo != nil {
-					if next.Value.SeqNo < *it.SnapshotSeqNo {
-						head = next
-					}
-				} else {
-					head = next
-				}
-			}
-		}
+// FilterIterator skips the items keep returns false for
+type FilterIterator struct {
+	iter Iterator
+	keep func(*value.Value) bool
+}
 
-		if it.SnapshotSeqNo != nil && head.Value.SeqNo >= *it.SnapshotSeqNo {
-			continue
-		}
+func NewFilterIterator(iter Iterator, keep func(*value.Value) bool) *FilterIterator {
+	return &FilterIterator{iter: iter, keep: keep}
+}
 
-		if reachedTombstone {
-			continue
+func (it *FilterIterator) Next() (*value.Value, error) {
+	for {
+		item, err := it.iter.Next()
+		if err != nil || item == nil || it.keep(item) {
+			return item, err
 		}
-
-		return &head.Value, nil
 	}
+}
 
-	return nil, nil
+func (it *FilterIterator) NextBack() (*value.Value, error) {
+	for {
+		item, err := it.iter.NextBack()
+		if err != nil || item == nil || it.keep(item) {
+			return item, err
+		}
+	}
 }
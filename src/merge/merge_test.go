@@ -0,0 +1,89 @@
+package merge
+
+import (
+	"bagh/value"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func items(pairs ...any) []value.Value {
+	var items []value.Value
+	for i := 0; i < len(pairs); i += 2 {
+		items = append(items, *value.NewValue([]byte(pairs[i].(string)), nil, value.SeqNo(pairs[i+1].(int)), value.Record))
+	}
+	return items
+}
+
+func collect(it *MergeIterator, backwards bool) []string {
+	var keys []string
+	for {
+		next := it.Next
+		if backwards {
+			next = it.NextBack
+		}
+		item, err := next()
+		if err != nil || item == nil {
+			return keys
+		}
+		keys = append(keys, string(item.Key)+"@"+string(rune('0'+item.SeqNo)))
+	}
+}
+
+func newIterator() *MergeIterator {
+	return NewMergeIterator([]Iterator{
+		NewSliceIterator(items("a", 1, "c", 5, "c", 2)),
+		NewSliceIterator(nil),
+		NewSliceIterator(items("b", 3, "c", 4, "d", 0)),
+	})
+}
+
+func TestMergeAllVersions(t *testing.T) {
+	assert.Equal(t, []string{"a@1", "b@3", "c@5", "c@4", "c@2", "d@0"}, collect(newIterator(), false))
+	assert.Equal(t, []string{"d@0", "c@2", "c@4", "c@5", "b@3", "a@1"}, collect(newIterator(), true))
+}
+
+func TestMergeEvictOldVersions(t *testing.T) {
+	assert.Equal(t, []string{"a@1", "b@3", "c@5", "d@0"}, collect(newIterator().EvictOldVersion(true), false))
+	assert.Equal(t, []string{"d@0", "c@5", "b@3", "a@1"}, collect(newIterator().EvictOldVersion(true), true))
+}
+
+func TestMergeSnapshot(t *testing.T) {
+	assert.Equal(t, []string{"a@1", "c@2", "d@0"}, collect(newIterator().EvictOldVersion(true).SnapshotSeq(3), false))
+	assert.Equal(t, []string{"d@0", "c@2", "a@1"}, collect(newIterator().EvictOldVersion(true).SnapshotSeq(3), true))
+	assert.Equal(t, []string{"d@0"}, collect(newIterator().SnapshotSeq(1), false))
+}
+
+func TestMergeTieBreak(t *testing.T) {
+	// Relocated blob pointers share key and seqno, the first iterator wins
+	newer := items("a", 1)
+	newer[0].Value = []byte("newer")
+	older := items("a", 1)
+	older[0].Value = []byte("older")
+
+	for _, backwards := range []bool{false, true} {
+		it := NewMergeIterator([]Iterator{NewSliceIterator(newer), NewSliceIterator(older)}).EvictOldVersion(true)
+		next := it.Next
+		if backwards {
+			next = it.NextBack
+		}
+		item, err := next()
+		assert.NoError(t, err)
+		assert.Equal(t, "newer", string(item.Value))
+		item, err = next()
+		assert.NoError(t, err)
+		assert.Nil(t, item)
+	}
+}
+
+func TestFilterIterator(t *testing.T) {
+	it := NewFilterIterator(NewSliceIterator(items("a", 1, "b", 2, "c", 3)), func(item *value.Value) bool {
+		return item.SeqNo != 2
+	})
+
+	var keys []string
+	for item, _ := it.Next(); item != nil; item, _ = it.Next() {
+		keys = append(keys, string(item.Key))
+	}
+	assert.Equal(t, []string{"a", "c"}, keys)
+}
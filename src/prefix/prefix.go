@@ -1,13 +1,11 @@
 package prefix
 
 import (
-	"bagh/memtable"
 	"bagh/merge"
 	"bagh/ranger"
 	"bagh/segment"
 	"bagh/value"
-	"bytes"
-	"encoding/json"
+	"time"
 )
 
 type Prefix struct {
@@ -15,14 +13,20 @@ type Prefix struct {
 	Prefix   value.UserKey
 	Segments []*segment.Segment
 	SeqNo    *value.SeqNo
+	Resolve  ranger.Resolver
+	Observe  ranger.ScanObserver
+
+	// Release lets go of the segments, once the iterator of the prefix is done
+	Release func()
 }
 
-func NewPrefix(guard ranger.MemTableGuard, prefix value.UserKey, segments []*segment.Segment, seqno *value.SeqNo) *Prefix {
+func NewPrefix(guard ranger.MemTableGuard, prefix value.UserKey, segments []*segment.Segment, seqno *value.SeqNo, resolve ranger.Resolver) *Prefix {
 	return &Prefix{
 		Guard:    guard,
 		Prefix:   prefix,
 		Segments: segments,
 		SeqNo:    seqno,
+		Resolve:  resolve,
 	}
 }
 
@@ -33,127 +37,88 @@ func NewPrefix(guard ranger.MemTableGuard, prefix value.UserKey, segments []*seg
 
 type PrefixIterator struct {
 	// @p2 create a boxed iterator maybe? a struct instead of interface
-	Iter merge.Iterator
+	Iter    merge.Iterator
+	resolve ranger.Resolver
+
+	observe ranger.ScanObserver
+	release func()
+	start   time.Time
+	bytes   uint64
+}
+
+// done reports the scan to the observer and releases the segments, once
+func (pi *PrefixIterator) done() {
+	if pi.observe != nil {
+		pi.observe(time.Since(pi.start), pi.bytes)
+		pi.observe = nil
+	}
+	if pi.release != nil {
+		pi.release()
+		pi.release = nil
+	}
+}
+
+// Close releases the segments of an iterator that is not read to the end
+func (pi *PrefixIterator) Close() {
+	pi.done()
 }
 
 func NewPrefixIterator(lock *Prefix, seqno *value.SeqNo) *PrefixIterator {
-	var segmentIters []merge.Iterator
+	var iters []merge.Iterator
 
 	for _, segment := range lock.Segments {
 		reader := segment.Prefix(lock.Prefix)
-		segmentIters = append(segmentIters, reader)
+		iters = append(iters, reader)
 	}
-	// @TODO: who tf is inserting iterators in here
-	// very expensive memory wise
-	iters := []merge.Iterator{merge.NewMergeIterator(segmentIters)}
-
 	for _, memtable := range *lock.Guard.Sealed.Obj {
-		iters = append(iters, newMemTableIterator(memtable, lock.Prefix))
+		iters = append(iters, merge.NewSliceIterator(memtable.Prefix(lock.Prefix)))
 	}
+	iters = append(iters, merge.NewSliceIterator(lock.Guard.Active.Obj.Prefix(lock.Prefix)))
 
-	memtableIter := newMemTableIterator(lock.Guard.Active.Obj, lock.Prefix)
-	iters = append(iters, memtableIter)
-
-	mergedIter := merge.NewMergeIterator(iters).EvictOldVersion(true)
+	// Every memtable of the tree is ordered by its comparator
+	mergedIter := merge.NewMergeIterator(iters).
+		WithComparator(lock.Guard.Active.Obj.Comparator()).
+		EvictOldVersion(true)
 
 	if seqno != nil {
 		mergedIter = mergedIter.SnapshotSeq(*seqno)
 	}
 
-	filteredIter := NewFilterIterator(mergedIter, func(value *value.Value) bool {
-		return value.IsTombstone()
+	filteredIter := merge.NewFilterIterator(mergedIter, func(value *value.Value) bool {
+		return !value.IsTombstone()
 	})
 
-	return &PrefixIterator{Iter: filteredIter}
+	return &PrefixIterator{Iter: filteredIter, resolve: lock.Resolve, observe: lock.Observe, release: lock.Release, start: time.Now()}
 }
 
 func (pi *PrefixIterator) Next() (*value.UserKey, *value.UserValue, error) {
 	value, err := pi.Iter.Next()
 	if err != nil || value == nil {
+		pi.done()
 		return nil, nil, err
 	}
+	if pi.resolve != nil {
+		if value, err = pi.resolve(value); err != nil {
+			pi.done()
+			return nil, nil, err
+		}
+	}
+	pi.bytes += uint64(len(value.Key) + len(value.Value))
 	return &value.Key, &value.Value, nil
 }
 
 func (pi *PrefixIterator) NextBack() (*value.UserKey, *value.UserValue, error) {
 	value, err := pi.Iter.NextBack()
 	if err != nil || value == nil {
+		pi.done()
 		return nil, nil, err
 	}
-	return &value.Key, &value.Value, nil
-}
-
-type MemTableIterator struct {
-	// @TODO: fixdis
-	items  map[string]value.UserValue
-	prefix value.UserKey
-}
-
-func newMemTableIterator(memtable *memtable.MemTable, prefix value.UserKey) merge.Iterator {
-	return &MemTableIterator{
-		items:  memtable.Items,
-		prefix: prefix,
-	}
-}
-
-func (mti *MemTableIterator) Next() (*value.Value, error) {
-	// Iterate over the memtable's items
-	for k, v := range mti.items {
-		var parsedKey value.ParsedInternalKey
-		if err := json.Unmarshal([]byte(k), &parsedKey); err != nil {
-			return nil, err
-		}
-
-		if bytes.Equal(parsedKey.UserKey, mti.prefix) {
-			result := &value.Value{
-				Key:       parsedKey.UserKey,
-				Value:     value.UserValue(v),
-				ValueType: parsedKey.ValueType,
-				SeqNo:     parsedKey.SeqNo,
-			}
-			return result, nil
-		}
-	}
-	return nil, nil
-}
-
-func (mti *MemTableIterator) NextBack() (*value.Value, error) {
-	// Iterate backwards over the memtable's items
-	return nil, nil
-}
-
-func NewFilterIterator(iter merge.Iterator, filterFunc func(*value.Value) bool) merge.Iterator {
-	return &FilterIterator{
-		iter:       iter,
-		filterFunc: filterFunc,
-	}
-}
-
-type FilterIterator struct {
-	iter       merge.Iterator
-	filterFunc func(*value.Value) bool
-}
-
-func (fi *FilterIterator) Next() (*value.Value, error) {
-	for {
-		value, err := fi.iter.Next()
-		if err != nil || value == nil {
-			return nil, err
-		}
-		if fi.filterFunc(value) {
-			return value, nil
-		}
-	}
-}
-
-func (fi *FilterIterator) NextBack() (*value.Value, error) {
-	for {
-		value, err := fi.iter.NextBack()
-		if err != nil || value == nil {
-			return nil, err
-		}
-		if fi.filterFunc(value) {
-			return value, nil
+	if pi.resolve != nil {
+		if value, err = pi.resolve(value); err != nil {
+			pi.done()
+			return nil, nil, err
 		}
 	}
+	pi.bytes += uint64(len(value.Key) + len(value.Value))
+	return &value.Key, &value.Value, nil
 }
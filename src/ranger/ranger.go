@@ -6,6 +6,7 @@ import (
 	"bagh/segment"
 	"bagh/value"
 	"sync"
+	"time"
 )
 
 // @TODO: do this for Diskblock as well, try here as well
@@ -19,11 +20,24 @@ type MemTableGuard struct {
 	Sealed *RwLockGuard[map[string]*memtable.MemTable]
 }
 
+// ScanObserver is called once a scan is exhausted, with its duration
+// and the user bytes it returned
+type ScanObserver func(duration time.Duration, bytes uint64)
+
+// Resolver turns an item read from the tree into the value returned to the user,
+// e.g. by following a blob file pointer
+type Resolver func(item *value.Value) (*value.Value, error)
+
 type Range struct {
 	Guard    MemTableGuard
 	Bounds   [2]segment.Bound[value.UserKey]
 	Segments []*segment.Segment
 	Seqno    value.SeqNo
+	Resolve  Resolver
+	Observe  ScanObserver
+
+	// Release lets go of the segments, once the iterator of the range is done
+	Release func()
 }
 
 func NewRange(
@@ -31,114 +45,129 @@ func NewRange(
 	bounds [2]segment.Bound[value.UserKey],
 	segments []*segment.Segment,
 	seqno value.SeqNo,
+	resolve Resolver,
 ) *Range {
 	return &Range{
 		Guard:    guard,
 		Bounds:   bounds,
 		Segments: segments,
 		Seqno:    seqno,
+		Resolve:  resolve,
 	}
 }
 
+// RangeIterator returns the items of a range, its Next and NextBack report
+// false at the end of the range, or on a failed read (see Err)
 type RangeIterator struct {
-	iter merge.Iterator
+	iter    merge.Iterator
+	resolve Resolver
+	err     error
+
+	observe ScanObserver
+	release func()
+	start   time.Time
+	bytes   uint64
 }
 
-func NewRangeIterator(lock *Range, seqno *value.SeqNo) *RangeIterator {
-	// lo := segment.Bound[value.ParsedInternalKey]{}
-	// switch {
-	// case lock.Bounds[0].Included != nil:
-	// 	lo = segment.Bound[value.ParsedInternalKey]{
-	// 		Included: &value.ParsedInternalKey{
-	// 			UserKey:   *lock.Bounds[0].Included,
-	// 			SeqNo:     math.MaxUint64,
-	// 			ValueType: value.Tombstone,
-	// 		},
-	// 	}
-	// case lock.Bounds[0].Excluded != nil:
-	// 	lo = segment.Bound[value.ParsedInternalKey]{
-	// 		Excluded: &value.ParsedInternalKey{
-	// 			UserKey:   *lock.Bounds[0].Excluded,
-	// 			SeqNo:     0,
-	// 			ValueType: value.Tombstone,
-	// 		},
-	// 	}
-	// default:
-	// 	lo = segment.Bound[value.ParsedInternalKey]{Unbounded: true}
-	// }
-
-	// hi := segment.Bound[value.ParsedInternalKey]{}
-	// switch {
-	// case lock.Bounds[1].Included != nil:
-	// 	hi = segment.Bound[value.ParsedInternalKey]{
-	// 		Included: &value.ParsedInternalKey{
-	// 			UserKey:   *lock.Bounds[0].Included,
-	// 			SeqNo:     0,
-	// 			ValueType: value.Record,
-	// 		},
-	// 	}
-	// case lock.Bounds[1].Excluded != nil:
-	// 	hi = segment.Bound[value.ParsedInternalKey]{
-	// 		Excluded: &value.ParsedInternalKey{
-	// 			UserKey:   *lock.Bounds[0].Excluded,
-	// 			SeqNo:     0,
-	// 			ValueType: value.Record,
-	// 		},
-	// 	}
-	// default:
-	// 	hi = segment.Bound[value.ParsedInternalKey]{Unbounded: true}
-	// }
-
-	segmentIters := make([]merge.Iterator, 0)
-
-	for _, segment := range lock.Segments {
-		// Assuming the Segment.range() method is available in Go
-		reader := segment.Range(lock.Bounds[0], lock.Bounds[1])
-		segmentIters = append(segmentIters, reader)
+// done reports the scan to the observer and releases the segments, once
+func (r *RangeIterator) done() {
+	if r.observe != nil {
+		r.observe(time.Since(r.start), r.bytes)
+		r.observe = nil
 	}
+	if r.release != nil {
+		r.release()
+		r.release = nil
+	}
+}
 
-	iters := []merge.Iterator{merge.NewMergeIterator(segmentIters)}
-
-	// // for _, mt := range *lock.Guard.Sealed.Obj {
-	// // 	v := mt.Range(lo, hi)
-	// // 	iters = append(iters, *v)
-	// // }
+// Close releases the segments of an iterator that is not read to the end
+func (r *RangeIterator) Close() {
+	r.done()
+}
 
-	// // activeMemtableIter := lock.Guard.Active.Obj.Range(lo, hi)
+func NewRangeIterator(lock *Range, seqno *value.SeqNo) *RangeIterator {
+	lo, hi := lock.Bounds[0], lock.Bounds[1]
 
-	// iters = append(iters, *activeMemtableIter)
+	var iters []merge.Iterator
+	for _, segment := range lock.Segments {
+		iters = append(iters, segment.Range(lo, hi))
+	}
+	for _, memtable := range *lock.Guard.Sealed.Obj {
+		iters = append(iters, memtable.Range(lo, hi))
+	}
+	iters = append(iters, lock.Guard.Active.Obj.Range(lo, hi))
 
-	mergeIter := merge.NewMergeIterator(iters)
+	// Every memtable of the tree is ordered by its comparator
+	mergeIter := merge.NewMergeIterator(iters).WithComparator(lock.Guard.Active.Obj.Comparator())
 	mergeIter.EvictOldVersion(true)
 
 	if seqno != nil {
 		mergeIter.SnapshotSeq(*seqno)
 	}
 
-	// remvoe tombstones @TODO:
-	// iter := merge.BoxedIterator(mergeIter.filter(func(value value.Value) bool {
-	// 	return value.IsTombstone()
-	// }))
+	iter := merge.NewFilterIterator(mergeIter, func(value *value.Value) bool {
+		return !value.IsTombstone()
+	})
+
+	return &RangeIterator{iter: iter, resolve: lock.Resolve, observe: lock.Observe, release: lock.Release, start: time.Now()}
+}
 
-	return &RangeIterator{iter: mergeIter}
+// Err returns the error that ended the iteration, nil if it reached the
+// end of the range
+func (r *RangeIterator) Err() error {
+	return r.err
+}
+
+// fail ends the iteration with an error
+func (r *RangeIterator) fail(err error) (*value.UserKey, *value.UserValue, bool) {
+	r.err = err
+	r.done()
+	return nil, nil, false
 }
 
 func (r *RangeIterator) Next() (*value.UserKey, *value.UserValue, bool) {
 	// This mimics the Rust Option and Result pattern using tuple (UserKey, UserValue, bool)
 	// where bool indicates if a value was returned or not
+	if r.err != nil {
+		return nil, nil, false
+	}
 	nextValue, err := r.iter.Next()
 	if err != nil {
+		return r.fail(err)
+	}
+	if nextValue == nil {
+		r.done()
 		return nil, nil, false
 	}
+	if r.resolve != nil {
+		if nextValue, err = r.resolve(nextValue); err != nil {
+			return r.fail(err)
+		}
+	}
+	r.bytes += uint64(len(nextValue.Key) + len(nextValue.Value))
 	return &nextValue.Key, &nextValue.Value, true
 }
 
 func (r *RangeIterator) NextBack() (*value.UserKey, *value.UserValue, bool) {
 	// Same as above, mimicking Rust's DoubleEndedIterator next_back
+	if r.err != nil {
+		return nil, nil, false
+	}
 	nextBackValue, err := r.iter.NextBack()
 	if err != nil {
+		return r.fail(err)
+	}
+	if nextBackValue == nil {
+		r.done()
 		return nil, nil, false
 	}
+	if r.resolve != nil {
+		if nextBackValue, err = r.resolve(nextBackValue); err != nil {
+			return r.fail(err)
+		}
+	}
+	r.bytes += uint64(len(nextBackValue.Key) + len(nextBackValue.Value))
 	return &nextBackValue.Key, &nextBackValue.Value, true
 
 }
@@ -0,0 +1,74 @@
+package segdump
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"bagh/codec"
+	"bagh/comparator"
+	"bagh/value"
+)
+
+// Difference is a version (key and seqno) that is only in one of two
+// segments, or whose type or value differs between them
+type Difference struct {
+	Key   value.UserKey
+	SeqNo value.SeqNo
+
+	// Nil if the version is not in that segment
+	Left  *value.Value
+	Right *value.Value
+}
+
+// Diff compares the logical content of two segments, ignoring how the
+// items are laid out in blocks and partitions, keys are ordered by cmp
+// (nil orders them bytewise)
+func Diff(left, right *Dump, cmp comparator.Comparator) []Difference {
+	a, b := left.Items(), right.Items()
+	cmp = comparator.OrDefault(cmp)
+
+	var diffs []Difference
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i].LessBy(cmp, b[j])):
+			diffs = append(diffs, Difference{Key: a[i].Key, SeqNo: a[i].SeqNo, Left: &a[i]})
+			i++
+		case i == len(a) || b[j].LessBy(cmp, a[i]):
+			diffs = append(diffs, Difference{Key: b[j].Key, SeqNo: b[j].SeqNo, Right: &b[j]})
+			j++
+		default:
+			if a[i].ValueType != b[j].ValueType || !bytes.Equal(a[i].Value, b[j].Value) {
+				diffs = append(diffs, Difference{Key: a[i].Key, SeqNo: a[i].SeqNo, Left: &a[i], Right: &b[j]})
+			}
+			i++
+			j++
+		}
+	}
+	return diffs
+}
+
+// WriteDiff prints differences like a unified diff, - for versions only in
+// the left segment, + for versions only in the right one
+func WriteDiff(w io.Writer, diffs []Difference, format codec.KeyFormat) error {
+	describe := func(item *value.Value) string {
+		return fmt.Sprintf("%s @%d %s, %d bytes", format(item.Key), item.SeqNo, codec.TypeName(item.ValueType), len(item.Value))
+	}
+
+	for _, diff := range diffs {
+		var err error
+		switch {
+		case diff.Right == nil:
+			_, err = fmt.Fprintf(w, "- %s\n", describe(diff.Left))
+		case diff.Left == nil:
+			_, err = fmt.Fprintf(w, "+ %s\n", describe(diff.Right))
+		default:
+			_, err = fmt.Fprintf(w, "- %s\n+ %s\n", describe(diff.Left), describe(diff.Right))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package segdump
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"bagh/codec"
+	"bagh/segment"
+	"bagh/value"
+)
+
+// WriteText prints the metadata, the index and the blocks of a dump, and
+// every item unless summary is set
+func WriteText(w io.Writer, d *Dump, format codec.KeyFormat, summary bool) error {
+	m := d.Metadata
+	fmt.Fprintf(w, "segment %s (version %d)\n", m.ID, m.Version)
+	fmt.Fprintf(w, "  %d items, %d keys, %d tombstones\n", m.ItemCount, m.KeyCount, m.TombstoneCount)
+	fmt.Fprintf(w, "  %d blocks, %d bytes, %d uncompressed\n", m.BlockCount, m.FileSize, m.UncompressedSize)
+	fmt.Fprintf(w, "  keys [%s, %s], seqnos [%d, %d]\n", format(m.KeyRange[0]), format(m.KeyRange[1]), m.Seqnos[0], m.Seqnos[1])
+	if m.GlobalSeqNo != 0 {
+		fmt.Fprintf(w, "  ingested, global seqno %d\n", m.GlobalSeqNo)
+	}
+
+	fmt.Fprintf(w, "\nindex: %d partitions\n", len(d.Partitions))
+	for i, p := range d.Partitions {
+		fmt.Fprintf(w, "  partition %d: start %s, offset %d, size %d, %d blocks\n", i, format(p.StartKey), p.Offset, p.Size, len(p.Blocks))
+		for _, handle := range p.Blocks {
+			fmt.Fprintf(w, "    %s -> offset %d, size %d\n", format(handle.StartKey), handle.Offset, handle.Size)
+		}
+	}
+
+	fmt.Fprintf(w, "\nblocks: %d\n", len(d.Blocks))
+	for i := range d.Blocks {
+		b := &d.Blocks[i]
+		fmt.Fprintf(w, "  block %d: offset %d, size %d, uncompressed %d, ratio %.2f, %d items, keys [%s, %s]\n",
+			i, b.Offset, b.Size, b.UncompressedSize, b.CompressionRatio(), len(b.Items), format(b.FirstKey()), format(b.LastKey()))
+		if summary {
+			continue
+		}
+		for _, item := range b.Items {
+			fmt.Fprintf(w, "    %s @%d %s, %d bytes\n", format(item.Key), item.SeqNo, codec.TypeName(item.ValueType), len(item.Value))
+		}
+	}
+
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+type jsonDump struct {
+	Metadata *segment.Metadata `json:"metadata"`
+	Index    []jsonPartition   `json:"index"`
+	Blocks   []jsonBlock       `json:"blocks"`
+}
+
+type jsonPartition struct {
+	StartKey string       `json:"start_key"`
+	Offset   uint64       `json:"offset"`
+	Size     uint32       `json:"size"`
+	Blocks   []jsonHandle `json:"blocks"`
+}
+
+type jsonHandle struct {
+	StartKey string `json:"start_key"`
+	Offset   uint64 `json:"offset"`
+	Size     uint32 `json:"size"`
+}
+
+type jsonBlock struct {
+	Offset           uint64     `json:"offset"`
+	Size             uint32     `json:"size"`
+	UncompressedSize uint32     `json:"uncompressed_size"`
+	CompressionRatio float64    `json:"compression_ratio"`
+	ItemCount        int        `json:"item_count"`
+	FirstKey         string     `json:"first_key"`
+	LastKey          string     `json:"last_key"`
+	Items            []jsonItem `json:"items,omitempty"`
+}
+
+type jsonItem struct {
+	Key       string      `json:"key"`
+	SeqNo     value.SeqNo `json:"seqno"`
+	Type      string      `json:"type"`
+	ValueSize int         `json:"value_size"`
+}
+
+// WriteJSON prints a dump as a JSON document, keys are formatted as strings,
+// items are left out if summary is set
+func WriteJSON(w io.Writer, d *Dump, format codec.KeyFormat, summary bool) error {
+	out := jsonDump{
+		Metadata: d.Metadata,
+		Index:    make([]jsonPartition, 0, len(d.Partitions)),
+		Blocks:   make([]jsonBlock, 0, len(d.Blocks)),
+	}
+
+	for _, p := range d.Partitions {
+		partition := jsonPartition{StartKey: format(p.StartKey), Offset: p.Offset, Size: p.Size}
+		for _, handle := range p.Blocks {
+			partition.Blocks = append(partition.Blocks, jsonHandle{
+				StartKey: format(handle.StartKey),
+				Offset:   handle.Offset,
+				Size:     handle.Size,
+			})
+		}
+		out.Index = append(out.Index, partition)
+	}
+
+	for i := range d.Blocks {
+		b := &d.Blocks[i]
+		block := jsonBlock{
+			Offset:           b.Offset,
+			Size:             b.Size,
+			UncompressedSize: b.UncompressedSize,
+			CompressionRatio: b.CompressionRatio(),
+			ItemCount:        len(b.Items),
+			FirstKey:         format(b.FirstKey()),
+			LastKey:          format(b.LastKey()),
+		}
+		if !summary {
+			for _, item := range b.Items {
+				block.Items = append(block.Items, jsonItem{
+					Key:       format(item.Key),
+					SeqNo:     item.SeqNo,
+					Type:      codec.TypeName(item.ValueType),
+					ValueSize: len(item.Value),
+				})
+			}
+		}
+		out.Blocks = append(out.Blocks, block)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(out)
+}
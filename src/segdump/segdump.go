@@ -0,0 +1,136 @@
+// Package segdump decodes a segment folder offline, for debugging
+//
+// The metadata, the top-level index, the index partitions and the data
+// blocks are read with the deserializers of the segment package, without a
+// tree, a block cache or a descriptor table.
+package segdump
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"bagh/comparator"
+	"bagh/file"
+	"bagh/segment"
+	"bagh/value"
+	"bagh/vfs"
+)
+
+// Dump is the decoded content of a segment folder
+type Dump struct {
+	Metadata   *segment.Metadata
+	Partitions []Partition
+	Blocks     []Block
+}
+
+// Partition is an index partition, referencing data blocks
+type Partition struct {
+	StartKey value.UserKey
+	Offset   uint64
+	Size     uint32
+	Blocks   []segment.BlockHandle
+}
+
+// Block is a data block, Size is its size on disk
+type Block struct {
+	Offset           uint64
+	Size             uint32
+	UncompressedSize uint32
+	Items            []value.Value
+}
+
+// CompressionRatio returns the uncompressed size per byte on disk
+func (b *Block) CompressionRatio() float64 {
+	if b.Size == 0 {
+		return 0
+	}
+	return float64(b.UncompressedSize) / float64(b.Size)
+}
+
+// FirstKey returns the first key of the block
+func (b *Block) FirstKey() value.UserKey {
+	if len(b.Items) == 0 {
+		return nil
+	}
+	return b.Items[0].Key
+}
+
+// LastKey returns the last key of the block
+func (b *Block) LastKey() value.UserKey {
+	if len(b.Items) == 0 {
+		return nil
+	}
+	return b.Items[len(b.Items)-1].Key
+}
+
+// Items returns the items of all blocks, in the order of the segment
+func (d *Dump) Items() []value.Value {
+	var items []value.Value
+	for _, block := range d.Blocks {
+		items = append(items, block.Items...)
+	}
+	return items
+}
+
+// Read decodes the segment in folder, whose keys are ordered by cmp
+//
+// A nil cmp is looked up by the name the segment records, see
+// comparator.Register. Index partitions are buffered in index_blocks while
+// the segment is written, and appended to the blocks file when it is
+// finished, so a remaining index_blocks file means the segment was never
+// finished.
+func Read(fs vfs.FS, folder string, cmp comparator.Comparator) (*Dump, error) {
+	fs = vfs.OrDefault(fs)
+	if _, err := fs.Stat(filepath.Join(folder, file.IndexBlocksFile)); err == nil {
+		return nil, fmt.Errorf("segment %s is unfinished: %s still exists", folder, file.IndexBlocksFile)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if cmp == nil {
+		metadata, err := segment.MetadataFromDisk(fs, filepath.Join(folder, file.SegmentMetadataFile))
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if cmp, ok = comparator.Lookup(metadata.ComparatorName()); !ok {
+			return nil, fmt.Errorf("segment %s is ordered by comparator %q, which is not registered", folder, metadata.ComparatorName())
+		}
+	}
+
+	inspector, err := segment.NewInspector(fs, folder, cmp)
+	if err != nil {
+		return nil, err
+	}
+	defer inspector.Close()
+
+	dump := &Dump{Metadata: inspector.Metadata}
+	for idx := range inspector.Index.Entries {
+		entry := &inspector.Index.Entries[idx]
+		handles, err := inspector.IndexPartition(entry)
+		if err != nil {
+			return nil, err
+		}
+		dump.Partitions = append(dump.Partitions, Partition{
+			StartKey: entry.StartKey,
+			Offset:   entry.Index.Offset,
+			Size:     entry.Index.Size,
+			Blocks:   handles,
+		})
+
+		for _, handle := range handles {
+			block, err := inspector.ReadBlock(handle)
+			if err != nil {
+				return nil, err
+			}
+			dump.Blocks = append(dump.Blocks, Block{
+				Offset:           handle.Offset,
+				Size:             handle.Size,
+				UncompressedSize: block.UncompressedSize,
+				Items:            block.Items,
+			})
+		}
+	}
+	return dump, nil
+}
@@ -0,0 +1,173 @@
+package segdump
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bagh/codec"
+	"bagh/comparator"
+	"bagh/file"
+	"bagh/segment"
+	"bagh/vfs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildSegment writes keys 0 to count-1, every key in deleted as a tombstone,
+// and every key in changed with another value
+func buildSegment(t *testing.T, fs vfs.FS, folder string, blockSize uint32, count int, deleted, changed map[int]bool) {
+	builder, err := segment.NewSegmentBuilderFS(fs, folder, blockSize)
+	require.NoError(t, err)
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		switch {
+		case deleted[i]:
+			require.NoError(t, builder.Delete(key))
+		case changed[i]:
+			require.NoError(t, builder.Put(key, []byte("changed")))
+		default:
+			require.NoError(t, builder.Put(key, []byte("value")))
+		}
+	}
+	_, err = builder.Finish()
+	require.NoError(t, err)
+}
+
+func TestRead(t *testing.T) {
+	fs := vfs.NewMemFS()
+	buildSegment(t, fs, "/a", 1024, 500, map[int]bool{7: true}, nil)
+
+	dump, err := Read(fs, "/a", nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(500), dump.Metadata.ItemCount)
+	assert.Len(t, dump.Blocks, int(dump.Metadata.BlockCount))
+	assert.Greater(t, len(dump.Blocks), 1)
+	assert.Len(t, dump.Items(), 500)
+
+	var handles int
+	for _, p := range dump.Partitions {
+		handles += len(p.Blocks)
+	}
+	assert.Equal(t, len(dump.Blocks), handles)
+
+	first := dump.Blocks[0]
+	assert.Equal(t, "key-0000", string(first.FirstKey()))
+	assert.Greater(t, first.CompressionRatio(), 1.0, "repetitive keys and values compress")
+	assert.Equal(t, "key-0499", string(dump.Blocks[len(dump.Blocks)-1].LastKey()))
+
+	var text bytes.Buffer
+	format := codec.String.Format
+	require.NoError(t, WriteText(&text, dump, format, false))
+	assert.Contains(t, text.String(), "500 items, 500 keys, 1 tombstones")
+	assert.Contains(t, text.String(), "key-0007 @0 tombstone, 0 bytes")
+
+	var out bytes.Buffer
+	require.NoError(t, WriteJSON(&out, dump, format, true))
+	var decoded jsonDump
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Len(t, decoded.Blocks, len(dump.Blocks))
+	assert.Equal(t, "key-0000", decoded.Blocks[0].FirstKey)
+	assert.Empty(t, decoded.Blocks[0].Items, "summary leaves out items")
+}
+
+func TestReadUnfinished(t *testing.T) {
+	fs := vfs.NewMemFS()
+	buildSegment(t, fs, "/a", 1024, 10, nil, nil)
+
+	f, err := fs.Create(filepath.Join("/a", file.IndexBlocksFile))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = Read(fs, "/a", nil)
+	assert.ErrorContains(t, err, "unfinished")
+}
+
+func TestReadCorrupted(t *testing.T) {
+	fs := vfs.NewMemFS()
+	buildSegment(t, fs, "/a", 1024, 100, nil, nil)
+
+	blocks, err := fs.OpenFile(filepath.Join("/a", file.BlocksFile), os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = blocks.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 16)
+	require.NoError(t, err)
+	require.NoError(t, blocks.Close())
+
+	_, err = Read(fs, "/a", nil)
+	assert.ErrorContains(t, err, "block at 0")
+}
+
+func TestDiff(t *testing.T) {
+	fs := vfs.NewMemFS()
+	buildSegment(t, fs, "/a", 1024, 300, map[int]bool{3: true}, nil)
+	// Same content, different block layout
+	buildSegment(t, fs, "/b", 4096, 300, map[int]bool{3: true}, nil)
+	buildSegment(t, fs, "/c", 1024, 301, nil, map[int]bool{42: true})
+
+	a, err := Read(fs, "/a", nil)
+	require.NoError(t, err)
+	b, err := Read(fs, "/b", nil)
+	require.NoError(t, err)
+	c, err := Read(fs, "/c", nil)
+	require.NoError(t, err)
+
+	assert.NotEqual(t, len(a.Blocks), len(b.Blocks))
+	assert.Empty(t, Diff(a, b, nil))
+
+	diffs := Diff(a, c, nil)
+	require.Len(t, diffs, 3)
+	assert.Equal(t, "key-0003", string(diffs[0].Key))
+	assert.NotNil(t, diffs[0].Left)
+	assert.NotNil(t, diffs[0].Right)
+	assert.Equal(t, "key-0042", string(diffs[1].Key))
+	assert.Equal(t, "key-0300", string(diffs[2].Key))
+	assert.Nil(t, diffs[2].Left)
+
+	var out bytes.Buffer
+	format := codec.Hex.Format
+	require.NoError(t, WriteDiff(&out, diffs[2:], format))
+	assert.Equal(t, "+ 6b65792d30333030 @0 record, 5 bytes\n", out.String())
+}
+
+// reverseComparator orders keys bytewise descending
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int { return bytes.Compare(b, a) }
+func (reverseComparator) Name() string            { return "segdump.test.Reverse" }
+
+func TestReadComparator(t *testing.T) {
+	fs := vfs.NewMemFS()
+	build := func(folder string, keys ...string) {
+		builder, err := segment.NewSegmentBuilderFS(fs, folder, 1024)
+		require.NoError(t, err)
+		builder.WithComparator(reverseComparator{})
+		for _, key := range keys {
+			require.NoError(t, builder.Put([]byte(key), []byte("value")))
+		}
+		_, err = builder.Finish()
+		require.NoError(t, err)
+	}
+	build("/a", "c", "b", "a")
+	build("/b", "d", "c", "a")
+
+	_, err := Read(fs, "/a", nil)
+	assert.ErrorContains(t, err, "not registered")
+	_, err = Read(fs, "/a", comparator.Bytewise)
+	assert.Error(t, err)
+
+	comparator.Register(reverseComparator{})
+	a, err := Read(fs, "/a", nil)
+	require.NoError(t, err)
+	b, err := Read(fs, "/b", reverseComparator{})
+	require.NoError(t, err)
+
+	var keys []string
+	for _, diff := range Diff(a, b, reverseComparator{}) {
+		keys = append(keys, string(diff.Key))
+	}
+	assert.Equal(t, []string{"d", "b"}, keys)
+}
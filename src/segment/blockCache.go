@@ -1,54 +1,74 @@
 package segment
 
 import (
+	"bagh/bloom"
 	"bagh/value"
-	"bytes"
-	"hash/fnv"
+	"container/list"
 	"sync"
+	"sync/atomic"
 )
 
 type BlockTag int
 
 const (
-	Data  BlockTag = 0
-	Index BlockTag = 1
+	Data     BlockTag = 0
+	Index    BlockTag = 1
+	TopLevel BlockTag = 2
+	Filter   BlockTag = 3
 )
 
 type Item struct {
 	ValueBlock       *ValueBlock
 	BlockHandleBlock *BlockHandleBlock
+	TopLevelIndex    *TopLevelIndex
+	Filter           *bloom.Filter
 }
 
 type CacheKey struct {
 	Tag       BlockTag
 	SegmentID string
-	UserKey   value.UserKey
+	UserKey   string
 }
 
-func (k CacheKey) Equal(other CacheKey) bool {
-	return k.Tag == other.Tag && k.SegmentID == other.SegmentID && bytes.Equal(k.UserKey, other.UserKey)
-
-}
-
-func (k CacheKey) Hash() uint64 {
-	h := fnv.New64a()
-	h.Write([]byte{byte(k.Tag)})
-	h.Write([]byte(k.SegmentID))
-	h.Write(k.UserKey)
-	return h.Sum64()
+func newCacheKey(tag BlockTag, segmentID string, key value.UserKey) CacheKey {
+	return CacheKey{Tag: tag, SegmentID: segmentID, UserKey: string(key)}
 }
 
 type BlockWeighter struct{}
 
-func (w BlockWeighter) Weight(key CacheKey, item Item) uint32 {
-	if item.ValueBlock != nil {
-		return uint32(len(item.ValueBlock.Items)) // Assuming ValueBlock has a Data field
-	}
-	var sum uint32
-	for _, i := range item.BlockHandleBlock.Items {
-		sum += uint32(len(i.StartKey) + 16) // Assuming BlockHandle is 16 bytes
+func (w BlockWeighter) Weight(key CacheKey, item Item) uint64 {
+	weight := uint64(len(key.SegmentID) + len(key.UserKey))
+
+	switch {
+	case item.ValueBlock != nil:
+		if item.ValueBlock.Data != nil {
+			return weight + uint64(len(item.ValueBlock.Data.data)+4*len(item.ValueBlock.Data.restarts))
+		}
+		for _, i := range item.ValueBlock.Items {
+			weight += uint64(i.Size())
+		}
+	case item.BlockHandleBlock != nil:
+		for _, i := range item.BlockHandleBlock.Items {
+			weight += uint64(len(i.StartKey) + 12)
+		}
+	case item.TopLevelIndex != nil:
+		for _, entry := range item.TopLevelIndex.Entries {
+			weight += uint64(len(entry.StartKey) + 24)
+		}
+	case item.Filter != nil:
+		weight += uint64(item.Filter.Size())
 	}
-	return sum
+	return weight
+}
+
+type cacheEntry struct {
+	key    CacheKey
+	item   Item
+	weight uint64
+	pinned bool
+
+	// position in the LRU list, nil for pinned entries
+	elem *list.Element
 }
 
 /// Block cache, in which blocks are cached in-memory
@@ -57,80 +77,234 @@ func (w BlockWeighter) Weight(key CacheKey, item Item) uint32 {
 /// This speeds up consecutive queries to nearby data, improving
 /// read performance for hot data.
 ///
+/// Blocks are evicted in least-recently-used order once the capacity is
+/// exceeded. Pinned blocks (see `Config.PinL0L1IndexAndFilter()`) are never
+/// evicted, until they are unpinned or their segment is removed.
+///
 /// # Examples
 ///
 /// Sharing block cache between multiple trees
 ///
 /// ```
-/// # use lsm_tree::{Tree, Config, BlockCache};
-/// # use std::sync::Arc;
-/// #
-/// // Provide 10'000 blocks 40 MB of cache capacity
-/// let block_cache = Arc::new(BlockCache::with_capacity_bytes(40 * 1_000 * 1_000));
+/// // Provide 40 MB of cache capacity
+/// blockCache := segment.NewBlockCache(40 * 1_000 * 1_000)
 ///
-/// # let folder = tempfile::tempdir()?;
-/// let tree1 = Config::new(folder).block_cache(block_cache.clone()).open()?;
-/// # let folder = tempfile::tempdir()?;
-/// let tree2 = Config::new(folder).block_cache(block_cache.clone()).open()?;
-/// #
-/// # Ok::<(), lsm_tree::Error>(())
+/// tree1, err := tree.Open(*config.NewConfig(folder1).SetBlockCache(blockCache))
+/// tree2, err := tree.Open(*config.NewConfig(folder2).SetBlockCache(blockCache))
 /// ```
 
 type BlockCache struct {
-	data *sync.Map
-	// capacity uint64 @p2
+	mutex    sync.Mutex
+	capacity uint64
+	size     uint64
+	pinned   uint64
+	reserved uint64
+	entries  map[CacheKey]*cacheEntry
+	lru      *list.List
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
 }
 
 func NewBlockCache(capacityBytes uint64) *BlockCache {
 	return &BlockCache{
-		data: &sync.Map{},
-		// capacity: capacityBytes,
+		capacity: capacityBytes,
+		entries:  make(map[CacheKey]*cacheEntry),
+		lru:      list.New(),
 	}
 }
 
-// func (c *BlockCache) Capacity() uint64 {
-// 	return c.capacity
-// }
+// Capacity returns the maximum size of unpinned blocks in bytes
+func (c *BlockCache) Capacity() uint64 {
+	return c.capacity
+}
+
+// Size returns the size of all cached blocks in bytes, including pinned ones
+func (c *BlockCache) Size() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.size
+}
+
+// PinnedSize returns the size of pinned blocks in bytes
+func (c *BlockCache) PinnedSize() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.pinned
+}
+
+// Hits returns how many lookups found their block in the cache
+func (c *BlockCache) Hits() uint64 {
+	return c.hits.Load()
+}
+
+// Misses returns how many lookups did not find their block in the cache
+func (c *BlockCache) Misses() uint64 {
+	return c.misses.Load()
+}
 
 func (c *BlockCache) Len() int {
-	length := 0
-	c.data.Range(func(_, _ interface{}) bool {
-		length++
-		return true
-	})
-	return length
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
 }
 
 func (c *BlockCache) IsEmpty() bool {
 	return c.Len() == 0
 }
 
+func (c *BlockCache) insert(key CacheKey, item Item, pinned bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !pinned && c.capacity == 0 {
+		return
+	}
+
+	if old, ok := c.entries[key]; ok {
+		pinned = pinned || old.pinned
+		c.unlink(old)
+	}
+
+	entry := &cacheEntry{
+		key:    key,
+		item:   item,
+		weight: BlockWeighter{}.Weight(key, item),
+		pinned: pinned,
+	}
+	c.entries[key] = entry
+	c.size += entry.weight
+
+	if pinned {
+		c.pinned += entry.weight
+	} else {
+		entry.elem = c.lru.PushFront(entry)
+	}
+
+	c.evict()
+}
+
+func (c *BlockCache) get(key CacheKey) (Item, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return Item{}, false
+	}
+	c.hits.Add(1)
+	if entry.elem != nil {
+		c.lru.MoveToFront(entry.elem)
+	}
+	return entry.item, true
+}
+
+// unlink removes an entry, the caller has to hold the mutex
+func (c *BlockCache) unlink(entry *cacheEntry) {
+	delete(c.entries, entry.key)
+	c.size -= entry.weight
+
+	if entry.pinned {
+		c.pinned -= entry.weight
+	} else {
+		c.lru.Remove(entry.elem)
+	}
+}
+
+// evict drops the least recently used blocks until the unpinned blocks
+// and the reserved memory fit
+func (c *BlockCache) evict() {
+	for c.lru.Len() > 0 && c.size-c.pinned+c.reserved > c.capacity {
+		c.unlink(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// Reserve charges memory used outside of the cache (e.g. memtables) against
+// its capacity, evicting blocks to make room
+func (c *BlockCache) Reserve(bytes uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.reserved += bytes
+	c.evict()
+}
+
+// Release gives back memory charged with Reserve
+func (c *BlockCache) Release(bytes uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if bytes > c.reserved {
+		bytes = c.reserved
+	}
+	c.reserved -= bytes
+}
+
+// ReservedSize returns the memory charged with Reserve in bytes
+func (c *BlockCache) ReservedSize() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.reserved
+}
+
+// Unpin makes the pinned blocks of a segment evictable again
+func (c *BlockCache) Unpin(segmentID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, entry := range c.entries {
+		if entry.key.SegmentID == segmentID && entry.pinned {
+			entry.pinned = false
+			c.pinned -= entry.weight
+			entry.elem = c.lru.PushFront(entry)
+		}
+	}
+	c.evict()
+}
+
+// RemoveSegment drops all blocks of a (deleted) segment
+func (c *BlockCache) RemoveSegment(segmentID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, entry := range c.entries {
+		if entry.key.SegmentID == segmentID {
+			c.unlink(entry)
+		}
+	}
+}
+
 func (c *BlockCache) InsertDiskBlock(segmentID string, key value.UserKey, value *ValueBlock) {
-	// if c.capacity > 0 {
-	cacheKey := CacheKey{Tag: Data, SegmentID: segmentID, UserKey: key}
-	c.data.Store(cacheKey, Item{ValueBlock: value})
-	// }
+	c.insert(newCacheKey(Data, segmentID, key), Item{ValueBlock: value}, false)
 }
 
 func (c *BlockCache) InsertBlockHandleBlock(segmentID string, key value.UserKey, value *BlockHandleBlock) {
-	// if c.capacity > 0 {
-	cacheKey := CacheKey{Tag: Index, SegmentID: segmentID, UserKey: key}
-	c.data.Store(cacheKey, Item{BlockHandleBlock: value})
-	// }
+	c.insert(newCacheKey(Index, segmentID, key), Item{BlockHandleBlock: value}, false)
+}
+
+func (c *BlockCache) InsertTopLevelIndex(segmentID string, index *TopLevelIndex, pinned bool) {
+	c.insert(newCacheKey(TopLevel, segmentID, nil), Item{TopLevelIndex: index}, pinned)
+}
+
+func (c *BlockCache) InsertFilter(segmentID string, key value.UserKey, filter *bloom.Filter, pinned bool) {
+	c.insert(newCacheKey(Filter, segmentID, key), Item{Filter: filter}, pinned)
 }
 
 func (c *BlockCache) GetDiskBlock(segmentID string, key value.UserKey) *ValueBlock {
-	cacheKey := CacheKey{Tag: Data, SegmentID: segmentID, UserKey: key}
-	if item, ok := c.data.Load(cacheKey); ok {
-		return item.(Item).ValueBlock
-	}
-	return nil
+	item, _ := c.get(newCacheKey(Data, segmentID, key))
+	return item.ValueBlock
 }
 
 func (c *BlockCache) GetBlockHandleBlock(segmentID string, key value.UserKey) *BlockHandleBlock {
-	cacheKey := CacheKey{Tag: Index, SegmentID: segmentID, UserKey: key}
-	if item, ok := c.data.Load(cacheKey); ok {
-		return item.(Item).BlockHandleBlock
-	}
-	return nil
+	item, _ := c.get(newCacheKey(Index, segmentID, key))
+	return item.BlockHandleBlock
+}
+
+func (c *BlockCache) GetTopLevelIndex(segmentID string) *TopLevelIndex {
+	item, _ := c.get(newCacheKey(TopLevel, segmentID, nil))
+	return item.TopLevelIndex
+}
+
+func (c *BlockCache) GetFilter(segmentID string, key value.UserKey) *bloom.Filter {
+	item, _ := c.get(newCacheKey(Filter, segmentID, key))
+	return item.Filter
 }
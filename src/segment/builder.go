@@ -0,0 +1,101 @@
+package segment
+
+import (
+	"fmt"
+
+	"bagh/comparator"
+	"bagh/id"
+	"bagh/value"
+	"bagh/vfs"
+)
+
+// DefaultBloomBitsPerKey is the bloom filter size of segments written by a SegmentBuilder
+const DefaultBloomBitsPerKey = 10
+
+// SegmentBuilder writes a standalone segment from keys given in ascending order
+//
+// The finished segment folder can be loaded into a tree with
+// Tree.IngestSegments, without going through the memtable and WAL.
+// All items are written with seqno 0, ingestion assigns a global seqno.
+type SegmentBuilder struct {
+	id      string
+	writer  *Writer
+	lastKey value.UserKey
+}
+
+// NewSegmentBuilder starts a new segment in the given (not yet existing) folder
+func NewSegmentBuilder(folder string, blockSize uint32) (*SegmentBuilder, error) {
+	return NewSegmentBuilderFS(vfs.Default, folder, blockSize)
+}
+
+// NewSegmentBuilderFS is like NewSegmentBuilder, writing to the given filesystem
+func NewSegmentBuilderFS(fs vfs.FS, folder string, blockSize uint32) (*SegmentBuilder, error) {
+	writer, err := NewWriter(Options{
+		Path:            folder,
+		EvictTombstones: false,
+		BlockSize:       blockSize,
+		BloomBitsPerKey: DefaultBloomBitsPerKey,
+		FS:              fs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SegmentBuilder{
+		id:     id.GenerateSegmentID(),
+		writer: writer,
+	}, nil
+}
+
+// WithComparator orders keys by c instead of bytewise, it has to be the
+// comparator of the tree the segment is ingested into, and set before
+// adding keys
+func (b *SegmentBuilder) WithComparator(c comparator.Comparator) *SegmentBuilder {
+	b.writer.Opts.Comparator = c
+	return b
+}
+
+func (b *SegmentBuilder) add(key value.UserKey, val value.UserValue, valueType value.ValueType) error {
+	if b.lastKey != nil && comparator.OrDefault(b.writer.Opts.Comparator).Compare(key, b.lastKey) <= 0 {
+		return fmt.Errorf("keys must be strictly ascending: %q after %q", key, b.lastKey)
+	}
+
+	item := value.NewValue(append(value.UserKey(nil), key...), append(value.UserValue(nil), val...), 0, valueType)
+	if err := b.writer.Write(*item); err != nil {
+		return err
+	}
+
+	b.lastKey = item.Key
+	return nil
+}
+
+// Put adds a key-value pair, keys have to be strictly ascending
+func (b *SegmentBuilder) Put(key value.UserKey, val value.UserValue) error {
+	return b.add(key, val, value.Record)
+}
+
+// Delete adds a tombstone, keys have to be strictly ascending
+func (b *SegmentBuilder) Delete(key value.UserKey) error {
+	return b.add(key, nil, value.Tombstone)
+}
+
+// Finish writes out the remaining blocks, the index and the segment metadata
+func (b *SegmentBuilder) Finish() (*Metadata, error) {
+	if b.writer.ItemCount == 0 && len(b.writer.Chunk.Items) == 0 {
+		return nil, fmt.Errorf("cannot build an empty segment")
+	}
+
+	if err := b.writer.Finish(); err != nil {
+		return nil, err
+	}
+
+	metadata, err := MetadataFromWriter(b.id, b.writer)
+	if err != nil {
+		return nil, err
+	}
+	if err := metadata.WriteToFile(b.writer.Opts.FS); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,38 @@
+package segment_test
+
+import (
+	"bagh/segment"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegmentBuilder(t *testing.T) {
+	builder, err := segment.NewSegmentBuilder(filepath.Join(t.TempDir(), "ingest"), 4096)
+	assert.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, builder.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte("value")))
+	}
+	assert.NoError(t, builder.Delete([]byte("key-9999")))
+
+	assert.Error(t, builder.Put([]byte("key-0500"), []byte("value")))
+	assert.Error(t, builder.Put([]byte("key-9999"), []byte("value")))
+
+	metadata, err := builder.Finish()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1001), metadata.ItemCount)
+	assert.Equal(t, uint64(1), metadata.TombstoneCount)
+	assert.Equal(t, "key-0000", string(metadata.KeyRange[0]))
+	assert.Equal(t, "key-9999", string(metadata.KeyRange[1]))
+}
+
+func TestSegmentBuilderEmpty(t *testing.T) {
+	builder, err := segment.NewSegmentBuilder(filepath.Join(t.TempDir(), "ingest"), 4096)
+	assert.NoError(t, err)
+
+	_, err = builder.Finish()
+	assert.Error(t, err)
+}
@@ -0,0 +1,312 @@
+package segment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"sync"
+
+	"bagh/comparator"
+	"bagh/value"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// DefaultRestartInterval is the amount of entries between two restart points
+const DefaultRestartInterval = 16
+
+const (
+	blockUncompressed byte = 0
+	blockLz4          byte = 1
+)
+
+// DataBlock is a prefix-compressed block of values, used by segments of version V1
+//
+// Every key is delta-encoded against the key before it, except for keys at
+// restart points, which are stored in full. Seeking binary-searches the
+// restart points, then scans forward from the closest one.
+//
+// # Disk representation
+//
+// \[entries] - \[restart offsets; 4 bytes each] - \[restart count; 4 bytes] - \[crc; 4 bytes]
+//
+// Each entry is laid out as:
+//
+// \[shared key len; varint] - \[unshared key len; varint] - \[value len; varint] - \[seqno; varint] - \[value type; 1 byte] - \[key suffix] - \[value]
+type DataBlock struct {
+	data     []byte
+	restarts []uint32
+
+	// overrides the seqno of every entry, if set (see Metadata.GlobalSeqNo)
+	globalSeqNo value.SeqNo
+
+	// Order of the keys, nil orders them bytewise (see Metadata.Compare)
+	cmp comparator.Comparator
+
+	once  sync.Once
+	items []value.Value
+	err   error
+}
+
+// EncodeDataBlock serializes sorted items into the prefix-compressed layout
+func EncodeDataBlock(items []value.Value, restartInterval int) []byte {
+	if restartInterval < 1 {
+		restartInterval = DefaultRestartInterval
+	}
+
+	buf := new(bytes.Buffer)
+	restarts := make([]uint32, 0, len(items)/restartInterval+1)
+	scratch := make([]byte, binary.MaxVarintLen64)
+
+	var prevKey value.UserKey
+	for i, item := range items {
+		shared := 0
+		if i%restartInterval == 0 {
+			restarts = append(restarts, uint32(buf.Len()))
+		} else {
+			shared = sharedPrefixLen(prevKey, item.Key)
+		}
+
+		for _, n := range []uint64{uint64(shared), uint64(len(item.Key) - shared), uint64(len(item.Value)), uint64(item.SeqNo)} {
+			buf.Write(scratch[:binary.PutUvarint(scratch, n)])
+		}
+		buf.WriteByte(item.ValueType.ToByte())
+		buf.Write(item.Key[shared:])
+		buf.Write(item.Value)
+
+		prevKey = item.Key
+	}
+
+	for _, offset := range restarts {
+		binary.Write(buf, binary.BigEndian, offset)
+	}
+	binary.Write(buf, binary.BigEndian, uint32(len(restarts)))
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	return buf.Bytes()
+}
+
+// DecodeDataBlock parses an uncompressed block, checking its CRC and restart array
+func DecodeDataBlock(raw []byte) (*DataBlock, error) {
+	if len(raw) < 8 {
+		return nil, fmt.Errorf("data block too short: %d bytes", len(raw))
+	}
+
+	body, trailer := raw[:len(raw)-4], raw[len(raw)-4:]
+	if crc := crc32.ChecksumIEEE(body); crc != binary.BigEndian.Uint32(trailer) {
+		return nil, fmt.Errorf("data block checksum mismatch")
+	}
+
+	restartCount := int(binary.BigEndian.Uint32(body[len(body)-4:]))
+	restartsStart := len(body) - 4 - 4*restartCount
+	if restartCount == 0 || restartsStart < 0 {
+		return nil, fmt.Errorf("invalid data block restart count: %d", restartCount)
+	}
+
+	restarts := make([]uint32, restartCount)
+	for i := range restarts {
+		restarts[i] = binary.BigEndian.Uint32(body[restartsStart+4*i:])
+		if int(restarts[i]) >= restartsStart {
+			return nil, fmt.Errorf("restart point %d out of bounds", i)
+		}
+	}
+
+	return &DataBlock{
+		data:     body[:restartsStart],
+		restarts: restarts,
+	}, nil
+}
+
+// RestartCount returns the amount of restart points in the block
+func (b *DataBlock) RestartCount() int {
+	return len(b.restarts)
+}
+
+// decodeEntry reads the entry at offset, expanding its key against prevKey
+func (b *DataBlock) decodeEntry(offset int, prevKey value.UserKey) (value.Value, int, error) {
+	var header [4]uint64
+	for i := range header {
+		n, read := binary.Uvarint(b.data[offset:])
+		if read <= 0 {
+			return value.Value{}, 0, fmt.Errorf("malformed entry at offset %d", offset)
+		}
+		header[i] = n
+		offset += read
+	}
+	shared, unshared, valueLen, seqno := int(header[0]), int(header[1]), int(header[2]), header[3]
+
+	if shared > len(prevKey) || offset+1+unshared+valueLen > len(b.data) {
+		return value.Value{}, 0, fmt.Errorf("entry at offset %d out of bounds", offset)
+	}
+
+	valueType := value.ValueTypeFromByte(b.data[offset])
+	offset++
+
+	if b.globalSeqNo != 0 {
+		seqno = uint64(b.globalSeqNo)
+	}
+
+	key := make(value.UserKey, shared+unshared)
+	copy(key, prevKey[:shared])
+	copy(key[shared:], b.data[offset:offset+unshared])
+	offset += unshared
+
+	val := make(value.UserValue, valueLen)
+	copy(val, b.data[offset:offset+valueLen])
+	offset += valueLen
+
+	return value.Value{
+		Key:       key,
+		Value:     val,
+		SeqNo:     value.SeqNo(seqno),
+		ValueType: valueType,
+	}, offset, nil
+}
+
+// restartKey returns the (full) key stored at the given restart point
+func (b *DataBlock) restartKey(idx int) (value.UserKey, error) {
+	item, _, err := b.decodeEntry(int(b.restarts[idx]), nil)
+	if err != nil {
+		return nil, err
+	}
+	return item.Key, nil
+}
+
+// seekRestart returns the restart point to start scanning from to find key
+//
+// Versions of the same key may span a restart point, so this is the last
+// restart point whose key is strictly smaller than the searched key.
+func (b *DataBlock) seekRestart(key []byte) (int, error) {
+	order := comparator.OrDefault(b.cmp)
+	var searchErr error
+	idx := sort.Search(len(b.restarts), func(i int) bool {
+		restartKey, err := b.restartKey(i)
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return order.Compare(restartKey, key) >= 0
+	})
+	if searchErr != nil {
+		return 0, searchErr
+	}
+	if idx > 0 {
+		idx--
+	}
+	return idx, nil
+}
+
+// Get returns the newest version of key, visible at seqno if given
+func (b *DataBlock) Get(key []byte, seqno *value.SeqNo) (*value.Value, error) {
+	restart, err := b.seekRestart(key)
+	if err != nil {
+		return nil, err
+	}
+
+	order := comparator.OrDefault(b.cmp)
+	var prevKey value.UserKey
+	for offset := int(b.restarts[restart]); offset < len(b.data); {
+		item, next, err := b.decodeEntry(offset, prevKey)
+		if err != nil {
+			return nil, err
+		}
+
+		switch cmp := order.Compare(item.Key, key); {
+		case cmp > 0:
+			return nil, nil
+		case cmp == 0 && (seqno == nil || item.SeqNo < *seqno):
+			return &item, nil
+		}
+
+		prevKey = item.Key
+		offset = next
+	}
+
+	return nil, nil
+}
+
+// Items decodes all entries of the block, the result is computed once and shared
+func (b *DataBlock) Items() ([]value.Value, error) {
+	b.once.Do(func() {
+		var prevKey value.UserKey
+		for offset := 0; offset < len(b.data); {
+			item, next, err := b.decodeEntry(offset, prevKey)
+			if err != nil {
+				b.items, b.err = nil, err
+				return
+			}
+			b.items = append(b.items, item)
+			prevKey = item.Key
+			offset = next
+		}
+	})
+	return b.items, b.err
+}
+
+func sharedPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// compressBlock frames a serialized block for disk, using LZ4 if it pays off
+//
+// \[compression; 1 byte] - \[uncompressed size; 4 bytes] - \[payload]
+func compressBlock(raw []byte) ([]byte, error) {
+	compressed := make([]byte, 5+lz4.CompressBlockBound(len(raw)))
+	compressed[0] = blockLz4
+	binary.BigEndian.PutUint32(compressed[1:5], uint32(len(raw)))
+
+	var compressor lz4.Compressor
+	n, err := compressor.CompressBlock(raw, compressed[5:])
+	if err != nil {
+		return nil, err
+	}
+
+	// NOTE: LZ4 reports 0 for incompressible input
+	if n == 0 || n >= len(raw) {
+		framed := make([]byte, 5+len(raw))
+		framed[0] = blockUncompressed
+		binary.BigEndian.PutUint32(framed[1:5], uint32(len(raw)))
+		copy(framed[5:], raw)
+		return framed, nil
+	}
+
+	return compressed[:5+n], nil
+}
+
+// decompressBlock reverses compressBlock
+func decompressBlock(framed []byte) ([]byte, error) {
+	if len(framed) < 5 {
+		return nil, fmt.Errorf("block frame too short: %d bytes", len(framed))
+	}
+
+	size := binary.BigEndian.Uint32(framed[1:5])
+	payload := framed[5:]
+
+	switch framed[0] {
+	case blockUncompressed:
+		if uint32(len(payload)) != size {
+			return nil, fmt.Errorf("block size mismatch: %d != %d", len(payload), size)
+		}
+		return payload, nil
+	case blockLz4:
+		raw := make([]byte, size)
+		n, err := lz4.UncompressBlock(payload, raw)
+		if err != nil {
+			return nil, err
+		}
+		if uint32(n) != size {
+			return nil, fmt.Errorf("block size mismatch: %d != %d", n, size)
+		}
+		return raw, nil
+	default:
+		return nil, fmt.Errorf("unknown block compression: %d", framed[0])
+	}
+}
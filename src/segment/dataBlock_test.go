@@ -0,0 +1,83 @@
+package segment_test
+
+import (
+	"bagh/segment"
+	"bagh/value"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fixtureItems() []value.Value {
+	var items []value.Value
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		// a few keys have multiple versions, newest first
+		for seqno := value.SeqNo(i % 3); ; seqno-- {
+			items = append(items, value.Value{
+				Key:       key,
+				Value:     []byte(fmt.Sprintf("value-%d-%d", i, seqno)),
+				SeqNo:     seqno,
+				ValueType: value.Record,
+			})
+			if seqno == 0 {
+				break
+			}
+		}
+	}
+	return items
+}
+
+func TestDataBlockRoundtrip(t *testing.T) {
+	items := fixtureItems()
+
+	block, err := segment.DecodeDataBlock(segment.EncodeDataBlock(items, 4))
+	assert.NoError(t, err)
+	assert.Equal(t, (len(items)+3)/4, block.RestartCount())
+
+	decoded, err := block.Items()
+	assert.NoError(t, err)
+	assert.Equal(t, items, decoded)
+}
+
+func TestDataBlockGet(t *testing.T) {
+	items := fixtureItems()
+
+	for _, interval := range []int{1, 2, 3, 16, 1000} {
+		block, err := segment.DecodeDataBlock(segment.EncodeDataBlock(items, interval))
+		assert.NoError(t, err)
+
+		item, err := block.Get([]byte("key-005"), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value-5-2"), item.Value)
+
+		seqno := value.SeqNo(2)
+		item, err = block.Get([]byte("key-005"), &seqno)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value-5-1"), item.Value)
+
+		seqno = 0
+		item, err = block.Get([]byte("key-005"), &seqno)
+		assert.NoError(t, err)
+		assert.Nil(t, item)
+
+		item, err = block.Get([]byte("key-099"), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value-99-0"), item.Value)
+
+		for _, missing := range []string{"a", "key-005a", "key-100", "zzz"} {
+			item, err = block.Get([]byte(missing), nil)
+			assert.NoError(t, err)
+			assert.Nil(t, item)
+		}
+	}
+}
+
+func TestDataBlockCorruption(t *testing.T) {
+	raw := segment.EncodeDataBlock(fixtureItems(), 16)
+	raw[10] ^= 0xFF
+
+	_, err := segment.DecodeDataBlock(raw)
+	assert.Error(t, err)
+}
@@ -1,47 +1,54 @@
 package segment
 
 import (
-	"bytes"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync/atomic"
 
+	"bagh/bloom"
+	"bagh/comparator"
 	"bagh/descriptor"
-	"bagh/disk"
 	"bagh/file"
 	"bagh/value"
+	"bagh/vfs"
 )
 
+// BlockHandleBlock is an index partition, referencing data blocks sorted by start key
 type BlockHandleBlock struct {
-	disk.DiskBlock[BlockHandle]
+	Items []BlockHandle
+
+	// Order of the start keys, nil orders them bytewise
+	cmp comparator.Comparator
 }
 
-func (bhb *BlockHandleBlock) GetPreviousBlockInfo(key []byte) *BlockHandle {
-	for i := len(bhb.Items) - 1; i >= 0; i-- {
-		if bytes.Compare(bhb.Items[i].StartKey, key) < 0 {
-			return &bhb.Items[i]
-		}
+// search returns the index of the first item whose start key is > key (or >= if inclusive)
+func (bhb *BlockHandleBlock) search(key []byte, inclusive bool) int {
+	order := comparator.OrDefault(bhb.cmp)
+	return sort.Search(len(bhb.Items), func(i int) bool {
+		cmp := order.Compare(bhb.Items[i].StartKey, key)
+		return cmp > 0 || (inclusive && cmp == 0)
+	})
+}
+
+func (bhb *BlockHandleBlock) item(idx int) *BlockHandle {
+	if idx < 0 || idx >= len(bhb.Items) {
+		return nil
 	}
-	return nil
+	return &bhb.Items[idx]
+}
+
+func (bhb *BlockHandleBlock) GetPreviousBlockInfo(key []byte) *BlockHandle {
+	return bhb.item(bhb.search(key, true) - 1)
 }
 
 func (bhb *BlockHandleBlock) GetNextBlockInfo(key []byte) *BlockHandle {
-	for _, item := range bhb.Items {
-		if bytes.Compare(item.StartKey, key) > 0 {
-			return &item
-		}
-	}
-	return nil
+	return bhb.item(bhb.search(key, false))
 }
 
 func (bhb *BlockHandleBlock) GetLowerBoundBlockInfo(key []byte) *BlockHandle {
-	for i := len(bhb.Items) - 1; i >= 0; i-- {
-		if bytes.Compare(bhb.Items[i].StartKey, key) <= 0 {
-			return &bhb.Items[i]
-		}
-	}
-	return nil
+	return bhb.item(bhb.search(key, false) - 1)
 }
 
 type BlockHandleBlockIndex struct {
@@ -56,16 +63,196 @@ func (bhbi *BlockHandleBlockIndex) Get(segmentID string, key value.UserKey) *Blo
 	return bhbi.cache.GetBlockHandleBlock(segmentID, key)
 }
 
+// BlockIndex is the two-level index of a segment
+//
+// The top-level index references index partitions, each of which references
+// data blocks. Every index partition has a matching bloom filter partition.
+// All of them are loaded through the block cache, the top-level index and
+// filters are pinned in it if the segment is pinned (see SetPinned).
 type BlockIndex struct {
 	descriptorTable *descriptor.FileDescriptorTable
 	segmentID       string
-	topLevelIndex   *TopLevelIndex
+	path            string
 	blocks          *BlockHandleBlockIndex
+	pinned          atomic.Bool
+
+	// Order of the keys of the segment
+	cmp comparator.Comparator
+
+	// Set while the segment's files are held, see Segment.HoldFiles
+	heldIndex atomic.Pointer[TopLevelIndex]
+	bloomFile atomic.Pointer[vfs.File]
+}
+
+// topLevelIndex returns the top-level index, loading it from disk if it is not cached
+func (b *BlockIndex) topLevelIndex() (*TopLevelIndex, error) {
+	if index := b.blocks.cache.GetTopLevelIndex(b.segmentID); index != nil {
+		return index, nil
+	}
+	if index := b.heldIndex.Load(); index != nil {
+		b.blocks.cache.InsertTopLevelIndex(b.segmentID, index, b.pinned.Load())
+		return index, nil
+	}
+
+	index, err := b.readTopLevelIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	b.blocks.cache.InsertTopLevelIndex(b.segmentID, index, b.pinned.Load())
+	return index, nil
+}
+
+// fs returns the filesystem of the segment, the one of its descriptor table
+func (b *BlockIndex) fs() vfs.FS {
+	return b.descriptorTable.FS()
+}
+
+func (b *BlockIndex) readTopLevelIndex() (*TopLevelIndex, error) {
+	framed, err := vfs.ReadFile(b.fs(), filepath.Join(b.path, file.TopLevelIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := decompressBlock(framed)
+	if err != nil {
+		return nil, err
+	}
+	index, err := decodeTopLevelIndex(raw, b.cmp)
+	if err != nil {
+		return nil, fmt.Errorf("segment %s: %w", b.segmentID, err)
+	}
+	return index, nil
+}
+
+// holdFiles keeps the top-level index in memory and the bloom filter file
+// open, until releaseFiles
+func (b *BlockIndex) holdFiles() error {
+	index, err := b.readTopLevelIndex()
+	if err != nil {
+		return err
+	}
+
+	f, err := b.fs().Open(filepath.Join(b.path, file.BloomFilterFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	b.heldIndex.Store(index)
+	if f != nil {
+		if old := b.bloomFile.Swap(&f); old != nil {
+			(*old).Close()
+		}
+	}
+	return nil
+}
+
+func (b *BlockIndex) releaseFiles() error {
+	b.heldIndex.Store(nil)
+	if f := b.bloomFile.Swap(nil); f != nil {
+		return (*f).Close()
+	}
+	return nil
+}
+
+// loadFilter returns the bloom filter partition of a top-level entry, nil if
+// the segment has no filters, or if its keys are not ordered bytewise, as
+// equal keys may then hash differently (e.g. in ingested segments)
+func (b *BlockIndex) loadFilter(entry *TopLevelEntry) (*bloom.Filter, error) {
+	if entry.Filter.Size == 0 || !comparator.IsBytewise(b.cmp) {
+		return nil, nil
+	}
+	if filter := b.blocks.cache.GetFilter(b.segmentID, entry.StartKey); filter != nil {
+		return filter, nil
+	}
+
+	var f vfs.File
+	if held := b.bloomFile.Load(); held != nil {
+		f = *held
+	} else {
+		var err error
+		if f, err = b.fs().Open(filepath.Join(b.path, file.BloomFilterFile)); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+
+	raw := make([]byte, entry.Filter.Size)
+	if _, err := f.ReadAt(raw, int64(entry.Filter.Offset)); err != nil {
+		return nil, err
+	}
+	filter, err := bloom.Decode(raw)
+	if err != nil {
+		return nil, fmt.Errorf("segment %s: %w", b.segmentID, err)
+	}
+
+	b.blocks.cache.InsertFilter(b.segmentID, entry.StartKey, filter, b.pinned.Load())
+	return filter, nil
+}
+
+// MayContain returns false if the key is definitely not in the segment,
+// checking the bloom filter partition that covers it
+func (b *BlockIndex) MayContain(key []byte) (bool, error) {
+	index, err := b.topLevelIndex()
+	if err != nil {
+		return false, err
+	}
+
+	entry, found := index.GetEntryContainingItem(key)
+	if !found {
+		return false, nil
+	}
+
+	filter, err := b.loadFilter(entry)
+	if err != nil || filter == nil {
+		return true, err
+	}
+	return filter.MayContain(bloom.HashKey(key)), nil
+}
+
+// SetPinned pins (or unpins) the top-level index and filter blocks in the block cache
+//
+// Pinning loads them eagerly, so they are never read from disk again.
+func (b *BlockIndex) SetPinned(pinned bool) error {
+	if b.pinned.Swap(pinned) == pinned {
+		return nil
+	}
+
+	if !pinned {
+		b.blocks.cache.Unpin(b.segmentID)
+		return nil
+	}
+
+	index, err := b.topLevelIndex()
+	if err != nil {
+		return err
+	}
+	b.blocks.cache.InsertTopLevelIndex(b.segmentID, index, true)
+
+	for i := range index.Entries {
+		filter, err := b.loadFilter(&index.Entries[i])
+		if err != nil {
+			return err
+		}
+		if filter != nil {
+			b.blocks.cache.InsertFilter(b.segmentID, index.Entries[i].StartKey, filter, true)
+		}
+	}
+	return nil
+}
+
+// IsPinned returns true if the index and filter blocks are pinned in the block cache
+func (b *BlockIndex) IsPinned() bool {
+	return b.pinned.Load()
 }
 
 func (bi *BlockIndex) GetPrefixUpperBound(key []byte) (*BlockHandle, error) {
-	blockKey, blockHandle, found := bi.topLevelIndex.GetPrefixUpperBound(key)
-	if found == false {
+	index, err := bi.topLevelIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	blockKey, blockHandle, found := index.GetPrefixUpperBound(key)
+	if !found {
 		return nil, nil
 	}
 
@@ -81,8 +268,13 @@ func (bi *BlockIndex) GetPrefixUpperBound(key []byte) (*BlockHandle, error) {
 }
 
 func (bi *BlockIndex) GetUpperBoundBlockInfo(key []byte) (*BlockHandle, error) {
-	blockKey, blockHandle, found := bi.topLevelIndex.GetBlockContainingItem(key)
-	if found == false {
+	index, err := bi.topLevelIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	blockKey, blockHandle, found := index.GetBlockContainingItem(key)
+	if !found {
 		return nil, nil
 	}
 
@@ -96,21 +288,27 @@ func (bi *BlockIndex) GetUpperBoundBlockInfo(key []byte) (*BlockHandle, error) {
 		return nextBlock, nil
 	}
 
-	nextBlockKey, nextBlockHandle, found := bi.topLevelIndex.GetNextBlockHandle(key)
-	if found == false {
+	nextBlockKey, nextBlockHandle, found := index.GetNextBlockHandle(key)
+	if !found {
 		return nil, nil
 	}
 
-	return &BlockHandle{
-		Offset:   nextBlockHandle.Offset,
-		Size:     nextBlockHandle.Size,
-		StartKey: nextBlockKey,
-	}, nil
+	indexBlock, err = bi.LoadAndCacheIndexBlock(nextBlockKey, nextBlockHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	return &indexBlock.Items[0], nil
 }
 
 func (bi *BlockIndex) GetLowerBoundBlockInfo(key []byte) (*BlockHandle, error) {
-	blockKey, blockHandle, found := bi.topLevelIndex.GetBlockContainingItem(key)
-	if found == false {
+	index, err := bi.topLevelIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	blockKey, blockHandle, found := index.GetBlockContainingItem(key)
+	if !found {
 		return nil, nil
 	}
 
@@ -123,8 +321,13 @@ func (bi *BlockIndex) GetLowerBoundBlockInfo(key []byte) (*BlockHandle, error) {
 }
 
 func (b *BlockIndex) GetPreviousBlockKey(key []byte) (*BlockHandle, error) {
-	firstBlockKey, firstBlockHandle, found := b.topLevelIndex.GetBlockContainingItem(key)
-	if found == false {
+	index, err := b.topLevelIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	firstBlockKey, firstBlockHandle, found := index.GetBlockContainingItem(key)
+	if !found {
 		return nil, nil
 	}
 
@@ -133,15 +336,12 @@ func (b *BlockIndex) GetPreviousBlockKey(key []byte) (*BlockHandle, error) {
 		return nil, err
 	}
 
-	maybePrev := indexBlock.GetPreviousBlockInfo(key)
-
-	// @TODO: : Might have to clone here, not sure and all subsequent places in this file
-	if maybePrev != nil {
+	if maybePrev := indexBlock.GetPreviousBlockInfo(key); maybePrev != nil {
 		return maybePrev, nil
 	}
 
-	prevBlockKey, prevBlockHandle, found := b.topLevelIndex.GetPreviousBlockHandle(firstBlockKey)
-	if found == false {
+	prevBlockKey, prevBlockHandle, found := index.GetPreviousBlockHandle(firstBlockKey)
+	if !found {
 		return nil, nil
 	}
 
@@ -150,13 +350,17 @@ func (b *BlockIndex) GetPreviousBlockKey(key []byte) (*BlockHandle, error) {
 		return nil, err
 	}
 
-	// @TODO: : Might have to clone here, not sure
 	return &indexBlock.Items[len(indexBlock.Items)-1], nil
 }
 
 func (b *BlockIndex) GetNextBlockKey(key []byte) (*BlockHandle, error) {
-	firstBlockKey, firstBlockHandle, found := b.topLevelIndex.GetBlockContainingItem(key)
-	if found == false {
+	index, err := b.topLevelIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	firstBlockKey, firstBlockHandle, found := index.GetBlockContainingItem(key)
+	if !found {
 		return nil, nil
 	}
 
@@ -165,14 +369,12 @@ func (b *BlockIndex) GetNextBlockKey(key []byte) (*BlockHandle, error) {
 		return nil, err
 	}
 
-	maybeNext := indexBlock.GetNextBlockInfo(key)
-
-	if maybeNext != nil {
+	if maybeNext := indexBlock.GetNextBlockInfo(key); maybeNext != nil {
 		return maybeNext, nil
 	}
 
-	nextBlockKey, nextBlockHandle, found := b.topLevelIndex.GetNextBlockHandle(firstBlockKey)
-	if found == false {
+	nextBlockKey, nextBlockHandle, found := index.GetNextBlockHandle(firstBlockKey)
+	if !found {
 		return nil, nil
 	}
 
@@ -185,28 +387,30 @@ func (b *BlockIndex) GetNextBlockKey(key []byte) (*BlockHandle, error) {
 }
 
 func (b *BlockIndex) GetFirstBlockKey() (*BlockHandle, error) {
-	blockKey, blockHandle := b.topLevelIndex.GetFirstBlockHandle()
-	indexBlock, err := b.LoadAndCacheIndexBlock(blockKey, blockHandle)
+	index, err := b.topLevelIndex()
 	if err != nil {
 		return nil, err
 	}
 
-	if len(indexBlock.Items) == 0 {
-		return nil, fmt.Errorf("block should not be empty")
+	blockKey, blockHandle := index.GetFirstBlockHandle()
+	indexBlock, err := b.LoadAndCacheIndexBlock(blockKey, blockHandle)
+	if err != nil {
+		return nil, err
 	}
 
 	return &indexBlock.Items[0], nil
 }
 
 func (b *BlockIndex) GetLastBlockKey() (*BlockHandle, error) {
-	blockKey, blockHandle := b.topLevelIndex.GetLastBlockHandle()
-	indexBlock, err := b.LoadAndCacheIndexBlock(blockKey, blockHandle)
+	index, err := b.topLevelIndex()
 	if err != nil {
 		return nil, err
 	}
 
-	if len(indexBlock.Items) == 0 {
-		return nil, fmt.Errorf("block should not be empty")
+	blockKey, blockHandle := index.GetLastBlockHandle()
+	indexBlock, err := b.LoadAndCacheIndexBlock(blockKey, blockHandle)
+	if err != nil {
+		return nil, err
 	}
 
 	return &indexBlock.Items[len(indexBlock.Items)-1], nil
@@ -223,30 +427,32 @@ func (b *BlockIndex) LoadAndCacheIndexBlock(blockKey []byte, blockHandle *BlockH
 	if err != nil {
 		return nil, err
 	}
-	defer fileGuard.Release() // defer or release earlier? @TODO:
-	db := new(BlockHandleBlock)
+	if fileGuard == nil {
+		return nil, fmt.Errorf("segment %s is not in the descriptor table", b.segmentID)
+	}
+	defer fileGuard.Release()
 
-	if err := db.FromFileCompressed(fileGuard.File(), int64(blockHandle.Offset), blockHandle.Size); err != nil {
+	framed := make([]byte, blockHandle.Size)
+	if _, err := fileGuard.File().ReadAt(framed, int64(blockHandle.Offset)); err != nil {
 		return nil, err
 	}
+	raw, err := decompressBlock(framed)
+	if err != nil {
+		return nil, err
+	}
+	items, err := decodeIndexBlock(raw)
+	if err != nil {
+		return nil, fmt.Errorf("segment %s: %w", b.segmentID, err)
+	}
 
+	db := &BlockHandleBlock{Items: items, cmp: b.cmp}
 	b.blocks.Insert(b.segmentID, blockKey, db)
 
 	return db, nil
 }
 
 func (b *BlockIndex) GetLatest(key []byte) (*BlockHandle, error) {
-	blockKey, indexBlockHandle, found := b.topLevelIndex.GetBlockContainingItem(key)
-	if found == false {
-		return nil, nil
-	}
-
-	indexBlock, err := b.LoadAndCacheIndexBlock(blockKey, indexBlockHandle)
-	if err != nil {
-		return nil, err
-	}
-
-	return indexBlock.GetLowerBoundBlockInfo(key), nil
+	return b.GetLowerBoundBlockInfo(key)
 }
 
 func NewBlockIndex(segmentID string, blockCache *BlockCache) *BlockIndex {
@@ -258,60 +464,27 @@ func NewBlockIndex(segmentID string, blockCache *BlockCache) *BlockIndex {
 		descriptorTable: descriptor.NewFileDescriptorTable(512, 1),
 		segmentID:       segmentID,
 		blocks:          indexBlockIndex,
-		topLevelIndex:   NewTopLevelIndex(make(map[string]*BlockHandleBlockHandle)),
+		cmp:             comparator.Bytewise,
 	}
 }
 
-func (b *BlockIndex) FromFile(segmentID string, descriptorTable *descriptor.FileDescriptorTable, path string, blockCache *BlockCache) error {
-	log.Printf("Reading block index from %s", path)
-
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return err
-	}
-	if _, err := os.Stat(filepath.Join(path, file.TopLevelIndexFile)); os.IsNotExist(err) {
-		return err
-	}
-	if _, err := os.Stat(filepath.Join(path, file.BlocksFile)); os.IsNotExist(err) {
-		return err
-	}
-
-	fileInfo, err := os.Stat(filepath.Join(path, file.TopLevelIndexFile))
-	if err != nil {
-		return err
-	}
+// WithComparator sets the order of the keys in the index, nil for bytewise
+func (b *BlockIndex) WithComparator(c comparator.Comparator) *BlockIndex {
+	b.cmp = c
+	return b
+}
 
-	file, err := os.Open(filepath.Join(path, file.TopLevelIndexFile))
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-	indexBlock := new(BlockHandleBlock)
-	if err := indexBlock.FromFileCompressed(file, 0, uint32(fileInfo.Size())); err != nil {
+func (b *BlockIndex) FromFile(segmentID string, descriptorTable *descriptor.FileDescriptorTable, path string, blockCache *BlockCache) error {
+	if _, err := descriptorTable.FS().Stat(filepath.Join(path, file.BlocksFile)); err != nil {
 		return err
 	}
 
-	if len(indexBlock.Items) == 0 {
-		return fmt.Errorf("index is empty")
-	}
-	// @P2: using normal map, should use some red black tree for faster range queries
-	tree := make(map[string]*BlockHandleBlockHandle)
-	for _, item := range indexBlock.Items {
-		tree[string(item.StartKey)] = &BlockHandleBlockHandle{
-			Offset: item.Offset,
-			Size:   item.Size,
-		}
-	}
-
 	b.descriptorTable = descriptorTable
 	b.blocks = &BlockHandleBlockIndex{blockCache}
-	b.topLevelIndex = NewTopLevelIndex(tree)
 	b.segmentID = segmentID
+	b.path = path
 
-	//  = &BlockIndex{
-	// 	descriptorTable: descriptorTable,
-	// 	segmentID:       segmentID,
-	// 	topLevelIndex:   NewTopLevelIndex(tree),
-	// 	blocks:          &BlockHandleBlockIndex{blockCache},
-	// }
-	return nil
+	// Make sure the index is readable
+	_, err := b.topLevelIndex()
+	return err
 }
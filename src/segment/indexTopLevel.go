@@ -1,9 +1,12 @@
 package segment
 
 import (
+	"bagh/comparator"
 	"bagh/value"
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"sort"
 )
@@ -35,97 +38,195 @@ func (bh *BlockHandleBlockHandle) Deserialize(reader io.Reader) error {
 	return binary.Read(reader, binary.BigEndian, &bh.Size)
 }
 
-// TopLevelIndex stores references to the positions of blocks on a file and their position
+// TopLevelEntry references an index partition, and the bloom filter
+// partition covering the same data blocks
+type TopLevelEntry struct {
+	// Key of the first item in the partition
+	StartKey value.UserKey
+
+	// Position of the index partition in the blocks file
+	Index BlockHandleBlockHandle
+
+	// Position of the filter partition in the filter file, zero sized if
+	// the segment was written without bloom filters
+	Filter BlockHandleBlockHandle
+}
+
+// TopLevelIndex references the index partitions of a segment, sorted by start key
 type TopLevelIndex struct {
-	Data map[string]*BlockHandleBlockHandle
+	Entries []TopLevelEntry
+
+	// Order of the start keys, nil orders them bytewise
+	cmp comparator.Comparator
+}
+
+func NewTopLevelIndex(entries []TopLevelEntry) *TopLevelIndex {
+	return &TopLevelIndex{Entries: entries}
+}
+
+func (tli *TopLevelIndex) entry(idx int) (value.UserKey, *BlockHandleBlockHandle, bool) {
+	if idx < 0 || idx >= len(tli.Entries) {
+		return nil, nil, false
+	}
+	return tli.Entries[idx].StartKey, &tli.Entries[idx].Index, true
 }
 
-func NewTopLevelIndex(data map[string]*BlockHandleBlockHandle) *TopLevelIndex {
-	return &TopLevelIndex{Data: data}
+// search returns the index of the first entry whose start key is > key (or >= if inclusive)
+func (tli *TopLevelIndex) search(key []byte, inclusive bool) int {
+	order := comparator.OrDefault(tli.cmp)
+	return sort.Search(len(tli.Entries), func(i int) bool {
+		cmp := order.Compare(tli.Entries[i].StartKey, key)
+		return cmp > 0 || (inclusive && cmp == 0)
+	})
 }
 
+// GetPrefixUpperBound returns the first partition starting after all keys with the given prefix
 func (tli *TopLevelIndex) GetPrefixUpperBound(prefix []byte) (value.UserKey, *BlockHandleBlockHandle, bool) {
-	var keys []string
-	for key := range tli.Data {
-		keys = append(keys, key)
+	idx := tli.search(prefix, true)
+	for idx < len(tli.Entries) && bytes.HasPrefix(tli.Entries[idx].StartKey, prefix) {
+		idx++
 	}
-	sort.Strings(keys)
+	return tli.entry(idx)
+}
 
-	for _, key := range keys {
-		if !bytes.HasPrefix([]byte(key), prefix) {
-			bh := tli.Data[key]
-			return value.UserKey(key), bh, true
-		}
+// GetEntryContainingItem returns the partition that may contain the key
+func (tli *TopLevelIndex) GetEntryContainingItem(key []byte) (*TopLevelEntry, bool) {
+	idx := tli.search(key, false) - 1
+	if idx < 0 {
+		return nil, false
 	}
-	return nil, nil, false
+	return &tli.Entries[idx], true
 }
 
 func (tli *TopLevelIndex) GetBlockContainingItem(key []byte) (value.UserKey, *BlockHandleBlockHandle, bool) {
-	var keys []string
-	for k := range tli.Data {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
+	return tli.entry(tli.search(key, false) - 1)
+}
 
-	for i := len(keys) - 1; i >= 0; i-- {
-		if bytes.Compare([]byte(keys[i]), key) <= 0 {
-			bh := tli.Data[keys[i]]
-			return value.UserKey(keys[i]), bh, true
-		}
+func (tli *TopLevelIndex) GetFirstBlockHandle() (value.UserKey, *BlockHandleBlockHandle) {
+	key, bh, _ := tli.entry(0)
+	return key, bh
+}
+
+func (tli *TopLevelIndex) GetLastBlockHandle() (value.UserKey, *BlockHandleBlockHandle) {
+	key, bh, _ := tli.entry(len(tli.Entries) - 1)
+	return key, bh
+}
+
+func (tli *TopLevelIndex) GetPreviousBlockHandle(key []byte) (value.UserKey, *BlockHandleBlockHandle, bool) {
+	return tli.entry(tli.search(key, true) - 1)
+}
+
+func (tli *TopLevelIndex) GetNextBlockHandle(key []byte) (value.UserKey, *BlockHandleBlockHandle, bool) {
+	return tli.entry(tli.search(key, false))
+}
+
+// encodeTopLevelIndex serializes the top-level index
+//
+// # Disk representation
+//
+// \[entries] - \[entry count; 4 bytes] - \[crc; 4 bytes]
+//
+// Each entry is laid out as:
+//
+// \[key len; 2 bytes] - \[key] - \[offset; 8 bytes] - \[size; 4 bytes] - \[filter offset; 8 bytes] - \[filter size; 4 bytes]
+func encodeTopLevelIndex(entries []TopLevelEntry) []byte {
+	buf := new(bytes.Buffer)
+	for _, entry := range entries {
+		binary.Write(buf, binary.BigEndian, uint16(len(entry.StartKey)))
+		buf.Write(entry.StartKey)
+		entry.Index.Serialize(buf)
+		entry.Filter.Serialize(buf)
 	}
-	return nil, nil, false
+	binary.Write(buf, binary.BigEndian, uint32(len(entries)))
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
 }
 
-func (tli *TopLevelIndex) GetFirstBlockHandle() (value.UserKey, *BlockHandleBlockHandle) {
-	var minKey string
-	for key := range tli.Data {
-		if minKey == "" || key < minKey {
-			minKey = key
+func decodeTopLevelIndex(raw []byte, cmp comparator.Comparator) (*TopLevelIndex, error) {
+	cmp = comparator.OrDefault(cmp)
+
+	body, count, err := checkIndexTrailer(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bytes.NewReader(body)
+	entries := make([]TopLevelEntry, count)
+	for i := range entries {
+		key, err := readIndexKey(reader)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].StartKey = key
+		if err := entries[i].Index.Deserialize(reader); err != nil {
+			return nil, err
+		}
+		if err := entries[i].Filter.Deserialize(reader); err != nil {
+			return nil, err
+		}
+		if i > 0 && cmp.Compare(entries[i-1].StartKey, key) >= 0 {
+			return nil, fmt.Errorf("top-level index is not sorted")
 		}
 	}
-	bh := tli.Data[minKey]
-	return value.UserKey(minKey), bh
+
+	index := NewTopLevelIndex(entries)
+	index.cmp = cmp
+	return index, nil
 }
 
-func (tli *TopLevelIndex) GetLastBlockHandle() (value.UserKey, *BlockHandleBlockHandle) {
-	var maxKey string
-	for key := range tli.Data {
-		if maxKey == "" || key > maxKey {
-			maxKey = key
-		}
+// encodeIndexBlock serializes an index partition, it uses the same layout as
+// the top-level index, without the filter handles
+func encodeIndexBlock(items []BlockHandle) []byte {
+	buf := new(bytes.Buffer)
+	for _, item := range items {
+		item.Serialize(buf)
 	}
-	bh := tli.Data[maxKey]
-	return value.UserKey(maxKey), bh
+	binary.Write(buf, binary.BigEndian, uint32(len(items)))
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
 }
 
-func (tli *TopLevelIndex) GetPreviousBlockHandle(key []byte) (value.UserKey, *BlockHandleBlockHandle, bool) {
-	var keys []string
-	for k := range tli.Data {
-		keys = append(keys, k)
+func decodeIndexBlock(raw []byte) ([]BlockHandle, error) {
+	body, count, err := checkIndexTrailer(raw)
+	if err != nil {
+		return nil, err
 	}
-	sort.Strings(keys)
 
-	for i := len(keys) - 1; i >= 0; i-- {
-		if bytes.Compare([]byte(keys[i]), key) < 0 {
-			bh := tli.Data[keys[i]]
-			return value.UserKey(keys[i]), bh, true
+	reader := bytes.NewReader(body)
+	items := make([]BlockHandle, count)
+	for i := range items {
+		if err := items[i].Deserialize(reader); err != nil {
+			return nil, err
 		}
 	}
-	return nil, nil, false
+	return items, nil
 }
 
-func (tli *TopLevelIndex) GetNextBlockHandle(key []byte) (value.UserKey, *BlockHandleBlockHandle, bool) {
-	var keys []string
-	for k := range tli.Data {
-		keys = append(keys, k)
+func checkIndexTrailer(raw []byte) ([]byte, uint32, error) {
+	if len(raw) < 8 {
+		return nil, 0, fmt.Errorf("index block too short: %d bytes", len(raw))
 	}
-	sort.Strings(keys)
 
-	for _, k := range keys {
-		if bytes.Compare([]byte(k), key) > 0 {
-			bh := tli.Data[k]
-			return value.UserKey(k), bh, true
-		}
+	body, trailer := raw[:len(raw)-4], raw[len(raw)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(trailer) {
+		return nil, 0, fmt.Errorf("index block checksum mismatch")
+	}
+
+	count := binary.BigEndian.Uint32(body[len(body)-4:])
+	if count == 0 {
+		return nil, 0, fmt.Errorf("index block is empty")
+	}
+	return body[:len(body)-4], count, nil
+}
+
+func readIndexKey(reader io.Reader) (value.UserKey, error) {
+	var keyLen uint16
+	if err := binary.Read(reader, binary.BigEndian, &keyLen); err != nil {
+		return nil, err
+	}
+	key := make(value.UserKey, keyLen)
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, err
 	}
-	return nil, nil, false
+	return key, nil
 }
@@ -1,26 +1,25 @@
 package segment
 
 import (
+	"bagh/bloom"
 	"bagh/file"
 	"bagh/value"
+	"bagh/vfs"
 	"bufio"
-	"bytes"
 	"io"
 	"os"
 	"path/filepath"
-
-	"github.com/pierrec/lz4/v4"
 )
 
-func concatFiles(srcPath, destPath string) error {
-	src, err := os.Open(srcPath)
+func concatFiles(fs vfs.FS, srcPath, destPath string) error {
+	src, err := fs.Open(srcPath)
 	if err != nil {
 		return err
 	}
 	defer src.Close()
 
 	// @TODO: check if this ok?
-	dest, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	dest, err := fs.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		return err
 	}
@@ -30,70 +29,99 @@ func concatFiles(srcPath, destPath string) error {
 	return err
 }
 
+// IndexWriter writes the two-level index, and the bloom filter partitions, of a segment
+//
+// Index partitions are buffered in a temporary file, and appended to the
+// blocks file once all data blocks are written. Every index partition gets
+// a filter partition covering the keys of its data blocks.
 type IndexWriter struct {
+	fs               vfs.FS
 	path             string
 	filePos          uint64
+	blockIndexFile   vfs.File
 	blockIndexWriter *bufio.Writer
-	indexIndexWriter *bufio.Writer
 	blockSize        uint32
 	blockCounter     uint32
 	blockChunk       BlockHandleBlock
-	indexChunk       BlockHandleBlock
-}
+	topLevel         []TopLevelEntry
 
-func NewIndexWriter(path string, blockSize uint32) (*IndexWriter, error) {
-	blockFile, err := os.Create(filepath.Join(path, file.IndexBlocksFile))
-	if err != nil {
-		return nil, err
-	}
-	blockIndexWriter := bufio.NewWriterSize(blockFile, 65535)
+	// nil if bloom filters are disabled
+	filterBuilder *bloom.Builder
+	filterFile    vfs.File
+	filterWriter  *bufio.Writer
+	filterPos     uint64
+}
 
-	indexFile, err := os.Create(filepath.Join(path, file.TopLevelIndexFile))
+// NewIndexWriter creates an index writer, bitsPerKey of 0 disables bloom filters
+func NewIndexWriter(fs vfs.FS, path string, blockSize uint32, bitsPerKey int) (*IndexWriter, error) {
+	blockFile, err := fs.Create(filepath.Join(path, file.IndexBlocksFile))
 	if err != nil {
 		return nil, err
 	}
-	indexIndexWriter := bufio.NewWriter(indexFile)
 
-	return &IndexWriter{
+	w := &IndexWriter{
+		fs:               fs,
 		path:             path,
-		filePos:          0,
-		blockIndexWriter: blockIndexWriter,
-		indexIndexWriter: indexIndexWriter,
+		blockIndexFile:   blockFile,
+		blockIndexWriter: bufio.NewWriterSize(blockFile, 65535),
 		blockSize:        blockSize,
-		blockCounter:     0,
-		blockChunk:       *new(BlockHandleBlock),
-		indexChunk:       *new(BlockHandleBlock),
-	}, nil
+	}
+
+	if bitsPerKey > 0 {
+		filterFile, err := fs.Create(filepath.Join(path, file.BloomFilterFile))
+		if err != nil {
+			return nil, err
+		}
+		w.filterBuilder = bloom.NewBuilder(bitsPerKey)
+		w.filterFile = filterFile
+		w.filterWriter = bufio.NewWriter(filterFile)
+	}
+
+	return w, nil
 }
 
-func (w *IndexWriter) writeBlock() error {
-	// Serialize block
-	err := w.blockChunk.CreateCRC()
-	if err != nil {
-		return err
+// AddKey adds a key to the filter partition of the data block being written
+func (w *IndexWriter) AddKey(key value.UserKey) {
+	if w.filterBuilder != nil {
+		w.filterBuilder.Add(bloom.HashKey(key))
 	}
-	// bhb := new(BlockHandleBlock)
-	// bytes := make([]byte, 0, 65535) // u16::MAX @TODO:
-	buf := new(bytes.Buffer)
-	err = w.blockChunk.Serialize(buf)
+}
+
+func (w *IndexWriter) writeBlock() error {
+	framed, err := compressBlock(encodeIndexBlock(w.blockChunk.Items))
 	if err != nil {
 		return err
 	}
-
-	if _, err := w.blockIndexWriter.Write(buf.Bytes()); err != nil {
+	if _, err := w.blockIndexWriter.Write(framed); err != nil {
 		return err
 	}
 
 	first := w.blockChunk.Items[0]
-	w.indexChunk.Items = append(w.indexChunk.Items, BlockHandle{
+	entry := TopLevelEntry{
 		StartKey: first.StartKey,
-		Offset:   w.filePos,
-		Size:     uint32(len(buf.Bytes())),
-	})
+		Index: BlockHandleBlockHandle{
+			Offset: w.filePos,
+			Size:   uint32(len(framed)),
+		},
+	}
+
+	if w.filterBuilder != nil {
+		filter := w.filterBuilder.Build()
+		if _, err := w.filterWriter.Write(filter); err != nil {
+			return err
+		}
+		entry.Filter = BlockHandleBlockHandle{
+			Offset: w.filterPos,
+			Size:   uint32(len(filter)),
+		}
+		w.filterPos += uint64(len(filter))
+	}
+
+	w.topLevel = append(w.topLevel, entry)
 
 	w.blockCounter = 0
-	w.blockChunk.Items = w.blockChunk.Items[:0]
-	w.filePos += uint64(len(buf.Bytes()))
+	w.blockChunk.Items = nil
+	w.filePos += uint64(len(framed))
 
 	return nil
 }
@@ -102,7 +130,7 @@ func (w *IndexWriter) RegisterBlock(startKey value.UserKey, offset uint64, size
 	blockHandleSize := uint32(len(startKey)) + 12 // 12 is the size of offset and size fields
 
 	reference := BlockHandle{
-		StartKey: startKey,
+		StartKey: append(value.UserKey(nil), startKey...),
 		Offset:   offset,
 		Size:     size,
 	}
@@ -118,47 +146,38 @@ func (w *IndexWriter) RegisterBlock(startKey value.UserKey, offset uint64, size
 }
 
 func (w *IndexWriter) writeTopLevelIndex(blockFileSize uint64) error {
-	if err := w.blockIndexWriter.Flush(); err != nil {
-		return err
-	}
-
 	if err := concatFiles(
+		w.fs,
 		filepath.Join(w.path, file.IndexBlocksFile),
 		filepath.Join(w.path, file.BlocksFile),
 	); err != nil {
 		return err
 	}
 
-	for i := range w.indexChunk.Items {
-		w.indexChunk.Items[i].Offset += blockFileSize
-	}
-
-	if err := w.indexChunk.CreateCRC(); err != nil {
-		return err
+	// Index partitions now live behind the data blocks
+	for i := range w.topLevel {
+		w.topLevel[i].Index.Offset += blockFileSize
 	}
 
-	// @TODO: do these even work?
-	buf := new(bytes.Buffer)
-	err := w.indexChunk.Serialize(buf)
+	framed, err := compressBlock(encodeTopLevelIndex(w.topLevel))
 	if err != nil {
 		return err
 	}
 
-	compressor := new(lz4.Compressor)
-	compressedBytes := make([]byte, 0)
-	if _, err := compressor.CompressBlock(buf.Bytes(), compressedBytes); err != nil {
+	indexFile, err := w.fs.Create(filepath.Join(w.path, file.TopLevelIndexFile))
+	if err != nil {
 		return err
 	}
+	defer indexFile.Close()
 
-	if _, err := w.indexIndexWriter.Write(compressedBytes); err != nil {
+	if _, err := indexFile.Write(framed); err != nil {
 		return err
 	}
-
-	return w.indexIndexWriter.Flush()
+	return indexFile.Sync()
 }
 
 func (w *IndexWriter) Finish(blockFileSize uint64) error {
-	if w.blockCounter > 0 {
+	if len(w.blockChunk.Items) > 0 {
 		if err := w.writeBlock(); err != nil {
 			return err
 		}
@@ -167,32 +186,33 @@ func (w *IndexWriter) Finish(blockFileSize uint64) error {
 	if err := w.blockIndexWriter.Flush(); err != nil {
 		return err
 	}
-
-	if err := w.writeTopLevelIndex(blockFileSize); err != nil {
+	if err := w.blockIndexFile.Close(); err != nil {
 		return err
 	}
 
-	if err := os.Remove(filepath.Join(w.path, file.IndexBlocksFile)); err != nil {
+	if w.filterFile != nil {
+		if err := w.filterWriter.Flush(); err != nil {
+			return err
+		}
+		if err := w.filterFile.Sync(); err != nil {
+			return err
+		}
+		if err := w.filterFile.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.writeTopLevelIndex(blockFileSize); err != nil {
 		return err
 	}
 
-	return nil
+	return w.fs.Remove(filepath.Join(w.path, file.IndexBlocksFile))
 }
 
-// func serializeAndCompress(block *DiskBlock) ([]byte, error) {
-// 	var buf bytes.Buffer
-// 	if err := block.Serialize(&buf); err != nil {
-// 		return nil, err
-// 	}
-
-// 	var compressed bytes.Buffer
-// 	lz4IndexWriter := lz4.NewIndexWriter(&compressed)
-// 	if _, err := lz4IndexWriter.Write(buf.Bytes()); err != nil {
-// 		return nil, err
-// 	}
-// 	if err := lz4IndexWriter.Close(); err != nil {
-// 		return nil, err
-// 	}
-
-// 	return compressed.Bytes(), nil
-// }
+// Abort closes the files of an index writer that has nothing to write
+func (w *IndexWriter) Abort() {
+	w.blockIndexFile.Close()
+	if w.filterFile != nil {
+		w.filterFile.Close()
+	}
+}
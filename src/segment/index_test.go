@@ -0,0 +1,192 @@
+package segment_test
+
+import (
+	"bagh/descriptor"
+	"bagh/file"
+	"bagh/segment"
+	"bagh/value"
+	"bagh/vfs"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFixtureSegment(t *testing.T, bitsPerKey int) (string, int) {
+	folder := filepath.Join(t.TempDir(), "segment")
+
+	// Small blocks, so the index has many partitions
+	writer, err := segment.NewWriter(segment.Options{
+		Path:            folder,
+		BlockSize:       1024,
+		BloomBitsPerKey: bitsPerKey,
+	})
+	assert.NoError(t, err)
+
+	const keyCount = 5000
+	for i := 0; i < keyCount; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		// every key has two versions, newest first
+		assert.NoError(t, writer.Write(*value.NewValue(key, []byte(fmt.Sprintf("new-%d", i)), value.SeqNo(2*i+1), value.Record)))
+		assert.NoError(t, writer.Write(*value.NewValue(key, []byte(fmt.Sprintf("old-%d", i)), value.SeqNo(2*i), value.Record)))
+	}
+	assert.NoError(t, writer.Finish())
+
+	metadata, err := segment.MetadataFromWriter("segment", writer)
+	assert.NoError(t, err)
+	assert.NoError(t, metadata.WriteToFile(vfs.Default))
+
+	return folder, keyCount
+}
+
+func openFixtureSegment(t *testing.T, folder string, cache *segment.BlockCache) *segment.Segment {
+	descriptorTable := descriptor.NewFileDescriptorTable(16, 1)
+	descriptorTable.Insert(filepath.Join(folder, file.BlocksFile), "segment")
+
+	sg, err := segment.RecoverSegment(folder, cache, descriptorTable, nil)
+	assert.NoError(t, err)
+	return sg
+}
+
+func TestSegmentPointReads(t *testing.T) {
+	for _, bitsPerKey := range []int{0, 10} {
+		folder, keyCount := writeFixtureSegment(t, bitsPerKey)
+		sg := openFixtureSegment(t, folder, segment.NewBlockCache(1024*1024))
+
+		for i := 0; i < keyCount; i++ {
+			key := []byte(fmt.Sprintf("key-%05d", i))
+
+			item, err := sg.Get(key, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("new-%d", i), string(item.Value))
+
+			seqno := value.SeqNo(2*i + 1)
+			item, err = sg.Get(key, &seqno)
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("old-%d", i), string(item.Value))
+		}
+
+		item, err := sg.Get([]byte("key-00042x"), nil)
+		assert.NoError(t, err)
+		assert.Nil(t, item)
+	}
+}
+
+func TestSegmentIter(t *testing.T) {
+	folder, keyCount := writeFixtureSegment(t, 10)
+	sg := openFixtureSegment(t, folder, segment.NewBlockCache(1024*1024))
+
+	count := 0
+	reader := sg.Iter(false)
+	for {
+		item, err := reader.Next()
+		assert.NoError(t, err)
+		if item == nil {
+			break
+		}
+		count++
+	}
+	assert.Equal(t, 2*keyCount, count)
+}
+
+func TestSegmentPinnedIndex(t *testing.T) {
+	folder, keyCount := writeFixtureSegment(t, 10)
+
+	// Tiny cache, everything unpinned is evicted right away
+	cache := segment.NewBlockCache(64)
+	sg := openFixtureSegment(t, folder, cache)
+	assert.Equal(t, uint64(0), cache.PinnedSize())
+
+	assert.NoError(t, sg.SetPinned(true))
+	pinned := cache.PinnedSize()
+	assert.Greater(t, pinned, uint64(0))
+
+	for i := 0; i < keyCount; i += 100 {
+		_, err := sg.Get([]byte(fmt.Sprintf("key-%05d", i)), nil)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, pinned, cache.PinnedSize())
+	assert.LessOrEqual(t, cache.Size()-cache.PinnedSize(), cache.Capacity())
+
+	assert.NoError(t, sg.SetPinned(false))
+	assert.Equal(t, uint64(0), cache.PinnedSize())
+
+	cache.RemoveSegment("segment")
+	assert.True(t, cache.IsEmpty())
+}
+
+func TestTopLevelIndexSearch(t *testing.T) {
+	index := segment.NewTopLevelIndex([]segment.TopLevelEntry{
+		{StartKey: []byte("b")},
+		{StartKey: []byte("d")},
+		{StartKey: []byte("f")},
+	})
+
+	key, _, found := index.GetBlockContainingItem([]byte("e"))
+	assert.True(t, found)
+	assert.Equal(t, "d", string(key))
+
+	_, _, found = index.GetBlockContainingItem([]byte("a"))
+	assert.False(t, found)
+
+	key, _, found = index.GetNextBlockHandle([]byte("d"))
+	assert.True(t, found)
+	assert.Equal(t, "f", string(key))
+
+	key, _, found = index.GetPreviousBlockHandle([]byte("d"))
+	assert.True(t, found)
+	assert.Equal(t, "b", string(key))
+
+	key, _, found = index.GetPrefixUpperBound([]byte("d"))
+	assert.True(t, found)
+	assert.Equal(t, "f", string(key))
+}
+
+func TestSegmentIndexSeparators(t *testing.T) {
+	folder := filepath.Join(t.TempDir(), "segment")
+	writer, err := segment.NewWriter(segment.Options{Path: folder, BlockSize: 256})
+	assert.NoError(t, err)
+
+	// Gaps between the keys leave room for short separators
+	key := func(i int) []byte { return append([]byte{byte(2 * i)}, strings.Repeat("x", 60)...) }
+	const keyCount = 100
+	for i := 0; i < keyCount; i++ {
+		assert.NoError(t, writer.Write(*value.NewValue(key(i), []byte("v"), value.SeqNo(i), value.Record)))
+	}
+	assert.NoError(t, writer.Finish())
+	metadata, err := segment.MetadataFromWriter("segment", writer)
+	assert.NoError(t, err)
+	assert.NoError(t, metadata.WriteToFile(vfs.Default))
+
+	inspector, err := segment.NewInspector(vfs.Default, folder, nil)
+	assert.NoError(t, err)
+	defer inspector.Close()
+	handles, err := inspector.BlockHandles()
+	assert.NoError(t, err)
+	assert.Greater(t, len(handles), 10)
+	assert.Equal(t, key(0), []byte(handles[0].StartKey))
+	for _, handle := range handles[1:] {
+		assert.Len(t, handle.StartKey, 1)
+	}
+	assert.NoError(t, inspector.Verify())
+
+	sg := openFixtureSegment(t, folder, segment.NewBlockCache(1024*1024))
+	for i := 0; i < keyCount; i++ {
+		item, err := sg.Get(key(i), nil)
+		assert.NoError(t, err)
+		assert.NotNil(t, item, i)
+	}
+	item, err := sg.Get([]byte{3}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, item)
+
+	count := 0
+	reader := sg.Iter(true)
+	for item, err := reader.Next(); item != nil; item, err = reader.Next() {
+		assert.NoError(t, err)
+		count++
+	}
+	assert.Equal(t, keyCount, count)
+}
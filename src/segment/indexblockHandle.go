@@ -9,7 +9,7 @@ import (
 // BlockHandle points to a block on file
 //
 // Disk representation:
-// [offset; 8 bytes] - [size; 4 bytes] - [key length; 2 bytes] - [key; N bytes]
+// [key length; 2 bytes] - [key; N bytes] - [offset; 8 bytes] - [size; 4 bytes]
 type BlockHandle struct {
 	// Key of first item in block
 	StartKey value.UserKey
@@ -22,38 +22,31 @@ type BlockHandle struct {
 }
 
 func (bh BlockHandle) Serialize(writer io.Writer) error {
-	if err := binary.Write(writer, binary.BigEndian, bh.Offset); err != nil {
+	// NOTE: Truncation is okay and actually needed
+	if err := binary.Write(writer, binary.BigEndian, uint16(len(bh.StartKey))); err != nil {
 		return err
 	}
-	if err := binary.Write(writer, binary.BigEndian, bh.Size); err != nil {
+	if _, err := writer.Write(bh.StartKey); err != nil {
 		return err
 	}
 
-	// NOTE: Truncation is okay and actually needed
-	if err := binary.Write(writer, binary.BigEndian, uint16(len(bh.StartKey))); err != nil {
+	if err := binary.Write(writer, binary.BigEndian, bh.Offset); err != nil {
 		return err
 	}
-
-	_, err := writer.Write(bh.StartKey)
-	return err
+	return binary.Write(writer, binary.BigEndian, bh.Size)
 }
 
-func (bh BlockHandle) Deserialize(reader io.Reader) error {
-	if err := binary.Read(reader, binary.BigEndian, &bh.Offset); err != nil {
-		return err
-	}
-	if err := binary.Read(reader, binary.BigEndian, &bh.Size); err != nil {
+func (bh *BlockHandle) Deserialize(reader io.Reader) error {
+	key, err := readIndexKey(reader)
+	if err != nil {
 		return err
 	}
+	bh.StartKey = key
 
-	var keyLen uint16
-	if err := binary.Read(reader, binary.BigEndian, &keyLen); err != nil {
+	if err := binary.Read(reader, binary.BigEndian, &bh.Offset); err != nil {
 		return err
 	}
-
-	bh.StartKey = make([]byte, keyLen)
-	_, err := io.ReadFull(reader, bh.StartKey)
-	return err
+	return binary.Read(reader, binary.BigEndian, &bh.Size)
 }
 
 // NewBlockHandle creates a new BlockHandle
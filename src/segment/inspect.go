@@ -0,0 +1,188 @@
+package segment
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"bagh/comparator"
+	"bagh/file"
+	"bagh/value"
+	"bagh/version"
+	"bagh/vfs"
+)
+
+// Inspector reads the files of a segment folder directly, bypassing the
+// block cache and the descriptor table, for offline tools and verification
+type Inspector struct {
+	Metadata *Metadata
+	Index    *TopLevelIndex
+
+	blocks vfs.File
+}
+
+// RawBlock is a data block as stored in the blocks file
+type RawBlock struct {
+	Handle BlockHandle
+
+	// Size of the block before compression, Handle.Size is the size on disk
+	UncompressedSize uint32
+
+	Items []value.Value
+}
+
+// NewInspector opens a segment folder, reading its metadata and top-level
+// index, its keys have to be ordered by cmp (nil for bytewise)
+func NewInspector(fs vfs.FS, folder string, cmp comparator.Comparator) (*Inspector, error) {
+	fs = vfs.OrDefault(fs)
+
+	metadata, err := MetadataFromDisk(fs, filepath.Join(folder, file.SegmentMetadataFile))
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Version == version.VersionV0 {
+		return nil, fmt.Errorf("segment %s: version %d is not supported", folder, metadata.Version)
+	}
+	cmp = comparator.OrDefault(cmp)
+	if name := metadata.ComparatorName(); name != cmp.Name() {
+		return nil, fmt.Errorf("segment %s is ordered by comparator %q, not %q", metadata.ID, name, cmp.Name())
+	}
+	metadata.cmp = cmp
+
+	framed, err := vfs.ReadFile(fs, filepath.Join(folder, file.TopLevelIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := decompressBlock(framed)
+	if err != nil {
+		return nil, fmt.Errorf("segment %s: top-level index: %w", metadata.ID, err)
+	}
+	index, err := decodeTopLevelIndex(raw, cmp)
+	if err != nil {
+		return nil, fmt.Errorf("segment %s: top-level index: %w", metadata.ID, err)
+	}
+
+	blocks, err := fs.Open(filepath.Join(folder, file.BlocksFile))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Inspector{
+		Metadata: metadata,
+		Index:    index,
+		blocks:   blocks,
+	}, nil
+}
+
+// Close closes the blocks file
+func (i *Inspector) Close() error {
+	return i.blocks.Close()
+}
+
+// read reads a framed block of the blocks file, and decompresses it
+func (i *Inspector) read(offset uint64, size uint32) ([]byte, error) {
+	framed := make([]byte, size)
+	if _, err := i.blocks.ReadAt(framed, int64(offset)); err != nil {
+		return nil, err
+	}
+	return decompressBlock(framed)
+}
+
+// IndexPartition reads the block handles of an index partition
+func (i *Inspector) IndexPartition(entry *TopLevelEntry) ([]BlockHandle, error) {
+	raw, err := i.read(entry.Index.Offset, entry.Index.Size)
+	if err != nil {
+		return nil, fmt.Errorf("segment %s: index partition at %d: %w", i.Metadata.ID, entry.Index.Offset, err)
+	}
+	items, err := decodeIndexBlock(raw)
+	if err != nil {
+		return nil, fmt.Errorf("segment %s: index partition at %d: %w", i.Metadata.ID, entry.Index.Offset, err)
+	}
+	return items, nil
+}
+
+// BlockHandles returns the handles of all data blocks, in key order
+func (i *Inspector) BlockHandles() ([]BlockHandle, error) {
+	var handles []BlockHandle
+	for idx := range i.Index.Entries {
+		items, err := i.IndexPartition(&i.Index.Entries[idx])
+		if err != nil {
+			return nil, err
+		}
+		handles = append(handles, items...)
+	}
+	return handles, nil
+}
+
+// ReadBlock reads and decodes a data block, checking its checksum
+func (i *Inspector) ReadBlock(handle BlockHandle) (*RawBlock, error) {
+	raw, err := i.read(handle.Offset, handle.Size)
+	if err != nil {
+		return nil, fmt.Errorf("segment %s: block at %d: %w", i.Metadata.ID, handle.Offset, err)
+	}
+	data, err := DecodeDataBlock(raw)
+	if err != nil {
+		return nil, fmt.Errorf("segment %s: block at %d: %w", i.Metadata.ID, handle.Offset, err)
+	}
+	data.globalSeqNo = i.Metadata.GlobalSeqNo
+	data.cmp = i.Metadata.cmp
+
+	items, err := data.Items()
+	if err != nil {
+		return nil, fmt.Errorf("segment %s: block at %d: %w", i.Metadata.ID, handle.Offset, err)
+	}
+
+	return &RawBlock{
+		Handle:           handle,
+		UncompressedSize: uint32(len(raw)),
+		Items:            items,
+	}, nil
+}
+
+// Verify reads every index partition and data block, checking their
+// checksums, the order of the items and that they match the metadata
+func (i *Inspector) Verify() error {
+	m := i.Metadata
+	handles, err := i.BlockHandles()
+	if err != nil {
+		return err
+	}
+	if len(handles) != int(m.BlockCount) {
+		return fmt.Errorf("segment %s has %d blocks, metadata says %d", m.ID, len(handles), m.BlockCount)
+	}
+
+	var itemCount uint64
+	var prev *value.Value
+	for _, handle := range handles {
+		block, err := i.ReadBlock(handle)
+		if err != nil {
+			return err
+		}
+		if len(block.Items) == 0 {
+			return fmt.Errorf("segment %s: block at %d is empty", m.ID, handle.Offset)
+		}
+		// The index key separates the block from the previous one
+		if m.Compare(handle.StartKey, block.Items[0].Key) > 0 || (prev != nil && m.Compare(prev.Key, handle.StartKey) >= 0) {
+			return fmt.Errorf("segment %s: block at %d starts with %q, index says %q", m.ID, handle.Offset, block.Items[0].Key, handle.StartKey)
+		}
+
+		for idx := range block.Items {
+			item := &block.Items[idx]
+			if prev != nil && !prev.LessBy(m.cmp, *item) {
+				return fmt.Errorf("segment %s is not sorted: %q@%d after %q@%d", m.ID, item.Key, item.SeqNo, prev.Key, prev.SeqNo)
+			}
+			if !m.KeyRangeContains(item.Key) {
+				return fmt.Errorf("segment %s: key %q is outside of its key range", m.ID, item.Key)
+			}
+			if m.GlobalSeqNo == 0 && (item.SeqNo < m.Seqnos[0] || item.SeqNo > m.Seqnos[1]) {
+				return fmt.Errorf("segment %s: seqno %d of %q is outside of its seqno range", m.ID, item.SeqNo, item.Key)
+			}
+			prev = item
+			itemCount++
+		}
+	}
+
+	if itemCount != m.ItemCount {
+		return fmt.Errorf("segment %s has %d items, metadata says %d", m.ID, itemCount, m.ItemCount)
+	}
+	return nil
+}
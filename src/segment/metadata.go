@@ -1,15 +1,16 @@
 package segment
 
 import (
+	"bagh/comparator"
 	"bagh/file"
 	"bagh/value"
 	"bagh/version"
+	"bagh/vfs"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
-	"runtime"
 	"time"
 )
 
@@ -38,12 +39,25 @@ type Metadata struct {
 	KeyRange         [2]value.UserKey
 	Seqnos           [2]value.SeqNo
 	TombstoneCount   uint64
+
+	// Seqno assigned to every item of an ingested segment, 0 if not ingested
+	GlobalSeqNo value.SeqNo
+
+	// Output of the properties collectors the segment was written with
+	Properties Properties
+
+	// Name of the comparator ordering the keys, empty in segments written
+	// before comparators could be configured, which are bytewise
+	Comparator string
+
+	// The comparator itself, set when the segment is written or recovered
+	cmp comparator.Comparator
 }
 
 func MetadataFromWriter(id string, writer *Writer) (*Metadata, error) {
 	return &Metadata{
 		ID:               id,
-		Version:          version.VersionV0,
+		Version:          version.VersionV1,
 		Path:             writer.Opts.Path,
 		BlockCount:       uint32(writer.BlockCount),
 		BlockSize:        writer.Opts.BlockSize,
@@ -56,52 +70,59 @@ func MetadataFromWriter(id string, writer *Writer) (*Metadata, error) {
 		Seqnos:           [2]value.SeqNo{writer.LowestSeqNo, writer.HighestSeqNo},
 		TombstoneCount:   uint64(writer.TombstoneCount),
 		UncompressedSize: writer.UncompressedSize,
+		Properties:       collectProperties(writer.Collectors),
+		Comparator:       comparator.OrDefault(writer.Opts.Comparator).Name(),
+		cmp:              writer.Opts.Comparator,
 	}, nil
 }
 
+// Compare orders two keys by the comparator of the segment
+func (m *Metadata) Compare(a, b []byte) int {
+	return comparator.OrDefault(m.cmp).Compare(a, b)
+}
+
+// ComparatorName returns the name of the comparator the segment was written with
+func (m *Metadata) ComparatorName() string {
+	return comparator.NameOrDefault(m.Comparator)
+}
+
+// PrefixContiguous reports whether the keys with a common prefix are
+// adjacent in the segment, see comparator.IsBytewise
+func (m *Metadata) PrefixContiguous() bool {
+	return comparator.IsBytewise(m.cmp)
+}
+
 func (m *Metadata) KeyRangeContains(key []byte) bool {
-	return bytes.Compare(key, m.KeyRange[0]) >= 0 && bytes.Compare(key, m.KeyRange[1]) <= 0
+	return m.Compare(key, m.KeyRange[0]) >= 0 && m.Compare(key, m.KeyRange[1]) <= 0
 }
 
-func (m *Metadata) WriteToFile() error {
+func (m *Metadata) WriteToFile(fs vfs.FS) error {
 	data, err := json.MarshalIndent(m, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to serialize to JSON: %v", err)
 	}
 
 	file := filepath.Join(m.Path, file.SegmentMetadataFile)
-	err = os.WriteFile(file, data, 0644)
+	f, err := fs.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	// Sync the file
-	f, err := os.OpenFile(file, os.O_RDWR, 0644)
-	if err != nil {
+	if _, err := f.Write(data); err != nil {
 		return err
 	}
-	defer f.Close()
+	// Sync the file
 	if err := f.Sync(); err != nil {
 		return err
 	}
 
-	// Sync the directory on Unix-like systems
-	if runtime.GOOS != "windows" {
-		dir, err := os.Open(m.Path)
-		if err != nil {
-			return err
-		}
-		defer dir.Close()
-		if err := dir.Sync(); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	// Sync the directory
+	return fs.SyncDir(m.Path)
 }
 
-func MetadataFromDisk(path string) (*Metadata, error) {
-	data, err := os.ReadFile(path)
+func MetadataFromDisk(fs vfs.FS, path string) (*Metadata, error) {
+	data, err := vfs.ReadFile(fs, path)
 	if err != nil {
 		return nil, err
 	}
@@ -114,13 +135,15 @@ func MetadataFromDisk(path string) (*Metadata, error) {
 	return &metadata, nil
 }
 
+// CheckPrefixOverlap returns true if the segment may contain keys with the
+// prefix, which is only known for bytewise segments
 func (m *Metadata) CheckPrefixOverlap(prefix []byte) bool {
-	if len(prefix) == 0 {
+	if len(prefix) == 0 || !m.PrefixContiguous() {
 		return true
 	}
 
 	start, end := m.KeyRange[0], m.KeyRange[1]
-	return (bytes.Compare(start, prefix) <= 0 && bytes.Compare(prefix, end) <= 0) ||
+	return (m.Compare(start, prefix) <= 0 && m.Compare(prefix, end) <= 0) ||
 		bytes.HasPrefix(start, prefix) ||
 		bytes.HasPrefix(end, prefix)
 }
@@ -1,10 +1,11 @@
 package segment
 
 import (
-	"bytes"
 	"fmt"
 	"path/filepath"
 
+	"bagh/bloom"
+	"bagh/comparator"
 	"bagh/descriptor"
 	"bagh/file"
 	"bagh/value"
@@ -21,13 +22,26 @@ func (s *Segment) String() string {
 	return fmt.Sprintf("Segment:%s", s.Metadata.ID)
 }
 
+// RecoverSegment opens the segment in folder, its keys have to be ordered by
+// cmp (nil for bytewise)
+//
 // @p2: recover from snapshots, doesnt work rn
-func RecoverSegment(folder string, blockCache *BlockCache, descriptorTable *descriptor.FileDescriptorTable) (*Segment, error) {
-	metadata, err := MetadataFromDisk(filepath.Join(folder, file.SegmentMetadataFile))
+func RecoverSegment(folder string, blockCache *BlockCache, descriptorTable *descriptor.FileDescriptorTable, cmp comparator.Comparator) (*Segment, error) {
+	metadata, err := MetadataFromDisk(descriptorTable.FS(), filepath.Join(folder, file.SegmentMetadataFile))
 	if err != nil {
 		return nil, err
 	}
-	blockIndex := new(BlockIndex)
+	// The folder may have been moved or linked since the metadata was
+	// written, e.g. into a checkpoint
+	metadata.Path = folder
+
+	cmp = comparator.OrDefault(cmp)
+	if name := metadata.ComparatorName(); name != cmp.Name() {
+		return nil, fmt.Errorf("segment %s is ordered by comparator %q, not %q", metadata.ID, name, cmp.Name())
+	}
+	metadata.cmp = cmp
+
+	blockIndex := &BlockIndex{cmp: cmp}
 	if err := blockIndex.FromFile(metadata.ID, descriptorTable, folder, blockCache); err != nil {
 		return nil, err
 	}
@@ -40,7 +54,17 @@ func RecoverSegment(folder string, blockCache *BlockCache, descriptorTable *desc
 	}, nil
 }
 
+// ReadObserver is notified about the bloom filter checks of point reads
+type ReadObserver interface {
+	FilterChecked(negative bool)
+}
+
 func (s *Segment) Get(key []byte, seqno *value.SeqNo) (*value.Value, error) {
+	return s.GetObserved(key, seqno, nil)
+}
+
+// GetObserved is like Get, reporting filter checks to the observer (may be nil)
+func (s *Segment) GetObserved(key []byte, seqno *value.SeqNo, observer ReadObserver) (*value.Value, error) {
 	if seqno != nil {
 		if s.Metadata.Seqnos[0] >= *seqno {
 			return nil, nil
@@ -51,82 +75,131 @@ func (s *Segment) Get(key []byte, seqno *value.SeqNo) (*value.Value, error) {
 		return nil, nil
 	}
 
-	if seqno == nil {
-		// Fast path for non-seqno reads
-		blockHandle, err := s.BlockIndex.GetLatest(key)
-		if err != nil {
-			return nil, err
+	mayContain, err := s.BlockIndex.MayContain(key)
+	if err != nil {
+		return nil, err
+	}
+	if observer != nil {
+		observer.FilterChecked(!mayContain)
+	}
+	if !mayContain {
+		return nil, nil
+	}
+
+	// All versions of a key are stored in the same block
+	blockHandle, err := s.BlockIndex.GetLatest(key)
+	if err != nil {
+		return nil, err
+	}
+	if blockHandle == nil {
+		return nil, nil
+	}
+
+	valueBlock, err := LoadAndCacheByBlockHandle(s.DescriptorTable, s.BlockCache, s.Metadata, blockHandle)
+	if err != nil {
+		return nil, err
+	}
+	if valueBlock == nil {
+		return nil, nil
+	}
+	return valueBlock.Get(key, seqno)
+}
+
+// MultiGet is like GetObserved for keys sorted in ascending order, reading
+// each block only once
+//
+// The result has an entry for every key, nil if the segment has no
+// visible version of it.
+func (s *Segment) MultiGet(keys [][]byte, seqno *value.SeqNo, observer ReadObserver) ([]*value.Value, error) {
+	items := make([]*value.Value, len(keys))
+	if seqno != nil && s.Metadata.Seqnos[0] >= *seqno {
+		return items, nil
+	}
+
+	index, err := s.BlockIndex.topLevelIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sorted keys visit the partitions and blocks in order, so only the
+	// last ones are needed
+	var entry *TopLevelEntry
+	var filter *bloom.Filter
+	var partition *BlockHandleBlock
+	var block *ValueBlock
+	var blockOffset uint64
+
+	for i, key := range keys {
+		if !s.keyRangeContains(key) {
+			continue
 		}
-		if blockHandle == nil {
-			return nil, nil
+
+		next, found := index.GetEntryContainingItem(key)
+		if !found {
+			continue
 		}
-		// returns valueblock
-		valueBlock, err := LoadAndCacheByBlockHandle(s.DescriptorTable, s.BlockCache, s.Metadata.ID, blockHandle)
-		if err != nil {
-			return nil, err
+		if next != entry {
+			entry = next
+			if filter, err = s.BlockIndex.loadFilter(entry); err != nil {
+				return nil, err
+			}
+			if partition, err = s.BlockIndex.LoadAndCacheIndexBlock(entry.StartKey, &entry.Index); err != nil {
+				return nil, err
+			}
 		}
 
-		if valueBlock != nil {
-			for _, item := range valueBlock.Items {
-				if bytes.Equal(item.Key, key) {
-					return item.Clone().(*value.Value), nil
-				}
-			}
+		mayContain := filter == nil || filter.MayContain(bloom.HashKey(key))
+		if observer != nil {
+			observer.FilterChecked(!mayContain)
 		}
-		return nil, nil
-	} else {
-		// Path for seqno-based reads
-		blockHandle, err := s.BlockIndex.GetLatest(key)
-		if err != nil {
-			return nil, err
+		if !mayContain {
+			continue
 		}
-		if blockHandle != nil {
-			valueBlock, err := LoadAndCacheByBlockHandle(s.DescriptorTable, s.BlockCache, s.Metadata.ID, blockHandle)
-			if err != nil {
-				return nil, err
-			}
 
-			if valueBlock != nil {
-				for _, item := range valueBlock.Items {
-					if bytes.Equal(item.Key, key) && item.SeqNo < *seqno {
-						return item.Clone().(*value.Value), nil
-					}
-				}
-			}
+		blockHandle := partition.GetLowerBoundBlockInfo(key)
+		if blockHandle == nil {
+			continue
+		}
 
-			// If not found in the first block, check the next block
-			nextBlockHandle, err := s.BlockIndex.GetNextBlockKey(blockHandle.StartKey)
+		if block == nil || blockHandle.Offset != blockOffset {
+			block, err = LoadAndCacheByBlockHandle(s.DescriptorTable, s.BlockCache, s.Metadata, blockHandle)
 			if err != nil {
 				return nil, err
 			}
-			if nextBlockHandle == nil {
-				return nil, nil
+			if block == nil {
+				return nil, fmt.Errorf("segment %s is not in the descriptor table", s.Metadata.ID)
 			}
+			blockOffset = blockHandle.Offset
+		}
 
-			// Placeholder: Implement Reader
-			iter := NewReader(s.DescriptorTable, s.Metadata.ID, s.BlockCache, s.BlockIndex, nextBlockHandle.StartKey, nil)
-
-			for {
-				item, err := iter.Next()
-				if err != nil {
-					return nil, err
-				}
-				if item == nil {
-					break
-				}
-
-				if !bytes.Equal(item.Key, key) {
-					return nil, nil
-				}
-
-				if item.SeqNo < *seqno {
-					return item.Clone().(*value.Value), nil
-				}
-			}
+		if items[i], err = block.Get(key, seqno); err != nil {
+			return nil, err
 		}
 	}
+	return items, nil
+}
 
-	return nil, nil
+// SetPinned pins (or unpins) the index and filter blocks of the segment in the block cache
+func (s *Segment) SetPinned(pinned bool) error {
+	return s.BlockIndex.SetPinned(pinned)
+}
+
+// HoldFiles opens the files of the segment and keeps them open until
+// ReleaseFiles, so the segment stays readable after its files are deleted,
+// e.g. by the primary instance a secondary instance follows
+func (s *Segment) HoldFiles() error {
+	blocksPath := filepath.Join(s.Metadata.Path, file.BlocksFile)
+	if err := s.DescriptorTable.InsertPinned(blocksPath, s.Metadata.ID); err != nil {
+		return err
+	}
+	return s.BlockIndex.holdFiles()
+}
+
+// ReleaseFiles closes the open files of the segment, including the
+// descriptors of its blocks file
+func (s *Segment) ReleaseFiles() error {
+	s.DescriptorTable.Remove(s.Metadata.ID)
+	return s.BlockIndex.releaseFiles()
 }
 
 // @TODO: iterator??? returning reader???? tf
@@ -136,7 +209,7 @@ func (s *Segment) Iter(useCache bool) *Reader {
 		cache = s.BlockCache
 	}
 
-	return NewReader(s.DescriptorTable, s.Metadata.ID, cache, s.BlockIndex, nil, nil)
+	return NewReader(s.DescriptorTable, s.Metadata, cache, s.BlockIndex, nil, nil)
 }
 
 func (s *Segment) Range(start, end Bound[value.UserKey]) *Range {
@@ -148,17 +221,22 @@ func (s *Segment) Range(start, end Bound[value.UserKey]) *Range {
 	// 	Key:  *end,
 	// 	Type: Included,
 	// }
-	return NewRange(s.DescriptorTable, s.Metadata.ID, s.BlockCache, s.BlockIndex, start, end)
+	return NewRange(s.DescriptorTable, s.Metadata, s.BlockCache, s.BlockIndex, start, end)
 }
 
 func (s *Segment) Prefix(prefix []byte) *PrefixedReader {
-	return NewPrefixedReader(s.DescriptorTable, s.Metadata.ID, s.BlockCache, s.BlockIndex, prefix)
+	return NewPrefixedReader(s.DescriptorTable, s.Metadata, s.BlockCache, s.BlockIndex, prefix)
 }
 
 func (s *Segment) GetLSN() value.SeqNo {
 	return s.Metadata.Seqnos[1]
 }
 
+// Properties returns the custom statistics collected while writing the segment
+func (s *Segment) Properties() Properties {
+	return s.Metadata.Properties
+}
+
 func (s *Segment) TombstoneCount() uint64 {
 	return s.Metadata.TombstoneCount
 }
@@ -187,9 +265,9 @@ func (s *Segment) CheckKeyRangeOverlap(lo, hi Bound[value.UserKey]) bool {
 			panic("Invalid key range check")
 		}
 		if lo.Included != nil {
-			return bytes.Compare(*lo.Included, segmentHi) <= 0
+			return s.Metadata.Compare(*lo.Included, segmentHi) <= 0
 		}
-		return bytes.Compare(*lo.Excluded, segmentHi) < 0
+		return s.Metadata.Compare(*lo.Excluded, segmentHi) < 0
 	}
 
 	// If lower bound is unbounded
@@ -198,24 +276,24 @@ func (s *Segment) CheckKeyRangeOverlap(lo, hi Bound[value.UserKey]) bool {
 			panic("Invalid key range check")
 		}
 		if hi.Included != nil {
-			return bytes.Compare(*hi.Included, segmentLo) >= 0
+			return s.Metadata.Compare(*hi.Included, segmentLo) >= 0
 		}
-		return bytes.Compare(*hi.Excluded, segmentLo) > 0
+		return s.Metadata.Compare(*hi.Excluded, segmentLo) > 0
 	}
 
 	// Both bounds are bounded
 	loIncluded := false
 	if lo.Included != nil {
-		loIncluded = bytes.Compare(*lo.Included, segmentHi) <= 0
+		loIncluded = s.Metadata.Compare(*lo.Included, segmentHi) <= 0
 	} else {
-		loIncluded = bytes.Compare(*lo.Excluded, segmentHi) < 0
+		loIncluded = s.Metadata.Compare(*lo.Excluded, segmentHi) < 0
 	}
 
 	hiIncluded := false
 	if hi.Included != nil {
-		hiIncluded = bytes.Compare(*hi.Included, segmentLo) >= 0
+		hiIncluded = s.Metadata.Compare(*hi.Included, segmentLo) >= 0
 	} else {
-		hiIncluded = bytes.Compare(*hi.Excluded, segmentLo) > 0
+		hiIncluded = s.Metadata.Compare(*hi.Excluded, segmentLo) > 0
 	}
 
 	return loIncluded && hiIncluded
@@ -10,7 +10,7 @@ type PrefixedReader struct {
 	DescriptorTable *descriptor.FileDescriptorTable
 	BlockIndex      *BlockIndex
 	blockCache      *BlockCache
-	SegmentID       string
+	Metadata        *Metadata
 
 	Prefix value.UserKey
 
@@ -19,7 +19,7 @@ type PrefixedReader struct {
 
 func NewPrefixedReader(
 	DescriptorTable *descriptor.FileDescriptorTable,
-	SegmentID string,
+	Metadata *Metadata,
 	blockCache *BlockCache,
 	BlockIndex *BlockIndex,
 	Prefix value.UserKey,
@@ -28,7 +28,7 @@ func NewPrefixedReader(
 		blockCache:      blockCache,
 		BlockIndex:      BlockIndex,
 		DescriptorTable: DescriptorTable,
-		SegmentID:       SegmentID,
+		Metadata:        Metadata,
 		iterator:        nil,
 		Prefix:          Prefix,
 	}
@@ -36,6 +36,19 @@ func NewPrefixedReader(
 
 // @TODO: optimize lol
 func (pr *PrefixedReader) Initialize() error {
+	if !pr.Metadata.PrefixContiguous() {
+		// Keys with the prefix may be anywhere in the segment
+		pr.iterator = NewRange(
+			pr.DescriptorTable,
+			pr.Metadata,
+			pr.blockCache,
+			pr.BlockIndex,
+			Bound[value.UserKey]{Unbounded: true},
+			Bound[value.UserKey]{Unbounded: true},
+		)
+		return nil
+	}
+
 	upperB, err := pr.BlockIndex.GetPrefixUpperBound(pr.Prefix)
 	if err != nil {
 		return err
@@ -53,7 +66,7 @@ func (pr *PrefixedReader) Initialize() error {
 
 	iterator := NewRange(
 		pr.DescriptorTable,
-		pr.SegmentID,
+		pr.Metadata,
 		pr.blockCache,
 		pr.BlockIndex,
 		lowerBound,
@@ -80,12 +93,19 @@ func (pr *PrefixedReader) Next() (*value.Value, error) {
 			return nil, nil
 		}
 
-		if bytes.Compare(entry.Key, pr.Prefix) == -1 {
+		if !pr.Metadata.PrefixContiguous() {
+			if !bytes.HasPrefix(entry.Key, pr.Prefix) {
+				continue
+			}
+			return entry, nil
+		}
+
+		if pr.Metadata.Compare(entry.Key, pr.Prefix) < 0 {
 			continue
 		}
 
-		if bytes.Compare(entry.Key, pr.Prefix) == 0 {
-			// @TODO: reached max keys what to do??? is this even correct?
+		// Keys with the prefix are contiguous, the first one without ends the scan
+		if !bytes.HasPrefix(entry.Key, pr.Prefix) {
 			return nil, nil
 		}
 
@@ -109,11 +129,11 @@ func (pr *PrefixedReader) NextBack() (*value.Value, error) {
 			return nil, nil
 		}
 
-		if bytes.Compare(entry.Key, pr.Prefix) == -1 {
+		if pr.Metadata.PrefixContiguous() && pr.Metadata.Compare(entry.Key, pr.Prefix) < 0 {
 			return nil, nil
 		}
 
-		if bytes.Compare(entry.Key, pr.Prefix) == 0 {
+		if !bytes.HasPrefix(entry.Key, pr.Prefix) {
 			continue
 		}
 
@@ -0,0 +1,47 @@
+package segment
+
+import "bagh/value"
+
+// Properties are user-defined statistics of a segment, persisted in its metadata
+//
+// Keys are namespaced by the name of the collector that produced them,
+// e.g. "timestamp.min".
+type Properties map[string]string
+
+// PropertiesCollector gathers custom statistics while a segment is written
+//
+// Add is called for every item written to the segment, in key order.
+// Finish is called once the segment is complete, its result is stored
+// with the segment's metadata.
+type PropertiesCollector interface {
+	Name() string
+	Add(item *value.Value)
+	Finish() Properties
+}
+
+// PropertiesCollectorFactory creates a fresh collector for every new segment
+type PropertiesCollectorFactory func() PropertiesCollector
+
+// SegmentFilter reports if a segment may contain items relevant to a
+// scan or compaction, segments it rejects are skipped
+type SegmentFilter func(s *Segment) bool
+
+// Get returns the property key of a collector
+func (p Properties) Get(collector, key string) (string, bool) {
+	v, ok := p[collector+"."+key]
+	return v, ok
+}
+
+func collectProperties(collectors []PropertiesCollector) Properties {
+	if len(collectors) == 0 {
+		return nil
+	}
+
+	properties := make(Properties)
+	for _, collector := range collectors {
+		for key, v := range collector.Finish() {
+			properties[collector.Name()+"."+key] = v
+		}
+	}
+	return properties
+}
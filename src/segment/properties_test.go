@@ -0,0 +1,72 @@
+package segment_test
+
+import (
+	"bagh/file"
+	"bagh/segment"
+	"bagh/value"
+	"bagh/vfs"
+	"encoding/binary"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// timestampCollector tracks the range of a timestamp prefixed to every key
+type timestampCollector struct {
+	min, max uint64
+}
+
+func (c *timestampCollector) Name() string { return "timestamp" }
+
+func (c *timestampCollector) Add(item *value.Value) {
+	ts := binary.BigEndian.Uint64(item.Key[:8])
+	if c.min == 0 || ts < c.min {
+		c.min = ts
+	}
+	if ts > c.max {
+		c.max = ts
+	}
+}
+
+func (c *timestampCollector) Finish() segment.Properties {
+	return segment.Properties{
+		"min": strconv.FormatUint(c.min, 10),
+		"max": strconv.FormatUint(c.max, 10),
+	}
+}
+
+func TestPropertiesCollector(t *testing.T) {
+	folder := filepath.Join(t.TempDir(), "segment")
+
+	writer, err := segment.NewWriter(segment.Options{
+		Path:      folder,
+		BlockSize: 4096,
+		Collectors: []segment.PropertiesCollectorFactory{
+			func() segment.PropertiesCollector { return &timestampCollector{} },
+		},
+	})
+	assert.NoError(t, err)
+
+	for ts := uint64(100); ts < 200; ts++ {
+		key := binary.BigEndian.AppendUint64(nil, ts)
+		assert.NoError(t, writer.Write(*value.NewValue(key, []byte("v"), value.SeqNo(ts), value.Record)))
+	}
+	assert.NoError(t, writer.Finish())
+
+	metadata, err := segment.MetadataFromWriter("segment", writer)
+	assert.NoError(t, err)
+	assert.NoError(t, metadata.WriteToFile(vfs.Default))
+
+	recovered, err := segment.MetadataFromDisk(vfs.Default, filepath.Join(folder, file.SegmentMetadataFile))
+	assert.NoError(t, err)
+
+	min, ok := recovered.Properties.Get("timestamp", "min")
+	assert.True(t, ok)
+	assert.Equal(t, "100", min)
+
+	max, ok := recovered.Properties.Get("timestamp", "max")
+	assert.True(t, ok)
+	assert.Equal(t, "199", max)
+}
@@ -3,7 +3,6 @@ package segment
 import (
 	"bagh/descriptor"
 	"bagh/value"
-	"bytes"
 )
 
 // type Bound int
@@ -28,7 +27,7 @@ type Range struct {
 	DescriptorTable *descriptor.FileDescriptorTable
 	BlockIndex      *BlockIndex
 	BlockCache      *BlockCache
-	SegmentID       string
+	Metadata        *Metadata
 
 	Start Bound[value.UserKey]
 	End   Bound[value.UserKey]
@@ -38,7 +37,7 @@ type Range struct {
 
 func NewRange(
 	DescriptorTable *descriptor.FileDescriptorTable,
-	SegmentID string,
+	Metadata *Metadata,
 	BlockCache *BlockCache,
 	BlockIndex *BlockIndex,
 	start Bound[value.UserKey],
@@ -48,7 +47,7 @@ func NewRange(
 		DescriptorTable: DescriptorTable,
 		BlockCache:      BlockCache,
 		BlockIndex:      BlockIndex,
-		SegmentID:       SegmentID,
+		Metadata:        Metadata,
 		Start:           start,
 		End:             end,
 		Iterator:        nil,
@@ -97,7 +96,7 @@ func (r *Range) initialize() error {
 
 	reader := NewReader(
 		r.DescriptorTable,
-		r.SegmentID,
+		r.Metadata,
 		r.BlockCache,
 		r.BlockIndex,
 		offsetLo,
@@ -126,12 +125,12 @@ func (r *Range) Next() (*value.Value, error) {
 
 		if !r.Start.Unbounded {
 			if r.Start.Included != nil {
-				if bytes.Compare(entry.Key, *r.Start.Included) < 0 {
+				if r.Metadata.Compare(entry.Key, *r.Start.Included) < 0 {
 					// Before min key
 					continue
 				}
 			} else if r.Start.Excluded != nil {
-				if bytes.Compare(entry.Key, *r.Start.Excluded) <= 0 {
+				if r.Metadata.Compare(entry.Key, *r.Start.Excluded) <= 0 {
 					// Before or equal min key
 					continue
 				}
@@ -140,12 +139,12 @@ func (r *Range) Next() (*value.Value, error) {
 
 		if !r.End.Unbounded {
 			if r.End.Included != nil {
-				if bytes.Compare(entry.Key, *r.Start.Included) > 0 {
+				if r.Metadata.Compare(entry.Key, *r.End.Included) > 0 {
 					// After max key
 					return nil, nil
 				}
 			} else if r.End.Excluded != nil {
-				if bytes.Compare(entry.Key, *r.Start.Excluded) >= 0 {
+				if r.Metadata.Compare(entry.Key, *r.End.Excluded) >= 0 {
 					// Reached max key
 					return nil, nil
 				}
@@ -174,12 +173,12 @@ func (r *Range) NextBack() (*value.Value, error) {
 
 		if !r.Start.Unbounded {
 			if r.Start.Included != nil {
-				if bytes.Compare(entry.Key, *r.Start.Included) < 0 {
+				if r.Metadata.Compare(entry.Key, *r.Start.Included) < 0 {
 					// Reached min key
 					return nil, nil
 				}
 			} else if r.Start.Excluded != nil {
-				if bytes.Compare(entry.Key, *r.Start.Excluded) <= 0 {
+				if r.Metadata.Compare(entry.Key, *r.Start.Excluded) <= 0 {
 					// Before min key
 					return nil, nil
 				}
@@ -188,12 +187,12 @@ func (r *Range) NextBack() (*value.Value, error) {
 
 		if !r.End.Unbounded {
 			if r.End.Included != nil {
-				if bytes.Compare(entry.Key, *r.Start.Included) > 0 {
+				if r.Metadata.Compare(entry.Key, *r.End.Included) > 0 {
 					// After max key
 					continue
 				}
 			} else if r.End.Excluded != nil {
-				if bytes.Compare(entry.Key, *r.Start.Excluded) >= 0 {
+				if r.Metadata.Compare(entry.Key, *r.End.Excluded) >= 0 {
 					// After or equal max key
 					continue
 				}
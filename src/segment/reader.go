@@ -14,6 +14,7 @@ type Reader struct {
 	BlockIndex      *BlockIndex
 
 	SegmentID  string
+	Metadata   *Metadata
 	BlockCache *BlockCache
 
 	Blocks    map[string]*list.List
@@ -28,7 +29,7 @@ type Reader struct {
 // NewReader creates a new Reader
 func NewReader(
 	descriptorTable *descriptor.FileDescriptorTable,
-	segmentID string,
+	metadata *Metadata,
 	blockCache *BlockCache,
 	blockIndex *BlockIndex,
 	startOffset value.UserKey,
@@ -36,7 +37,8 @@ func NewReader(
 ) *Reader {
 	return &Reader{
 		DescriptorTable: descriptorTable,
-		SegmentID:       segmentID,
+		SegmentID:       metadata.ID,
+		Metadata:        metadata,
 		BlockCache:      blockCache,
 		BlockIndex:      blockIndex,
 		Blocks:          make(map[string]*list.List),
@@ -74,19 +76,14 @@ func (r *Reader) loadBlock(key value.UserKey) error {
 			r.DescriptorTable,
 			r.BlockIndex,
 			r.BlockCache,
-			r.SegmentID,
+			r.Metadata,
 			key,
 		)
 		if err != nil {
 			return err
 		}
 		if block != nil {
-			items := list.New()
-			for _, item := range block.Items {
-				items.PushBack(item)
-			}
-			r.Blocks[string(key)] = items
-			return nil
+			return r.pushBlock(key, block)
 		}
 	} else {
 		blockHandle, err := r.BlockIndex.GetLowerBoundBlockInfo(key)
@@ -101,28 +98,33 @@ func (r *Reader) loadBlock(key value.UserKey) error {
 			if fileGuard == nil {
 				return fmt.Errorf("failed to acquire file handle")
 			}
-			// @TODO: this works??
-			block := new(ValueBlock)
-			err = block.FromFileCompressed(
-				fileGuard.File(),
-				int64(blockHandle.Offset),
-				blockHandle.Size,
-			)
+			defer fileGuard.Release()
+
+			block, err := ReadValueBlock(fileGuard.File(), r.Metadata, blockHandle)
 			if err != nil {
 				return err
 			}
-
-			items := list.New()
-			for _, item := range block.Items {
-				items.PushBack(item)
-			}
-			r.Blocks[string(key)] = items
-			return nil
+			return r.pushBlock(key, block)
 		}
 	}
 	return nil
 }
 
+// pushBlock queues the items of a loaded block under its start key
+func (r *Reader) pushBlock(key value.UserKey, block *ValueBlock) error {
+	values, err := block.Values()
+	if err != nil {
+		return err
+	}
+
+	items := list.New()
+	for i := range values {
+		items.PushBack(&values[i])
+	}
+	r.Blocks[string(key)] = items
+	return nil
+}
+
 // Next returns the next item
 func (r *Reader) Next() (*value.Value, error) {
 	if !r.IsInitialized {
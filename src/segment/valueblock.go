@@ -1,16 +1,48 @@
 package segment
 
 import (
+	"io"
 	"unsafe"
 
+	"bagh/comparator"
 	"bagh/descriptor"
 	"bagh/disk"
 	"bagh/value"
+	"bagh/version"
 )
 
 // ValueBlock is a type alias for DiskBlock<Value>
 type ValueBlock struct {
 	disk.DiskBlock[value.Value]
+
+	// Data is set for prefix-compressed blocks (segment version V1)
+	Data *DataBlock
+
+	// Order of the keys, nil orders them bytewise
+	cmp comparator.Comparator
+}
+
+// Values returns the items of the block, decoding them if needed
+func (vb *ValueBlock) Values() ([]value.Value, error) {
+	if vb.Data != nil {
+		return vb.Data.Items()
+	}
+	return vb.Items, nil
+}
+
+// Get returns the newest version of key in the block, visible at seqno if given
+func (vb *ValueBlock) Get(key []byte, seqno *value.SeqNo) (*value.Value, error) {
+	if vb.Data != nil {
+		return vb.Data.Get(key, seqno)
+	}
+
+	order := comparator.OrDefault(vb.cmp)
+	for _, item := range vb.Items {
+		if order.Compare(item.Key, key) == 0 && (seqno == nil || item.SeqNo < *seqno) {
+			return item.Clone().(*value.Value), nil
+		}
+	}
+	return nil, nil
 }
 
 // @TODO: this might be wrong
@@ -22,35 +54,66 @@ func (vb *ValueBlock) Size() int {
 	return size
 }
 
+// ReadValueBlock reads a block in the layout of the segment's version
+func ReadValueBlock(file io.ReadSeeker, metadata *Metadata, blockHandle *BlockHandle) (*ValueBlock, error) {
+	block := &ValueBlock{cmp: metadata.cmp}
+
+	if metadata.Version == version.VersionV0 {
+		// @TODO: file? is it same as io.readseeker?
+		if err := block.FromFileCompressed(file, int64(blockHandle.Offset), blockHandle.Size); err != nil {
+			return nil, err
+		}
+		return block, nil
+	}
+
+	if _, err := file.Seek(int64(blockHandle.Offset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	framed := make([]byte, blockHandle.Size)
+	if _, err := io.ReadFull(file, framed); err != nil {
+		return nil, err
+	}
+	raw, err := decompressBlock(framed)
+	if err != nil {
+		return nil, err
+	}
+	data, err := DecodeDataBlock(raw)
+	if err != nil {
+		return nil, err
+	}
+	data.globalSeqNo = metadata.GlobalSeqNo
+	data.cmp = metadata.cmp
+	block.Data = data
+
+	return block, nil
+}
+
 func LoadAndCacheByBlockHandle(
 	descriptorTable *descriptor.FileDescriptorTable,
 	blockCache *BlockCache,
-	segmentID string,
+	metadata *Metadata,
 	blockHandle *BlockHandle,
 ) (*ValueBlock, error) {
-	if block := blockCache.GetDiskBlock(segmentID, blockHandle.StartKey); block != nil {
+	if block := blockCache.GetDiskBlock(metadata.ID, blockHandle.StartKey); block != nil {
 		// Cache hit: Copy from block
 		return block, nil
 	}
 
 	// Cache miss: load from disk
-	fileGuard, err := descriptorTable.Access(segmentID)
+	fileGuard, err := descriptorTable.Access(metadata.ID)
 	if err != nil {
 		return nil, err
 	}
 	if fileGuard == nil {
 		return nil, err
 	}
+	defer fileGuard.Release()
 
-	file := fileGuard.File()
-	// might not work? @TODO:
-	block := new(ValueBlock)
-	// @TODO: file? is it same as io.readseeker?
-	err = block.FromFileCompressed(file, int64(blockHandle.Offset), blockHandle.Size)
+	block, err := ReadValueBlock(fileGuard.File(), metadata, blockHandle)
 	if err != nil {
 		return nil, err
 	}
-	blockCache.InsertDiskBlock(segmentID, blockHandle.StartKey, block)
+	blockCache.InsertDiskBlock(metadata.ID, blockHandle.StartKey, block)
 
 	return block, nil
 }
@@ -59,7 +122,7 @@ func LoadAndCacheBlockByItemKey(
 	descriptorTable *descriptor.FileDescriptorTable,
 	blockIndex *BlockIndex,
 	blockCache *BlockCache,
-	segmentID string,
+	metadata *Metadata,
 	itemKey []byte,
 ) (*ValueBlock, error) {
 	blockHandle, err := blockIndex.GetLowerBoundBlockInfo(itemKey)
@@ -70,7 +133,7 @@ func LoadAndCacheBlockByItemKey(
 		return nil, nil
 	}
 
-	return LoadAndCacheByBlockHandle(descriptorTable, blockCache, segmentID, blockHandle)
+	return LoadAndCacheByBlockHandle(descriptorTable, blockCache, metadata, blockHandle)
 }
 
 // // Helper functions (to be implemented)
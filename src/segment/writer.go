@@ -1,16 +1,14 @@
 package segment
 
 import (
+	"bagh/comparator"
 	"bagh/file"
 	"bagh/id"
 	"bagh/value"
+	"bagh/vfs"
 	"bufio"
-	"bytes"
 	"fmt"
-	"os"
 	"path/filepath"
-
-	"github.com/pierrec/lz4/v4"
 )
 
 type MultiWriter struct {
@@ -26,7 +24,7 @@ type Writer struct {
 	BlockWriter      *bufio.Writer // writes os.file
 	IndexWriter      IndexWriter
 	Chunk            ValueBlock
-	BlockFile        *os.File
+	BlockFile        vfs.File
 	BlockCount       int
 	ItemCount        int
 	FilePos          uint64
@@ -39,12 +37,34 @@ type Writer struct {
 	HighestSeqNo     value.SeqNo
 	KeyCount         int
 	CurrentKey       value.UserKey
+	Collectors       []PropertiesCollector
+
+	// Last key of the previously written block
+	lastBlockKey value.UserKey
 }
 
 type Options struct {
 	Path            string
 	EvictTombstones bool
 	BlockSize       uint32
+
+	// Amount of items between two restart points in a data block,
+	// defaults to DefaultRestartInterval
+	RestartInterval int
+
+	// Called for every written item, see PropertiesCollector
+	Collectors []PropertiesCollectorFactory
+
+	// Bits of bloom filter per key, 0 disables bloom filters. Filters hash
+	// the bytes of keys, so they are only written for bytewise comparators.
+	BloomBitsPerKey int
+
+	// Filesystem the segment is written to, defaults to vfs.Default
+	FS vfs.FS
+
+	// Order of the written keys, recorded in the metadata, defaults to
+	// comparator.Bytewise
+	Comparator comparator.Comparator
 }
 
 func NewMultiWriter(targetSize uint64, opts Options) (*MultiWriter, error) {
@@ -54,6 +74,11 @@ func NewMultiWriter(targetSize uint64, opts Options) (*MultiWriter, error) {
 		Path:            filepath.Join(opts.Path, segmentID),
 		EvictTombstones: opts.EvictTombstones,
 		BlockSize:       opts.BlockSize,
+		RestartInterval: opts.RestartInterval,
+		Collectors:      opts.Collectors,
+		BloomBitsPerKey: opts.BloomBitsPerKey,
+		FS:              opts.FS,
+		Comparator:      opts.Comparator,
 	})
 	if err != nil {
 		return nil, err
@@ -80,6 +105,11 @@ func (mw *MultiWriter) Rotate() error {
 		Path:            filepath.Join(mw.Opts.Path, newSegmentID),
 		EvictTombstones: mw.Opts.EvictTombstones,
 		BlockSize:       mw.Opts.BlockSize,
+		RestartInterval: mw.Opts.RestartInterval,
+		Collectors:      mw.Opts.Collectors,
+		BloomBitsPerKey: mw.Opts.BloomBitsPerKey,
+		FS:              mw.Opts.FS,
+		Comparator:      mw.Opts.Comparator,
 	})
 	if err != nil {
 		return err
@@ -102,17 +132,14 @@ func (mw *MultiWriter) Rotate() error {
 }
 
 func (mw *MultiWriter) Write(item value.Value) error {
-	if err := mw.Writer.Write(item); err != nil {
-		return err
-	}
-
-	if mw.Writer.FilePos >= mw.TargetSize {
+	// Versions of a key are never split across segments
+	if mw.Writer.FilePos >= mw.TargetSize && comparator.OrDefault(mw.Opts.Comparator).Compare(item.Key, mw.Writer.CurrentKey) != 0 {
 		if err := mw.Rotate(); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return mw.Writer.Write(item)
 }
 
 func (mw *MultiWriter) Finish() ([]Metadata, error) {
@@ -132,18 +159,23 @@ func (mw *MultiWriter) Finish() ([]Metadata, error) {
 }
 
 func NewWriter(opts Options) (*Writer, error) {
-	if err := os.MkdirAll(opts.Path, 0755); err != nil {
+	opts.FS = vfs.OrDefault(opts.FS)
+	if err := file.MkdirAllSynced(opts.FS, opts.Path); err != nil {
 		return nil, err
 	}
 
-	blockFile, err := os.Create(filepath.Join(opts.Path, file.BlocksFile))
+	blockFile, err := opts.FS.Create(filepath.Join(opts.Path, file.BlocksFile))
 	if err != nil {
 		return nil, err
 	}
 
 	blockWriter := bufio.NewWriterSize(blockFile, 512000)
 
-	indexWriter, err := NewIndexWriter(opts.Path, opts.BlockSize)
+	bitsPerKey := opts.BloomBitsPerKey
+	if !comparator.IsBytewise(opts.Comparator) {
+		bitsPerKey = 0
+	}
+	indexWriter, err := NewIndexWriter(opts.FS, opts.Path, opts.BlockSize, bitsPerKey)
 	if err != nil {
 		return nil, err
 	}
@@ -151,6 +183,11 @@ func NewWriter(opts Options) (*Writer, error) {
 	chunk.Items = make([]value.Value, 0, 1000)
 	chunk.CRC = 0
 
+	collectors := make([]PropertiesCollector, 0, len(opts.Collectors))
+	for _, newCollector := range opts.Collectors {
+		collectors = append(collectors, newCollector())
+	}
+
 	return &Writer{
 		Opts:         opts,
 		BlockWriter:  blockWriter,
@@ -159,6 +196,7 @@ func NewWriter(opts Options) (*Writer, error) {
 		BlockFile:    blockFile,
 		LowestSeqNo:  value.SeqNo(^uint64(0)), // MAX value
 		HighestSeqNo: 0,
+		Collectors:   collectors,
 	}, nil
 }
 
@@ -174,21 +212,12 @@ func (w *Writer) WriteBlock() error {
 
 	w.UncompressedSize += uncompressedChunkSize
 
-	// Serialize block
-	// @TODO: do these even work?
-	buf := new(bytes.Buffer)
-	err := w.Chunk.Serialize(buf)
-	if err != nil {
-		return err
-	}
-
-	// Compress using LZ4
-	compressor := new(lz4.Compressor)
-	compressedBytes := make([]byte, 0)
-	bytesWritten, err := compressor.CompressBlock(buf.Bytes(), compressedBytes)
+	// Serialize block, prefix-compressing keys between restart points
+	compressedBytes, err := compressBlock(EncodeDataBlock(w.Chunk.Items, w.Opts.RestartInterval))
 	if err != nil {
 		return err
 	}
+	bytesWritten := len(compressedBytes)
 
 	// Write to file
 	if _, err := w.BlockWriter.Write(compressedBytes); err != nil {
@@ -196,9 +225,10 @@ func (w *Writer) WriteBlock() error {
 	}
 
 	firstItem := w.Chunk.Items[0]
-	if err := w.IndexWriter.RegisterBlock(firstItem.Key, w.FilePos, uint32(bytesWritten)); err != nil {
+	if err := w.IndexWriter.RegisterBlock(w.indexKey(firstItem.Key), w.FilePos, uint32(bytesWritten)); err != nil {
 		return err
 	}
+	w.lastBlockKey = w.Chunk.Items[len(w.Chunk.Items)-1].Key
 
 	// Adjust metadata
 	w.FilePos += uint64(bytesWritten)
@@ -209,6 +239,23 @@ func (w *Writer) WriteBlock() error {
 	return nil
 }
 
+// indexKey returns the key a block is indexed by, which only has to separate
+// it from the previous block: a short key in between, if the comparator can
+// find one, or the first key of the block
+func (w *Writer) indexKey(first value.UserKey) value.UserKey {
+	cmp := comparator.OrDefault(w.Opts.Comparator)
+	shortener, ok := cmp.(comparator.Shortener)
+	if !ok || w.BlockCount == 0 {
+		return first
+	}
+
+	separator := shortener.FindShortestSeparator(w.lastBlockKey, first)
+	if len(separator) >= len(first) || cmp.Compare(w.lastBlockKey, separator) >= 0 {
+		return first
+	}
+	return separator
+}
+
 func (w *Writer) Write(item value.Value) error {
 	if item.IsTombstone() {
 		if w.Opts.EvictTombstones {
@@ -217,25 +264,34 @@ func (w *Writer) Write(item value.Value) error {
 		w.TombstoneCount++
 	}
 
-	if !bytes.Equal(item.Key, w.CurrentKey) {
+	newKey := comparator.OrDefault(w.Opts.Comparator).Compare(item.Key, w.CurrentKey) != 0
+
+	// Versions of a key are never split across blocks,
+	// so point reads only need to look at a single block
+	if newKey && w.ChunkSize >= int(w.Opts.BlockSize) {
+		if err := w.WriteBlock(); err != nil {
+			return err
+		}
+		w.ChunkSize = 0
+	}
+
+	if newKey {
 		w.KeyCount++
 		w.CurrentKey = item.Key
+		w.IndexWriter.AddKey(item.Key)
 	}
 
 	itemKey := make([]byte, len(item.Key))
 	copy(itemKey, item.Key)
 	seqno := item.SeqNo
 
+	for _, collector := range w.Collectors {
+		collector.Add(&item)
+	}
+
 	w.ChunkSize += item.Size()
 	w.Chunk.Items = append(w.Chunk.Items, item)
 
-	if w.ChunkSize >= int(w.Opts.BlockSize) {
-		if err := w.WriteBlock(); err != nil {
-			return err
-		}
-		w.ChunkSize = 0
-	}
-
 	if w.FirstKey == nil {
 		w.FirstKey = itemKey
 	}
@@ -260,7 +316,9 @@ func (w *Writer) Finish() error {
 	}
 
 	if w.ItemCount == 0 {
-		if err := os.RemoveAll(w.Opts.Path); err != nil {
+		w.IndexWriter.Abort()
+		w.BlockFile.Close()
+		if err := w.Opts.FS.RemoveAll(w.Opts.Path); err != nil {
 			return err
 		}
 		return nil
@@ -280,5 +338,5 @@ func (w *Writer) Finish() error {
 		return err
 	}
 
-	return nil
+	return w.BlockFile.Close()
 }
@@ -0,0 +1,296 @@
+package stall
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrWriteStalled is returned to writes that asked not to be slowed down
+// while the controller delays or stops writes
+var ErrWriteStalled = errors.New("write stalled")
+
+// State of the write controller
+type State uint8
+
+const (
+	// Writes are not limited
+	Normal State = iota
+	// Writes are slowed down in proportion to the debt
+	Delayed
+	// Writes wait until the tree has caught up
+	Stopped
+)
+
+func (s State) String() string {
+	switch s {
+	case Normal:
+		return "normal"
+	case Delayed:
+		return "delayed"
+	case Stopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("State(%d)", uint8(s))
+}
+
+// Reason names the limit that caused a stall
+type Reason string
+
+const (
+	ReasonNone                   Reason = ""
+	ReasonL0Segments             Reason = "l0_segments"
+	ReasonSealedMemtables        Reason = "sealed_memtables"
+	ReasonPendingCompactionBytes Reason = "pending_compaction_bytes"
+)
+
+// Pressure is a snapshot of the tree's write debt
+type Pressure struct {
+	L0Segments             int
+	SealedMemtables        int
+	PendingCompactionBytes uint64
+}
+
+// Options configures the limits of the write controller, a zero limit disables it
+type Options struct {
+	// Writes are delayed once L0 has this many segments
+	L0SlowdownTrigger int
+
+	// Writes are stopped once L0 has this many segments
+	L0StopTrigger int
+
+	// Writes are stopped once this many memtables wait to be flushed,
+	// and delayed one memtable before that
+	MaxSealedMemtables int
+
+	// Writes are delayed, and stopped, once the estimated bytes that need
+	// to be compacted pass these limits
+	SoftPendingCompactionBytes uint64
+	HardPendingCompactionBytes uint64
+
+	// Delay of a single write at the highest debt before stopping
+	MaxDelay time.Duration
+
+	// Called whenever the controller changes its state
+	OnEvent func(Event)
+}
+
+// DefaultOptions returns the default limits
+func DefaultOptions() Options {
+	return Options{
+		L0SlowdownTrigger:          16,
+		L0StopTrigger:              20,
+		MaxSealedMemtables:         4,
+		SoftPendingCompactionBytes: 64 * 1024 * 1024 * 1024,
+		HardPendingCompactionBytes: 256 * 1024 * 1024 * 1024,
+		MaxDelay:                   time.Millisecond,
+	}
+}
+
+// Event is emitted when a stall starts, changes, or ends
+type Event struct {
+	State    State
+	Previous State
+	Reason   Reason
+
+	// How long the previous state lasted
+	Duration time.Duration
+}
+
+// Counters are cumulative statistics of the write controller
+type Counters struct {
+	// Amount of stalls (delayed or stopped periods) so far
+	Stalls uint64
+
+	DelayedWrites  uint64
+	StoppedWrites  uint64
+	RejectedWrites uint64
+
+	// Total time writes spent sleeping or waiting
+	DelayTime time.Duration
+	StopTime  time.Duration
+}
+
+// Controller throttles writes while flushes and compactions fall behind
+type Controller struct {
+	opts  Options
+	probe func() Pressure
+
+	mutex    sync.Mutex
+	state    State
+	reason   Reason
+	since    time.Time
+	changed  chan struct{}
+	counters Counters
+}
+
+// NewController creates a write controller, probe returns the current
+// write debt of the tree and must not call back into the controller
+func NewController(opts Options, probe func() Pressure) *Controller {
+	return &Controller{
+		opts:    opts,
+		probe:   probe,
+		since:   time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// Evaluate returns the state the given pressure should put writes in,
+// the limit responsible for it, and the debt in (0, 1] when delayed
+func (o *Options) Evaluate(p Pressure) (State, Reason, float64) {
+	if o.L0StopTrigger > 0 && p.L0Segments >= o.L0StopTrigger {
+		return Stopped, ReasonL0Segments, 1
+	}
+	if o.MaxSealedMemtables > 0 && p.SealedMemtables >= o.MaxSealedMemtables {
+		return Stopped, ReasonSealedMemtables, 1
+	}
+	if o.HardPendingCompactionBytes > 0 && p.PendingCompactionBytes >= o.HardPendingCompactionBytes {
+		return Stopped, ReasonPendingCompactionBytes, 1
+	}
+
+	reason, debt := ReasonNone, 0.0
+	raise := func(r Reason, d float64) {
+		if d > debt {
+			reason, debt = r, d
+		}
+	}
+
+	if o.L0SlowdownTrigger > 0 && p.L0Segments >= o.L0SlowdownTrigger {
+		steps := 1
+		if o.L0StopTrigger > o.L0SlowdownTrigger {
+			steps = o.L0StopTrigger - o.L0SlowdownTrigger
+		}
+		raise(ReasonL0Segments, float64(p.L0Segments-o.L0SlowdownTrigger+1)/float64(steps+1))
+	}
+	if o.MaxSealedMemtables > 1 && p.SealedMemtables >= o.MaxSealedMemtables-1 {
+		raise(ReasonSealedMemtables, 0.5)
+	}
+	if o.SoftPendingCompactionBytes > 0 && p.PendingCompactionBytes >= o.SoftPendingCompactionBytes {
+		d := 1.0
+		if o.HardPendingCompactionBytes > o.SoftPendingCompactionBytes {
+			d = float64(p.PendingCompactionBytes-o.SoftPendingCompactionBytes+1) /
+				float64(o.HardPendingCompactionBytes-o.SoftPendingCompactionBytes)
+		}
+		raise(ReasonPendingCompactionBytes, d)
+	}
+
+	if debt == 0 {
+		return Normal, ReasonNone, 0
+	}
+	if debt > 1 {
+		debt = 1
+	}
+	return Delayed, reason, debt
+}
+
+// update re-evaluates the pressure, and emits an event if the state changed
+func (c *Controller) update() (State, Reason, float64, <-chan struct{}) {
+	c.mutex.Lock()
+	state, reason, debt := c.opts.Evaluate(c.probe())
+
+	var event *Event
+	if state != c.state || reason != c.reason {
+		now := time.Now()
+		event = &Event{
+			State:    state,
+			Previous: c.state,
+			Reason:   reason,
+			Duration: now.Sub(c.since),
+		}
+		if c.state == Normal {
+			c.counters.Stalls++
+		}
+		c.state, c.reason, c.since = state, reason, now
+
+		close(c.changed)
+		c.changed = make(chan struct{})
+	}
+	changed := c.changed
+	c.mutex.Unlock()
+
+	if event != nil && c.opts.OnEvent != nil {
+		c.opts.OnEvent(*event)
+	}
+	return state, reason, debt, changed
+}
+
+// Signal re-evaluates the write debt, it should be called whenever a flush
+// or compaction changed the tree, so stopped writes can resume
+func (c *Controller) Signal() {
+	c.update()
+}
+
+// Wait blocks the calling write as long as the controller requires
+//
+// Delayed writes sleep in proportion to the debt, stopped writes wait until
+// the tree has caught up. With noSlowdown, ErrWriteStalled is returned instead.
+func (c *Controller) Wait(noSlowdown bool) error {
+	stopped := false
+	for {
+		state, reason, debt, changed := c.update()
+
+		switch state {
+		case Normal:
+			return nil
+
+		case Delayed:
+			if noSlowdown {
+				c.reject()
+				return fmt.Errorf("%w: %s", ErrWriteStalled, reason)
+			}
+			delay := time.Duration(float64(c.opts.MaxDelay) * debt)
+			time.Sleep(delay)
+
+			c.mutex.Lock()
+			c.counters.DelayedWrites++
+			c.counters.DelayTime += delay
+			c.mutex.Unlock()
+			return nil
+
+		case Stopped:
+			if noSlowdown {
+				c.reject()
+				return fmt.Errorf("%w: %s", ErrWriteStalled, reason)
+			}
+			if !stopped {
+				stopped = true
+				c.mutex.Lock()
+				c.counters.StoppedWrites++
+				c.mutex.Unlock()
+			}
+
+			// Signal wakes up waiters early, the timeout covers trees
+			// that change without signalling (e.g. manual compactions)
+			start := time.Now()
+			select {
+			case <-changed:
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			c.mutex.Lock()
+			c.counters.StopTime += time.Since(start)
+			c.mutex.Unlock()
+		}
+	}
+}
+
+func (c *Controller) reject() {
+	c.mutex.Lock()
+	c.counters.RejectedWrites++
+	c.mutex.Unlock()
+}
+
+// State returns the current state and the limit responsible for it
+func (c *Controller) State() (State, Reason) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.state, c.reason
+}
+
+// Counters returns the cumulative stall statistics
+func (c *Controller) Counters() Counters {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counters
+}
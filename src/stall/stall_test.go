@@ -0,0 +1,116 @@
+package stall
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluate(t *testing.T) {
+	opts := DefaultOptions()
+
+	state, reason, _ := opts.Evaluate(Pressure{L0Segments: 3})
+	assert.Equal(t, Normal, state)
+	assert.Equal(t, ReasonNone, reason)
+
+	state, reason, low := opts.Evaluate(Pressure{L0Segments: 16})
+	assert.Equal(t, Delayed, state)
+	assert.Equal(t, ReasonL0Segments, reason)
+
+	_, _, high := opts.Evaluate(Pressure{L0Segments: 19})
+	assert.Greater(t, high, low)
+	assert.LessOrEqual(t, high, 1.0)
+
+	state, reason, _ = opts.Evaluate(Pressure{L0Segments: 20})
+	assert.Equal(t, Stopped, state)
+	assert.Equal(t, ReasonL0Segments, reason)
+
+	state, reason, _ = opts.Evaluate(Pressure{SealedMemtables: 3})
+	assert.Equal(t, Delayed, state)
+	assert.Equal(t, ReasonSealedMemtables, reason)
+
+	state, reason, _ = opts.Evaluate(Pressure{SealedMemtables: 4})
+	assert.Equal(t, Stopped, state)
+	assert.Equal(t, ReasonSealedMemtables, reason)
+
+	state, reason, _ = opts.Evaluate(Pressure{PendingCompactionBytes: opts.SoftPendingCompactionBytes})
+	assert.Equal(t, Delayed, state)
+	assert.Equal(t, ReasonPendingCompactionBytes, reason)
+
+	state, _, _ = opts.Evaluate(Pressure{PendingCompactionBytes: opts.HardPendingCompactionBytes})
+	assert.Equal(t, Stopped, state)
+
+	// Zero disables a limit
+	opts.L0StopTrigger = 0
+	opts.L0SlowdownTrigger = 0
+	state, _, _ = opts.Evaluate(Pressure{L0Segments: 1000})
+	assert.Equal(t, Normal, state)
+}
+
+func TestControllerNoSlowdown(t *testing.T) {
+	controller := NewController(DefaultOptions(), func() Pressure {
+		return Pressure{L0Segments: 17}
+	})
+
+	err := controller.Wait(true)
+	assert.True(t, errors.Is(err, ErrWriteStalled))
+	assert.Equal(t, uint64(1), controller.Counters().RejectedWrites)
+
+	assert.NoError(t, controller.Wait(false))
+	assert.Equal(t, uint64(1), controller.Counters().DelayedWrites)
+	assert.Greater(t, controller.Counters().DelayTime, time.Duration(0))
+}
+
+func TestControllerStopAndResume(t *testing.T) {
+	var l0 atomic.Int64
+	l0.Store(25)
+
+	var mutex sync.Mutex
+	var events []Event
+
+	opts := DefaultOptions()
+	opts.OnEvent = func(e Event) {
+		mutex.Lock()
+		events = append(events, e)
+		mutex.Unlock()
+	}
+	controller := NewController(opts, func() Pressure {
+		return Pressure{L0Segments: int(l0.Load())}
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- controller.Wait(false)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("write should be stopped")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	l0.Store(2)
+	controller.Signal()
+	assert.NoError(t, <-done)
+
+	state, _ := controller.State()
+	assert.Equal(t, Normal, state)
+
+	counters := controller.Counters()
+	assert.Equal(t, uint64(1), counters.Stalls)
+	assert.Equal(t, uint64(1), counters.StoppedWrites)
+	assert.Greater(t, counters.StopTime, time.Duration(0))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Len(t, events, 2)
+	assert.Equal(t, Stopped, events[0].State)
+	assert.Equal(t, ReasonL0Segments, events[0].Reason)
+	assert.Equal(t, Normal, events[1].State)
+	assert.Equal(t, Stopped, events[1].Previous)
+	assert.Greater(t, events[1].Duration, time.Duration(0))
+}
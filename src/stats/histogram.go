@@ -0,0 +1,88 @@
+package stats
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the latency buckets: 1µs, 2µs, 4µs, ... ~16.8s
+var latencyBuckets = func() []time.Duration {
+	buckets := make([]time.Duration, 25)
+	for i := range buckets {
+		buckets[i] = time.Microsecond << i
+	}
+	return buckets
+}()
+
+// Histogram records latencies in exponential buckets, it is safe for concurrent use
+type Histogram struct {
+	buckets [25]atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Int64
+}
+
+// Observe records a single latency
+func (h *Histogram) Observe(d time.Duration) {
+	for i, bound := range latencyBuckets {
+		if d <= bound {
+			h.buckets[i].Add(1)
+			break
+		}
+	}
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Since records the latency of an operation started at start
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start))
+}
+
+// Snapshot returns the current state of the histogram
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Bounds: latencyBuckets,
+		Counts: make([]uint64, len(latencyBuckets)),
+		Count:  h.count.Load(),
+		Sum:    time.Duration(h.sum.Load()),
+	}
+	for i := range s.Counts {
+		s.Counts[i] = h.buckets[i].Load()
+	}
+	return s
+}
+
+// HistogramSnapshot is a point-in-time copy of a Histogram
+//
+// Counts are per bucket (not cumulative), observations larger than the
+// last bound are only part of Count.
+type HistogramSnapshot struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// Mean returns the average latency, 0 if nothing was observed
+func (s HistogramSnapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+// Quantile returns the upper bound of the bucket containing the q-quantile
+func (s HistogramSnapshot) Quantile(q float64) time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(s.Count))
+	var seen uint64
+	for i, count := range s.Counts {
+		seen += count
+		if seen > rank {
+			return s.Bounds[i]
+		}
+	}
+	return s.Bounds[len(s.Bounds)-1]
+}
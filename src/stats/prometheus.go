@@ -0,0 +1,129 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+const metricPrefix = "bagh_"
+
+// WritePrometheus writes the statistics in the Prometheus text exposition format
+func WritePrometheus(w io.Writer, s Stats) error {
+	bw := bufio.NewWriter(w)
+	p := promWriter{w: bw}
+
+	p.counter("gets_total", "Point reads.", s.Gets)
+	p.counter("puts_total", "Inserted items.", s.Puts)
+	p.counter("deletes_total", "Removed items.", s.Deletes)
+	p.counter("scans_total", "Range and prefix scans.", s.Scans)
+
+	p.histogram("get_latency_seconds", "Latency of point reads.", s.GetLatency)
+	p.histogram("put_latency_seconds", "Latency of inserts.", s.PutLatency)
+	p.histogram("delete_latency_seconds", "Latency of removes.", s.DeleteLatency)
+	p.histogram("scan_latency_seconds", "Duration of scans, until the iterator is exhausted.", s.ScanLatency)
+
+	p.counter("written_bytes_total", "User bytes (keys and values) written.", s.BytesWritten)
+	p.counter("read_bytes_total", "User bytes (keys and values) read.", s.BytesRead)
+
+	p.gauge("memtable_active_bytes", "Approximate size of the active memtable.", float64(s.ActiveMemtableBytes))
+	p.gauge("memtable_sealed_bytes", "Approximate size of memtables waiting to be flushed.", float64(s.SealedMemtableBytes))
+	p.gauge("memtable_sealed", "Memtables waiting to be flushed.", float64(s.SealedMemtables))
+	p.gauge("wal_bytes", "Size of the write-ahead log.", float64(s.WalBytes))
+
+	p.counter("flushes_total", "Memtables flushed to segments.", s.Flushes)
+	p.counter("flush_bytes_total", "Bytes written by flushes.", s.FlushBytes)
+	p.histogram("flush_duration_seconds", "Duration of memtable flushes.", s.FlushLatency)
+
+	p.counter("compactions_total", "Compactions run.", s.Compactions)
+	p.counter("compaction_read_bytes_total", "Bytes of segments read by compactions.", s.CompactionBytesRead)
+	p.counter("compaction_written_bytes_total", "Bytes of segments written by compactions.", s.CompactionBytesWritten)
+	p.histogram("compaction_duration_seconds", "Duration of compactions.", s.CompactionLatency)
+
+	p.gauge("write_amplification", "Bytes written to disk per user byte written.", s.WriteAmplification)
+
+	p.counter("block_cache_hits_total", "Block lookups served from the block cache.", s.BlockCacheHits)
+	p.counter("block_cache_misses_total", "Block lookups that had to read from disk.", s.BlockCacheMisses)
+	p.gauge("block_cache_hit_ratio", "Fraction of block lookups served from the block cache.", s.BlockCacheHitRate())
+	p.gauge("block_cache_bytes", "Size of the block cache.", float64(s.BlockCacheBytes))
+
+	p.counter("bloom_filter_checks_total", "Bloom filters consulted by point reads.", s.FilterChecks)
+	p.counter("bloom_filter_negatives_total", "Bloom filter checks that ruled out a segment.", s.FilterNegatives)
+	p.gauge("bloom_filter_hit_ratio", "Fraction of bloom filter checks that saved a block read.", s.FilterHitRate())
+
+	p.counter("write_stalls_total", "Periods in which writes were delayed or stopped.", s.Stalls)
+	p.gauge("write_stall_delay_seconds_total", "Time writes spent delayed.", s.StallDelayTime.Seconds())
+	p.gauge("write_stall_stop_seconds_total", "Time writes spent stopped.", s.StallStopTime.Seconds())
+
+	p.header("segments", "Segments per level.", "gauge")
+	for level, count := range s.SegmentsPerLevel {
+		p.sample("segments", fmt.Sprintf(`level="%d"`, level), strconv.Itoa(count))
+	}
+	p.gauge("disk_bytes", "Size of all segments.", float64(s.DiskBytes))
+
+	if p.err != nil {
+		return p.err
+	}
+	return bw.Flush()
+}
+
+// Handler serves the statistics returned by snapshot in the Prometheus text format
+func Handler(snapshot func() Stats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := WritePrometheus(w, snapshot()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) printf(format string, args ...any) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+func (p *promWriter) header(name, help, kind string) {
+	p.printf("# HELP %s%s %s\n# TYPE %s%s %s\n", metricPrefix, name, help, metricPrefix, name, kind)
+}
+
+func (p *promWriter) sample(name, labels, value string) {
+	if labels != "" {
+		p.printf("%s%s{%s} %s\n", metricPrefix, name, labels, value)
+		return
+	}
+	p.printf("%s%s %s\n", metricPrefix, name, value)
+}
+
+func (p *promWriter) counter(name, help string, value uint64) {
+	p.header(name, help, "counter")
+	p.sample(name, "", strconv.FormatUint(value, 10))
+}
+
+func (p *promWriter) gauge(name, help string, value float64) {
+	p.header(name, help, "gauge")
+	p.sample(name, "", formatFloat(value))
+}
+
+func (p *promWriter) histogram(name, help string, h HistogramSnapshot) {
+	p.header(name, help, "histogram")
+	var cumulative uint64
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		p.sample(name+"_bucket", fmt.Sprintf(`le="%s"`, formatFloat(bound.Seconds())), strconv.FormatUint(cumulative, 10))
+	}
+	p.sample(name+"_bucket", `le="+Inf"`, strconv.FormatUint(h.Count, 10))
+	p.sample(name+"_sum", "", formatFloat(h.Sum.Seconds()))
+	p.sample(name+"_count", "", strconv.FormatUint(h.Count, 10))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
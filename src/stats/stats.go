@@ -0,0 +1,158 @@
+package stats
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Registry holds the live counters of a tree, updated by the read and
+// write paths and the background workers
+type Registry struct {
+	Gets    atomic.Uint64
+	Puts    atomic.Uint64
+	Deletes atomic.Uint64
+	Scans   atomic.Uint64
+
+	GetLatency    Histogram
+	PutLatency    Histogram
+	DeleteLatency Histogram
+	ScanLatency   Histogram
+
+	// User bytes (keys and values) written and read
+	BytesWritten atomic.Uint64
+	BytesRead    atomic.Uint64
+
+	Flushes      atomic.Uint64
+	FlushBytes   atomic.Uint64
+	FlushLatency Histogram
+
+	Compactions            atomic.Uint64
+	CompactionBytesRead    atomic.Uint64
+	CompactionBytesWritten atomic.Uint64
+	CompactionLatency      Histogram
+
+	// Bloom filters consulted by point reads, and how many of them
+	// ruled out the segment (saving a block read)
+	FilterChecks    atomic.Uint64
+	FilterNegatives atomic.Uint64
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// FilterChecked counts a bloom filter check of a point read
+func (r *Registry) FilterChecked(negative bool) {
+	r.FilterChecks.Add(1)
+	if negative {
+		r.FilterNegatives.Add(1)
+	}
+}
+
+// ScanDone records a finished scan
+func (r *Registry) ScanDone(duration time.Duration, bytes uint64) {
+	r.ScanLatency.Observe(duration)
+	r.BytesRead.Add(bytes)
+}
+
+// Stats is a point-in-time snapshot of the statistics of a tree
+type Stats struct {
+	Gets    uint64
+	Puts    uint64
+	Deletes uint64
+	Scans   uint64
+
+	GetLatency    HistogramSnapshot
+	PutLatency    HistogramSnapshot
+	DeleteLatency HistogramSnapshot
+	ScanLatency   HistogramSnapshot
+
+	BytesWritten uint64
+	BytesRead    uint64
+
+	ActiveMemtableBytes uint64
+	SealedMemtableBytes uint64
+	SealedMemtables     int
+	WalBytes            uint64
+
+	Flushes      uint64
+	FlushBytes   uint64
+	FlushLatency HistogramSnapshot
+
+	Compactions            uint64
+	CompactionBytesRead    uint64
+	CompactionBytesWritten uint64
+	CompactionLatency      HistogramSnapshot
+
+	// Bytes written to disk by flushes and compactions per user byte written
+	WriteAmplification float64
+
+	BlockCacheHits   uint64
+	BlockCacheMisses uint64
+	BlockCacheBytes  uint64
+
+	FilterChecks    uint64
+	FilterNegatives uint64
+
+	Stalls         uint64
+	StallDelayTime time.Duration
+	StallStopTime  time.Duration
+
+	// Amount of segments in every level, starting with L0
+	SegmentsPerLevel []int
+	DiskBytes        uint64
+}
+
+// Snapshot copies the counters of the registry, gauges (memtables, levels,
+// block cache, stalls) are filled in by the tree
+func (r *Registry) Snapshot() Stats {
+	s := Stats{
+		Gets:    r.Gets.Load(),
+		Puts:    r.Puts.Load(),
+		Deletes: r.Deletes.Load(),
+		Scans:   r.Scans.Load(),
+
+		GetLatency:    r.GetLatency.Snapshot(),
+		PutLatency:    r.PutLatency.Snapshot(),
+		DeleteLatency: r.DeleteLatency.Snapshot(),
+		ScanLatency:   r.ScanLatency.Snapshot(),
+
+		BytesWritten: r.BytesWritten.Load(),
+		BytesRead:    r.BytesRead.Load(),
+
+		Flushes:      r.Flushes.Load(),
+		FlushBytes:   r.FlushBytes.Load(),
+		FlushLatency: r.FlushLatency.Snapshot(),
+
+		Compactions:            r.Compactions.Load(),
+		CompactionBytesRead:    r.CompactionBytesRead.Load(),
+		CompactionBytesWritten: r.CompactionBytesWritten.Load(),
+		CompactionLatency:      r.CompactionLatency.Snapshot(),
+
+		FilterChecks:    r.FilterChecks.Load(),
+		FilterNegatives: r.FilterNegatives.Load(),
+	}
+
+	if s.BytesWritten > 0 {
+		s.WriteAmplification = float64(s.FlushBytes+s.CompactionBytesWritten) / float64(s.BytesWritten)
+	}
+	return s
+}
+
+// BlockCacheHitRate returns the fraction of block lookups served from the cache
+func (s *Stats) BlockCacheHitRate() float64 {
+	return ratio(s.BlockCacheHits, s.BlockCacheHits+s.BlockCacheMisses)
+}
+
+// FilterHitRate returns the fraction of filter checks that saved a block read
+func (s *Stats) FilterHitRate() float64 {
+	return ratio(s.FilterNegatives, s.FilterChecks)
+}
+
+func ratio(a, b uint64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
@@ -0,0 +1,72 @@
+package stats
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	h.Observe(500 * time.Nanosecond)
+	h.Observe(3 * time.Microsecond)
+	h.Observe(3 * time.Microsecond)
+	h.Observe(time.Minute)
+
+	s := h.Snapshot()
+	assert.Equal(t, uint64(4), s.Count)
+	assert.Equal(t, uint64(1), s.Counts[0])
+	assert.Equal(t, uint64(2), s.Counts[2])
+	assert.Equal(t, 4*time.Microsecond, s.Quantile(0.5))
+	assert.Equal(t, (time.Minute+6500*time.Nanosecond)/4, s.Mean())
+}
+
+func TestRegistrySnapshot(t *testing.T) {
+	r := NewRegistry()
+	r.BytesWritten.Add(100)
+	r.FlushBytes.Add(150)
+	r.CompactionBytesWritten.Add(150)
+	r.FilterChecked(true)
+	r.FilterChecked(false)
+	r.ScanDone(time.Millisecond, 42)
+
+	s := r.Snapshot()
+	assert.Equal(t, 3.0, s.WriteAmplification)
+	assert.Equal(t, 0.5, s.FilterHitRate())
+	assert.Equal(t, 0.0, s.BlockCacheHitRate())
+	assert.Equal(t, uint64(1), s.ScanLatency.Count)
+	assert.Equal(t, uint64(42), s.BytesRead)
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	r := NewRegistry()
+	r.Gets.Add(7)
+	r.GetLatency.Observe(3 * time.Microsecond)
+
+	handler := Handler(func() Stats {
+		s := r.Snapshot()
+		s.SegmentsPerLevel = []int{2, 0, 1}
+		return s
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"))
+
+	body, err := io.ReadAll(rec.Body)
+	assert.NoError(t, err)
+	text := string(body)
+
+	assert.Contains(t, text, "# TYPE bagh_gets_total counter\nbagh_gets_total 7\n")
+	assert.Contains(t, text, `bagh_get_latency_seconds_bucket{le="2e-06"} 0`)
+	assert.Contains(t, text, `bagh_get_latency_seconds_bucket{le="4e-06"} 1`)
+	assert.Contains(t, text, `bagh_get_latency_seconds_bucket{le="+Inf"} 1`)
+	assert.Contains(t, text, "bagh_get_latency_seconds_count 1\n")
+	assert.Contains(t, text, `bagh_segments{level="0"} 2`)
+	assert.Contains(t, text, `bagh_segments{level="2"} 1`)
+}
@@ -0,0 +1,66 @@
+package stress
+
+import (
+	"fmt"
+	"sync"
+)
+
+// entry is the expected value of a key
+type entry struct {
+	value   string
+	present bool
+}
+
+// model is the reference the tree is checked against
+//
+// Writes and point reads lock the keys they use, and hold the read lock,
+// scans and snapshots hold the write lock, so they see no write in flight.
+type model struct {
+	mutex   sync.RWMutex
+	keys    []sync.Mutex
+	entries []entry
+}
+
+func newModel(keyCount int) *model {
+	return &model{
+		keys:    make([]sync.Mutex, keyCount),
+		entries: make([]entry, keyCount),
+	}
+}
+
+// keyName is the key of a key index, keys sort like their indexes
+func keyName(index int) string {
+	return fmt.Sprintf("key%08d", index)
+}
+
+// prefixBounds returns the prefix shared by the keys of a group of ten,
+// and the index range of the group
+func prefixBounds(index, keyCount int) (string, int, int) {
+	lo := index / 10 * 10
+	hi := min(lo+9, keyCount-1)
+	name := keyName(index)
+	return name[:len(name)-1], lo, hi
+}
+
+// item is a key and its value, as returned by scans
+type item struct {
+	key   string
+	value string
+}
+
+// scan returns the present keys from lo to hi (inclusive), the caller has to
+// hold the write lock
+func (m *model) scan(lo, hi int) []item {
+	var items []item
+	for index := lo; index <= hi; index++ {
+		if e := m.entries[index]; e.present {
+			items = append(items, item{key: keyName(index), value: e.value})
+		}
+	}
+	return items
+}
+
+// snapshot copies the entries, the caller has to hold the write lock
+func (m *model) snapshot() *model {
+	return &model{entries: append([]entry(nil), m.entries...)}
+}
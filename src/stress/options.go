@@ -0,0 +1,188 @@
+package stress
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bagh/vfs"
+)
+
+// Op is an operation of the workload
+type Op string
+
+const (
+	OpInsert   Op = "insert"
+	OpRemove   Op = "remove"
+	OpBatch    Op = "batch"
+	OpGet      Op = "get"
+	OpSnapshot Op = "snapshot"
+	OpRange    Op = "range"
+	OpPrefix   Op = "prefix"
+	OpFirst    Op = "first"
+	OpLast     Op = "last"
+	OpFlush    Op = "flush"
+	OpCompact  Op = "compact"
+)
+
+// Distribution picks the keys operations work on
+type Distribution string
+
+const (
+	// Every key is equally likely
+	Uniform Distribution = "uniform"
+
+	// A few keys are hot, the lower the index the hotter
+	Zipf Distribution = "zipf"
+
+	// Keys close to the most recently written one are hot
+	Latest Distribution = "latest"
+)
+
+// Options configure a stress run
+//
+// Everything that influences the workload is part of the options, so a
+// failing run is replayed by running its saved options again.
+type Options struct {
+	Seed int64 `json:"seed"`
+
+	// Goroutines running operations, each one runs OpsPerWorker operations
+	Workers      int `json:"workers"`
+	OpsPerWorker int `json:"ops_per_worker"`
+
+	// Run the operations of the workers one at a time, in an order
+	// picked by the seed, which makes the run deterministic
+	Serial bool `json:"serial"`
+
+	// Keys are numbered from 0 to KeyCount-1
+	KeyCount     int          `json:"key_count"`
+	Distribution Distribution `json:"distribution"`
+
+	// Values are between MinValueSize and MaxValueSize bytes long
+	MinValueSize int `json:"min_value_size"`
+	MaxValueSize int `json:"max_value_size"`
+
+	// Relative frequency of each operation, operations not in the map never run
+	Weights map[Op]int `json:"weights"`
+
+	// Directory of the tree, an in-memory filesystem is used if empty
+	Path string `json:"path,omitempty"`
+
+	// Failing runs save their options to this directory, if set
+	FailureDir string `json:"-"`
+
+	// Filesystem of the tree, overrides Path
+	FS vfs.FS `json:"-"`
+}
+
+// DefaultWeights runs mostly writes and point reads, with occasional
+// scans, snapshots, flushes and compactions
+func DefaultWeights() map[Op]int {
+	return map[Op]int{
+		OpInsert:   30,
+		OpRemove:   10,
+		OpBatch:    5,
+		OpGet:      30,
+		OpSnapshot: 3,
+		OpRange:    5,
+		OpPrefix:   5,
+		OpFirst:    2,
+		OpLast:     2,
+		OpFlush:    1,
+		OpCompact:  1,
+	}
+}
+
+// DefaultOptions creates options for a short in-memory run
+func DefaultOptions() Options {
+	return Options{
+		Seed:         time.Now().UnixNano(),
+		Workers:      4,
+		OpsPerWorker: 10_000,
+		KeyCount:     1000,
+		Distribution: Uniform,
+		MinValueSize: 1,
+		MaxValueSize: 64,
+		Weights:      DefaultWeights(),
+	}
+}
+
+func (o *Options) validate() error {
+	switch {
+	case o.Workers < 1:
+		return fmt.Errorf("workers must be at least 1")
+	case o.KeyCount < 1:
+		return fmt.Errorf("key count must be at least 1")
+	case o.MinValueSize < 1 || o.MaxValueSize < o.MinValueSize:
+		return fmt.Errorf("invalid value sizes %d..%d", o.MinValueSize, o.MaxValueSize)
+	}
+	switch o.Distribution {
+	case Uniform, Zipf, Latest:
+	default:
+		return fmt.Errorf("unknown key distribution %q", o.Distribution)
+	}
+
+	total := 0
+	for op, weight := range o.Weights {
+		if !op.valid() {
+			return fmt.Errorf("unknown operation %q", op)
+		}
+		if weight < 0 {
+			return fmt.Errorf("negative weight for %s", op)
+		}
+		total += weight
+	}
+	if total == 0 {
+		return fmt.Errorf("no operation has a weight")
+	}
+	return nil
+}
+
+func (op Op) valid() bool {
+	switch op {
+	case OpInsert, OpRemove, OpBatch, OpGet, OpSnapshot, OpRange, OpPrefix, OpFirst, OpLast, OpFlush, OpCompact:
+		return true
+	}
+	return false
+}
+
+// failureFile is what a failing run saves
+type failureFile struct {
+	Options Options `json:"options"`
+	Failure string  `json:"failure"`
+}
+
+// saveFailure writes the options of a failing run to the failure directory
+func saveFailure(opts Options, failure error) (string, error) {
+	if err := os.MkdirAll(opts.FailureDir, 0755); err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(failureFile{Options: opts, Failure: failure.Error()}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(opts.FailureDir, fmt.Sprintf("seed-%d.json", opts.Seed))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// LoadFailure reads the options of a failing run saved to a failure
+// directory, running them again replays the run
+func LoadFailure(path string) (Options, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Options{}, err
+	}
+
+	var file failureFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return Options{}, fmt.Errorf("invalid failure file %s: %w", path, err)
+	}
+	return file.Options, nil
+}
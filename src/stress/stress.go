@@ -0,0 +1,193 @@
+// Package stress runs randomized concurrent workloads against a tree, and
+// checks every read against an in-memory model of the written data
+package stress
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bagh/config"
+	"bagh/seqno"
+	"bagh/tree"
+	"bagh/vfs"
+)
+
+// compactionTargetSize keeps segments small, so compactions write several of them
+const compactionTargetSize = 64 * 1024
+
+// Failure is a result of the tree that does not match the model, or an
+// operation that failed
+type Failure struct {
+	Seed   int64
+	Worker int
+	Op     Op
+	Detail string
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("stress seed %d, worker %d, %s: %s", f.Seed, f.Worker, f.Op, f.Detail)
+}
+
+// Report describes a finished run
+type Report struct {
+	// Operations run, by kind
+	Ops      map[Op]int64
+	Duration time.Duration
+
+	// Where the options of a failing run were saved, if anywhere
+	FailurePath string
+}
+
+// runner holds the state shared by the workers of a run
+type runner struct {
+	opts  Options
+	tree  *tree.Tree
+	model *model
+	seqno *seqno.SequenceNumberCounter
+
+	// Operations in a fixed order, with their cumulative weights
+	ops     []Op
+	weights []int
+
+	// Most recently written key, for the Latest distribution
+	latest atomic.Int64
+
+	counts  sync.Map
+	failure atomic.Pointer[Failure]
+}
+
+// Run runs a workload against a new tree, and returns a *Failure if the
+// tree returned something the model does not expect
+//
+// Runs are only deterministic if opts.Serial is set.
+func Run(opts Options) (*Report, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	fs, path := opts.FS, opts.Path
+	switch {
+	case fs != nil:
+	case path == "":
+		fs, path = vfs.NewMemFS(), "/stress"
+	default:
+		fs = vfs.Default
+	}
+	if _, err := fs.Stat(path); !os.IsNotExist(err) {
+		return nil, fmt.Errorf("stress tree %s must not exist yet", path)
+	}
+
+	t, err := tree.Open(*config.NewConfig(path).SetFS(fs))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &runner{
+		opts:  opts,
+		tree:  t,
+		model: newModel(opts.KeyCount),
+		seqno: seqno.NewSequenceNumberCounter(0),
+	}
+	for op, weight := range opts.Weights {
+		if weight > 0 {
+			r.ops = append(r.ops, op)
+		}
+	}
+	sort.Slice(r.ops, func(i, j int) bool { return r.ops[i] < r.ops[j] })
+	total := 0
+	for _, op := range r.ops {
+		total += opts.Weights[op]
+		r.weights = append(r.weights, total)
+	}
+
+	workers := make([]*worker, opts.Workers)
+	for i := range workers {
+		workers[i] = r.newWorker(i)
+	}
+
+	start := time.Now()
+	if opts.Serial {
+		r.runSerial(workers)
+	} else {
+		r.runConcurrent(workers)
+	}
+	for _, w := range workers {
+		w.dropSnapshot()
+	}
+
+	report := &Report{Ops: make(map[Op]int64), Duration: time.Since(start)}
+	r.counts.Range(func(op, count any) bool {
+		report.Ops[op.(Op)] = count.(*atomic.Int64).Load()
+		return true
+	})
+
+	err = t.Close()
+	if failure := r.failure.Load(); failure != nil {
+		if opts.FailureDir != "" {
+			path, saveErr := saveFailure(opts, failure)
+			if saveErr != nil {
+				return report, errors.Join(failure, saveErr)
+			}
+			report.FailurePath = path
+		}
+		return report, failure
+	}
+	return report, err
+}
+
+// runSerial runs one operation at a time, picking the worker with a
+// generator of its own, so the run only depends on the seed
+func (r *runner) runSerial(workers []*worker) {
+	scheduler := rand.New(rand.NewSource(r.opts.Seed))
+
+	active := append([]*worker(nil), workers...)
+	remaining := make(map[*worker]int, len(workers))
+	for _, w := range workers {
+		remaining[w] = r.opts.OpsPerWorker
+	}
+
+	for len(active) > 0 && r.failure.Load() == nil {
+		i := scheduler.Intn(len(active))
+		w := active[i]
+		w.step()
+
+		if remaining[w]--; remaining[w] == 0 {
+			active = append(active[:i], active[i+1:]...)
+		}
+	}
+}
+
+func (r *runner) runConcurrent(workers []*worker) {
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			for i := 0; i < r.opts.OpsPerWorker && r.failure.Load() == nil; i++ {
+				w.step()
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// fail records the first failure of the run
+func (r *runner) fail(worker int, op Op, format string, args ...any) {
+	r.failure.CompareAndSwap(nil, &Failure{
+		Seed:   r.opts.Seed,
+		Worker: worker,
+		Op:     op,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+func (r *runner) count(op Op) {
+	counter, _ := r.counts.LoadOrStore(op, new(atomic.Int64))
+	counter.(*atomic.Int64).Add(1)
+}
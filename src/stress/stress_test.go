@@ -0,0 +1,118 @@
+package stress
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testOptions runs every operation with the default weights, reads are
+// checked against the model
+func testOptions(seed int64) Options {
+	opts := DefaultOptions()
+	opts.Seed = seed
+	opts.OpsPerWorker = 1000
+	return opts
+}
+
+func TestRunSerial(t *testing.T) {
+	opts := testOptions(1)
+	opts.Serial = true
+
+	report, err := Run(opts)
+	require.NoError(t, err)
+
+	var ops int64
+	for _, count := range report.Ops {
+		ops += count
+	}
+	assert.Equal(t, int64(opts.Workers*opts.OpsPerWorker), ops)
+}
+
+func TestRunDefaults(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Seed = 7
+	opts.Serial = true
+
+	_, err := Run(opts)
+	require.NoError(t, err)
+}
+
+func TestRunScans(t *testing.T) {
+	opts := testOptions(5)
+	opts.Serial = true
+	opts.Weights[OpRange] = 20
+	opts.Weights[OpPrefix] = 20
+	opts.Weights[OpSnapshot] = 10
+
+	_, err := Run(opts)
+	require.NoError(t, err)
+}
+
+func TestRunReads(t *testing.T) {
+	opts := testOptions(6)
+	opts.Serial = true
+	opts.Weights[OpGet] = 100
+
+	_, err := Run(opts)
+	require.NoError(t, err)
+}
+
+func TestRunConcurrent(t *testing.T) {
+	for _, distribution := range []Distribution{Uniform, Zipf, Latest} {
+		opts := testOptions(2)
+		opts.Distribution = distribution
+
+		_, err := Run(opts)
+		assert.NoError(t, err, distribution)
+	}
+}
+
+func TestRunOnDisk(t *testing.T) {
+	opts := testOptions(3)
+	opts.OpsPerWorker = 200
+	opts.Path = filepath.Join(t.TempDir(), "tree")
+
+	_, err := Run(opts)
+	require.NoError(t, err)
+
+	// A run needs a new tree
+	_, err = Run(opts)
+	assert.Error(t, err)
+}
+
+func TestOptionsValidate(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Weights = map[Op]int{"sleep": 1}
+	_, err := Run(opts)
+	assert.Error(t, err)
+
+	opts = DefaultOptions()
+	opts.Weights = map[Op]int{OpInsert: 0}
+	_, err = Run(opts)
+	assert.Error(t, err)
+
+	opts = DefaultOptions()
+	opts.Distribution = "gaussian"
+	_, err = Run(opts)
+	assert.Error(t, err)
+}
+
+func TestSaveAndLoadFailure(t *testing.T) {
+	opts := testOptions(4)
+	opts.Serial = true
+	opts.FailureDir = t.TempDir()
+
+	path, err := saveFailure(opts, &Failure{Seed: 4, Op: OpGet, Detail: "got nothing"})
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(opts.FailureDir, "seed-4.json"), path)
+
+	loaded, err := LoadFailure(path)
+	require.NoError(t, err)
+
+	// Loaded options replay the run, only the local settings are not saved
+	opts.FailureDir = ""
+	assert.Equal(t, opts, loaded)
+}
@@ -0,0 +1,363 @@
+package stress
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"bagh/prefix"
+	"bagh/ranger"
+	"bagh/segment"
+	"bagh/tree"
+	"bagh/value"
+)
+
+// worker runs operations with a random generator of its own
+type worker struct {
+	r    *runner
+	id   int
+	rng  *rand.Rand
+	zipf *rand.Zipf
+	ops  int
+
+	// Open snapshot and the model as of its seqno, the next snapshot
+	// operation of the worker checks and drops it
+	snapshot      *tree.Snapshot
+	snapshotModel *model
+}
+
+func (r *runner) newWorker(id int) *worker {
+	rng := rand.New(rand.NewSource(r.opts.Seed + int64(id+1)*1_000_003))
+	return &worker{
+		r:    r,
+		id:   id,
+		rng:  rng,
+		zipf: rand.NewZipf(rng, 1.1, 1, uint64(r.opts.KeyCount-1)),
+	}
+}
+
+// step runs a random operation
+func (w *worker) step() {
+	pick := w.rng.Intn(w.r.weights[len(w.r.weights)-1])
+	op := w.r.ops[sort.SearchInts(w.r.weights, pick+1)]
+
+	w.ops++
+	w.r.count(op)
+
+	// Panics of the tree are failures as well, so their seed is saved
+	defer func() {
+		if err := recover(); err != nil {
+			w.fail(op, "panic: %v\n%s", err, debug.Stack())
+		}
+	}()
+
+	switch op {
+	case OpInsert:
+		w.write(op, []int{w.key()}, false)
+	case OpRemove:
+		w.write(op, []int{w.key()}, true)
+	case OpBatch:
+		w.batch()
+	case OpGet:
+		w.get()
+	case OpSnapshot:
+		w.snapshotOp()
+	case OpRange:
+		w.rangeOp()
+	case OpPrefix:
+		w.prefixOp()
+	case OpFirst, OpLast:
+		w.firstLast(op)
+	case OpFlush:
+		if _, err := w.r.tree.FlushActiveMemtable(); err != nil {
+			w.fail(op, "%v", err)
+		}
+	case OpCompact:
+		if err := w.r.tree.MajorCompact(compactionTargetSize); err != nil {
+			w.fail(op, "%v", err)
+		}
+	}
+}
+
+func (w *worker) fail(op Op, format string, args ...any) {
+	w.r.fail(w.id, op, format, args...)
+}
+
+// key picks a key index of the configured distribution
+func (w *worker) key() int {
+	n := w.r.opts.KeyCount
+	switch w.r.opts.Distribution {
+	case Zipf:
+		return int(w.zipf.Uint64())
+	case Latest:
+		return int((w.r.latest.Load() - int64(w.zipf.Uint64()) + int64(n)) % int64(n))
+	}
+	return w.rng.Intn(n)
+}
+
+// value creates a value of a random size, unique to this write
+func (w *worker) value() string {
+	size := w.r.opts.MinValueSize + w.rng.Intn(w.r.opts.MaxValueSize-w.r.opts.MinValueSize+1)
+	id := fmt.Sprintf("w%d-%d;", w.id, w.ops)
+	if len(id) >= size {
+		return id[:size]
+	}
+	return id + strings.Repeat(string(rune('a'+w.rng.Intn(26))), size-len(id))
+}
+
+// write inserts or removes the keys with a single seqno, like a batch
+func (w *worker) write(op Op, indexes []int, remove bool) {
+	removes := make([]bool, len(indexes))
+	values := make([]string, len(indexes))
+	for i := range indexes {
+		removes[i] = remove
+		if !remove {
+			values[i] = w.value()
+		}
+	}
+	w.apply(op, indexes, removes, values)
+}
+
+func (w *worker) batch() {
+	picked := make(map[int]bool)
+	for n := 2 + w.rng.Intn(7); n > 0; n-- {
+		picked[w.key()] = true
+	}
+	indexes := make([]int, 0, len(picked))
+	for index := range picked {
+		indexes = append(indexes, index)
+	}
+	// Locks are taken in key order
+	sort.Ints(indexes)
+
+	removes := make([]bool, len(indexes))
+	values := make([]string, len(indexes))
+	for i := range indexes {
+		if removes[i] = w.rng.Intn(4) == 0; !removes[i] {
+			values[i] = w.value()
+		}
+	}
+	w.apply(OpBatch, indexes, removes, values)
+}
+
+// apply writes sorted, distinct keys with one seqno, and updates the model
+func (w *worker) apply(op Op, indexes []int, removes []bool, values []string) {
+	m := w.r.model
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, index := range indexes {
+		m.keys[index].Lock()
+		defer m.keys[index].Unlock()
+	}
+
+	seqno := w.r.seqno.Next()
+	for i, index := range indexes {
+		key := []byte(keyName(index))
+
+		var err error
+		if removes[i] {
+			_, _, err = w.r.tree.Remove(key, seqno)
+		} else {
+			_, _, err = w.r.tree.Insert(key, []byte(values[i]), seqno)
+		}
+		if err != nil {
+			w.fail(op, "writing %s: %v", key, err)
+			return
+		}
+
+		m.entries[index] = entry{value: values[i], present: !removes[i]}
+		w.r.latest.Store(int64(index))
+	}
+}
+
+func (w *worker) get() {
+	index := w.key()
+
+	m := w.r.model
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	m.keys[index].Lock()
+	defer m.keys[index].Unlock()
+
+	got, err := w.r.tree.Get([]byte(keyName(index)))
+	if err != nil {
+		w.fail(OpGet, "%v", err)
+		return
+	}
+	checkGet(w, OpGet, index, got, m.entries[index])
+}
+
+func checkGet(w *worker, op Op, index int, got value.UserValue, want entry) {
+	switch {
+	case got == nil && want.present:
+		w.fail(op, "%s: got nothing, want %q", keyName(index), want.value)
+	case got != nil && !want.present:
+		w.fail(op, "%s: got %q, want nothing", keyName(index), got)
+	case got != nil && string(got) != want.value:
+		w.fail(op, "%s: got %q, want %q", keyName(index), got, want.value)
+	}
+}
+
+// scanBounds picks the (inclusive) key indexes of a range
+func (w *worker) scanBounds() (int, int) {
+	lo := w.key()
+	return lo, min(lo+w.rng.Intn(50), w.r.opts.KeyCount-1)
+}
+
+func (w *worker) rangeOp() {
+	lo, hi := w.scanBounds()
+
+	m := w.r.model
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	got, err := collectRange(w.r.tree.Range([]byte(keyName(lo)), []byte(keyName(hi))).IntoIter())
+	if err != nil {
+		w.fail(OpRange, "%v", err)
+		return
+	}
+	checkItems(w, OpRange, got, m.scan(lo, hi))
+}
+
+func (w *worker) prefixOp() {
+	pfix, lo, hi := prefixBounds(w.key(), w.r.opts.KeyCount)
+
+	m := w.r.model
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	p := w.r.tree.Prefix([]byte(pfix))
+	got, err := collectPrefix(prefix.NewPrefixIterator(p, p.SeqNo))
+	if err != nil {
+		w.fail(OpPrefix, "%v", err)
+		return
+	}
+	checkItems(w, OpPrefix, got, m.scan(lo, hi))
+}
+
+func (w *worker) firstLast(op Op) {
+	m := w.r.model
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var key value.UserKey
+	var val value.UserValue
+	var ok bool
+	if op == OpFirst {
+		key, val, ok = w.r.tree.FirstKeyValue()
+	} else {
+		key, val, ok = w.r.tree.LastKeyValue()
+	}
+
+	var got []item
+	if ok {
+		got = append(got, item{key: string(key), value: string(val)})
+	}
+	checkItems(w, op, got, firstOrLast(op, m.scan(0, w.r.opts.KeyCount-1)))
+}
+
+func firstOrLast(op Op, items []item) []item {
+	switch {
+	case len(items) == 0:
+		return nil
+	case op == OpFirst:
+		return items[:1]
+	default:
+		return items[len(items)-1:]
+	}
+}
+
+// snapshotOp opens a snapshot, or checks and drops the open one, so
+// snapshots see the writes, flushes and compactions in between
+func (w *worker) snapshotOp() {
+	if w.snapshot == nil {
+		m := w.r.model
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+
+		w.snapshot = w.r.tree.Snapshot(w.r.seqno.Get())
+		w.snapshotModel = m.snapshot()
+		return
+	}
+	defer w.dropSnapshot()
+
+	snapshot, want := w.snapshot, w.snapshotModel
+	for i := 0; i < 10; i++ {
+		index := w.key()
+		got, err := snapshot.Get([]byte(keyName(index)))
+		if err != nil {
+			w.fail(OpSnapshot, "get: %v", err)
+			return
+		}
+		checkGet(w, OpSnapshot, index, got, want.entries[index])
+	}
+
+	lo, hi := w.scanBounds()
+	loKey, hiKey := value.UserKey(keyName(lo)), value.UserKey(keyName(hi))
+	got, err := collectRange(snapshot.Range(
+		&segment.Bound[value.UserKey]{Included: &loKey},
+		&segment.Bound[value.UserKey]{Included: &hiKey},
+	).IntoIter())
+	if err != nil {
+		w.fail(OpSnapshot, "range: %v", err)
+		return
+	}
+	checkItems(w, OpSnapshot, got, want.scan(lo, hi))
+
+	pfix, lo, hi := prefixBounds(w.key(), w.r.opts.KeyCount)
+	p := snapshot.Prefix([]byte(pfix))
+	got, err = collectPrefix(prefix.NewPrefixIterator(p, p.SeqNo))
+	if err != nil {
+		w.fail(OpSnapshot, "prefix: %v", err)
+		return
+	}
+	checkItems(w, OpSnapshot, got, want.scan(lo, hi))
+}
+
+func (w *worker) dropSnapshot() {
+	if w.snapshot != nil {
+		w.snapshot.Drop()
+		w.snapshot, w.snapshotModel = nil, nil
+	}
+}
+
+func collectRange(iter *ranger.RangeIterator) ([]item, error) {
+	var items []item
+	for {
+		key, val, ok := iter.Next()
+		if !ok {
+			return items, iter.Err()
+		}
+		items = append(items, item{key: string(*key), value: string(*val)})
+	}
+}
+
+func collectPrefix(iter *prefix.PrefixIterator) ([]item, error) {
+	var items []item
+	for {
+		key, val, err := iter.Next()
+		if err != nil || key == nil {
+			return items, err
+		}
+		items = append(items, item{key: string(*key), value: string(*val)})
+	}
+}
+
+// checkItems fails at the first difference of a scan and the model
+func checkItems(w *worker, op Op, got, want []item) {
+	for i := 0; i < max(len(got), len(want)); i++ {
+		switch {
+		case i >= len(got):
+			w.fail(op, "missing %s=%q after %d items", want[i].key, want[i].value, i)
+		case i >= len(want):
+			w.fail(op, "unexpected %s=%q after %d items", got[i].key, got[i].value, i)
+		case got[i] != want[i]:
+			w.fail(op, "item %d: got %s=%q, want %s=%q", i, got[i].key, got[i].value, want[i].key, want[i].value)
+		default:
+			continue
+		}
+		return
+	}
+}
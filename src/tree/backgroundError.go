@@ -0,0 +1,133 @@
+package tree
+
+import (
+	"bagh/event"
+	"bagh/logging"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// BackgroundError is returned by writes once a flush, compaction or
+// manifest write failed, the tree stays read-only until Resume succeeds
+type BackgroundError struct {
+	Reason event.BackgroundErrorReason
+	Err    error
+}
+
+func (e *BackgroundError) Error() string {
+	return fmt.Sprintf("tree is read-only after %s error: %v", e.Reason, e.Err)
+}
+
+func (e *BackgroundError) Unwrap() error {
+	return e.Err
+}
+
+// manifestError marks a failed write of the levels manifest
+type manifestError struct {
+	err error
+}
+
+func (e *manifestError) Error() string {
+	return fmt.Sprintf("failed to write levels manifest: %v", e.err)
+}
+
+func (e *manifestError) Unwrap() error {
+	return e.err
+}
+
+// writeManifest writes the levels manifest, the caller has to hold the levels lock
+func (t *Tree) writeManifest() error {
+	if err := t.TreeInner.Levels.WriteToDisk(); err != nil {
+		return &manifestError{err: err}
+	}
+	return nil
+}
+
+// BackgroundError returns the error that switched the tree into
+// read-only mode, nil if the tree is writable
+func (t *Tree) BackgroundError() error {
+	if bgErr := t.TreeInner.BackgroundErr.Load(); bgErr != nil {
+		return bgErr
+	}
+	return nil
+}
+
+// IsReadOnly returns true if writes are rejected because of a background error
+func (t *Tree) IsReadOnly() bool {
+	return t.TreeInner.BackgroundErr.Load() != nil
+}
+
+// setBackgroundError switches the tree into read-only mode, only the
+// first error is kept until Resume
+func (t *Tree) setBackgroundError(reason event.BackgroundErrorReason, err error) {
+	var mErr *manifestError
+	if errors.As(err, &mErr) {
+		reason = event.ReasonManifest
+	}
+
+	if t.TreeInner.BackgroundErr.CompareAndSwap(nil, &BackgroundError{Reason: reason, Err: err}) {
+		t.TreeInner.Logger.Error("Background error, tree is read-only",
+			slog.String("reason", string(reason)), logging.Err(err))
+	}
+
+	info := event.BackgroundErrorInfo{Reason: reason, Err: err}
+	t.notify(func(l event.Listener) { l.OnBackgroundError(info) })
+}
+
+// Resume retries the work that failed in the background, and makes the tree
+// writable again, call it once the underlying problem (e.g. a full disk) is fixed
+//
+// The levels manifest is rewritten and failed flushes are queued again, in
+// their original order. If the work fails again, its error is returned and
+// the tree stays read-only.
+func (t *Tree) Resume() error {
+	q := t.TreeInner.FlushQueue
+
+	q.enqueueMutex.Lock()
+	if t.IsClosed() {
+		q.enqueueMutex.Unlock()
+		return ErrClosed
+	}
+	if !t.IsReadOnly() {
+		q.enqueueMutex.Unlock()
+		return nil
+	}
+
+	// Queued flushes fail fast while the tree is read-only, once they are
+	// done all sealed memtables are waiting to be retried
+	q.waitIdle()
+
+	t.TreeInner.LevelsMutex.Lock()
+	err := t.writeManifest()
+	if err == nil {
+		err = t.updatePinning()
+	}
+	t.TreeInner.LevelsMutex.Unlock()
+	if err != nil {
+		q.enqueueMutex.Unlock()
+		return err
+	}
+
+	t.TreeInner.BackgroundMutex.Lock()
+	failed := t.TreeInner.FailedFlushes
+	t.TreeInner.FailedFlushes = nil
+	t.TreeInner.BackgroundErr.Store(nil)
+	t.TreeInner.BackgroundMutex.Unlock()
+
+	t.TreeInner.Logger.Info("Resuming tree", slog.Int("flushes", len(failed)))
+
+	retried := make([]*PendingFlush, 0, len(failed))
+	for _, task := range failed {
+		retried = append(retried, t.enqueue(task.id, task.memtable, task.onDurable))
+	}
+	q.enqueueMutex.Unlock()
+
+	defer t.TreeInner.WriteController.Signal()
+	for _, task := range retried {
+		if _, err := task.Wait(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
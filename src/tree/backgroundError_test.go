@@ -0,0 +1,99 @@
+package tree
+
+import (
+	"bagh/config"
+	"bagh/event"
+	"bagh/file"
+	"bagh/value"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushErrorSwitchesToReadOnly(t *testing.T) {
+	folder := t.TempDir()
+	tree, err := Open(*config.NewConfig(folder))
+	assert.NoError(t, err)
+	assert.NoError(t, tree.Resume())
+
+	// Segments cannot be written into a file
+	segments := filepath.Join(folder, file.SegmentsFolder)
+	assert.NoError(t, os.RemoveAll(segments))
+	assert.NoError(t, os.WriteFile(segments, nil, 0644))
+
+	_, _, err = tree.Insert([]byte("a"), []byte("1"), 0)
+	assert.NoError(t, err)
+	_, err = tree.FlushActiveMemtable()
+	assert.Error(t, err)
+	assert.True(t, tree.IsReadOnly())
+
+	_, _, err = tree.Insert([]byte("b"), []byte("2"), 1)
+	var bgErr *BackgroundError
+	assert.True(t, errors.As(err, &bgErr))
+	assert.Equal(t, event.ReasonFlush, bgErr.Reason)
+	assert.Equal(t, bgErr, tree.BackgroundError())
+
+	// The sealed memtable is still readable
+	val, err := tree.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(val))
+	assert.Equal(t, 1, tree.PendingFlushes())
+
+	// Still broken, the tree stays read-only
+	assert.Error(t, tree.Resume())
+	assert.True(t, tree.IsReadOnly())
+
+	assert.NoError(t, os.Remove(segments))
+	assert.NoError(t, os.Mkdir(segments, 0755))
+	assert.NoError(t, tree.Resume())
+
+	assert.False(t, tree.IsReadOnly())
+	assert.Equal(t, 0, tree.PendingFlushes())
+	assert.Equal(t, 1, tree.SegmentCount())
+
+	_, _, err = tree.Insert([]byte("b"), []byte("2"), 1)
+	assert.NoError(t, err)
+	val, err = tree.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(val))
+
+	// The segment survives a restart
+	assert.NoError(t, tree.Close())
+	tree, err = Open(*config.NewConfig(folder))
+	assert.NoError(t, err)
+	val, err = tree.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(val))
+}
+
+func TestQueuedFlushesWaitForFailedFlush(t *testing.T) {
+	folder := t.TempDir()
+	tree, err := Open(*config.NewConfig(folder).FlushWorkers(2))
+	assert.NoError(t, err)
+
+	segments := filepath.Join(folder, file.SegmentsFolder)
+	assert.NoError(t, os.RemoveAll(segments))
+	assert.NoError(t, os.WriteFile(segments, nil, 0644))
+
+	var pending []*PendingFlush
+	for i, key := range []string{"a", "b", "c"} {
+		_, _, err := tree.Insert([]byte(key), []byte("v"), value.SeqNo(i))
+		assert.NoError(t, err)
+		pending = append(pending, tree.ScheduleFlush(nil))
+	}
+	for _, task := range pending {
+		_, err := task.Wait()
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 3, tree.PendingFlushes())
+
+	assert.NoError(t, os.Remove(segments))
+	assert.NoError(t, os.Mkdir(segments, 0755))
+	assert.NoError(t, tree.Resume())
+
+	assert.Equal(t, 0, tree.PendingFlushes())
+	assert.Equal(t, 3, tree.SegmentCount())
+}
@@ -0,0 +1,235 @@
+package tree
+
+import (
+	"bagh/blob"
+	"bagh/segment"
+	"bagh/value"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// blobRefsCollector is the name of the collector recording the blob files
+// a segment points into, in the property "files"
+const blobRefsCollector = "bagh.blob"
+
+type blobRefs struct {
+	files map[string]struct{}
+}
+
+func newBlobRefs() segment.PropertiesCollector {
+	return &blobRefs{files: make(map[string]struct{})}
+}
+
+func (c *blobRefs) Name() string {
+	return blobRefsCollector
+}
+
+func (c *blobRefs) Add(item *value.Value) {
+	if !item.IsIndirection() {
+		return
+	}
+	if ptr, err := blob.DecodeValuePointer(item.Value); err == nil {
+		c.files[ptr.FileID] = struct{}{}
+	}
+}
+
+func (c *blobRefs) Finish() segment.Properties {
+	files := make([]string, 0, len(c.files))
+	for fileID := range c.files {
+		files = append(files, fileID)
+	}
+	sort.Strings(files)
+	return segment.Properties{"files": strings.Join(files, ",")}
+}
+
+// withBlobRefs appends the blob references collector to the collectors of the config
+func withBlobRefs(collectors []segment.PropertiesCollectorFactory) []segment.PropertiesCollectorFactory {
+	return append(collectors[:len(collectors):len(collectors)], newBlobRefs)
+}
+
+// segmentBlobRefs adds the blob files a segment points into to files, and
+// reports false if the segment does not record them
+func segmentBlobRefs(sg *segment.Segment, files map[string]struct{}) bool {
+	refs, ok := sg.Properties().Get(blobRefsCollector, "files")
+	if !ok {
+		return false
+	}
+	for _, fileID := range strings.Split(refs, ",") {
+		if fileID != "" {
+			files[fileID] = struct{}{}
+		}
+	}
+	return true
+}
+
+// resolveValue replaces an indirection by the value stored in its blob file
+func (t *Tree) resolveValue(item *value.Value) (*value.Value, error) {
+	if item == nil || !item.IsIndirection() {
+		return item, nil
+	}
+
+	ptr, err := blob.DecodeValuePointer(item.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := t.TreeInner.Blobs.Get(ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &value.Value{
+		Key:       item.Key,
+		Value:     val,
+		SeqNo:     item.SeqNo,
+		ValueType: value.Record,
+	}, nil
+}
+
+// BlobFileCount returns the amount of blob files of the tree
+func (t *Tree) BlobFileCount() int {
+	return t.TreeInner.Blobs.Len()
+}
+
+// isBlobLive reports if the newest version of a key still points at the given blob record
+//
+// Reads may still find the pointer into an obsolete blob file, whose record
+// was relocated with the same key and seqno, the relocated copy is live then.
+func (t *Tree) isBlobLive(record *blob.Record) (bool, error) {
+	item, err := t.GetInternalEntry(record.Key, false, nil)
+	if err != nil || item == nil {
+		return false, err
+	}
+	if !item.IsIndirection() || item.SeqNo != record.SeqNo {
+		return false, nil
+	}
+
+	ptr, err := blob.DecodeValuePointer(item.Value)
+	if err != nil {
+		return false, err
+	}
+	return *ptr == record.Pointer || t.TreeInner.Blobs.IsObsolete(ptr.FileID), nil
+}
+
+// CollectBlobGarbage rewrites blob files whose stale ratio is at least staleThreshold
+//
+// Live values are moved into a new blob file, and their new pointers are
+// flushed into a segment with their original seqno. The old blob files are
+// deleted once compactions have dropped every segment pointing into them.
+func (t *Tree) CollectBlobGarbage(staleThreshold float64) (*blob.GcReport, error) {
+	if err := t.checkPrimary(); err != nil {
+		return nil, err
+	}
+	if t.TreeInner.OpenSnapshots.HasOpenSnapshots() {
+		return nil, fmt.Errorf("cannot collect blob garbage while snapshots are open")
+	}
+
+	t.TreeInner.BlobMutex.Lock()
+	defer t.TreeInner.BlobMutex.Unlock()
+
+	report, err := t.TreeInner.Blobs.Collect(staleThreshold, t.isBlobLive)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, relocation := range report.Relocations {
+		_, _, err := t.AppendEntry(value.Value{
+			Key:       relocation.Key,
+			Value:     relocation.Pointer.Encode(),
+			SeqNo:     relocation.SeqNo,
+			ValueType: value.Indirection,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(report.Relocations) > 0 {
+		if _, err := t.FlushActiveMemtable(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only now the relocations are durable, and the old files must not be collected again
+	for _, fileID := range report.Obsolete {
+		if err := t.TreeInner.Blobs.MarkObsolete(fileID); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.removeUnreferencedBlobs(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// removeObsoleteBlobs deletes the obsolete blob files no segment points into,
+// including the segments that are only kept for open scans
+func (t *Tree) removeObsoleteBlobs() error {
+	t.TreeInner.BlobMutex.Lock()
+	defer t.TreeInner.BlobMutex.Unlock()
+	return t.removeUnreferencedBlobs()
+}
+
+// removeUnreferencedBlobs is removeObsoleteBlobs, the caller has to hold the blob lock
+func (t *Tree) removeUnreferencedBlobs() error {
+	obsolete := t.TreeInner.Blobs.Obsolete()
+	if len(obsolete) == 0 {
+		return nil
+	}
+
+	referenced, ok := t.referencedBlobFiles()
+	if !ok {
+		return nil
+	}
+	for _, fileID := range obsolete {
+		if _, ok := referenced[fileID]; ok {
+			continue
+		}
+		if err := t.TreeInner.Blobs.Remove(fileID); err != nil {
+			return err
+		}
+		t.TreeInner.Logger.Debug("Removed obsolete blob file", slog.String("blob_file", fileID))
+	}
+	return nil
+}
+
+// referencedBlobFiles returns the blob files the segments point into, it
+// reports false if a segment does not record them
+func (t *Tree) referencedBlobFiles() (map[string]struct{}, bool) {
+	referenced := make(map[string]struct{})
+
+	t.TreeInner.LevelsMutex.RLock()
+	defer t.TreeInner.LevelsMutex.RUnlock()
+
+	for _, sg := range t.TreeInner.Levels.GetAllSegmentsFlattened() {
+		if !segmentBlobRefs(sg, referenced) {
+			return nil, false
+		}
+	}
+	for _, sg := range t.heldObsoleteSegments() {
+		if !segmentBlobRefs(sg, referenced) {
+			return nil, false
+		}
+	}
+	return referenced, true
+}
+
+// markUnreferencedBlobs marks the blob files no segment points into as
+// obsolete, e.g. the ones written by a flush that did not finish
+func (t *Tree) markUnreferencedBlobs() error {
+	referenced, ok := t.referencedBlobFiles()
+	if !ok {
+		return nil
+	}
+	for _, info := range t.TreeInner.Blobs.Files() {
+		if _, ok := referenced[info.ID]; ok {
+			continue
+		}
+		if err := t.TreeInner.Blobs.MarkObsolete(info.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
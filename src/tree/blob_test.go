@@ -0,0 +1,122 @@
+package tree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"bagh/config"
+	"bagh/value"
+	"bagh/vfs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectBlobGarbage(t *testing.T) {
+	fs := vfs.NewMemFS()
+	cfg := *config.NewConfig("/tree").SetFS(fs).BlobThreshold(100)
+	tree, err := Open(cfg)
+	require.NoError(t, err)
+
+	large := func(key string) []byte { return bytes.Repeat([]byte(key), 200) }
+	seqno := value.SeqNo(0)
+	insert := func(key string, val []byte) {
+		_, _, err := tree.Insert([]byte(key), val, seqno)
+		require.NoError(t, err)
+		seqno++
+	}
+	flush := func() {
+		_, err := tree.FlushActiveMemtable()
+		require.NoError(t, err)
+	}
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		insert(key, large(key))
+	}
+	flush()
+
+	// Half of the blob file goes stale
+	insert("c", []byte("small"))
+	insert("d", []byte("small"))
+	flush()
+
+	// Unrelated segments, so the relocations are not the newest segment
+	for i := 0; i < 12; i++ {
+		insert(fmt.Sprintf("other-%02d", i), []byte("v"))
+		flush()
+	}
+
+	assertValues := func(tree *Tree) {
+		t.Helper()
+		assertGet(t, string(large("a")), tree.Get, "a")
+		assertGet(t, string(large("b")), tree.Get, "b")
+		assertGet(t, "small", tree.Get, "c")
+		assertGet(t, "small", tree.Get, "d")
+	}
+
+	report, err := tree.CollectBlobGarbage(0.3)
+	require.NoError(t, err)
+	require.Len(t, report.Relocations, 2)
+	require.Len(t, report.Obsolete, 1)
+	assertValues(tree)
+
+	// Reads still find the old pointers, the relocated values are live
+	report, err = tree.CollectBlobGarbage(0.3)
+	require.NoError(t, err)
+	assert.Empty(t, report.Obsolete)
+
+	// The old segment still points into the rewritten blob file
+	assert.Equal(t, 2, tree.BlobFileCount())
+
+	require.NoError(t, tree.Close())
+	tree, err = Open(cfg)
+	require.NoError(t, err)
+	assertValues(tree)
+	assert.Equal(t, 2, tree.BlobFileCount())
+
+	// Compaction drops the last pointers into the rewritten blob file
+	require.NoError(t, tree.MajorCompact(1<<20))
+	assertValues(tree)
+	assert.Equal(t, 1, tree.BlobFileCount())
+
+	require.NoError(t, tree.Close())
+	tree, err = Open(cfg)
+	require.NoError(t, err)
+	defer tree.Close()
+	assertValues(tree)
+	assert.Equal(t, 1, tree.BlobFileCount())
+}
+
+func TestScanMissingBlobFile(t *testing.T) {
+	fs := vfs.NewMemFS()
+	cfg := *config.NewConfig("/tree").SetFS(fs).BlobThreshold(100)
+	tree, err := Open(cfg)
+	require.NoError(t, err)
+
+	for _, key := range []string{"a", "b", "c"} {
+		_, _, err := tree.Insert([]byte(key), bytes.Repeat([]byte(key), 200), 0)
+		require.NoError(t, err)
+	}
+	_, err = tree.FlushActiveMemtable()
+	require.NoError(t, err)
+	files := tree.TreeInner.Blobs.Files()
+	require.Len(t, files, 1)
+	require.NoError(t, tree.Close())
+
+	require.NoError(t, fs.Remove(files[0].Path))
+	tree, err = Open(cfg)
+	require.NoError(t, err)
+	defer tree.Close()
+
+	// The scan fails instead of ending early
+	iter := tree.Iter().IntoIter()
+	_, _, ok := iter.Next()
+	assert.False(t, ok)
+	assert.Error(t, iter.Err())
+
+	iter = tree.Iter().IntoIter()
+	_, _, ok = iter.NextBack()
+	assert.False(t, ok)
+	assert.Error(t, iter.Err())
+}
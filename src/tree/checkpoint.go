@@ -0,0 +1,160 @@
+package tree
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"bagh/file"
+	"bagh/segment"
+	"bagh/vfs"
+)
+
+// Verify reads every block of every segment, checking the checksums, the
+// order of the items and that each segment matches its metadata
+//
+// Compactions cannot replace segments while the tree is verified.
+func (t *Tree) Verify() error {
+	if t.TreeInner.Closed.Load() {
+		return ErrClosed
+	}
+
+	t.TreeInner.LevelsMutex.RLock()
+	defer t.TreeInner.LevelsMutex.RUnlock()
+
+	for _, sg := range t.TreeInner.Levels.GetAllSegmentsFlattened() {
+		inspector, err := segment.NewInspector(t.TreeInner.FS, sg.Metadata.Path, t.TreeInner.Comparator)
+		if err != nil {
+			return err
+		}
+		err = inspector.Verify()
+		inspector.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checkpoint creates an openable copy of the tree's segments in dir, which
+// must not exist yet
+//
+// Segment and blob files are immutable, so they are hard-linked (or copied,
+// if linking fails), and the checkpoint takes hardly any space. Items still
+// in memtables are not part of the checkpoint, flush them first.
+func (t *Tree) Checkpoint(dir string) error {
+	if t.TreeInner.Closed.Load() {
+		return ErrClosed
+	}
+
+	fs := t.TreeInner.FS
+	path := t.TreeInner.Config.Path
+	if _, err := fs.Stat(dir); !os.IsNotExist(err) {
+		return fmt.Errorf("checkpoint directory %s must not exist yet", dir)
+	}
+	if err := file.MkdirAllSynced(fs, filepath.Join(dir, file.SegmentsFolder)); err != nil {
+		return err
+	}
+
+	for _, name := range []string{file.ConfigFile, file.LSMMarker} {
+		if err := copyFile(fs, filepath.Join(path, name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	// The linked blob files have to include every file the linked segments
+	// point into, so blob garbage collection cannot remove any of them,
+	// and the manifest has to match the linked segments, so compactions
+	// cannot replace them in the meantime
+	t.TreeInner.BlobMutex.Lock()
+	defer t.TreeInner.BlobMutex.Unlock()
+	t.TreeInner.LevelsMutex.RLock()
+	defer t.TreeInner.LevelsMutex.RUnlock()
+
+	if err := t.linkBlobs(dir); err != nil {
+		return err
+	}
+
+	for _, sg := range t.TreeInner.Levels.GetAllSegmentsFlattened() {
+		folder := filepath.Join(dir, file.SegmentsFolder, sg.Metadata.ID)
+		if err := linkFolder(fs, sg.Metadata.Path, folder); err != nil {
+			return fmt.Errorf("failed to checkpoint segment %s: %w", sg.Metadata.ID, err)
+		}
+	}
+
+	manifest, err := json.MarshalIndent(t.TreeInner.Levels.Levels, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := file.RewriteAtomic(fs, filepath.Join(dir, file.LevelsManifestFile), manifest); err != nil {
+		return err
+	}
+
+	return fs.SyncDir(dir)
+}
+
+// linkBlobs links the blob files of the tree into the checkpoint directory
+func (t *Tree) linkBlobs(dir string) error {
+	files := t.TreeInner.Blobs.Files()
+	if len(files) == 0 {
+		return nil
+	}
+
+	folder := filepath.Join(dir, file.BlobsFolder)
+	if err := file.MkdirAllSynced(t.TreeInner.FS, folder); err != nil {
+		return err
+	}
+	for _, info := range files {
+		if err := linkFile(t.TreeInner.FS, info.Path, filepath.Join(folder, info.ID)); err != nil {
+			return err
+		}
+	}
+	return t.TreeInner.FS.SyncDir(folder)
+}
+
+// linkFolder links all files of a folder into a new folder
+func linkFolder(fs vfs.FS, src, dest string) error {
+	entries, err := fs.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err := file.MkdirAllSynced(fs, dest); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := linkFile(fs, filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return fs.SyncDir(dest)
+}
+
+// linkFile hard-links a file, copying it if the filesystem cannot link it
+func linkFile(fs vfs.FS, src, dest string) error {
+	if err := fs.Link(src, dest); err == nil {
+		return nil
+	}
+	return copyFile(fs, src, dest)
+}
+
+func copyFile(fs vfs.FS, src, dest string) error {
+	content, err := vfs.ReadFile(fs, src)
+	if err != nil {
+		return err
+	}
+
+	f, err := fs.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
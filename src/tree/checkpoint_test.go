@@ -0,0 +1,122 @@
+package tree
+
+import (
+	"bagh/config"
+	"bagh/file"
+	"bagh/value"
+	"bagh/vfs"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scanAll(t *testing.T, tree *Tree) []string {
+	var items []string
+	iter := tree.Iter().IntoIter()
+	for key, val, ok := iter.Next(); ok; key, val, ok = iter.Next() {
+		items = append(items, fmt.Sprintf("%s=%s", *key, *val))
+	}
+	return items
+}
+
+func TestCheckpoint(t *testing.T) {
+	tree := newScanTree(t)
+	_, err := tree.FlushActiveMemtable()
+	require.NoError(t, err)
+	require.NoError(t, tree.Verify())
+
+	fs := tree.TreeInner.FS
+	require.NoError(t, tree.Checkpoint("/checkpoint"))
+	assert.Error(t, tree.Checkpoint("/checkpoint"), "the directory exists")
+
+	checkpoint, err := Open(*config.NewConfig("/checkpoint").SetFS(fs))
+	require.NoError(t, err)
+	defer checkpoint.Close()
+
+	assert.Equal(t, tree.SegmentCount(), checkpoint.SegmentCount())
+	assert.Equal(t, expectedScan(0, 299), scanAll(t, checkpoint))
+	require.NoError(t, checkpoint.Verify())
+
+	// Both trees go their own way from here
+	_, _, err = checkpoint.Insert([]byte("key-999"), []byte("new"), 3)
+	require.NoError(t, err)
+	_, err = checkpoint.FlushActiveMemtable()
+	require.NoError(t, err)
+	require.NoError(t, checkpoint.MajorCompact(64*1024*1024))
+
+	entries, err := fs.ReadDir(filepath.Join("/checkpoint", file.SegmentsFolder))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	assert.Equal(t, expectedScan(0, 299), scanAll(t, tree))
+	require.NoError(t, tree.Verify())
+}
+
+func TestVerifyCorruption(t *testing.T) {
+	tree := newScanTree(t)
+	require.NoError(t, tree.Verify())
+
+	sg := tree.TreeInner.Levels.GetAllSegmentsFlattened()[0]
+	blocks, err := tree.TreeInner.FS.OpenFile(filepath.Join(sg.Metadata.Path, file.BlocksFile), os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = blocks.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 32)
+	require.NoError(t, err)
+	require.NoError(t, blocks.Close())
+
+	assert.ErrorContains(t, tree.Verify(), sg.Metadata.ID)
+}
+
+func TestCheckpointDuringBlobGarbageCollection(t *testing.T) {
+	fs := vfs.NewMemFS()
+	tree, err := Open(*config.NewConfig("/tree").SetFS(fs).BlobThreshold(100))
+	require.NoError(t, err)
+	defer tree.Close()
+
+	keys := []string{"a", "b", "c", "d"}
+	large := func(key string, round int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%s%d", key, round)), 100)
+	}
+	seqno := value.SeqNo(0)
+	write := func(round int, keys ...string) {
+		for _, key := range keys {
+			_, _, err := tree.Insert([]byte(key), large(key, round), seqno)
+			assert.NoError(t, err)
+			seqno++
+		}
+		_, err := tree.FlushActiveMemtable()
+		assert.NoError(t, err)
+	}
+	write(0, keys...)
+
+	// Half of every blob file goes stale, and is rewritten
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 1; round <= 20; round++ {
+			write(round, "c", "d")
+			_, err := tree.CollectBlobGarbage(0.3)
+			assert.NoError(t, err)
+			assert.NoError(t, tree.MajorCompact(1<<20))
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		dir := fmt.Sprintf("/checkpoint-%d", i)
+		require.NoError(t, tree.Checkpoint(dir))
+
+		checkpoint, err := Open(*config.NewConfig(dir).SetFS(fs))
+		require.NoError(t, err)
+		for _, key := range keys {
+			val, err := checkpoint.Get([]byte(key))
+			require.NoError(t, err, key)
+			assert.NotNil(t, val, key)
+		}
+		require.NoError(t, checkpoint.Close())
+	}
+	<-done
+}
@@ -0,0 +1,76 @@
+package tree
+
+import (
+	"bagh/logging"
+	"errors"
+)
+
+// ErrClosed is returned by calls on a closed tree
+var ErrClosed = errors.New("tree is closed")
+
+// ErrComparatorMismatch is returned when opening a tree with another
+// comparator than the one it was created with
+var ErrComparatorMismatch = errors.New("comparator mismatch")
+
+// errCompactionCancelled is returned by compactions stopped by the stop signal
+var errCompactionCancelled = errors.New("compaction cancelled")
+
+// Close stops the flush workers once the queued flushes are done, waits for
+// running compactions, releases the open files of the tree and the lock
+// of its directory
+//
+// The active memtable is not flushed, its items are only durable if they are
+// in a write-ahead log. Calls after Close return ErrClosed.
+func (t *Tree) Close() error {
+	q := t.TreeInner.FlushQueue
+
+	q.enqueueMutex.Lock()
+	if !t.TreeInner.Closed.CompareAndSwap(false, true) {
+		q.enqueueMutex.Unlock()
+		return ErrClosed
+	}
+	close(q.tasks)
+	q.enqueueMutex.Unlock()
+
+	t.TreeInner.Logger.Info("Closing LSM-tree", logging.Path(t.TreeInner.Config.Path))
+
+	q.workers.Wait()
+
+	// Compactions and ingestion hold the read lock
+	t.TreeInner.WorkMutex.Lock()
+	defer t.TreeInner.WorkMutex.Unlock()
+
+	// Writers waiting for a stall to end fail with ErrClosed
+	t.TreeInner.WriteController.Signal()
+
+	if manager := t.TreeInner.WriteBufferManager; manager != nil {
+		manager.Unregister(t)
+
+		t.TreeInner.ActiveMutex.RLock()
+		manager.Free(uint64(t.TreeInner.ActiveMemtable.Size()))
+		t.TreeInner.ActiveMutex.RUnlock()
+
+		t.TreeInner.SealedMutex.RLock()
+		for _, sealed := range t.TreeInner.SealedMemtables {
+			manager.Free(uint64(sealed.Size()))
+		}
+		t.TreeInner.SealedMutex.RUnlock()
+	}
+
+	// The block cache and descriptor table may be shared with other trees
+	t.releaseSegments()
+	t.TreeInner.Blobs.Close()
+
+	return t.TreeInner.DirLock.Unlock()
+}
+
+// CancelBackgroundWork sends the stop signal, running compactions are
+// cancelled instead of finishing, e.g. to close the tree faster
+func (t *Tree) CancelBackgroundWork() {
+	t.TreeInner.StopSignal.Send()
+}
+
+// IsClosed returns true once Close was called
+func (t *Tree) IsClosed() bool {
+	return t.TreeInner.Closed.Load()
+}
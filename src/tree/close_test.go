@@ -0,0 +1,93 @@
+package tree
+
+import (
+	"bagh/compaction"
+	"bagh/config"
+	"bagh/file"
+	"bagh/value"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClose(t *testing.T) {
+	folder := t.TempDir()
+	cfg := config.NewConfig(folder)
+	tree, err := Open(*cfg)
+	assert.NoError(t, err)
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("key-%d", i))
+			_, _, err := tree.Insert(key, []byte(fmt.Sprintf("value-%d", round)), value.SeqNo(round*10+i))
+			assert.NoError(t, err)
+		}
+		if round == 1 {
+			_, err := tree.FlushActiveMemtable()
+			assert.NoError(t, err)
+
+			assert.NotZero(t, cfg.DescriptorTable.Len())
+			continue
+		}
+		// Queued flushes are finished by Close
+		assert.NotNil(t, tree.ScheduleFlush(nil))
+	}
+
+	assert.NoError(t, tree.Close())
+	assert.True(t, tree.IsClosed())
+	assert.Equal(t, 3, tree.SegmentCount())
+	assert.Zero(t, cfg.DescriptorTable.Len())
+
+	assert.ErrorIs(t, tree.Close(), ErrClosed)
+	_, _, err = tree.Insert([]byte("a"), []byte("1"), 100)
+	assert.ErrorIs(t, err, ErrClosed)
+	_, err = tree.Get([]byte("key-1"))
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, tree.Compact(compaction.NewMajor(64*1024*1024)), ErrClosed)
+	_, err = tree.FlushActiveMemtable()
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, tree.Resume(), ErrClosed)
+
+	tree, err = Open(*config.NewConfig(folder))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, tree.SegmentCount())
+	assert.NoError(t, tree.Close())
+}
+
+func TestCancelledCompaction(t *testing.T) {
+	tree, err := Open(*config.NewConfig(t.TempDir()))
+	assert.NoError(t, err)
+
+	for round := 0; round < 2; round++ {
+		_, _, err := tree.Insert([]byte("a"), []byte("1"), value.SeqNo(round))
+		assert.NoError(t, err)
+		_, err = tree.FlushActiveMemtable()
+		assert.NoError(t, err)
+	}
+
+	tree.CancelBackgroundWork()
+	assert.Error(t, tree.Compact(compaction.NewMajor(64*1024*1024)))
+
+	// Cancelling is not a background error, the segments are untouched
+	assert.False(t, tree.IsReadOnly())
+	assert.Equal(t, 2, tree.SegmentCount())
+	assert.NoError(t, tree.Close())
+}
+
+func TestOpenLocksDirectory(t *testing.T) {
+	folder := t.TempDir()
+	tree, err := Open(*config.NewConfig(folder))
+	assert.NoError(t, err)
+
+	_, err = Open(*config.NewConfig(folder))
+	assert.ErrorIs(t, err, file.ErrLocked)
+	assert.ErrorContains(t, err, fmt.Sprintf("process %d", os.Getpid()))
+
+	assert.NoError(t, tree.Close())
+
+	tree, err = Open(*config.NewConfig(folder))
+	assert.NoError(t, err)
+	assert.NoError(t, tree.Close())
+}
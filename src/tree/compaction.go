@@ -0,0 +1,284 @@
+package tree
+
+import (
+	"bagh/compaction"
+	"bagh/event"
+	"bagh/file"
+	"bagh/logging"
+	"bagh/merge"
+	"bagh/segment"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Compact runs a single compaction, as decided by the given strategy
+func (t *Tree) Compact(strategy compaction.Strategy) error {
+	t.TreeInner.WorkMutex.RLock()
+	defer t.TreeInner.WorkMutex.RUnlock()
+
+	if t.IsClosed() {
+		return ErrClosed
+	}
+	if err := t.checkPrimary(); err != nil {
+		return err
+	}
+	if err := t.BackgroundError(); err != nil {
+		return err
+	}
+
+	// Runs after the levels lock is released, stopped writes may resume
+	defer t.TreeInner.WriteController.Signal()
+
+	start := time.Now()
+	info, obsolete, err := t.compact(strategy)
+	if info == nil {
+		return err
+	}
+
+	info.Duration = time.Since(start)
+	info.Err = err
+	t.notify(func(l event.Listener) { l.OnCompactionCompleted(*info) })
+
+	if err == nil {
+		err = t.deleteSegments(obsolete)
+	}
+	if err == nil {
+		err = t.removeObsoleteBlobs()
+	}
+	if err != nil && !errors.Is(err, errCompactionCancelled) {
+		t.setBackgroundError(event.ReasonCompaction, err)
+	}
+	return err
+}
+
+// compact runs the compaction chosen by the strategy, and returns the
+// segments to delete once it is done, info is nil if nothing was chosen
+func (t *Tree) compact(strategy compaction.Strategy) (*event.CompactionInfo, []*segment.Segment, error) {
+	t.TreeInner.LevelsMutex.Lock()
+	choice := strategy.Choose(t.TreeInner.Levels, t.TreeInner.Config)
+
+	if choice.IsEmpty() {
+		t.TreeInner.LevelsMutex.Unlock()
+		return nil, nil, nil
+	}
+
+	if len(choice.Drop) > 0 {
+		dropped := t.unlinkSegments(choice.Drop)
+		info := &event.CompactionInfo{Inputs: segmentMetadatas(dropped)}
+		err := t.writeManifest()
+		t.TreeInner.LevelsMutex.Unlock()
+
+		t.notify(func(l event.Listener) { l.OnCompactionBegin(*info) })
+		if err != nil {
+			return info, nil, err
+		}
+		return info, dropped, nil
+	}
+
+	input := choice.Merge
+	t.TreeInner.Levels.HideSegments(input.SegmentIDs)
+	start := time.Now()
+
+	// Leftover segments (not chosen) may hold older versions of the merged keys,
+	// so tombstones need to be kept around to shadow them
+	evictTombstones := input.DestLevel == t.TreeInner.Levels.LastLevelIndex() &&
+		len(input.SegmentIDs) == t.TreeInner.Levels.Len()
+
+	var bytesRead uint64
+	inputs := make([]*segment.Segment, 0, len(input.SegmentIDs))
+	sources := make([]merge.Iterator, 0, len(input.SegmentIDs))
+	for _, segmentID := range input.SegmentIDs {
+		sg := t.TreeInner.Levels.Segments[segmentID]
+		bytesRead += sg.Metadata.FileSize
+		inputs = append(inputs, sg)
+	}
+	sortNewestFirst(inputs)
+	for _, sg := range inputs {
+		sources = append(sources, sg.Iter(false))
+	}
+	t.TreeInner.LevelsMutex.Unlock()
+
+	info := &event.CompactionInfo{DestLevel: input.DestLevel, Inputs: segmentMetadatas(inputs)}
+	t.notify(func(l event.Listener) { l.OnCompactionBegin(*info) })
+
+	created, err := t.mergeSegments(sources, input, evictTombstones)
+
+	t.TreeInner.LevelsMutex.Lock()
+	defer t.TreeInner.LevelsMutex.Unlock()
+
+	t.TreeInner.Levels.ShowSegments(input.SegmentIDs)
+	if err != nil {
+		return info, nil, err
+	}
+
+	old := t.unlinkSegments(input.SegmentIDs)
+	for _, sg := range created {
+		t.TreeInner.Levels.InsertIntoLevel(input.DestLevel, sg)
+	}
+	info.Outputs = segmentMetadatas(created)
+	if err := t.writeManifest(); err != nil {
+		return info, nil, err
+	}
+	if err := t.updatePinning(); err != nil {
+		return info, nil, err
+	}
+
+	var bytesWritten uint64
+	for _, sg := range created {
+		bytesWritten += sg.Metadata.FileSize
+	}
+	registry := t.TreeInner.Stats
+	registry.Compactions.Add(1)
+	registry.CompactionBytesRead.Add(bytesRead)
+	registry.CompactionBytesWritten.Add(bytesWritten)
+	registry.CompactionLatency.Since(start)
+
+	t.TreeInner.Logger.Info("Compacted segments",
+		logging.Level(input.DestLevel),
+		slog.Int("inputs", len(input.SegmentIDs)),
+		slog.Int("outputs", len(created)))
+
+	return info, old, nil
+}
+
+// MajorCompact merges all segments into the last level
+func (t *Tree) MajorCompact(targetSize uint64) error {
+	t.TreeInner.Logger.Info("Starting major compaction")
+	return t.Compact(compaction.NewMajor(targetSize))
+}
+
+func (t *Tree) mergeSegments(sources []merge.Iterator, input *compaction.Input, evictTombstones bool) ([]*segment.Segment, error) {
+	// Old versions need to stay readable for open snapshots
+	evictOldVersions := !t.TreeInner.OpenSnapshots.HasOpenSnapshots()
+
+	iter := merge.NewMergeIterator(sources).
+		EvictOldVersion(evictOldVersions).
+		WithComparator(t.TreeInner.Comparator)
+
+	// Only the newest version of a key is written, so its tombstone shadows nothing
+	evictTombstones = evictOldVersions && evictTombstones
+
+	segmentsFolder := filepath.Join(t.TreeInner.Config.Path, file.SegmentsFolder)
+	writer, err := segment.NewMultiWriter(input.TargetSize, segment.Options{
+		Path:            segmentsFolder,
+		EvictTombstones: evictTombstones,
+		BlockSize:       t.TreeInner.Config.BlockSize,
+		Collectors:      t.TreeInner.Collectors,
+		BloomBitsPerKey: t.TreeInner.Config.BloomBitsPerKey,
+		FS:              t.TreeInner.FS,
+		Comparator:      t.TreeInner.Comparator,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if t.TreeInner.StopSignal.IsStopped() {
+			return nil, errCompactionCancelled
+		}
+
+		item, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		if item == nil {
+			break
+		}
+		if err := writer.Write(*item); err != nil {
+			return nil, err
+		}
+	}
+
+	metadatas, err := writer.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	created := make([]*segment.Segment, 0, len(metadatas))
+	for i := range metadatas {
+		metadata := &metadatas[i]
+		if err := metadata.WriteToFile(t.TreeInner.FS); err != nil {
+			return nil, err
+		}
+
+		sg, err := segment.RecoverSegment(metadata.Path, t.TreeInner.BlockCache, t.TreeInner.DescriptorTable, t.TreeInner.Comparator)
+		if err != nil {
+			return nil, err
+		}
+		t.TreeInner.DescriptorTable.Insert(filepath.Join(metadata.Path, file.BlocksFile), metadata.ID)
+
+		created = append(created, sg)
+	}
+
+	return created, nil
+}
+
+// unlinkSegments removes segments from the levels, the caller has to hold the levels lock
+func (t *Tree) unlinkSegments(segmentIDs []string) []*segment.Segment {
+	removed := make([]*segment.Segment, 0, len(segmentIDs))
+	for _, segmentID := range segmentIDs {
+		sg, ok := t.TreeInner.Levels.Segments[segmentID]
+		if !ok {
+			continue
+		}
+		t.TreeInner.Levels.Remove(segmentID)
+		removed = append(removed, sg)
+	}
+	return removed
+}
+
+// deleteSegments deletes the files of segments that are no longer part of the tree,
+// the caller must not hold the levels lock
+//
+// Segments still read by scans are deleted once the last scan is done.
+func (t *Tree) deleteSegments(segments []*segment.Segment) error {
+	for _, sg := range segments {
+		sg := sg
+		deferred := t.deferCleanup(sg, func() {
+			err := t.deleteSegment(sg)
+			if err == nil {
+				err = t.removeObsoleteBlobs()
+			}
+			if err != nil {
+				t.TreeInner.Logger.Warn("Failed to delete segment after its last scan", logging.SegmentID(sg.Metadata.ID), logging.Err(err))
+			}
+		})
+		if deferred {
+			continue
+		}
+		if err := t.deleteSegment(sg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tree) deleteSegment(sg *segment.Segment) error {
+	t.TreeInner.DescriptorTable.Remove(sg.Metadata.ID)
+	t.TreeInner.BlockCache.RemoveSegment(sg.Metadata.ID)
+	err := t.TreeInner.FS.RemoveAll(sg.Metadata.Path)
+
+	info := event.SegmentDeletedInfo{SegmentID: sg.Metadata.ID, Path: sg.Metadata.Path, Err: err}
+	t.notify(func(l event.Listener) { l.OnSegmentDeleted(info) })
+
+	if err != nil {
+		return fmt.Errorf("failed to delete segment %s: %w", sg.Metadata.ID, err)
+	}
+	return nil
+}
+
+// sortNewestFirst orders segments by descending creation time, so the merge
+// prefers the newest copy of entries sharing key and seqno
+func sortNewestFirst(segments []*segment.Segment) {
+	sort.SliceStable(segments, func(i, j int) bool {
+		a, b := segments[i].Metadata, segments[j].Metadata
+		if a.CreatedAt != b.CreatedAt {
+			return a.CreatedAt > b.CreatedAt
+		}
+		return a.ID > b.ID
+	})
+}
@@ -0,0 +1,42 @@
+package tree
+
+import (
+	"path/filepath"
+	"testing"
+
+	"bagh/compaction"
+	"bagh/config"
+	"bagh/segment"
+	"bagh/value"
+	"bagh/vfs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMajorFilterOverlapping(t *testing.T) {
+	tree, err := Open(*config.NewConfig("/tree").SetFS(vfs.NewMemFS()))
+	require.NoError(t, err)
+	defer tree.Close()
+
+	flush := func(key, val string, seqno int) string {
+		_, _, err := tree.Insert([]byte(key), []byte(val), value.SeqNo(seqno))
+		require.NoError(t, err)
+		path, err := tree.FlushActiveMemtable()
+		require.NoError(t, err)
+		return filepath.Base(path)
+	}
+
+	old := flush("x", "old", 0)
+	flush("x", "new", 1)
+	unrelated := flush("z", "z", 2)
+
+	// The rejected segment holds an older version of a merged key
+	rejected := map[string]bool{old: true, unrelated: true}
+	filter := func(sg *segment.Segment) bool { return !rejected[sg.Metadata.ID] }
+	require.NoError(t, tree.Compact(&compaction.Major{TargetSize: 1 << 20, Filter: filter}))
+
+	assertGet(t, "new", tree.Get, "x")
+	assertGet(t, "z", tree.Get, "z")
+	assert.Equal(t, 2, tree.SegmentCount())
+}
@@ -0,0 +1,210 @@
+package tree
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"bagh/comparator"
+	"bagh/config"
+	"bagh/file"
+	"bagh/prefix"
+	"bagh/segment"
+	"bagh/value"
+	"bagh/vfs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reverseComparator orders keys bytewise descending
+type reverseComparator struct{}
+
+func (reverseComparator) Compare(a, b []byte) int { return bytes.Compare(b, a) }
+func (reverseComparator) Name() string            { return "test.ReverseComparator" }
+
+func TestComparator(t *testing.T) {
+	fs := vfs.NewMemFS()
+	cfg := *config.NewConfig("/tree").SetFS(fs).BlockSize(1024).SetComparator(reverseComparator{})
+	tree, err := Open(cfg)
+	require.NoError(t, err)
+
+	key := func(i int) string { return fmt.Sprintf("key-%03d", i) }
+	for i := 0; i < 300; i++ {
+		_, _, err := tree.Insert([]byte(key(i)), []byte("old"), 0)
+		require.NoError(t, err)
+	}
+	_, err = tree.FlushActiveMemtable()
+	require.NoError(t, err)
+	require.NoError(t, tree.MajorCompact(1))
+	lvl := tree.TreeInner.Levels
+	require.Greater(t, len(lvl.Levels[lvl.LastLevelIndex()].Segments), 1)
+
+	// Newer versions in L0 and the memtable
+	for i := 0; i < 300; i += 3 {
+		_, _, err := tree.Insert([]byte(key(i)), []byte("new"), 1)
+		require.NoError(t, err)
+	}
+	_, err = tree.FlushActiveMemtable()
+	require.NoError(t, err)
+	_, _, err = tree.Insert([]byte(key(1)), []byte("newest"), 2)
+	require.NoError(t, err)
+
+	expected := func(i int) string {
+		switch {
+		case i == 1:
+			return "newest"
+		case i%3 == 0:
+			return "new"
+		}
+		return "old"
+	}
+	for i := 0; i < 300; i++ {
+		assertGet(t, expected(i), tree.Get, key(i))
+	}
+	values, err := tree.MultiGet([][]byte{[]byte(key(0)), []byte(key(1)), []byte(key(299)), []byte("key-999")})
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(values[0]))
+	assert.Equal(t, "newest", string(values[1]))
+	assert.Equal(t, "old", string(values[2]))
+	assert.Nil(t, values[3])
+
+	// Scans run in comparator order
+	var scanned []string
+	iter := tree.Range([]byte(key(250)), []byte(key(50))).IntoIter()
+	for k, v, ok := iter.Next(); ok; k, v, ok = iter.Next() {
+		scanned = append(scanned, fmt.Sprintf("%s=%s", *k, *v))
+	}
+	require.Len(t, scanned, 201)
+	for j, item := range scanned {
+		assert.Equal(t, fmt.Sprintf("%s=%s", key(250-j), expected(250-j)), item)
+	}
+
+	require.NoError(t, tree.MajorCompact(1))
+	require.NoError(t, tree.Verify())
+	for i := 0; i < 300; i++ {
+		assertGet(t, expected(i), tree.Get, key(i))
+	}
+	require.NoError(t, tree.Close())
+
+	raw, err := vfs.ReadFile(fs, filepath.Join("/tree", file.ConfigFile))
+	require.NoError(t, err)
+	var persisted config.PersistedConfig
+	require.NoError(t, json.Unmarshal(raw, &persisted))
+	assert.Equal(t, "test.ReverseComparator", persisted.Comparator)
+
+	_, err = Open(*config.NewConfig("/tree").SetFS(fs))
+	assert.ErrorIs(t, err, ErrComparatorMismatch)
+
+	tree, err = Open(cfg)
+	require.NoError(t, err)
+	defer tree.Close()
+	first, _, ok := tree.FirstKeyValue()
+	require.True(t, ok)
+	assert.Equal(t, key(299), string(first))
+}
+
+func TestComparatorIngest(t *testing.T) {
+	fs := vfs.NewMemFS()
+	tree, err := Open(*config.NewConfig("/tree").SetFS(fs).SetComparator(reverseComparator{}))
+	require.NoError(t, err)
+	defer tree.Close()
+
+	build := func(folder string, cmp comparator.Comparator, keys ...string) string {
+		builder, err := segment.NewSegmentBuilderFS(fs, folder, 4096)
+		require.NoError(t, err)
+		builder.WithComparator(cmp)
+		for _, k := range keys {
+			require.NoError(t, builder.Put([]byte(k), []byte("ingested")))
+		}
+		_, err = builder.Finish()
+		require.NoError(t, err)
+		return folder
+	}
+
+	// Keys ascending bytewise are out of order for the tree
+	builder, err := segment.NewSegmentBuilderFS(fs, "/unsorted", 4096)
+	require.NoError(t, err)
+	builder.WithComparator(reverseComparator{})
+	require.NoError(t, builder.Put([]byte("a"), nil))
+	assert.Error(t, builder.Put([]byte("b"), nil))
+
+	bytewise := build("/bytewise", nil, "a", "b")
+	assert.Error(t, tree.IngestSegments([]string{bytewise}, 1))
+
+	reverse := build("/reverse", reverseComparator{}, "c", "b", "a")
+	require.NoError(t, tree.IngestSegments([]string{reverse}, 1))
+	assertGet(t, "ingested", tree.Get, "b")
+
+	first, _, ok := tree.FirstKeyValue()
+	require.True(t, ok)
+	assert.Equal(t, "c", string(first))
+}
+
+func TestComparatorPrefix(t *testing.T) {
+	tree, err := Open(*config.NewConfig("/tree").SetFS(vfs.NewMemFS()).SetComparator(reverseComparator{}))
+	require.NoError(t, err)
+	defer tree.Close()
+
+	scan := func() []string {
+		var keys []string
+		p := tree.Prefix([]byte("b"))
+		iter := prefix.NewPrefixIterator(p, p.SeqNo)
+		for {
+			k, _, err := iter.Next()
+			require.NoError(t, err)
+			if k == nil {
+				return keys
+			}
+			keys = append(keys, string(*k))
+		}
+	}
+
+	for i, k := range []string{"a", "b", "ba", "bz", "c"} {
+		_, _, err := tree.Insert([]byte(k), []byte(k), value.SeqNo(i))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"bz", "ba", "b"}, scan())
+
+	_, err = tree.FlushActiveMemtable()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bz", "ba", "b"}, scan())
+}
+
+// foldComparator orders keys case-insensitively, so distinct byte strings
+// can be the same key
+type foldComparator struct{}
+
+func (foldComparator) Compare(a, b []byte) int {
+	return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+}
+func (foldComparator) Name() string { return "test.FoldComparator" }
+
+func TestComparatorEquality(t *testing.T) {
+	cfg := *config.NewConfig("/tree").SetFS(vfs.NewMemFS()).SetComparator(foldComparator{})
+	tree, err := Open(cfg)
+	require.NoError(t, err)
+	defer tree.Close()
+
+	_, _, err = tree.Insert([]byte("key"), []byte("old"), 0)
+	require.NoError(t, err)
+	_, err = tree.FlushActiveMemtable()
+	require.NoError(t, err)
+	_, _, err = tree.Insert([]byte("KEY"), []byte("new"), 1)
+	require.NoError(t, err)
+
+	assertGet(t, "new", tree.Get, "Key")
+	values, err := tree.MultiGet([][]byte{[]byte("key"), []byte("KEY")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new", "new"}, []string{string(values[0]), string(values[1])})
+
+	_, err = tree.FlushActiveMemtable()
+	require.NoError(t, err)
+	require.NoError(t, tree.MajorCompact(1<<20))
+	assertGet(t, "new", tree.Get, "key")
+	n, err := tree.Len()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
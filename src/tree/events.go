@@ -0,0 +1,23 @@
+package tree
+
+import (
+	"bagh/event"
+	"bagh/segment"
+)
+
+// notify calls f for every registered event listener,
+// the caller must not hold any tree locks
+func (t *Tree) notify(f func(event.Listener)) {
+	for _, listener := range t.TreeInner.EventListeners {
+		f(listener)
+	}
+}
+
+// segmentMetadatas returns the metadata of the given segments
+func segmentMetadatas(segments []*segment.Segment) []*segment.Metadata {
+	metadatas := make([]*segment.Metadata, 0, len(segments))
+	for _, sg := range segments {
+		metadatas = append(metadatas, sg.Metadata)
+	}
+	return metadatas
+}
@@ -0,0 +1,134 @@
+package tree
+
+import (
+	"bagh/config"
+	"bagh/event"
+	"bagh/file"
+	"bagh/stall"
+	"bagh/value"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingListener struct {
+	mutex sync.Mutex
+
+	flushes            []event.FlushInfo
+	compactionsBegun   []event.CompactionInfo
+	compactionsDone    []event.CompactionInfo
+	deleted            []event.SegmentDeletedInfo
+	stalls             []stall.Event
+	backgroundFailures []event.BackgroundErrorInfo
+}
+
+func (r *recordingListener) OnFlushCompleted(info event.FlushInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.flushes = append(r.flushes, info)
+}
+
+func (r *recordingListener) OnCompactionBegin(info event.CompactionInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.compactionsBegun = append(r.compactionsBegun, info)
+}
+
+func (r *recordingListener) OnCompactionCompleted(info event.CompactionInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.compactionsDone = append(r.compactionsDone, info)
+}
+
+func (r *recordingListener) OnSegmentDeleted(info event.SegmentDeletedInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.deleted = append(r.deleted, info)
+}
+
+func (r *recordingListener) OnWriteStallChanged(info stall.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stalls = append(r.stalls, info)
+}
+
+func (r *recordingListener) OnBackgroundError(info event.BackgroundErrorInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.backgroundFailures = append(r.backgroundFailures, info)
+}
+
+func TestEventListener(t *testing.T) {
+	listener := &recordingListener{}
+	cfg := config.NewConfig(t.TempDir()).AddEventListener(listener).L0SlowdownTrigger(2)
+	tree, err := Open(*cfg)
+	assert.NoError(t, err)
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("key-%d", i))
+			_, _, err := tree.Insert(key, []byte("value"), value.SeqNo(round*10+i))
+			assert.NoError(t, err)
+		}
+		_, err := tree.FlushActiveMemtable()
+		assert.NoError(t, err)
+	}
+
+	assert.Len(t, listener.flushes, 2)
+	assert.Equal(t, 10, listener.flushes[0].ItemCount)
+	assert.Equal(t, uint64(10), listener.flushes[0].Segment.ItemCount)
+
+	// Two L0 segments delay writes
+	assert.Len(t, listener.stalls, 1)
+	assert.Equal(t, stall.Delayed, listener.stalls[0].State)
+
+	assert.NoError(t, tree.MajorCompact(64*1024*1024))
+
+	assert.Len(t, listener.compactionsBegun, 1)
+	assert.Len(t, listener.compactionsBegun[0].Inputs, 2)
+	assert.Empty(t, listener.compactionsBegun[0].Outputs)
+
+	assert.Len(t, listener.compactionsDone, 1)
+	done := listener.compactionsDone[0]
+	assert.NoError(t, done.Err)
+	assert.Len(t, done.Outputs, 1)
+	assert.Equal(t, uint64(10), done.Outputs[0].ItemCount)
+
+	assert.Len(t, listener.deleted, 2)
+	for _, info := range listener.deleted {
+		assert.NoError(t, info.Err)
+		_, err := os.Stat(info.Path)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// L0 is empty again
+	assert.Len(t, listener.stalls, 2)
+	assert.Equal(t, stall.Normal, listener.stalls[1].State)
+
+	assert.Empty(t, listener.backgroundFailures)
+}
+
+func TestEventListenerFlushError(t *testing.T) {
+	listener := &recordingListener{}
+	folder := t.TempDir()
+	tree, err := Open(*config.NewConfig(folder).AddEventListener(listener))
+	assert.NoError(t, err)
+
+	// Segments cannot be written into a file
+	segments := filepath.Join(folder, file.SegmentsFolder)
+	assert.NoError(t, os.RemoveAll(segments))
+	assert.NoError(t, os.WriteFile(segments, nil, 0644))
+
+	_, _, err = tree.Insert([]byte("a"), []byte("1"), 0)
+	assert.NoError(t, err)
+	_, err = tree.FlushActiveMemtable()
+	assert.Error(t, err)
+
+	assert.Empty(t, listener.flushes)
+	assert.Len(t, listener.backgroundFailures, 1)
+	assert.Equal(t, event.ReasonFlush, listener.backgroundFailures[0].Reason)
+}
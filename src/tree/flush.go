@@ -0,0 +1,307 @@
+package tree
+
+import (
+	"bagh/event"
+	"bagh/file"
+	"bagh/flush"
+	"bagh/id"
+	"bagh/logging"
+	"bagh/memtable"
+	"bagh/segment"
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFlushWorkers   = 1
+	DefaultFlushQueueSize = 4
+)
+
+// PendingFlush is a sealed memtable waiting to be written to a segment
+type PendingFlush struct {
+	id       string
+	memtable *memtable.MemTable
+
+	// Position in the queue, segments are registered in this order,
+	// which is the order of the memtables' seqnos
+	ticket uint64
+
+	// Called once the segment is durable and registered, e.g. to remove the WAL
+	onDurable func()
+
+	done chan struct{}
+	path string
+	err  error
+}
+
+// flushQueue is the bounded queue of sealed memtables, drained by the flush workers
+type flushQueue struct {
+	tasks chan *PendingFlush
+
+	// Serializes rotations, so memtables are queued in seqno order
+	enqueueMutex sync.Mutex
+	nextTicket   uint64
+
+	// Workers flush in parallel, but register their segments in queue order
+	turnMutex sync.Mutex
+	turn      *sync.Cond
+	current   uint64
+
+	// Running workers, they exit once the queue is closed and drained
+	workers sync.WaitGroup
+}
+
+func newFlushQueue(size int) *flushQueue {
+	if size <= 0 {
+		size = DefaultFlushQueueSize
+	}
+	q := &flushQueue{tasks: make(chan *PendingFlush, size)}
+	q.turn = sync.NewCond(&q.turnMutex)
+	return q
+}
+
+// startFlushWorkers spawns the workers draining the flush queue
+func (t *Tree) startFlushWorkers(workers int) {
+	if workers <= 0 {
+		workers = DefaultFlushWorkers
+	}
+	t.TreeInner.FlushQueue.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go t.flushWorker()
+	}
+}
+
+// ScheduleFlush seals the active memtable, replacing it with a fresh one, and
+// queues it for flushing in the background
+//
+// onDurable (may be nil) is called once the segment is durable and registered.
+// Blocks if the flush queue is full. Returns nil if the memtable is empty,
+// the flush fails with ErrClosed if the tree is closed.
+func (t *Tree) ScheduleFlush(onDurable func()) *PendingFlush {
+	q := t.TreeInner.FlushQueue
+
+	q.enqueueMutex.Lock()
+	defer q.enqueueMutex.Unlock()
+
+	if t.IsClosed() {
+		task := &PendingFlush{done: make(chan struct{}), err: ErrClosed}
+		close(task.done)
+		return task
+	}
+	if err := t.checkPrimary(); err != nil {
+		task := &PendingFlush{done: make(chan struct{}), err: err}
+		close(task.done)
+		return task
+	}
+
+	memtableID, sealed := t.RotateMemtable()
+	if memtableID == nil {
+		return nil
+	}
+	return t.enqueue(*memtableID, sealed, onDurable)
+}
+
+// enqueue queues a sealed memtable for the flush workers, the caller has to
+// hold the enqueue lock
+func (t *Tree) enqueue(memtableID string, sealed *memtable.MemTable, onDurable func()) *PendingFlush {
+	q := t.TreeInner.FlushQueue
+
+	task := &PendingFlush{
+		id:        memtableID,
+		memtable:  sealed,
+		ticket:    q.nextTicket,
+		onDurable: onDurable,
+		done:      make(chan struct{}),
+	}
+	q.nextTicket++
+	q.tasks <- task
+
+	return task
+}
+
+// waitIdle blocks until all queued flushes are done, the caller has to
+// hold the enqueue lock
+func (q *flushQueue) waitIdle() {
+	q.turnMutex.Lock()
+	defer q.turnMutex.Unlock()
+	for q.current != q.nextTicket {
+		q.turn.Wait()
+	}
+}
+
+// Wait blocks until the memtable is flushed, and returns the segment path
+func (p *PendingFlush) Wait() (string, error) {
+	<-p.done
+	return p.path, p.err
+}
+
+// Done returns a channel that is closed once the flush is done, see Wait
+func (p *PendingFlush) Done() <-chan struct{} {
+	return p.done
+}
+
+// PendingFlushes returns the amount of sealed memtables that are not flushed yet
+func (t *Tree) PendingFlushes() int {
+	t.TreeInner.SealedMutex.RLock()
+	defer t.TreeInner.SealedMutex.RUnlock()
+	return len(t.TreeInner.SealedMemtables)
+}
+
+func (t *Tree) flushWorker() {
+	q := t.TreeInner.FlushQueue
+	defer q.workers.Done()
+
+	for task := range q.tasks {
+		// Once a flush failed, later memtables must not be registered before
+		// it, they wait to be retried by Resume as well
+		var sg *segment.Segment
+		err := t.BackgroundError()
+
+		start := time.Now()
+		if err == nil {
+			sg, err = t.writeSegment(task.id, task.memtable)
+		}
+		duration := time.Since(start)
+
+		q.turnMutex.Lock()
+		for q.current != task.ticket {
+			q.turn.Wait()
+		}
+		q.turnMutex.Unlock()
+
+		if bgErr := t.BackgroundError(); err == nil && bgErr != nil {
+			err = bgErr
+		}
+		if err == nil {
+			err = t.RegisterSegments([]segment.Segment{*sg})
+			t.TreeInner.WriteController.Signal()
+		}
+		if err == nil {
+			registry := t.TreeInner.Stats
+			registry.Flushes.Add(1)
+			registry.FlushBytes.Add(sg.Metadata.FileSize)
+			registry.FlushLatency.Observe(duration)
+
+			task.path = sg.Metadata.Path
+			if manager := t.TreeInner.WriteBufferManager; manager != nil {
+				manager.Free(uint64(task.memtable.Size()))
+			}
+			if task.onDurable != nil {
+				task.onDurable()
+			}
+		} else {
+			// The memtable stays sealed, so its items are still readable
+			t.TreeInner.Logger.Error("Failed to flush memtable", logging.SegmentID(task.id), logging.Err(err))
+			task.err = err
+			t.discardSegment(task.id)
+
+			var bgErr *BackgroundError
+			if !errors.As(err, &bgErr) {
+				t.setBackgroundError(event.ReasonFlush, err)
+			}
+			t.TreeInner.BackgroundMutex.Lock()
+			t.TreeInner.FailedFlushes = append(t.TreeInner.FailedFlushes, task)
+			t.TreeInner.BackgroundMutex.Unlock()
+		}
+
+		q.turnMutex.Lock()
+		q.current++
+		q.turn.Broadcast()
+		q.turnMutex.Unlock()
+
+		if err == nil {
+			info := event.FlushInfo{Segment: sg.Metadata, ItemCount: task.memtable.Len(), Duration: duration}
+			t.notify(func(l event.Listener) { l.OnFlushCompleted(info) })
+		}
+
+		close(task.done)
+	}
+}
+
+// writeSegment writes a sealed memtable to a segment, without registering it
+func (t *Tree) writeSegment(segmentID string, mt *memtable.MemTable) (*segment.Segment, error) {
+	segmentFolder := filepath.Join(t.TreeInner.Config.Path, file.SegmentsFolder)
+
+	return flush.FlushToSegment(flush.Options{
+		BlockCache:      t.TreeInner.BlockCache,
+		BlockSize:       t.TreeInner.Config.BlockSize,
+		Folder:          segmentFolder,
+		SegmentID:       segmentID,
+		MemTable:        mt,
+		DescriptorTable: t.TreeInner.DescriptorTable,
+		Blobs:           t.TreeInner.Blobs,
+		BlobThreshold:   t.TreeInner.Config.BlobThreshold,
+		Collectors:      t.TreeInner.Collectors,
+		BloomBitsPerKey: t.TreeInner.Config.BloomBitsPerKey,
+		Logger:          t.TreeInner.Logger,
+	})
+}
+
+// discardSegment removes what a failed flush wrote, so it can be retried
+func (t *Tree) discardSegment(segmentID string) {
+	t.TreeInner.DescriptorTable.Remove(segmentID)
+	t.TreeInner.BlockCache.RemoveSegment(segmentID)
+	path := filepath.Join(t.TreeInner.Config.Path, file.SegmentsFolder, segmentID)
+	if err := t.TreeInner.FS.RemoveAll(path); err != nil {
+		t.TreeInner.Logger.Warn("Failed to remove segment of failed flush", logging.Path(path), logging.Err(err))
+	}
+}
+
+// RotateMemtable swaps the active memtable for an empty one, and adds the
+// sealed memtable to the sealed memtables, returns nil if the memtable is empty
+//
+// The sealed memtable is only removed once it is flushed, see ScheduleFlush.
+func (t *Tree) RotateMemtable() (*string, *memtable.MemTable) {
+	t.TreeInner.ActiveMutex.Lock()
+	defer t.TreeInner.ActiveMutex.Unlock()
+
+	sealed := t.TreeInner.ActiveMemtable
+	if sealed.IsEmpty() {
+		return nil, nil
+	}
+	t.TreeInner.ActiveMemtable = memtable.NewMemTableWithComparator(t.TreeInner.Comparator)
+
+	t.TreeInner.SealedMutex.Lock()
+	defer t.TreeInner.SealedMutex.Unlock()
+
+	memtableID := id.GenerateSegmentID()
+	t.TreeInner.SealedMemtables[memtableID] = sealed
+
+	return &memtableID, sealed
+}
+
+// SetFlushHandler sets what happens when the write buffer manager asks
+// the tree to flush, e.g. to also rotate a write-ahead log
+//
+// Defaults to ScheduleFlush without a callback.
+func (t *Tree) SetFlushHandler(handler func()) {
+	t.TreeInner.FlushQueue.enqueueMutex.Lock()
+	defer t.TreeInner.FlushQueue.enqueueMutex.Unlock()
+	t.TreeInner.FlushHandler = handler
+}
+
+// RequestFlush seals the active memtable and queues it for flushing,
+// through the flush handler if one is set
+func (t *Tree) RequestFlush() {
+	t.TreeInner.FlushQueue.enqueueMutex.Lock()
+	handler := t.TreeInner.FlushHandler
+	t.TreeInner.FlushQueue.enqueueMutex.Unlock()
+
+	if handler != nil {
+		handler()
+		return
+	}
+	t.ScheduleFlush(nil)
+}
+
+// FlushActiveMemtable flushes the active memtable and waits for the segment
+// to be registered, returns the path of the segment or "" if there was nothing to flush
+func (t *Tree) FlushActiveMemtable() (string, error) {
+	task := t.ScheduleFlush(nil)
+	if task == nil {
+		return "", nil
+	}
+	return task.Wait()
+}
@@ -0,0 +1,111 @@
+package tree
+
+import (
+	"bagh/config"
+	"bagh/memtable"
+	"bagh/value"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleFlushRegistersInOrder(t *testing.T) {
+	cfg := config.NewConfig(t.TempDir()).FlushWorkers(3).FlushQueueSize(2)
+	tree, err := Open(*cfg)
+	assert.NoError(t, err)
+
+	var mutex sync.Mutex
+	var durable []int
+	var pending []*PendingFlush
+
+	seqno := 0
+	for round := 0; round < 6; round++ {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key-%03d", i))
+			_, _, err := tree.Insert(key, []byte(fmt.Sprintf("value-%d", round)), value.SeqNo(seqno))
+			assert.NoError(t, err)
+			seqno++
+		}
+
+		round := round
+		task := tree.ScheduleFlush(func() {
+			mutex.Lock()
+			durable = append(durable, round)
+			mutex.Unlock()
+		})
+		assert.NotNil(t, task)
+		assert.Equal(t, 0, tree.TreeInner.ActiveMemtable.Len())
+		pending = append(pending, task)
+	}
+
+	for _, task := range pending {
+		path, err := task.Wait()
+		assert.NoError(t, err)
+		assert.NotEmpty(t, path)
+	}
+
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5}, durable)
+	assert.Equal(t, 0, tree.PendingFlushes())
+	assert.Equal(t, 6, tree.SegmentCount())
+
+	// Empty memtables are not flushed
+	assert.Nil(t, tree.ScheduleFlush(nil))
+}
+
+func TestFlushActiveMemtable(t *testing.T) {
+	tree, err := Open(*config.NewConfig(t.TempDir()))
+	assert.NoError(t, err)
+
+	_, _, err = tree.Insert([]byte("a"), []byte("1"), 0)
+	assert.NoError(t, err)
+
+	path, err := tree.FlushActiveMemtable()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, path)
+	assert.Equal(t, 1, tree.FirstLevelSegmentCount())
+	assert.Equal(t, 0, tree.PendingFlushes())
+
+	path, err = tree.FlushActiveMemtable()
+	assert.NoError(t, err)
+	assert.Empty(t, path)
+}
+
+func TestWriteBufferManagerFlushesTree(t *testing.T) {
+	manager := memtable.NewWriteBufferManager(4096, nil)
+
+	tree, err := Open(*config.NewConfig(t.TempDir()).SetWriteBufferManager(manager))
+	assert.NoError(t, err)
+
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		_, _, err := tree.Insert(key, []byte("some value to fill the memtable"), value.SeqNo(i))
+		assert.NoError(t, err)
+	}
+
+	assert.Eventually(t, func() bool {
+		return tree.SegmentCount() > 0 && tree.PendingFlushes() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Less(t, manager.Usage(), uint64(200*40))
+}
+
+func TestFlushLogsStructuredFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	tree, err := Open(*config.NewConfig(t.TempDir()).SetLogger(logger))
+	assert.NoError(t, err)
+
+	_, _, err = tree.Insert([]byte("a"), []byte("1"), 0)
+	assert.NoError(t, err)
+	_, err = tree.FlushActiveMemtable()
+	assert.NoError(t, err)
+
+	assert.Contains(t, buf.String(), `"msg":"Flushed segment"`)
+	assert.Contains(t, buf.String(), `"segment_id":`)
+	assert.Contains(t, buf.String(), `"path":`)
+}
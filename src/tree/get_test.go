@@ -0,0 +1,117 @@
+package tree
+
+import (
+	"fmt"
+	"testing"
+
+	"bagh/config"
+	"bagh/value"
+	"bagh/vfs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func assertGet(t *testing.T, expected string, get func([]byte) (value.UserValue, error), key string) {
+	t.Helper()
+	val, err := get([]byte(key))
+	require.NoError(t, err)
+	if expected == "" {
+		assert.Nil(t, val, key)
+	} else {
+		assert.Equal(t, expected, string(val), key)
+	}
+}
+
+func TestGetNewestFirst(t *testing.T) {
+	tree, err := Open(*config.NewConfig("/tree").SetFS(vfs.NewMemFS()))
+	require.NoError(t, err)
+	defer tree.Close()
+
+	// Every version of the key in another source: two L0 segments, two
+	// sealed memtables and the active memtable
+	for seqno := value.SeqNo(0); seqno < 5; seqno++ {
+		_, _, err := tree.Insert([]byte("a"), []byte(fmt.Sprintf("v%d", seqno)), seqno)
+		require.NoError(t, err)
+		switch {
+		case seqno < 2:
+			_, err = tree.FlushActiveMemtable()
+			require.NoError(t, err)
+		case seqno < 4:
+			tree.RotateMemtable()
+		}
+	}
+
+	for seqno := value.SeqNo(1); seqno <= 5; seqno++ {
+		snapshot := tree.Snapshot(seqno)
+		assertGet(t, fmt.Sprintf("v%d", seqno-1), snapshot.Get, "a")
+		snapshot.Drop()
+	}
+	assertGet(t, "v4", tree.Get, "a")
+}
+
+func TestGetDeeperLevels(t *testing.T) {
+	tree, err := Open(*config.NewConfig("/tree").SetFS(vfs.NewMemFS()).BlockSize(1024))
+	require.NoError(t, err)
+	defer tree.Close()
+
+	key := func(i int) string { return fmt.Sprintf("key-%03d", i) }
+	for i := 0; i < 300; i++ {
+		_, _, err := tree.Insert([]byte(key(i)), []byte("old"), 0)
+		require.NoError(t, err)
+	}
+	_, err = tree.FlushActiveMemtable()
+	require.NoError(t, err)
+	require.NoError(t, tree.MajorCompact(1))
+
+	lvl := tree.TreeInner.Levels
+	require.Greater(t, len(lvl.Levels[lvl.LastLevelIndex()].Segments), 1)
+
+	// Newer versions in L0 shadow the last level
+	for i := 0; i < 300; i += 2 {
+		_, _, err := tree.Insert([]byte(key(i)), []byte("new"), 1)
+		require.NoError(t, err)
+	}
+	_, err = tree.FlushActiveMemtable()
+	require.NoError(t, err)
+
+	for i := 0; i < 300; i++ {
+		expected := "old"
+		if i%2 == 0 {
+			expected = "new"
+		}
+		assertGet(t, expected, tree.Get, key(i))
+	}
+	assertGet(t, "", tree.Get, "key-")
+	assertGet(t, "", tree.Get, "key-999")
+
+	snapshot := tree.Snapshot(1)
+	defer snapshot.Drop()
+	assertGet(t, "old", snapshot.Get, key(0))
+}
+
+func TestGetInterleavedSeqnos(t *testing.T) {
+	tree, err := Open(*config.NewConfig("/tree").SetFS(vfs.NewMemFS()))
+	require.NoError(t, err)
+	defer tree.Close()
+
+	flush := func(items map[string]value.SeqNo) {
+		for key, seqno := range items {
+			_, _, err := tree.Insert([]byte(key), []byte(fmt.Sprintf("v%d", seqno)), seqno)
+			require.NoError(t, err)
+		}
+		_, err := tree.FlushActiveMemtable()
+		require.NoError(t, err)
+	}
+
+	// Like a blob relocation, the second segment keeps an old version
+	// of "a", but sorts first in L0 because of its max seqno
+	flush(map[string]value.SeqNo{"a": 5})
+	flush(map[string]value.SeqNo{"a": 3, "z": 9})
+
+	assertGet(t, "v5", tree.Get, "a")
+	values, err := tree.MultiGet([][]byte{[]byte("a"), []byte("z")})
+	require.NoError(t, err)
+	assert.Equal(t, "v5", string(values[0]))
+	assert.Equal(t, "v9", string(values[1]))
+}
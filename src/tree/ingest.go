@@ -0,0 +1,322 @@
+package tree
+
+import (
+	"bagh/comparator"
+	"bagh/descriptor"
+	"bagh/event"
+	"bagh/file"
+	"bagh/id"
+	"bagh/logging"
+	"bagh/memtable"
+	"bagh/segment"
+	"bagh/value"
+	"bagh/vfs"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// validateIngestedSegment checks that a segment built outside of the tree
+// is sorted by cmp and matches its metadata
+func validateIngestedSegment(fs vfs.FS, folder string, cmp comparator.Comparator) (*segment.Metadata, error) {
+	metadata, err := segment.MetadataFromDisk(fs, filepath.Join(folder, file.SegmentMetadataFile))
+	if err != nil {
+		return nil, err
+	}
+	if metadata.ItemCount == 0 {
+		return nil, fmt.Errorf("segment %s is empty", folder)
+	}
+	if cmp.Compare(metadata.KeyRange[0], metadata.KeyRange[1]) > 0 {
+		return nil, fmt.Errorf("segment %s has an invalid key range", folder)
+	}
+
+	// Use throwaway tables, so validation does not pollute the tree's caches
+	descriptorTable := descriptor.NewFileDescriptorTableFS(fs, 4, 1)
+	descriptorTable.Insert(filepath.Join(folder, file.BlocksFile), metadata.ID)
+	defer descriptorTable.Remove(metadata.ID)
+
+	sg, err := segment.RecoverSegment(folder, segment.NewBlockCache(0), descriptorTable, cmp)
+	if err != nil {
+		return nil, err
+	}
+
+	var itemCount uint64
+	var first, last value.UserKey
+
+	reader := sg.Iter(false)
+	for {
+		item, err := reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if item == nil {
+			break
+		}
+
+		if last != nil && cmp.Compare(item.Key, last) <= 0 {
+			return nil, fmt.Errorf("segment %s is not sorted: %q after %q", folder, item.Key, last)
+		}
+		if first == nil {
+			first = item.Key
+		}
+		last = item.Key
+		itemCount++
+	}
+
+	if itemCount != metadata.ItemCount {
+		return nil, fmt.Errorf("segment %s has %d items, metadata says %d", folder, itemCount, metadata.ItemCount)
+	}
+	if cmp.Compare(first, metadata.KeyRange[0]) != 0 || cmp.Compare(last, metadata.KeyRange[1]) != 0 {
+		return nil, fmt.Errorf("segment %s key range does not match its metadata", folder)
+	}
+
+	return metadata, nil
+}
+
+func memtableOverlaps(mt *memtable.MemTable, lo, hi value.UserKey) (bool, error) {
+	items, err := mt.Iter()
+	if err != nil {
+		return false, err
+	}
+	cmp := mt.Comparator()
+	for _, item := range items {
+		if cmp.Compare(item.Key, lo) >= 0 && cmp.Compare(item.Key, hi) <= 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkMemtableOverlaps fails if the memtable holds a key in the range of an ingested segment
+func checkMemtableOverlaps(mt *memtable.MemTable, metadatas []*segment.Metadata) error {
+	for _, metadata := range metadatas {
+		overlaps, err := memtableOverlaps(mt, metadata.KeyRange[0], metadata.KeyRange[1])
+		if err != nil {
+			return err
+		}
+		if overlaps {
+			return fmt.Errorf("ingested segment %s overlaps a memtable, it has to be flushed first", metadata.Path)
+		}
+	}
+	return nil
+}
+
+// checkIngestSeqNo fails if the seqno is not higher than every seqno in the
+// tree, the caller has to hold the Active, Levels and Sealed locks
+func (t *Tree) checkIngestSeqNo(seqno value.SeqNo) error {
+	var lsns []*value.SeqNo
+
+	if t.TreeInner.Levels.Len() > 0 {
+		lsn := t.GetSegmentLSN()
+		lsns = append(lsns, &lsn)
+	}
+
+	lsn, err := t.TreeInner.ActiveMemtable.GetLSN()
+	if err != nil {
+		return err
+	}
+	lsns = append(lsns, lsn)
+
+	for _, sealed := range t.TreeInner.SealedMemtables {
+		lsn, err := sealed.GetLSN()
+		if err != nil {
+			return err
+		}
+		lsns = append(lsns, lsn)
+	}
+
+	for _, lsn := range lsns {
+		if lsn != nil && seqno <= *lsn {
+			return fmt.Errorf("ingestion seqno %d is not higher than seqno %d of the tree", seqno, *lsn)
+		}
+	}
+	return nil
+}
+
+// linkSegmentFolder links the files of a built segment into the tree, except
+// for its metadata, which is written anew, so the source stays untouched
+func linkSegmentFolder(fs vfs.FS, src, dest string) error {
+	entries, err := fs.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err := file.MkdirAllSynced(fs, dest); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == file.SegmentMetadataFile {
+			continue
+		}
+		if err := linkFile(fs, filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ingestTargetLevel returns the deepest level the key range can be put into,
+// without being shadowed by, or shadowing, older data in the levels above
+func (t *Tree) ingestTargetLevel(lo, hi value.UserKey) uint8 {
+	lvl := t.TreeInner.Levels
+
+	target := uint8(0)
+	for levelNo := uint8(0); levelNo < lvl.Depth(); levelNo++ {
+		if lvl.LevelOverlaps(levelNo, lo, hi) {
+			break
+		}
+		target = levelNo
+	}
+	return target
+}
+
+// IngestSegments loads segments built with a SegmentBuilder into the tree
+//
+// Every item of the ingested segments is assigned the given (global) seqno,
+// which has to be higher than any seqno in the tree. The segment folders are
+// linked into the tree and removed once registered. Each segment goes into
+// the deepest level it does not overlap existing data in. Memtables holding keys in the range of
+// an ingested segment have to be flushed by the caller first, together with
+// their WAL, the ingestion is rejected otherwise.
+func (t *Tree) IngestSegments(paths []string, seqno value.SeqNo) error {
+	t.TreeInner.WorkMutex.RLock()
+	defer t.TreeInner.WorkMutex.RUnlock()
+
+	if t.IsClosed() {
+		return ErrClosed
+	}
+	if err := t.checkPrimary(); err != nil {
+		return err
+	}
+	if err := t.BackgroundError(); err != nil {
+		return err
+	}
+	defer t.TreeInner.WriteController.Signal()
+
+	metadatas := make([]*segment.Metadata, 0, len(paths))
+	for _, path := range paths {
+		metadata, err := validateIngestedSegment(t.TreeInner.FS, path, t.TreeInner.Comparator)
+		if err != nil {
+			return err
+		}
+		metadata.Path = path
+		metadatas = append(metadatas, metadata)
+	}
+
+	// All items share the same seqno, so ingested segments may not overlap each other
+	cmp := t.TreeInner.Comparator
+	sort.Slice(metadatas, func(i, j int) bool {
+		return cmp.Compare(metadatas[i].KeyRange[0], metadatas[j].KeyRange[0]) < 0
+	})
+	for i := 1; i < len(metadatas); i++ {
+		if cmp.Compare(metadatas[i-1].KeyRange[1], metadatas[i].KeyRange[0]) >= 0 {
+			return fmt.Errorf("ingested segments %s and %s overlap", metadatas[i-1].Path, metadatas[i].Path)
+		}
+	}
+
+	err := t.ingest(metadatas, seqno)
+	var mErr *manifestError
+	if errors.As(err, &mErr) {
+		// The segments are already part of the levels, the manifest has to catch up
+		t.setBackgroundError(event.ReasonManifest, err)
+	}
+	return err
+}
+
+// ingest checks the segments against the memtables and the seqnos of the
+// tree, and registers them, under the same locks, so no write, flush or
+// compaction gets in between
+func (t *Tree) ingest(metadatas []*segment.Metadata, seqno value.SeqNo) error {
+	t.TreeInner.ActiveMutex.RLock()
+	defer t.TreeInner.ActiveMutex.RUnlock()
+	t.TreeInner.LevelsMutex.Lock()
+	defer t.TreeInner.LevelsMutex.Unlock()
+	t.TreeInner.SealedMutex.RLock()
+	defer t.TreeInner.SealedMutex.RUnlock()
+
+	// Memtables are read before segments, so overlapping (older) writes would shadow the ingested items
+	if err := checkMemtableOverlaps(t.TreeInner.ActiveMemtable, metadatas); err != nil {
+		return err
+	}
+	for _, sealed := range t.TreeInner.SealedMemtables {
+		if err := checkMemtableOverlaps(sealed, metadatas); err != nil {
+			return err
+		}
+	}
+
+	if err := t.checkIngestSeqNo(seqno); err != nil {
+		return err
+	}
+
+	return t.registerIngested(metadatas, seqno)
+}
+
+// registerIngested links validated segments into the tree and adds them to
+// the levels, the caller has to hold the Levels lock
+//
+// The source folders are only removed once the manifest includes the
+// segments, until then a failure leaves them untouched.
+func (t *Tree) registerIngested(metadatas []*segment.Metadata, seqno value.SeqNo) error {
+	segmentsFolder := filepath.Join(t.TreeInner.Config.Path, file.SegmentsFolder)
+	sources := make([]string, 0, len(metadatas))
+
+	for _, metadata := range metadatas {
+		src := metadata.Path
+		dest := filepath.Join(segmentsFolder, id.GenerateSegmentID())
+
+		sg, err := t.linkIngested(metadata, dest, seqno)
+		if err != nil {
+			// The folder is not part of the levels, it would only be deleted by the next Open
+			if rmErr := t.TreeInner.FS.RemoveAll(dest); rmErr != nil {
+				t.TreeInner.Logger.Error("Failed to remove ingested segment", logging.Path(dest), logging.Err(rmErr))
+			}
+			return err
+		}
+		sources = append(sources, src)
+
+		level := t.ingestTargetLevel(metadata.KeyRange[0], metadata.KeyRange[1])
+		t.TreeInner.Levels.InsertIntoLevel(level, sg)
+	}
+
+	if err := t.writeManifest(); err != nil {
+		return err
+	}
+
+	for _, src := range sources {
+		if err := t.TreeInner.FS.RemoveAll(src); err != nil {
+			t.TreeInner.Logger.Error("Failed to remove ingested segment source", logging.Path(src), logging.Err(err))
+		}
+	}
+	return t.updatePinning()
+}
+
+// linkIngested links a validated segment into dest, and writes its metadata
+// with the tree's segment ID and the global seqno
+func (t *Tree) linkIngested(metadata *segment.Metadata, dest string, seqno value.SeqNo) (*segment.Segment, error) {
+	if err := linkSegmentFolder(t.TreeInner.FS, metadata.Path, dest); err != nil {
+		return nil, err
+	}
+
+	linked := *metadata
+	linked.ID = filepath.Base(dest)
+	linked.Path = dest
+	linked.GlobalSeqNo = seqno
+	linked.Seqnos = [2]value.SeqNo{seqno, seqno}
+	// Built segments have no indirections
+	linked.Properties = make(segment.Properties, len(metadata.Properties)+1)
+	for key, val := range metadata.Properties {
+		linked.Properties[key] = val
+	}
+	linked.Properties[blobRefsCollector+".files"] = ""
+	if err := linked.WriteToFile(t.TreeInner.FS); err != nil {
+		return nil, err
+	}
+
+	sg, err := segment.RecoverSegment(dest, t.TreeInner.BlockCache, t.TreeInner.DescriptorTable, t.TreeInner.Comparator)
+	if err != nil {
+		return nil, err
+	}
+	t.TreeInner.DescriptorTable.Insert(filepath.Join(dest, file.BlocksFile), linked.ID)
+	*metadata = linked
+	return sg, nil
+}
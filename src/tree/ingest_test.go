@@ -0,0 +1,82 @@
+package tree
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bagh/config"
+	"bagh/file"
+	"bagh/segment"
+	"bagh/vfs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func buildSegment(t *testing.T, fs vfs.FS, folder string, keys ...string) string {
+	builder, err := segment.NewSegmentBuilderFS(fs, folder, 4096)
+	require.NoError(t, err)
+	for _, k := range keys {
+		require.NoError(t, builder.Put([]byte(k), []byte("new")))
+	}
+	_, err = builder.Finish()
+	require.NoError(t, err)
+	return folder
+}
+
+func TestIngestSegments(t *testing.T) {
+	fs := vfs.NewMemFS()
+	tree, err := Open(*config.NewConfig("/tree").SetFS(fs))
+	require.NoError(t, err)
+	defer tree.Close()
+
+	_, _, err = tree.Insert([]byte("k"), []byte("old"), 5)
+	require.NoError(t, err)
+
+	// The memtable would shadow the ingested key
+	src := buildSegment(t, fs, "/in", "j", "k")
+	assert.Error(t, tree.IngestSegments([]string{src}, 6))
+
+	_, err = tree.FlushActiveMemtable()
+	require.NoError(t, err)
+
+	// Seqnos of the tree would shadow the ingested items
+	assert.Error(t, tree.IngestSegments([]string{src}, 5))
+
+	require.NoError(t, tree.IngestSegments([]string{src}, 6))
+	assertGet(t, "new", tree.Get, "j")
+	assertGet(t, "new", tree.Get, "k")
+
+	_, err = fs.Stat(src)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestIngestSegmentsKeepsSourceOnFailure(t *testing.T) {
+	mem := vfs.NewMemFS()
+	fs := vfs.NewFaultFS(mem, 0)
+	tree, err := Open(*config.NewConfig("/tree").SetFS(fs))
+	require.NoError(t, err)
+
+	src := buildSegment(t, fs, "/in", "a", "b")
+	metadata, err := vfs.ReadFile(fs, filepath.Join(src, file.SegmentMetadataFile))
+	require.NoError(t, err)
+
+	// The manifest cannot be written
+	fs.FailNth(vfs.OpRename, 1)
+	assert.Error(t, tree.IngestSegments([]string{src}, 1))
+	tree.Close()
+
+	tree, err = Open(*config.NewConfig("/tree").SetFS(mem))
+	require.NoError(t, err)
+	defer tree.Close()
+	assert.Equal(t, 0, tree.SegmentCount())
+
+	// The source is untouched, and can be ingested again
+	unchanged, err := vfs.ReadFile(mem, filepath.Join(src, file.SegmentMetadataFile))
+	require.NoError(t, err)
+	assert.Equal(t, metadata, unchanged)
+
+	require.NoError(t, tree.IngestSegments([]string{src}, 1))
+	assertGet(t, "new", tree.Get, "a")
+}
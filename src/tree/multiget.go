@@ -0,0 +1,154 @@
+package tree
+
+import (
+	"slices"
+	"sort"
+
+	"bagh/memtable"
+	"bagh/value"
+)
+
+// MultiGet returns the values of many keys at once, in the order of the
+// keys, nil for keys that do not exist
+//
+// Unlike calling Get for every key, the memtable and level locks are taken
+// once, and every block is read at most once.
+func (t *Tree) MultiGet(keys [][]byte) ([]value.UserValue, error) {
+	return t.multiGet(keys, nil)
+}
+
+// MultiGet is like Tree.MultiGet, reading the snapshot
+func (s *Snapshot) MultiGet(keys [][]byte) ([]value.UserValue, error) {
+	return s.tree.multiGet(keys, &s.seqno)
+}
+
+func (t *Tree) multiGet(keys [][]byte, seqno *value.SeqNo) ([]value.UserValue, error) {
+	if t.IsClosed() {
+		return nil, ErrClosed
+	}
+	registry := t.TreeInner.Stats
+	registry.Gets.Add(uint64(len(keys)))
+
+	// Lookups run in key order, duplicate keys are looked up once
+	compare := t.TreeInner.Comparator.Compare
+	sorted := slices.Clone(keys)
+	slices.SortFunc(sorted, compare)
+	sorted = slices.CompactFunc(sorted, func(a, b []byte) bool { return compare(a, b) == 0 })
+
+	items, err := t.multiGetInternal(sorted, seqno)
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range items {
+		if item == nil || item.IsTombstone() {
+			items[i] = nil
+			continue
+		}
+		if items[i], err = t.resolveValue(item); err != nil {
+			return nil, err
+		}
+	}
+
+	values := make([]value.UserValue, len(keys))
+	for i, key := range keys {
+		idx, _ := slices.BinarySearchFunc(sorted, key, compare)
+		if item := items[idx]; item != nil {
+			values[i] = item.Value
+			registry.BytesRead.Add(uint64(len(key) + len(item.Value)))
+		}
+	}
+	return values, nil
+}
+
+// multiGetInternal returns the newest visible version of every key, keys
+// have to be sorted and unique
+//
+// Sources are read newest first: the active memtable, the sealed memtables,
+// then the segments of every level. A key is no longer looked up once a
+// version of it is found, after L0 if it is found there.
+func (t *Tree) multiGetInternal(keys [][]byte, seqno *value.SeqNo) ([]*value.Value, error) {
+	items := make([]*value.Value, len(keys))
+
+	// Indexes of the keys without a version yet, in key order
+	pending := make([]int, len(keys))
+	for i := range pending {
+		pending[i] = i
+	}
+	lookup := func(mt *memtable.MemTable) {
+		remaining := pending[:0]
+		for _, i := range pending {
+			if items[i] = mt.Get(keys[i], seqno); items[i] == nil {
+				remaining = append(remaining, i)
+			}
+		}
+		pending = remaining
+	}
+
+	t.TreeInner.ActiveMutex.RLock()
+	lookup(t.TreeInner.ActiveMemtable)
+	t.TreeInner.ActiveMutex.RUnlock()
+
+	t.TreeInner.SealedMutex.RLock()
+	for _, mt := range t.sealedNewestFirst() {
+		lookup(mt)
+	}
+	t.TreeInner.SealedMutex.RUnlock()
+
+	t.TreeInner.LevelsMutex.RLock()
+	defer t.TreeInner.LevelsMutex.RUnlock()
+
+	compare := t.TreeInner.Comparator.Compare
+	lvls := t.TreeInner.Levels
+	for levelNo, level := range lvls.Levels {
+		// Seqno ranges of L0 segments may interleave, so keys stay pending
+		// until every L0 segment is read, keeping their highest seqno (see
+		// getFromSegments). The segments of deeper levels do not overlap.
+		for j := len(level.Segments) - 1; j >= 0 && len(pending) > 0; j-- {
+			sg := lvls.Segments[level.Segments[j]]
+
+			// The pending keys within the key range of the segment
+			lo := sort.Search(len(pending), func(k int) bool {
+				return compare(keys[pending[k]], sg.Metadata.KeyRange[0]) >= 0
+			})
+			hi := sort.Search(len(pending), func(k int) bool {
+				return compare(keys[pending[k]], sg.Metadata.KeyRange[1]) > 0
+			})
+			if lo == hi {
+				continue
+			}
+
+			batch := make([][]byte, hi-lo)
+			for k := range batch {
+				batch[k] = keys[pending[lo+k]]
+			}
+			found, err := sg.MultiGet(batch, seqno, t.TreeInner.Stats)
+			if err != nil {
+				return nil, err
+			}
+
+			remaining := slices.Clone(pending[:lo])
+			for k, item := range found {
+				i := pending[lo+k]
+				if item != nil && (items[i] == nil || item.SeqNo > items[i].SeqNo) {
+					items[i] = item
+				}
+				if items[i] == nil || levelNo == 0 {
+					remaining = append(remaining, i)
+				}
+			}
+			pending = append(remaining, pending[hi:]...)
+		}
+
+		if levelNo == 0 {
+			remaining := pending[:0]
+			for _, i := range pending {
+				if items[i] == nil {
+					remaining = append(remaining, i)
+				}
+			}
+			pending = remaining
+		}
+	}
+
+	return items, nil
+}
@@ -0,0 +1,75 @@
+package tree
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiGet(t *testing.T) {
+	tree := newScanTree(t)
+	// A sealed memtable on top, with a newer version of key-001
+	_, _, err := tree.Insert([]byte("key-001"), []byte("sealed"), 3)
+	require.NoError(t, err)
+	tree.RotateMemtable()
+	_, _, err = tree.Insert([]byte("key-005"), []byte("active"), 4)
+	require.NoError(t, err)
+
+	var keys [][]byte
+	for i := 299; i >= 0; i -= 2 {
+		keys = append(keys, []byte(fmt.Sprintf("key-%03d", i)))
+	}
+	keys = append(keys, []byte("missing"), []byte("key-001"), []byte("key-004"), []byte("key-999"))
+
+	values, err := tree.MultiGet(keys)
+	require.NoError(t, err)
+	require.Len(t, values, len(keys))
+
+	for i, key := range keys {
+		var n int
+		if _, err := fmt.Sscanf(string(key), "key-%03d", &n); err != nil || n >= 300 {
+			assert.Nil(t, values[i], string(key))
+			continue
+		}
+		switch {
+		case n == 1:
+			assert.Equal(t, "sealed", string(values[i]))
+		case n == 5:
+			assert.Equal(t, "active", string(values[i]))
+		case n%3 == 0:
+			assert.Nil(t, values[i], string(key))
+		case n%2 == 0:
+			assert.Equal(t, "new", string(values[i]), string(key))
+		default:
+			assert.Equal(t, "old", string(values[i]), string(key))
+		}
+	}
+
+	// Snapshots only see what was written before them
+	snapshot := tree.Snapshot(2)
+	defer snapshot.Drop()
+	values, err = snapshot.MultiGet([][]byte{[]byte("key-003"), []byte("key-002"), []byte("key-001"), []byte("key-000")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old", "new", "old", "new"}, []string{string(values[0]), string(values[1]), string(values[2]), string(values[3])})
+}
+
+func TestMultiGetBlockReads(t *testing.T) {
+	tree := newScanTree(t)
+	_, err := tree.FlushActiveMemtable()
+	require.NoError(t, err)
+
+	var keys [][]byte
+	for i := 0; i < 300; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%03d", i)))
+	}
+
+	// Every block is read once, not once per key
+	before := tree.Stats()
+	_, err = tree.MultiGet(keys)
+	require.NoError(t, err)
+	after := tree.Stats()
+	lookups := after.BlockCacheHits + after.BlockCacheMisses - before.BlockCacheHits - before.BlockCacheMisses
+	assert.Less(t, lookups, uint64(len(keys)))
+}
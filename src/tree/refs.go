@@ -0,0 +1,92 @@
+package tree
+
+import (
+	"sync"
+
+	"bagh/segment"
+)
+
+// segmentRefs counts the open scans reading each segment, so segments removed
+// from the levels in the meantime are only cleaned up once the last one is done
+type segmentRefs struct {
+	mutex    sync.Mutex
+	counts   map[string]int
+	obsolete map[string]obsoleteSegment
+}
+
+// obsoleteSegment is a segment removed from the levels while scans read it
+type obsoleteSegment struct {
+	segment *segment.Segment
+	cleanup func()
+}
+
+// holdSegments keeps the segments readable until the returned release
+// function is called, the caller has to hold the levels lock, so none of
+// them can be removed in between
+func (t *Tree) holdSegments(segments []*segment.Segment) func() {
+	refs := &t.TreeInner.segmentRefs
+	refs.mutex.Lock()
+	if refs.counts == nil {
+		refs.counts = make(map[string]int)
+	}
+	for _, sg := range segments {
+		refs.counts[sg.Metadata.ID]++
+	}
+	refs.mutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			var cleanups []func()
+
+			refs.mutex.Lock()
+			for _, sg := range segments {
+				id := sg.Metadata.ID
+				if refs.counts[id]--; refs.counts[id] > 0 {
+					continue
+				}
+				delete(refs.counts, id)
+				if obsolete, ok := refs.obsolete[id]; ok {
+					delete(refs.obsolete, id)
+					cleanups = append(cleanups, obsolete.cleanup)
+				}
+			}
+			refs.mutex.Unlock()
+
+			for _, cleanup := range cleanups {
+				cleanup()
+			}
+		})
+	}
+}
+
+// deferCleanup postpones the cleanup of a segment removed from the levels
+// while scans still read it, and reports whether it did
+func (t *Tree) deferCleanup(sg *segment.Segment, cleanup func()) bool {
+	refs := &t.TreeInner.segmentRefs
+	refs.mutex.Lock()
+	defer refs.mutex.Unlock()
+
+	if refs.counts[sg.Metadata.ID] == 0 {
+		return false
+	}
+	if refs.obsolete == nil {
+		refs.obsolete = make(map[string]obsoleteSegment)
+	}
+	refs.obsolete[sg.Metadata.ID] = obsoleteSegment{segment: sg, cleanup: cleanup}
+	return true
+}
+
+// heldObsoleteSegments returns the segments removed from the levels, that
+// are still read by scans
+func (t *Tree) heldObsoleteSegments() []*segment.Segment {
+	refs := &t.TreeInner.segmentRefs
+	refs.mutex.Lock()
+	defer refs.mutex.Unlock()
+
+	segments := make([]*segment.Segment, 0, len(refs.obsolete))
+	for _, obsolete := range refs.obsolete {
+		segments = append(segments, obsolete.segment)
+	}
+	return segments
+}
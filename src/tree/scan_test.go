@@ -0,0 +1,162 @@
+package tree
+
+import (
+	"bagh/config"
+	"bagh/prefix"
+	"bagh/vfs"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newScanTree spreads 300 keys over multi-block segments and the memtable,
+// every key divisible by 3 is removed and every even key is overwritten
+func newScanTree(t *testing.T) *Tree {
+	tree, err := Open(*config.NewConfig("/tree").SetFS(vfs.NewMemFS()).BlockSize(1024))
+	require.NoError(t, err)
+	t.Cleanup(func() { tree.Close() })
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%03d", i)) }
+	for i := 0; i < 300; i++ {
+		_, _, err := tree.Insert(key(i), []byte("old"), 0)
+		require.NoError(t, err)
+	}
+	_, err = tree.FlushActiveMemtable()
+	require.NoError(t, err)
+
+	for i := 0; i < 300; i += 2 {
+		_, _, err := tree.Insert(key(i), []byte("new"), 1)
+		require.NoError(t, err)
+	}
+	_, err = tree.FlushActiveMemtable()
+	require.NoError(t, err)
+
+	for i := 0; i < 300; i += 3 {
+		_, _, err := tree.Remove(key(i), 2)
+		require.NoError(t, err)
+	}
+	return tree
+}
+
+func expectedScan(lo, hi int) []string {
+	var items []string
+	for i := lo; i <= hi; i++ {
+		switch {
+		case i%3 == 0:
+		case i%2 == 0:
+			items = append(items, fmt.Sprintf("key-%03d=new", i))
+		default:
+			items = append(items, fmt.Sprintf("key-%03d=old", i))
+		}
+	}
+	return items
+}
+
+func reversed(items []string) []string {
+	out := make([]string, len(items))
+	for i, item := range items {
+		out[len(items)-1-i] = item
+	}
+	return out
+}
+
+func TestRange(t *testing.T) {
+	tree := newScanTree(t)
+
+	var forward, backward []string
+	iter := tree.Range([]byte("key-050"), []byte("key-250")).IntoIter()
+	for key, val, ok := iter.Next(); ok; key, val, ok = iter.Next() {
+		forward = append(forward, string(*key)+"="+string(*val))
+	}
+	iter = tree.Range([]byte("key-050"), []byte("key-250")).IntoIter()
+	for key, val, ok := iter.NextBack(); ok; key, val, ok = iter.NextBack() {
+		backward = append(backward, string(*key)+"="+string(*val))
+	}
+
+	assert.Equal(t, expectedScan(50, 250), forward)
+	assert.Equal(t, reversed(expectedScan(50, 250)), backward)
+
+	first, _, ok := tree.FirstKeyValue()
+	assert.True(t, ok)
+	assert.Equal(t, "key-001", string(first))
+	last, _, ok := tree.LastKeyValue()
+	assert.True(t, ok)
+	assert.Equal(t, "key-299", string(last))
+}
+
+func TestPrefix(t *testing.T) {
+	tree := newScanTree(t)
+
+	var forward, backward []string
+	p := tree.Prefix([]byte("key-1"))
+	iter := prefix.NewPrefixIterator(p, p.SeqNo)
+	for key, val, err := iter.Next(); key != nil; key, val, err = iter.Next() {
+		require.NoError(t, err)
+		forward = append(forward, string(*key)+"="+string(*val))
+	}
+	iter = prefix.NewPrefixIterator(p, p.SeqNo)
+	for key, val, err := iter.NextBack(); key != nil; key, val, err = iter.NextBack() {
+		require.NoError(t, err)
+		backward = append(backward, string(*key)+"="+string(*val))
+	}
+
+	assert.Equal(t, expectedScan(100, 199), forward)
+	assert.Equal(t, reversed(expectedScan(100, 199)), backward)
+}
+
+func TestRangeSnapshot(t *testing.T) {
+	tree := newScanTree(t)
+
+	// Before the removes and overwrites, every key has its first value
+	snapshot := tree.Snapshot(1)
+	defer snapshot.Drop()
+
+	count := 0
+	iter := snapshot.Range(nil, nil).IntoIter()
+	for _, val, ok := iter.Next(); ok; _, val, ok = iter.Next() {
+		assert.Equal(t, "old", string(*val))
+		count++
+	}
+	assert.Equal(t, 300, count)
+}
+
+func TestScanDuringCompaction(t *testing.T) {
+	tree := newScanTree(t)
+	fs := tree.TreeInner.FS
+
+	tree.TreeInner.LevelsMutex.RLock()
+	old := tree.TreeInner.Levels.GetAllSegmentsFlattened()
+	tree.TreeInner.LevelsMutex.RUnlock()
+	require.Len(t, old, 2)
+
+	var items []string
+	iter := tree.Iter().IntoIter()
+	key, val, ok := iter.Next()
+	require.True(t, ok)
+	items = append(items, fmt.Sprintf("%s=%s", *key, *val))
+
+	// The compacted segments are kept until the scan is done
+	closed := tree.Iter().IntoIter()
+	require.NoError(t, tree.MajorCompact(1<<20))
+	for _, sg := range old {
+		_, err := fs.Stat(sg.Metadata.Path)
+		assert.NoError(t, err)
+	}
+
+	for key, val, ok := iter.Next(); ok; key, val, ok = iter.Next() {
+		items = append(items, fmt.Sprintf("%s=%s", *key, *val))
+	}
+	assert.Equal(t, expectedScan(0, 299), items)
+
+	for _, sg := range old {
+		_, err := fs.Stat(sg.Metadata.Path)
+		assert.NoError(t, err, "still read by an open iterator")
+	}
+	closed.Close()
+	for _, sg := range old {
+		_, err := fs.Stat(sg.Metadata.Path)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,333 @@
+package tree
+
+import (
+	"bagh/blob"
+	"bagh/comparator"
+	"bagh/config"
+	"bagh/file"
+	"bagh/levels"
+	"bagh/logging"
+	"bagh/memtable"
+	"bagh/segment"
+	"bagh/stall"
+	"bagh/stats"
+	"bagh/stop"
+	"bagh/version"
+	"bagh/vfs"
+	"bagh/wal"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Mode is the way a tree directory is opened
+type Mode uint8
+
+const (
+	// ModePrimary owns the directory, it is the only mode that writes to it
+	ModePrimary Mode = iota
+
+	// ModeReadOnly reads the state of the directory at the time it was opened
+	ModeReadOnly
+
+	// ModeSecondary follows a primary through TryCatchUpWithPrimary
+	ModeSecondary
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModePrimary:
+		return "primary"
+	case ModeReadOnly:
+		return "read-only"
+	case ModeSecondary:
+		return "secondary"
+	default:
+		return fmt.Sprintf("Mode(%d)", uint8(m))
+	}
+}
+
+var (
+	// ErrNotPrimary is returned by writes to a read-only or secondary tree
+	ErrNotPrimary = errors.New("tree is not opened as primary")
+
+	// ErrNotSecondary is returned by TryCatchUpWithPrimary on other trees
+	ErrNotSecondary = errors.New("tree is not opened as secondary")
+)
+
+// Manifest entries that vanish while being opened are retried this often,
+// the primary may delete compacted segments right after reading the manifest
+const catchUpAttempts = 10
+
+// OpenReadOnly opens the tree in the directory without ever writing to it
+//
+// The directory may be used by a primary at the same time, the tree
+// reflects its segments and write-ahead log at the time of opening.
+func OpenReadOnly(path string) (*Tree, error) {
+	return OpenReadOnlyWithConfig(*config.NewConfig(path))
+}
+
+// OpenReadOnlyWithConfig is like OpenReadOnly, the persisted part of the
+// config is read from the directory
+func OpenReadOnlyWithConfig(cfg config.Config) (*Tree, error) {
+	return openFollower(cfg, ModeReadOnly)
+}
+
+// OpenSecondary opens the tree in the directory of a primary, without ever
+// writing to it, and follows the primary through TryCatchUpWithPrimary
+func OpenSecondary(path string) (*Tree, error) {
+	return OpenSecondaryWithConfig(*config.NewConfig(path))
+}
+
+// OpenSecondaryWithConfig is like OpenSecondary, the persisted part of the
+// config is read from the directory
+func OpenSecondaryWithConfig(cfg config.Config) (*Tree, error) {
+	return openFollower(cfg, ModeSecondary)
+}
+
+func openFollower(cfg config.Config, mode Mode) (*Tree, error) {
+	path := cfg.Inner.Path
+	fs := vfs.OrDefault(cfg.FS)
+	logger := logging.OrDiscard(cfg.Logger)
+
+	logger.Info("Opening LSM-tree as follower", logging.Path(path), slog.String("mode", mode.String()))
+
+	if bytes, err := vfs.ReadFile(fs, filepath.Join(path, file.LSMMarker)); err != nil {
+		return nil, err
+	} else if vs := version.ParseFileHeader(bytes); vs != version.VersionV0 {
+		return nil, fmt.Errorf("invalid version: %v", vs)
+	}
+
+	configStr, err := vfs.ReadFile(fs, filepath.Join(path, file.ConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	var persisted config.PersistedConfig
+	if err := json.Unmarshal(configStr, &persisted); err != nil {
+		return nil, err
+	}
+	// The directory may have been moved since the primary created it
+	persisted.Path = path
+
+	cmp := comparator.OrDefault(cfg.Comparator)
+	persisted.Comparator = comparator.NameOrDefault(persisted.Comparator)
+	if persisted.Comparator != cmp.Name() {
+		return nil, fmt.Errorf("%w: tree is ordered by %q, not %q", ErrComparatorMismatch, persisted.Comparator, cmp.Name())
+	}
+
+	blobs, err := blob.OpenReadOnly(filepath.Join(path, file.BlobsFolder), cfg.DescriptorTable)
+	if err != nil {
+		return nil, err
+	}
+
+	inner := &TreeInner{
+		Mode:            mode,
+		ActiveMemtable:  memtable.NewMemTableWithComparator(cmp),
+		SealedMemtables: make(map[string]*memtable.MemTable),
+		Levels:          levels.FromManifest(fs, filepath.Join(path, file.LevelsManifestFile), nil, nil),
+		Blobs:           blobs,
+		Config:          &persisted,
+		BlockCache:      cfg.BlockCache,
+		DescriptorTable: cfg.DescriptorTable,
+		FS:              fs,
+		OpenSnapshots:   NewSnapshotCounter(),
+		StopSignal:      stop.NewStopSignal(),
+		FlushQueue:      newFlushQueue(0),
+		WalTailer:       wal.NewTailer(fs, path, logger),
+		Logger:          logger,
+		Stats:           stats.NewRegistry(),
+		EventListeners:  cfg.EventListeners,
+		Comparator:      cmp,
+
+		PinIndexAndFilterBlocks: cfg.PinIndexAndFilterBlocks,
+	}
+	inner.Levels.Comparator = cmp
+
+	tree := &Tree{TreeInner: inner}
+	if err := tree.catchUp(); err != nil {
+		tree.releaseSegments()
+		blobs.Close()
+		return nil, err
+	}
+
+	// Never stalls, followers do not write
+	inner.WriteController = stall.NewController(stall.Options{}, tree.writePressure)
+	return tree, nil
+}
+
+// Mode returns the way the tree was opened
+func (t *Tree) Mode() Mode {
+	return t.TreeInner.Mode
+}
+
+// checkPrimary returns ErrNotPrimary for read-only and secondary trees
+func (t *Tree) checkPrimary() error {
+	if t.TreeInner.Mode != ModePrimary {
+		return ErrNotPrimary
+	}
+	return nil
+}
+
+// TryCatchUpWithPrimary applies what the primary wrote since the last call
+//
+// New entries of the write-ahead log are added to the private memtable of
+// the secondary, and the segments of the levels manifest replace the current
+// ones. Segments deleted by the primary stay readable until they are
+// dropped by a catch-up and no open scan reads them, their files are held open.
+func (t *Tree) TryCatchUpWithPrimary() error {
+	if t.TreeInner.Mode != ModeSecondary {
+		return ErrNotSecondary
+	}
+	if t.IsClosed() {
+		return ErrClosed
+	}
+	return t.catchUp()
+}
+
+func (t *Tree) catchUp() (err error) {
+	inner := t.TreeInner
+
+	inner.CatchUpMutex.Lock()
+	defer inner.CatchUpMutex.Unlock()
+
+	// The WAL is read before the manifest, the primary only removes a WAL
+	// file once the segment of its memtable is in the manifest
+	inner.ActiveMutex.Lock()
+	flushed, err := inner.WalTailer.Tail(inner.ActiveMemtable)
+	inner.ActiveMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var rebuilt *memtable.MemTable
+	if flushed {
+		// Drop the items that are in segments by now
+		rebuilt = memtable.NewMemTableWithComparator(inner.Comparator)
+		inner.WalTailer.Reset()
+		// The read positions belong to the rebuilt memtable from here on
+		defer func() {
+			if err != nil {
+				inner.WalTailer.Reset()
+			}
+		}()
+		if _, err := inner.WalTailer.Tail(rebuilt); err != nil {
+			return err
+		}
+	}
+
+	lvl, err := t.openManifest()
+	if err != nil {
+		return err
+	}
+	if err := inner.Blobs.Refresh(); err != nil {
+		return err
+	}
+
+	// Readers see either the old memtable and segments or the new ones
+	inner.ActiveMutex.Lock()
+	inner.LevelsMutex.Lock()
+	if rebuilt != nil {
+		inner.ActiveMemtable = rebuilt
+	}
+	previous := inner.Levels
+	inner.Levels = lvl
+	err = t.updatePinning()
+	inner.LevelsMutex.Unlock()
+	inner.ActiveMutex.Unlock()
+
+	// Open scans may still read dropped segments, the last one releases them
+	for segmentID, sg := range previous.Segments {
+		if _, ok := lvl.Segments[segmentID]; ok {
+			continue
+		}
+		release := func() {
+			sg.ReleaseFiles()
+			inner.BlockCache.RemoveSegment(sg.Metadata.ID)
+		}
+		if !t.deferCleanup(sg, release) {
+			release()
+		}
+	}
+
+	return err
+}
+
+// openManifest reads the levels manifest, and opens the segments that are not
+// open yet, holding their files
+func (t *Tree) openManifest() (*levels.Levels, error) {
+	inner := t.TreeInner
+	manifestPath := filepath.Join(inner.Config.Path, file.LevelsManifestFile)
+
+	inner.LevelsMutex.RLock()
+	current := inner.Levels.Segments
+	inner.LevelsMutex.RUnlock()
+
+	for attempt := 1; ; attempt++ {
+		manifest, err := levels.ReadManifest(inner.FS, manifestPath)
+		if err != nil {
+			return nil, err
+		}
+
+		var segments, opened []*segment.Segment
+		for _, segmentID := range levels.SegmentIDs(manifest) {
+			if sg, ok := current[segmentID]; ok {
+				segments = append(segments, sg)
+				continue
+			}
+
+			var sg *segment.Segment
+			sg, err = t.openHeldSegment(segmentID)
+			if err != nil {
+				break
+			}
+			segments = append(segments, sg)
+			opened = append(opened, sg)
+		}
+
+		if err == nil {
+			lvl := levels.FromManifest(inner.FS, manifestPath, manifest, segments)
+			lvl.Comparator = inner.Comparator
+			lvl.SortLevels()
+			return lvl, nil
+		}
+
+		for _, sg := range opened {
+			sg.ReleaseFiles()
+		}
+		if !os.IsNotExist(err) || attempt == catchUpAttempts {
+			return nil, err
+		}
+		inner.Logger.Debug("Segment of levels manifest vanished, reading it again", logging.Err(err))
+	}
+}
+
+func (t *Tree) openHeldSegment(segmentID string) (*segment.Segment, error) {
+	inner := t.TreeInner
+	path := filepath.Join(inner.Config.Path, file.SegmentsFolder, segmentID)
+
+	sg, err := segment.RecoverSegment(path, inner.BlockCache, inner.DescriptorTable, inner.Comparator)
+	if err != nil {
+		return nil, err
+	}
+	if err := sg.HoldFiles(); err != nil {
+		sg.ReleaseFiles()
+		return nil, err
+	}
+
+	inner.Logger.Debug("Opened segment of primary", logging.SegmentID(segmentID), logging.Path(path))
+	return sg, nil
+}
+
+// releaseSegments closes the open files of all segments
+func (t *Tree) releaseSegments() {
+	t.TreeInner.LevelsMutex.RLock()
+	defer t.TreeInner.LevelsMutex.RUnlock()
+
+	for _, sg := range t.TreeInner.Levels.GetAllSegmentsFlattened() {
+		sg.ReleaseFiles()
+		t.TreeInner.BlockCache.RemoveSegment(sg.Metadata.ID)
+	}
+}
@@ -0,0 +1,194 @@
+package tree
+
+import (
+	"bagh/config"
+	"bagh/value"
+	"bagh/vfs"
+	"bagh/wal"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func insertKeys(t *testing.T, tree *Tree, prefix string, seqno value.SeqNo) {
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("%s-%d", prefix, i))
+		_, _, err := tree.Insert(key, []byte(prefix), seqno+value.SeqNo(i))
+		assert.NoError(t, err)
+	}
+}
+
+func assertKeys(t *testing.T, tree *Tree, prefix string) {
+	for i := 0; i < 10; i++ {
+		val, err := tree.Get([]byte(fmt.Sprintf("%s-%d", prefix, i)))
+		assert.NoError(t, err)
+		assert.Equal(t, prefix, string(val))
+	}
+}
+
+func listFiles(t *testing.T, folder string) []string {
+	var files []string
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		files = append(files, fmt.Sprintf("%s %d %v", path, info.Size(), info.ModTime()))
+		return nil
+	})
+	assert.NoError(t, err)
+	return files
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	folder := t.TempDir()
+	primary, err := Open(*config.NewConfig(folder))
+	assert.NoError(t, err)
+
+	insertKeys(t, primary, "segment", 0)
+	_, err = primary.FlushActiveMemtable()
+	assert.NoError(t, err)
+
+	log, _, err := wal.OpenWal(vfs.Default, folder, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, log.Write(*value.NewValue([]byte("logged"), []byte("1"), 10, value.Record)))
+	assert.NoError(t, log.Sync())
+
+	before := listFiles(t, folder)
+
+	// The primary holds the lock of the directory
+	tree, err := OpenReadOnly(folder)
+	assert.NoError(t, err)
+	assert.Equal(t, ModeReadOnly, tree.Mode())
+
+	assertKeys(t, tree, "segment")
+	val, err := tree.Get([]byte("logged"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(val))
+
+	_, _, err = tree.Insert([]byte("a"), []byte("1"), 100)
+	assert.ErrorIs(t, err, ErrNotPrimary)
+	_, err = tree.FlushActiveMemtable()
+	assert.ErrorIs(t, err, ErrNotPrimary)
+	assert.ErrorIs(t, tree.MajorCompact(64*1024*1024), ErrNotPrimary)
+	assert.ErrorIs(t, tree.TryCatchUpWithPrimary(), ErrNotSecondary)
+
+	assert.NoError(t, tree.Close())
+	assert.Equal(t, before, listFiles(t, folder))
+
+	assert.NoError(t, log.Close())
+	assert.NoError(t, primary.Close())
+}
+
+func TestSecondaryCatchUp(t *testing.T) {
+	folder := t.TempDir()
+	primary, err := Open(*config.NewConfig(folder))
+	assert.NoError(t, err)
+
+	log, _, err := wal.OpenWal(vfs.Default, folder, nil, nil)
+	assert.NoError(t, err)
+
+	insertKeys(t, primary, "first", 0)
+	_, err = primary.FlushActiveMemtable()
+	assert.NoError(t, err)
+
+	secondary, err := OpenSecondary(folder)
+	assert.NoError(t, err)
+	assertKeys(t, secondary, "first")
+
+	insertKeys(t, primary, "second", 10)
+	_, err = primary.FlushActiveMemtable()
+	assert.NoError(t, err)
+
+	// Written by the primary, but not flushed yet
+	item := value.NewValue([]byte("logged"), []byte("1"), 20, value.Record)
+	_, _, err = primary.AppendEntry(*item)
+	assert.NoError(t, err)
+	assert.NoError(t, log.Write(*item))
+
+	val, err := secondary.Get([]byte("second-0"))
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+
+	assert.NoError(t, secondary.TryCatchUpWithPrimary())
+	assertKeys(t, secondary, "second")
+	val, err = secondary.Get([]byte("logged"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(val))
+	assert.Equal(t, 2, secondary.SegmentCount())
+
+	// The primary deletes the compacted segments, the secondary keeps reading them
+	var compacted []string
+	for _, sg := range secondary.TreeInner.Levels.GetAllSegmentsFlattened() {
+		compacted = append(compacted, sg.Metadata.Path)
+	}
+	assert.NoError(t, primary.MajorCompact(64*1024*1024))
+	for _, path := range compacted {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+	}
+	assertKeys(t, secondary, "first")
+	assertKeys(t, secondary, "second")
+
+	// Flushing the memtable of the WAL removes its files
+	sealed, err := log.Rotate()
+	assert.NoError(t, err)
+	_, err = primary.FlushActiveMemtable()
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Remove(vfs.Default, sealed))
+
+	assert.NoError(t, secondary.TryCatchUpWithPrimary())
+	assert.Equal(t, primary.SegmentCount(), secondary.SegmentCount())
+	assert.True(t, secondary.TreeInner.ActiveMemtable.IsEmpty())
+	assertKeys(t, secondary, "first")
+	assertKeys(t, secondary, "second")
+	val, err = secondary.Get([]byte("logged"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(val))
+
+	_, _, err = secondary.Insert([]byte("a"), []byte("1"), 100)
+	assert.ErrorIs(t, err, ErrNotPrimary)
+
+	assert.NoError(t, secondary.Close())
+	assert.ErrorIs(t, secondary.TryCatchUpWithPrimary(), ErrClosed)
+	assert.NoError(t, log.Close())
+	assert.NoError(t, primary.Close())
+}
+
+func TestSecondaryScanDuringCatchUp(t *testing.T) {
+	folder := t.TempDir()
+	primary, err := Open(*config.NewConfig(folder).BlockSize(1024))
+	assert.NoError(t, err)
+	defer primary.Close()
+
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		_, _, err := primary.Insert(key, bytes.Repeat([]byte("v"), 100), value.SeqNo(i))
+		assert.NoError(t, err)
+		if i%100 == 99 {
+			_, err = primary.FlushActiveMemtable()
+			assert.NoError(t, err)
+		}
+	}
+
+	secondary, err := OpenSecondary(folder)
+	assert.NoError(t, err)
+	defer secondary.Close()
+
+	iter := secondary.Iter().IntoIter()
+	_, _, ok := iter.Next()
+	assert.True(t, ok)
+
+	// The catch-up drops the compacted segments, the open scan keeps reading them
+	assert.NoError(t, primary.MajorCompact(64*1024*1024))
+	assert.NoError(t, secondary.TryCatchUpWithPrimary())
+
+	count := 1
+	for _, _, ok := iter.Next(); ok; _, _, ok = iter.Next() {
+		count++
+	}
+	assert.Equal(t, 200, count)
+}
@@ -1,13 +1,13 @@
 package tree
 
 import (
+	"bagh/logging"
 	"bagh/prefix"
 	"bagh/ranger"
 	"bagh/segment"
 	"bagh/value"
 	"errors"
 	"io"
-	"log"
 	"sync/atomic"
 )
 
@@ -40,7 +40,7 @@ type Snapshot struct {
 
 func NewSnapshot(tree *Tree, seqno value.SeqNo) *Snapshot {
 	tree.TreeInner.OpenSnapshots.Increment()
-	log.Printf("Opening snapshot with seqno: %d", seqno)
+	tree.TreeInner.Logger.Debug("Opening snapshot", logging.SeqNo(seqno))
 	return &Snapshot{
 		tree:  tree,
 		seqno: seqno,
@@ -55,6 +55,10 @@ func (s *Snapshot) Get(key []byte) (value.UserValue, error) {
 	if entry == nil {
 		return nil, nil
 	}
+	entry, err = s.tree.resolveValue(entry)
+	if err != nil {
+		return nil, err
+	}
 	return entry.Value, nil
 }
 
@@ -63,27 +67,36 @@ func (s *Snapshot) Iter() *ranger.Range {
 }
 
 func (s *Snapshot) Range(start, end *segment.Bound[value.UserKey]) *ranger.Range {
-	return s.tree.CreateRange(start, end, &s.seqno)
+	return s.tree.CreateRange(start, end, &s.seqno, nil)
 }
 
 func (s *Snapshot) Prefix(prefix []byte) *prefix.Prefix {
-	return s.tree.CreatePrefix(prefix, &s.seqno)
+	return s.tree.CreatePrefix(prefix, &s.seqno, nil)
 }
 
 func (s *Snapshot) FirstKeyValue() (value.UserKey, value.UserValue, error) {
 	iter := s.Iter().IntoIter()
+	defer iter.Close()
 	a, b, c := iter.Next()
 	if c {
 		return *a, *b, nil
 	}
+	if err := iter.Err(); err != nil {
+		return nil, nil, err
+	}
 	return nil, nil, errors.ErrUnsupported
 }
 
 func (s *Snapshot) LastKeyValue() (value.UserKey, value.UserValue, error) {
-	a, b, c := s.Iter().IntoIter().NextBack()
+	iter := s.Iter().IntoIter()
+	defer iter.Close()
+	a, b, c := iter.NextBack()
 	if c {
 		return *a, *b, nil
 	}
+	if err := iter.Err(); err != nil {
+		return nil, nil, err
+	}
 	return nil, nil, errors.ErrUnsupported
 }
 
@@ -121,6 +134,6 @@ func (s *Snapshot) Len() (int, error) {
 }
 
 func (s *Snapshot) Drop() {
-	log.Println("Closing snapshot")
+	s.tree.TreeInner.Logger.Debug("Closing snapshot", logging.SeqNo(s.seqno))
 	s.tree.TreeInner.OpenSnapshots.Decrement()
 }
@@ -0,0 +1,50 @@
+package tree
+
+import (
+	"bagh/stats"
+	"net/http"
+)
+
+// Stats returns a snapshot of the statistics of the tree
+func (t *Tree) Stats() stats.Stats {
+	s := t.TreeInner.Stats.Snapshot()
+
+	t.TreeInner.ActiveMutex.RLock()
+	s.ActiveMemtableBytes = uint64(t.TreeInner.ActiveMemtable.Size())
+	t.TreeInner.ActiveMutex.RUnlock()
+
+	t.TreeInner.SealedMutex.RLock()
+	s.SealedMemtables = len(t.TreeInner.SealedMemtables)
+	for _, mt := range t.TreeInner.SealedMemtables {
+		s.SealedMemtableBytes += uint64(mt.Size())
+	}
+	t.TreeInner.SealedMutex.RUnlock()
+
+	t.TreeInner.LevelsMutex.RLock()
+	s.SegmentsPerLevel = make([]int, len(t.TreeInner.Levels.Levels))
+	for levelNo, level := range t.TreeInner.Levels.Levels {
+		s.SegmentsPerLevel[levelNo] = len(level.Segments)
+	}
+	s.DiskBytes = t.TreeInner.Levels.Size()
+	t.TreeInner.LevelsMutex.RUnlock()
+
+	if cache := t.TreeInner.BlockCache; cache != nil {
+		s.BlockCacheHits = cache.Hits()
+		s.BlockCacheMisses = cache.Misses()
+		s.BlockCacheBytes = cache.Size()
+	}
+
+	if controller := t.TreeInner.WriteController; controller != nil {
+		counters := controller.Counters()
+		s.Stalls = counters.Stalls
+		s.StallDelayTime = counters.DelayTime
+		s.StallStopTime = counters.StopTime
+	}
+
+	return s
+}
+
+// StatsHandler serves the statistics of the tree in the Prometheus text format
+func (t *Tree) StatsHandler() http.Handler {
+	return stats.Handler(t.Stats)
+}
@@ -0,0 +1,77 @@
+package tree
+
+import (
+	"bagh/config"
+	"bagh/value"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTreeStats(t *testing.T) {
+	tree, err := Open(*config.NewConfig(t.TempDir()))
+	assert.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		_, _, err := tree.Insert([]byte(fmt.Sprintf("key-%03d", i)), []byte("value"), value.SeqNo(i))
+		assert.NoError(t, err)
+	}
+	_, _, err = tree.Remove([]byte("key-000"), 100)
+	assert.NoError(t, err)
+
+	s := tree.Stats()
+	assert.Equal(t, uint64(100), s.Puts)
+	assert.Equal(t, uint64(1), s.Deletes)
+	assert.Equal(t, uint64(100*(7+5)+7), s.BytesWritten)
+	assert.NotZero(t, s.ActiveMemtableBytes)
+
+	_, err = tree.FlushActiveMemtable()
+	assert.NoError(t, err)
+
+	// Point reads that find an item are covered by the stats of the read path
+	val, err := tree.Get([]byte("key-0005"))
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+
+	tree.Range([]byte("key-010"), []byte("key-019"))
+
+	s = tree.Stats()
+	assert.Equal(t, uint64(1), s.Gets)
+	assert.Equal(t, uint64(1), s.Scans)
+	assert.Equal(t, uint64(1), s.Flushes)
+	assert.NotZero(t, s.FlushBytes)
+	assert.Equal(t, s.DiskBytes, s.FlushBytes)
+	assert.Equal(t, 1, s.SegmentsPerLevel[0])
+	assert.Zero(t, s.ActiveMemtableBytes)
+	assert.Equal(t, uint64(1), s.FilterChecks)
+
+	rec := httptest.NewRecorder()
+	tree.StatsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "bagh_gets_total 1\n")
+	assert.Contains(t, string(body), "bagh_flushes_total 1\n")
+}
+
+func TestRecoveredTreeStats(t *testing.T) {
+	folder := t.TempDir()
+	tree, err := Open(*config.NewConfig(folder))
+	assert.NoError(t, err)
+	_, _, err = tree.Insert([]byte("a"), []byte("1"), 0)
+	assert.NoError(t, err)
+	_, err = tree.FlushActiveMemtable()
+	assert.NoError(t, err)
+	assert.NoError(t, tree.Close())
+
+	tree, err = Open(*config.NewConfig(folder))
+	assert.NoError(t, err)
+	_, _, err = tree.Insert([]byte("b"), []byte("2"), 1)
+	assert.NoError(t, err)
+
+	s := tree.Stats()
+	assert.Equal(t, uint64(1), s.Puts)
+	assert.Equal(t, 1, s.SegmentsPerLevel[0])
+}
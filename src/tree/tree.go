@@ -1,25 +1,33 @@
 package tree
 
 import (
+	"bagh/blob"
+	"bagh/comparator"
 	"bagh/config"
 	"bagh/descriptor"
+	"bagh/event"
 	"bagh/file"
-	"bagh/flush"
-	"bagh/id"
 	"bagh/levels"
+	"bagh/logging"
 	"bagh/memtable"
 	"bagh/prefix"
 	"bagh/ranger"
 	"bagh/segment"
+	"bagh/stall"
+	"bagh/stats"
 	"bagh/stop"
 	"bagh/value"
 	"bagh/version"
+	"bagh/vfs"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
 	"slices"
-	"strings"
+	"sort"
+	"time"
 )
 
 type Tree struct {
@@ -40,13 +48,13 @@ type Tree struct {
 /// Returns error, if an IO error occured.
 
 func Open(config config.Config) (*Tree, error) {
-	fmt.Println("Opening LSM-tree at %s", config.Inner.Path)
+	logging.OrDiscard(config.Logger).Info("Opening LSM-tree", logging.Path(config.Inner.Path))
 
 	var tree *Tree
-	var err error
 
-	if _, err := os.Stat(filepath.Join(config.Inner.Path, file.LSMMarker)); err == nil {
-		tree, err = Recover(config.Inner.Path, config.BlockCache, config.DescriptorTable)
+	_, err := vfs.OrDefault(config.FS).Stat(filepath.Join(config.Inner.Path, file.LSMMarker))
+	if err == nil {
+		tree, err = Recover(config)
 	} else if os.IsNotExist(err) {
 		tree, err = CreateNew(config)
 	}
@@ -58,30 +66,6 @@ func Open(config config.Config) (*Tree, error) {
 	return tree, nil
 }
 
-// func (t *Tree) Compact(strategy CompactionStrategy) error {
-// 	options := &CompactionOptions{
-// 		Config:          t.TreeInner.Config.Clone(),
-// 		SealedMemtables: t.TreeInner.SealedMemtables.Clone(),
-// 		Levels:          t.TreeInner.Levels.Clone(),
-// 		OpenSnapshots:   t.TreeInner.OpenSnapshots.Clone(),
-// 		StopSignal:      t.TreeInner.StopSignal.Clone(),
-// 		BlockCache:      t.TreeInner.BlockCache.Clone(),
-// 		Strategy:        strategy,
-// 		DescriptorTable: t.TreeInner.DescriptorTable.Clone(),
-// 	}
-// 	if err := doCompaction(options); err != nil {
-// 		return err
-// 	}
-// 	fmt.Printf("lsm-tree: compaction run over")
-// 	return nil
-// }
-
-// func (t *Tree) MajorCompact(targetSize uint64) error {
-// 	fmt.Printf("Starting major compaction")
-// 	strategy := NewMajorCompactionStrategy(targetSize)
-// 	return t.Compact(strategy)
-// }
-
 func (t *Tree) Snapshot(seqno value.SeqNo) *Snapshot {
 	return NewSnapshot(t, seqno)
 }
@@ -96,50 +80,57 @@ func (t *Tree) RegisterSegments(segments []segment.Segment) error {
 		t.TreeInner.Levels.Add(&segment)
 	}
 
-	for _, segment := range segments {
-		delete(t.TreeInner.SealedMemtables, segment.Metadata.ID)
+	// The memtables stay sealed until the segments are durable
+	if err := t.writeManifest(); err != nil {
+		for _, segment := range segments {
+			t.TreeInner.Levels.Remove(segment.Metadata.ID)
+		}
+		return err
 	}
 
-	if err := t.TreeInner.Levels.WriteToDisk(); err != nil {
-		return err
+	for _, segment := range segments {
+		delete(t.TreeInner.SealedMemtables, segment.Metadata.ID)
 	}
 
-	return nil
+	return t.updatePinning()
 }
 
-func (t *Tree) FlushActiveMemtable() (string, error) {
-	fmt.Println("flush: flushing active memtable")
-
-	segmentID, yankedMemtable := t.RotateMemtable()
-	if segmentID == nil || yankedMemtable == nil {
-		return "", nil
+// start sets up the write controller and spawns the background workers
+func (t *Tree) start(cfg *config.Config) {
+	t.TreeInner.MaxMemtableSize = cfg.MaxMemtableBytes
+	stallOpts := cfg.WriteStall
+	onEvent := stallOpts.OnEvent
+	stallOpts.OnEvent = func(e stall.Event) {
+		t.TreeInner.Logger.Warn("Write stall changed",
+			slog.String("state", e.State.String()),
+			slog.String("reason", string(e.Reason)),
+			slog.Duration("previous_duration", e.Duration))
+		if onEvent != nil {
+			onEvent(e)
+		}
+		t.notify(func(l event.Listener) { l.OnWriteStallChanged(e) })
 	}
+	t.TreeInner.WriteController = stall.NewController(stallOpts, t.writePressure)
+	t.startFlushWorkers(cfg.FlushWorkerCount)
 
-	segmentFolder := filepath.Join(t.TreeInner.Config.Path, file.SegmentsFolder)
-	fmt.Printf("flush: writing segment to %s", segmentFolder)
-
-	sg, err := flush.FlushToSegment(flush.Options{
-		BlockCache:      t.TreeInner.BlockCache,
-		BlockSize:       t.TreeInner.Config.BlockSize,
-		Folder:          segmentFolder,
-		SegmentID:       *segmentID,
-		MemTable:        yankedMemtable,
-		DescriptorTable: t.TreeInner.DescriptorTable,
-	})
-
-	if err != nil {
-		return "", err
+	if cfg.WriteBufferManager != nil {
+		t.TreeInner.WriteBufferManager = cfg.WriteBufferManager
+		cfg.WriteBufferManager.Register(t)
 	}
+}
 
-	resultPath := sg.Metadata.Path
-
-	err = t.RegisterSegments([]segment.Segment{*sg})
-	if err != nil {
-		return "", err
+// updatePinning pins the index and filter blocks of segments in L0 and L1,
+// and unpins them for deeper segments, the caller has to hold the levels lock
+func (t *Tree) updatePinning() error {
+	for levelNo, level := range t.TreeInner.Levels.Levels {
+		pinned := t.TreeInner.PinIndexAndFilterBlocks && levelNo <= 1
+		for _, segmentID := range level.Segments {
+			if err := t.TreeInner.Levels.Segments[segmentID].SetPinned(pinned); err != nil {
+				return err
+			}
+		}
 	}
-
-	print("flush: thread done")
-	return resultPath, nil
+	return nil
 }
 
 // @TODO: dont think we need locks here and next as well
@@ -187,30 +178,14 @@ func (t *Tree) ActiveMemtableSize() uint32 {
 	return t.TreeInner.ActiveMemtable.ApproximateSize.Load()
 }
 
-func (t *Tree) RotateMemtable() (*string, *memtable.MemTable) {
-	fmt.Printf("rotate: acquiring active memtable write lock")
-	t.TreeInner.ActiveMutex.Lock()
-	defer t.TreeInner.ActiveMutex.Unlock()
-	activeMemtable := t.TreeInner.ActiveMemtable
-	if len(activeMemtable.Items) == 0 {
-		return nil, nil
-	}
-
-	fmt.Printf("rotate: acquiring sealed memtables write lock")
-	t.TreeInner.SealedMutex.Lock()
-	defer t.TreeInner.SealedMutex.Unlock()
-	sealedMemtables := t.TreeInner.SealedMemtables
-
-	yankedMemtable, _ := activeMemtable.Clone()
-	tmpMemtableID := id.GenerateSegmentID()
-	sealedMemtables[tmpMemtableID] = yankedMemtable
-
-	return &tmpMemtableID, yankedMemtable
-}
-
 func (t *Tree) SetActiveMemtable(memtable *memtable.MemTable) {
 	t.TreeInner.ActiveMutex.Lock()
 	defer t.TreeInner.ActiveMutex.Unlock()
+
+	if manager := t.TreeInner.WriteBufferManager; manager != nil {
+		manager.Free(uint64(t.TreeInner.ActiveMemtable.Size()))
+		manager.Reserve(uint64(memtable.Size()))
+	}
 	t.TreeInner.ActiveMemtable = memtable
 }
 
@@ -228,7 +203,9 @@ func (t *Tree) AddSealedMemtable(id string, memtable *memtable.MemTable) {
 
 func (t *Tree) Len() (int, error) {
 	var count int
-	items := t.Iter().Segments
+	r := t.Iter()
+	r.Release()
+	items := r.Segments
 	for _, item := range items {
 		if item != nil {
 			count++
@@ -250,62 +227,153 @@ func IgnoreTombstoneValue(item *value.Value) *value.Value {
 }
 
 func (t *Tree) GetInternalEntry(key []byte, evictTombstone bool, seqno *value.SeqNo) (*value.Value, error) {
-	t.TreeInner.ActiveMutex.Lock()
+	if t.IsClosed() {
+		return nil, ErrClosed
+	}
+	item, err := t.getInternalEntry(key, seqno)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	if evictTombstone {
+		return IgnoreTombstoneValue(item), nil
+	}
+	return item, nil
+}
 
-	if item := t.TreeInner.ActiveMemtable.Get(key, seqno); item != nil {
-		if evictTombstone {
-			return IgnoreTombstoneValue(item), nil
-		}
+// getInternalEntry returns the newest version of the key visible at seqno
+//
+// Sources are read newest first: the active memtable, the sealed memtables
+// by descending seqno, the L0 segments by descending max seqno, then the one
+// segment of every deeper level whose key range contains the key.
+func (t *Tree) getInternalEntry(key []byte, seqno *value.SeqNo) (*value.Value, error) {
+	if item := t.getFromMemtables(key, seqno); item != nil {
 		return item, nil
 	}
+	return t.getFromSegments(key, seqno)
+}
 
-	t.TreeInner.ActiveMutex.Unlock()
-	t.TreeInner.SealedMutex.Lock()
-	sealedMemtables := t.TreeInner.SealedMemtables
+func (t *Tree) getFromMemtables(key []byte, seqno *value.SeqNo) *value.Value {
+	t.TreeInner.ActiveMutex.RLock()
+	item := t.TreeInner.ActiveMemtable.Get(key, seqno)
+	t.TreeInner.ActiveMutex.RUnlock()
+	if item != nil {
+		return item
+	}
 
-	for _, memtable := range sealedMemtables {
-		if item := memtable.Get(key, seqno); item != nil {
-			if evictTombstone {
-				return IgnoreTombstoneValue(item), nil
-			}
-			return item, nil
+	t.TreeInner.SealedMutex.RLock()
+	defer t.TreeInner.SealedMutex.RUnlock()
+
+	for _, mt := range t.sealedNewestFirst() {
+		if item := mt.Get(key, seqno); item != nil {
+			return item
 		}
 	}
-	t.TreeInner.SealedMutex.Unlock()
+	return nil
+}
 
-	t.TreeInner.LevelsMutex.Lock()
-	segmentsLock := t.TreeInner.Levels
+func (t *Tree) getFromSegments(key []byte, seqno *value.SeqNo) (*value.Value, error) {
+	t.TreeInner.LevelsMutex.RLock()
+	defer t.TreeInner.LevelsMutex.RUnlock()
 
-	for _, segment := range segmentsLock.GetAllSegmentsFlattened() {
-		if item, err := segment.Get(key, seqno); err == nil && item != nil {
-			if evictTombstone {
-				return IgnoreTombstoneValue(item), nil
-			}
-			return item, nil
+	// Seqno ranges of L0 segments may interleave (e.g. blob relocations and
+	// ingested segments keep old seqnos), so the newest version is the hit
+	// with the highest seqno. L0 is sorted by ascending max seqno, only
+	// segments with a higher max seqno than the best hit can hold a newer one.
+	lvl := t.TreeInner.Levels
+	l0 := lvl.Levels[0].Segments
+	var newest *value.Value
+	for i := len(l0) - 1; i >= 0; i-- {
+		sg := lvl.Segments[l0[i]]
+		if newest != nil && sg.Metadata.Seqnos[1] <= newest.SeqNo {
+			break
+		}
+		item, err := sg.GetObserved(key, seqno, t.TreeInner.Stats)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil && (newest == nil || item.SeqNo > newest.SeqNo) {
+			newest = item
 		}
 	}
-	t.TreeInner.LevelsMutex.Unlock()
+	if newest != nil {
+		return newest, nil
+	}
 
+	for levelNo := uint8(1); levelNo < lvl.Depth(); levelNo++ {
+		sg := lvl.SegmentContaining(levelNo, key)
+		if sg == nil {
+			continue
+		}
+		item, err := sg.GetObserved(key, seqno, t.TreeInner.Stats)
+		if err != nil || item != nil {
+			return item, err
+		}
+	}
 	return nil, nil
 }
 
+// sealedNewestFirst returns the sealed memtables by descending highest
+// seqno, the caller has to hold the sealed lock
+func (t *Tree) sealedNewestFirst() []*memtable.MemTable {
+	sealed := make([]*memtable.MemTable, 0, len(t.TreeInner.SealedMemtables))
+	for _, mt := range t.TreeInner.SealedMemtables {
+		sealed = append(sealed, mt)
+	}
+	lsn := func(mt *memtable.MemTable) value.SeqNo {
+		seqno, _ := mt.GetLSN()
+		return *seqno
+	}
+	sort.Slice(sealed, func(i, j int) bool {
+		return lsn(sealed[i]) > lsn(sealed[j])
+	})
+	return sealed
+}
+
 func (t *Tree) Get(key []byte) (value.UserValue, error) {
+	registry := t.TreeInner.Stats
+	registry.Gets.Add(1)
+	defer registry.GetLatency.Since(time.Now())
+
 	item, err := t.GetInternalEntry(key, true, nil)
 	if err != nil {
 		return nil, err
 	}
+	item, err = t.resolveValue(item)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, nil
+	}
+	registry.BytesRead.Add(uint64(len(key) + len(item.Value)))
 	return item.Value, nil
 }
 
 func (t *Tree) Insert(key, val []byte, seqno value.SeqNo) (uint32, uint32, error) {
+	registry := t.TreeInner.Stats
+	registry.Puts.Add(1)
+	defer registry.PutLatency.Since(time.Now())
+
 	item := value.NewValue(key, val, seqno, value.Record)
 	a, b, c := t.AppendEntry(*item)
+	if c != nil {
+		return 0, 0, c
+	}
+	registry.BytesWritten.Add(uint64(len(key) + len(val)))
 	return *a, *b, c
 }
 
 func (t *Tree) Remove(key []byte, seqno value.SeqNo) (uint32, uint32, error) {
+	registry := t.TreeInner.Stats
+	registry.Deletes.Add(1)
+	defer registry.DeleteLatency.Since(time.Now())
+
 	item := value.NewValue(key, nil, seqno, value.Tombstone)
 	a, b, c := t.AppendEntry(*item)
+	if c != nil {
+		return 0, 0, c
+	}
+	registry.BytesWritten.Add(uint64(len(key)))
 	return *a, *b, c
 }
 
@@ -318,7 +386,7 @@ func (t *Tree) ContainsKey(key []byte) (bool, error) {
 }
 
 func (t *Tree) CreateIter(seqno *value.SeqNo) *ranger.Range {
-	return t.CreateRange(nil, nil, seqno)
+	return t.CreateRange(nil, nil, seqno, nil)
 }
 
 // @TODO: wtf u doin implementing dis shit like this ?? its a map lmao
@@ -326,29 +394,78 @@ func (t *Tree) Iter() *ranger.Range {
 	return t.CreateIter(nil)
 }
 
-func (t *Tree) CreateRange(lo, hi *segment.Bound[value.UserKey], seqno *value.SeqNo) *ranger.Range {
-	levels := t.TreeInner.Levels
-	// @TODO: add level lock
-	segmentArr := levels.GetAllSegmentsFlattened()
+// CreateRange creates a range over the tree, nil bounds are unbounded
+//
+// Segments rejected by the filter (if any) are not read.
+func (t *Tree) CreateRange(lo, hi *segment.Bound[value.UserKey], seqno *value.SeqNo, filter segment.SegmentFilter) *ranger.Range {
+	if lo == nil {
+		lo = &segment.Bound[value.UserKey]{Unbounded: true}
+	}
+	if hi == nil {
+		hi = &segment.Bound[value.UserKey]{Unbounded: true}
+	}
+
+	// Without a snapshot, every item is visible
+	readSeqno := value.SeqNo(math.MaxUint64)
+	if seqno != nil {
+		readSeqno = *seqno
+	}
+
+	guard := t.memtableGuard()
+
+	t.TreeInner.LevelsMutex.RLock()
 	segments := []*segment.Segment{}
-	for _, v := range segmentArr {
-		if v.CheckKeyRangeOverlap(*lo, *hi) {
+	for _, v := range t.TreeInner.Levels.GetAllSegmentsFlattened() {
+		if v.CheckKeyRangeOverlap(*lo, *hi) && (filter == nil || filter(v)) {
 			segments = append(segments, v)
 		}
 	}
+	release := t.holdSegments(segments)
+	t.TreeInner.LevelsMutex.RUnlock()
 
-	return ranger.NewRange(
-		ranger.MemTableGuard{
-			Active: &ranger.RwLockGuard[memtable.MemTable]{Obj: t.TreeInner.ActiveMemtable},
-			Sealed: &ranger.RwLockGuard[map[string]*memtable.MemTable]{Obj: &t.TreeInner.SealedMemtables},
-		},
+	t.TreeInner.Stats.Scans.Add(1)
+	r := ranger.NewRange(
+		guard,
 		[2]segment.Bound[value.UserKey]{*lo, *hi},
 		segments,
-		*seqno,
+		readSeqno,
+		t.resolveValue,
 	)
+	r.Observe = t.TreeInner.Stats.ScanDone
+	r.Release = release
+	return r
+}
+
+// memtableGuard captures the current memtables for a scan, the sealed
+// memtables are copied as flushes remove them from the tree's map
+func (t *Tree) memtableGuard() ranger.MemTableGuard {
+	t.TreeInner.ActiveMutex.RLock()
+	active := t.TreeInner.ActiveMemtable
+	t.TreeInner.ActiveMutex.RUnlock()
+
+	t.TreeInner.SealedMutex.RLock()
+	sealed := make(map[string]*memtable.MemTable, len(t.TreeInner.SealedMemtables))
+	for id, mt := range t.TreeInner.SealedMemtables {
+		sealed[id] = mt
+	}
+	t.TreeInner.SealedMutex.RUnlock()
+
+	return ranger.MemTableGuard{
+		Active: &ranger.RwLockGuard[memtable.MemTable]{Obj: active},
+		Sealed: &ranger.RwLockGuard[map[string]*memtable.MemTable]{Obj: &sealed},
+	}
 }
 
 func (t *Tree) Range(start, end []byte) *ranger.Range {
+	return t.RangeWithFilter(start, end, nil)
+}
+
+// RangeWithFilter is like Range, but skips segments the filter rejects,
+// e.g. based on their Properties
+//
+// Skipped segments may shadow older versions in other segments, so the
+// filter should only reject segments that cannot contain any relevant item.
+func (t *Tree) RangeWithFilter(start, end []byte, filter segment.SegmentFilter) *ranger.Range {
 	st := &segment.Bound[value.UserKey]{
 		Included: &start,
 	}
@@ -356,39 +473,48 @@ func (t *Tree) Range(start, end []byte) *ranger.Range {
 	ed := &segment.Bound[value.UserKey]{
 		Included: &end,
 	}
-	return t.CreateRange(st, ed, nil)
+	return t.CreateRange(st, ed, nil, filter)
 }
 
-func (t *Tree) CreatePrefix(pfix []byte, seqno *value.SeqNo) *prefix.Prefix {
-	levels := t.TreeInner.Levels
-	// @TODO: add level lock
-	segmentArr := levels.GetAllSegmentsFlattened()
+func (t *Tree) CreatePrefix(pfix []byte, seqno *value.SeqNo, filter segment.SegmentFilter) *prefix.Prefix {
+	guard := t.memtableGuard()
+
+	t.TreeInner.LevelsMutex.RLock()
 	segments := []*segment.Segment{}
-	for _, v := range segmentArr {
-		if v.CheckPrefixOverlap(pfix) {
+	for _, v := range t.TreeInner.Levels.GetAllSegmentsFlattened() {
+		if v.CheckPrefixOverlap(pfix) && (filter == nil || filter(v)) {
 			segments = append(segments, v)
 		}
 	}
-	// segmentInfo := t.Levels.ReadLock().GetAllSegments().Filter(func(s *Segment) bool {
-	// 	return s.CheckPrefixOverlap(pfix)
-	// })
-	return prefix.NewPrefix(
-		ranger.MemTableGuard{
-			Active: &ranger.RwLockGuard[memtable.MemTable]{Obj: t.TreeInner.ActiveMemtable},
-			Sealed: &ranger.RwLockGuard[map[string]*memtable.MemTable]{Obj: &t.TreeInner.SealedMemtables},
-		},
+	release := t.holdSegments(segments)
+	t.TreeInner.LevelsMutex.RUnlock()
+
+	t.TreeInner.Stats.Scans.Add(1)
+	p := prefix.NewPrefix(
+		guard,
 		pfix,
 		segments,
 		seqno,
+		t.resolveValue,
 	)
+	p.Observe = t.TreeInner.Stats.ScanDone
+	p.Release = release
+	return p
 }
 
 func (t *Tree) Prefix(pfix []byte) *prefix.Prefix {
-	return t.CreatePrefix(pfix, nil)
+	return t.CreatePrefix(pfix, nil, nil)
+}
+
+// PrefixWithFilter is like Prefix, but skips segments the filter rejects
+func (t *Tree) PrefixWithFilter(pfix []byte, filter segment.SegmentFilter) *prefix.Prefix {
+	return t.CreatePrefix(pfix, nil, filter)
 }
 
 func (t *Tree) FirstKeyValue() (value.UserKey, value.UserValue, bool) {
-	key, val, ok := t.Iter().IntoIter().Next()
+	iter := t.Iter().IntoIter()
+	defer iter.Close()
+	key, val, ok := iter.Next()
 	if !ok {
 		return nil, nil, false
 	}
@@ -396,7 +522,9 @@ func (t *Tree) FirstKeyValue() (value.UserKey, value.UserValue, bool) {
 }
 
 func (t *Tree) LastKeyValue() (value.UserKey, value.UserValue, bool) {
-	key, val, ok := t.Iter().IntoIter().NextBack()
+	iter := t.Iter().IntoIter()
+	defer iter.Close()
+	key, val, ok := iter.NextBack()
 	if !ok {
 		return nil, nil, false
 	}
@@ -404,6 +532,16 @@ func (t *Tree) LastKeyValue() (value.UserKey, value.UserValue, bool) {
 }
 
 func (t *Tree) AppendEntry(value value.Value) (*uint32, *uint32, error) {
+	if t.IsClosed() {
+		return nil, nil, ErrClosed
+	}
+	if err := t.checkPrimary(); err != nil {
+		return nil, nil, err
+	}
+	if err := t.BackgroundError(); err != nil {
+		return nil, nil, err
+	}
+
 	t.TreeInner.ActiveMutex.Lock()
 	defer t.TreeInner.ActiveMutex.Unlock()
 
@@ -411,72 +549,156 @@ func (t *Tree) AppendEntry(value value.Value) (*uint32, *uint32, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	if manager := t.TreeInner.WriteBufferManager; manager != nil {
+		manager.Reserve(uint64(itemSize))
+	}
 	return &itemSize, &sizeAfter, nil
 }
 
-func Recover(path string, blockCache *segment.BlockCache, descriptorTable *descriptor.FileDescriptorTable) (*Tree, error) {
-	fmt.Printf("Recovering LSM-tree at %s", path)
+// Recover opens an existing tree, holding the lock of its directory until Close
+func Recover(cfg config.Config) (*Tree, error) {
+	lock, err := file.LockDir(vfs.OrDefault(cfg.FS), cfg.Inner.Path)
+	if err != nil {
+		return nil, err
+	}
 
-	if bytes, err := os.ReadFile(strings.Join([]string{path, file.LSMMarker}, "")); err != nil {
+	tree, err := recoverTree(cfg)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	tree.TreeInner.DirLock = lock
+	return tree, nil
+}
+
+func recoverTree(cfg config.Config) (*Tree, error) {
+	path := cfg.Inner.Path
+	blockCache := cfg.BlockCache
+	descriptorTable := cfg.DescriptorTable
+	fs := vfs.OrDefault(cfg.FS)
+	logger := logging.OrDiscard(cfg.Logger)
+
+	logger.Info("Recovering LSM-tree", logging.Path(path))
+
+	if bytes, err := vfs.ReadFile(fs, filepath.Join(path, file.LSMMarker)); err != nil {
 		return nil, err
 	} else if vs := version.ParseFileHeader(bytes); vs != version.VersionV0 {
 		return nil, fmt.Errorf("invalid version: %v", vs)
 	}
 
-	lvl, err := RecoverLevels(path, blockCache, descriptorTable)
+	configStr, err := vfs.ReadFile(fs, filepath.Join(path, file.ConfigFile))
 	if err != nil {
 		return nil, err
 	}
-	lvl.SortLevels()
+	var persisted config.PersistedConfig
+	if err := json.Unmarshal(configStr, &persisted); err != nil {
+		return nil, err
+	}
+	// The directory may have been moved since, e.g. a checkpoint
+	persisted.Path = path
+
+	cmp := comparator.OrDefault(cfg.Comparator)
+	persisted.Comparator = comparator.NameOrDefault(persisted.Comparator)
+	if persisted.Comparator != cmp.Name() {
+		return nil, fmt.Errorf("%w: tree is ordered by %q, not %q", ErrComparatorMismatch, persisted.Comparator, cmp.Name())
+	}
 
-	configStr, err := os.ReadFile(strings.Join([]string{path, file.ConfigFile}, ""))
+	lvl, err := RecoverLevels(fs, path, blockCache, descriptorTable, logger, cmp)
 	if err != nil {
 		return nil, err
 	}
-	var cfg config.PersistedConfig
-	if err := json.Unmarshal(configStr, &cfg); err != nil {
+	lvl.SortLevels()
+
+	blobs, err := blob.Recover(filepath.Join(path, file.BlobsFolder), descriptorTable)
+	if err != nil {
 		return nil, err
 	}
 
 	inner := &TreeInner{
-		ActiveMemtable:  &memtable.MemTable{},
+		ActiveMemtable:  memtable.NewMemTableWithComparator(cmp),
+		Blobs:           blobs,
 		SealedMemtables: make(map[string]*memtable.MemTable),
-		Levels:          &levels.Levels{},
-		OpenSnapshots:   &SnapshotCounter{},
-		StopSignal:      &stop.StopSignal{},
-		Config:          &cfg,
+		Levels:          lvl,
+		OpenSnapshots:   NewSnapshotCounter(),
+		StopSignal:      stop.NewStopSignal(),
+		Config:          &persisted,
 		BlockCache:      blockCache,
 		DescriptorTable: descriptorTable,
+		FS:              fs,
+		Collectors:      withBlobRefs(cfg.PropertiesCollectors),
+		FlushQueue:      newFlushQueue(cfg.FlushQueueCapacity),
+		Logger:          logger,
+		Stats:           stats.NewRegistry(),
+		EventListeners:  cfg.EventListeners,
+		Comparator:      cmp,
+
+		PinIndexAndFilterBlocks: cfg.PinIndexAndFilterBlocks,
+	}
+
+	tree := &Tree{TreeInner: inner}
+	if err := tree.updatePinning(); err != nil {
+		return nil, err
 	}
 
-	return &Tree{TreeInner: inner}, nil
+	// Blob files of flushes that did not finish are not referenced by any segment
+	if err := tree.markUnreferencedBlobs(); err != nil {
+		return nil, err
+	}
+	if err := tree.removeObsoleteBlobs(); err != nil {
+		return nil, err
+	}
+	tree.start(&cfg)
+	return tree, nil
 }
 
+// CreateNew creates a tree in an empty directory, holding the lock of the
+// directory until Close
 func CreateNew(config config.Config) (*Tree, error) {
 	path := config.Inner.Path
-	if err := os.MkdirAll(path, 0755); err != nil {
+	fs := vfs.OrDefault(config.FS)
+	if err := file.MkdirAllSynced(fs, path); err != nil {
+		return nil, err
+	}
+
+	lock, err := file.LockDir(fs, path)
+	if err != nil {
 		return nil, err
 	}
 
-	markerPath := strings.Join([]string{path, file.LSMMarker}, "")
-	if _, err := os.Stat(markerPath); err == nil {
+	tree, err := createNewTree(config)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	tree.TreeInner.DirLock = lock
+	return tree, nil
+}
+
+func createNewTree(config config.Config) (*Tree, error) {
+	path := config.Inner.Path
+	fs := vfs.OrDefault(config.FS)
+
+	markerPath := filepath.Join(path, file.LSMMarker)
+	if _, err := fs.Stat(markerPath); err == nil {
 		return nil, fmt.Errorf("marker file %s already exists", markerPath)
 	}
 
 	// 0755 is ---rwxr-x http://permissions-calculator.org/
 	// 0755 Commonly used on web servers. The owner can read, write, execute. Everyone else can read and execute but not modify the file.
-	if err := os.MkdirAll(strings.Join([]string{path, file.SegmentsFolder}, ""), 0755); err != nil {
+	if err := file.MkdirAllSynced(fs, filepath.Join(path, file.SegmentsFolder)); err != nil {
 		return nil, err
 	}
 
+	config.Inner.Comparator = comparator.OrDefault(config.Comparator).Name()
+
 	// probably doesnt work, @TODO:
 	configStr, err := json.MarshalIndent(config.Inner, "", "  ")
 	if err != nil {
 		return nil, err
 	}
 
-	// 0644 Only the owner can read and write. Everyone else can only read. No one can execute the file.
-	if err := os.WriteFile(strings.Join([]string{path, file.ConfigFile}, ""), configStr, 0644); err != nil {
+	// The config has to be durable before the marker makes the tree recoverable
+	if err := file.RewriteAtomic(fs, filepath.Join(path, file.ConfigFile), configStr); err != nil {
 		return nil, err
 	}
 
@@ -485,10 +707,11 @@ func CreateNew(config config.Config) (*Tree, error) {
 		return nil, err
 	}
 
-	file, err := os.Create(markerPath)
+	file, err := fs.Create(markerPath)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 	if _, err := version.VersionV0.WriteFileHeader(file); err != nil {
 		return nil, err
 	}
@@ -496,8 +719,13 @@ func CreateNew(config config.Config) (*Tree, error) {
 	if err := file.Sync(); err != nil {
 		return nil, err
 	}
+	if err := fs.SyncDir(path); err != nil {
+		return nil, err
+	}
 
-	return &Tree{TreeInner: inner}, nil
+	tree := &Tree{TreeInner: inner}
+	tree.start(&config)
+	return tree, nil
 }
 
 func (t *Tree) DiskSpace() uint64 {
@@ -527,33 +755,33 @@ func (t *Tree) GetMemtableLSN() (*value.SeqNo, error) {
 	return t.TreeInner.ActiveMemtable.GetLSN()
 }
 
-func RecoverLevels(treePath string, blockCache *segment.BlockCache, descriptorTable *descriptor.FileDescriptorTable) (*levels.Levels, error) {
-	fmt.Printf("Recovering disk segments from %s", treePath)
+func RecoverLevels(fs vfs.FS, treePath string, blockCache *segment.BlockCache, descriptorTable *descriptor.FileDescriptorTable, logger *slog.Logger, cmp comparator.Comparator) (*levels.Levels, error) {
+	logger.Debug("Recovering disk segments", logging.Path(treePath))
 
 	manifestPath := filepath.Join(treePath, file.LevelsManifestFile)
 
-	segmentIDsToRecover, err := (&levels.Levels{}).RecoverIds(manifestPath)
+	manifest, err := levels.ReadManifest(fs, manifestPath)
 	if err != nil {
 		return nil, err
 	}
+	segmentIDsToRecover := levels.SegmentIDs(manifest)
 
 	var segments []*segment.Segment
 
-	err = filepath.Walk(filepath.Join(treePath, file.SegmentsFolder), func(path string, info os.FileInfo, err error) error {
+	segmentsFolder := filepath.Join(treePath, file.SegmentsFolder)
+	err = vfs.Walk(fs, segmentsFolder, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		if !info.IsDir() {
+		if !info.IsDir() || path == segmentsFolder {
 			return nil
 		}
 
 		segmentID := filepath.Base(path)
 
-		fmt.Printf("Recovering segment from %s", path)
-
 		if slices.Contains(segmentIDsToRecover, segmentID) {
-			sg, err := segment.RecoverSegment(path, blockCache, descriptorTable)
+			sg, err := segment.RecoverSegment(path, blockCache, descriptorTable, cmp)
 			if err != nil {
 				return err
 			}
@@ -564,16 +792,17 @@ func RecoverLevels(treePath string, blockCache *segment.BlockCache, descriptorTa
 			)
 
 			segments = append(segments, sg)
-			fmt.Printf("Recovered segment from %s", path)
+			logger.Debug("Recovered segment", logging.SegmentID(segmentID), logging.Path(path))
 		} else {
-			fmt.Printf("Deleting unfinished segment (not part of level manifest): %s", path)
-			err := os.RemoveAll(path)
+			logger.Warn("Deleting unfinished segment (not part of level manifest)", logging.SegmentID(segmentID), logging.Path(path))
+			err := fs.RemoveAll(path)
 			if err != nil {
 				return err
 			}
 		}
 
-		return nil
+		// Segment folders are handled as a whole
+		return filepath.SkipDir
 	})
 
 	if err != nil {
@@ -581,11 +810,13 @@ func RecoverLevels(treePath string, blockCache *segment.BlockCache, descriptorTa
 	}
 
 	if len(segments) < len(segmentIDsToRecover) {
-		fmt.Printf("Expected segments: %v", segmentIDsToRecover)
+		logger.Error("Some segments were not recovered", slog.Any("expected", segmentIDsToRecover))
 		return nil, fmt.Errorf("some segments were not recovered")
 	}
 
-	fmt.Printf("Recovered %d segments", len(segments))
+	logger.Info("Recovered segments", slog.Int("count", len(segments)))
 
-	return (&levels.Levels{}).Recover(manifestPath, segments)
+	lvl := levels.FromManifest(fs, manifestPath, manifest, segments)
+	lvl.Comparator = cmp
+	return lvl, nil
 }
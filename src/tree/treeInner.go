@@ -1,60 +1,150 @@
 package tree
 
 import (
+	"bagh/blob"
+	"bagh/comparator"
 	"bagh/config"
 	"bagh/descriptor"
+	"bagh/event"
 	"bagh/file"
 	"bagh/levels"
+	"bagh/logging"
 	"bagh/memtable"
 	"bagh/segment"
+	"bagh/stall"
+	"bagh/stats"
 	"bagh/stop"
-	"log"
+	"bagh/vfs"
+	"bagh/wal"
+	"log/slog"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 )
 
 // @TODO: how to use this in sync map?
 // type SealedMemtables map[string]*memtable.MemTable
 
 type TreeInner struct {
+	// Read-only and secondary trees never write to the directory
+	Mode Mode
+
 	ActiveMemtable  *memtable.MemTable
 	SealedMemtables map[string]*memtable.MemTable
 	Levels          *levels.Levels
+	segmentRefs     segmentRefs
+	Blobs           *blob.Manager
 	Config          *config.PersistedConfig
 	BlockCache      *segment.BlockCache
 	DescriptorTable *descriptor.FileDescriptorTable
+	FS              vfs.FS
+	Collectors      []segment.PropertiesCollectorFactory
 	OpenSnapshots   *SnapshotCounter
 	StopSignal      *stop.StopSignal
 
+	// Sealed memtables waiting for the flush workers
+	FlushQueue *flushQueue
+
+	// Throttles writes while flushes and compactions fall behind
+	WriteController *stall.Controller
+	MaxMemtableSize uint32
+
+	// Accounts memtable memory, may be nil
+	WriteBufferManager *memtable.WriteBufferManager
+
+	// Called when the write buffer manager asks for a flush
+	FlushHandler func()
+
+	Logger *slog.Logger
+
+	// Counters of reads, writes, flushes and compactions
+	Stats *stats.Registry
+
+	EventListeners []event.Listener
+
+	// Set once background work failed, writes are rejected until Resume
+	BackgroundErr atomic.Pointer[BackgroundError]
+
+	// Flushes that failed (or were skipped) while the tree is read-only, in queue order
+	FailedFlushes   []*PendingFlush
+	BackgroundMutex sync.Mutex
+
+	// Set by Close, later calls return ErrClosed
+	Closed atomic.Bool
+
+	// Held (read) by compactions and ingestion, Close takes it to wait for them
+	WorkMutex sync.RWMutex
+
+	// Exclusive lock of the tree directory, released by Close
+	DirLock *file.DirLock
+
+	// Follows the write-ahead log of the primary, only set for followers
+	WalTailer    *wal.Tailer
+	CatchUpMutex sync.Mutex
+
+	// Pin index and filter blocks of L0 and L1 segments in the block cache
+	PinIndexAndFilterBlocks bool
+
+	// Order of the keys, persisted by name in the config
+	Comparator comparator.Comparator
+
+	// Held by blob garbage collection and the removal of blob files, and
+	// by checkpoints, so they link a consistent set of blob files, taken
+	// before the levels lock
+	BlobMutex sync.Mutex
+
 	ActiveMutex sync.RWMutex
 	SealedMutex sync.RWMutex
 	LevelsMutex sync.RWMutex
 }
 
 func CreateNewTreeInner(config *config.Config) (*TreeInner, error) {
+	fs := vfs.OrDefault(config.FS)
+	cmp := comparator.OrDefault(config.Comparator)
+	config.Inner.Comparator = cmp.Name()
+
 	levels, err := levels.NewLevels(
+		fs,
 		config.Inner.LevelCount,
 		filepath.Join(config.Inner.Path, file.LevelsManifestFile),
 	)
 	if err != nil {
 		return nil, err
 	}
+	levels.Comparator = cmp
+
+	blobs, err := blob.NewManager(
+		filepath.Join(config.Inner.Path, file.BlobsFolder),
+		config.DescriptorTable,
+	)
+	if err != nil {
+		return nil, err
+	}
 
 	return &TreeInner{
-		ActiveMemtable:  memtable.NewMemTable(),
-		SealedMemtables: *new(map[string]*memtable.MemTable),
+		ActiveMemtable:  memtable.NewMemTableWithComparator(cmp),
+		SealedMemtables: make(map[string]*memtable.MemTable),
 		Levels:          levels,
+		Blobs:           blobs,
 		Config:          config.Inner,
 		BlockCache:      config.BlockCache,
 		DescriptorTable: config.DescriptorTable,
+		FS:              fs,
+		Collectors:      withBlobRefs(config.PropertiesCollectors),
 		OpenSnapshots:   NewSnapshotCounter(),
 		StopSignal:      stop.NewStopSignal(),
+		FlushQueue:      newFlushQueue(config.FlushQueueCapacity),
+		Logger:          logging.OrDiscard(config.Logger),
+		Stats:           stats.NewRegistry(),
+		EventListeners:  config.EventListeners,
+		Comparator:      cmp,
+
+		PinIndexAndFilterBlocks: config.PinIndexAndFilterBlocks,
 	}, nil
 }
 
 func (t *TreeInner) Drop() {
-	log.Println("Dropping TreeInner")
-	log.Println("Sending stop signal to compactors")
+	t.Logger.Debug("Dropping tree, sending stop signal to compactors")
 	t.StopSignal.Send()
 }
 
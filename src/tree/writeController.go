@@ -0,0 +1,32 @@
+package tree
+
+import (
+	"bagh/stall"
+)
+
+// WriteController returns the controller throttling writes while flushes
+// and compactions fall behind, writers should call its Wait before writing
+func (t *Tree) WriteController() *stall.Controller {
+	return t.TreeInner.WriteController
+}
+
+// MaxMemtableSize returns the size at which the active memtable should be sealed
+func (t *Tree) MaxMemtableSize() uint32 {
+	return t.TreeInner.MaxMemtableSize
+}
+
+// writePressure returns the current write debt of the tree
+func (t *Tree) writePressure() stall.Pressure {
+	t.TreeInner.SealedMutex.RLock()
+	sealed := len(t.TreeInner.SealedMemtables)
+	t.TreeInner.SealedMutex.RUnlock()
+
+	t.TreeInner.LevelsMutex.RLock()
+	defer t.TreeInner.LevelsMutex.RUnlock()
+
+	return stall.Pressure{
+		L0Segments:             t.TreeInner.Levels.FirstLevelSegmentCount(),
+		SealedMemtables:        sealed,
+		PendingCompactionBytes: t.TreeInner.Levels.PendingCompactionBytes(t.TreeInner.Config.LevelRatio),
+	}
+}
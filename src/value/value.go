@@ -1,7 +1,7 @@
 package value
 
 import (
-	"bytes"
+	"bagh/comparator"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -26,8 +26,9 @@ type SeqNo uint64
 type ValueType uint8
 
 const (
-	Record    ValueType = iota // Regular value
-	Tombstone                  // Deleted value
+	Record      ValueType = iota // Regular value
+	Tombstone                    // Deleted value
+	Indirection                  // Value is a pointer into a blob file
 )
 
 // Converts from a byte to ValueType
@@ -35,6 +36,8 @@ func ValueTypeFromByte(b byte) ValueType {
 	switch b {
 	case 0:
 		return Record
+	case 2:
+		return Indirection
 	default:
 		return Tombstone
 	}
@@ -47,6 +50,8 @@ func (v ValueType) ToByte() byte {
 		return 0
 	case Tombstone:
 		return 1
+	case Indirection:
+		return 2
 	}
 	return 1
 }
@@ -71,7 +76,7 @@ func (pik ParsedInternalKey) IsTombstone() bool {
 }
 
 func (pik ParsedInternalKey) String() string {
-	return fmt.Sprintf("%x:%d:%d", pik.UserKey, pik.ValueType)
+	return fmt.Sprintf("%x:%d:%d", pik.UserKey, pik.SeqNo, pik.ValueType)
 }
 
 // Order by user key, THEN by sequence number
@@ -84,7 +89,15 @@ func (piks ParsedInternalKeys) Swap(i, j int) { piks[i], piks[j] = piks[j], piks
 
 // Custom sorting for ParsedInternalKey based on user key and sequence number.
 func (p ParsedInternalKey) Less(other ParsedInternalKey) bool {
-	return bytes.Compare(p.UserKey, other.UserKey) < 0
+	return p.LessBy(comparator.Bytewise, other)
+}
+
+// LessBy is like Less, ordering user keys by the comparator
+func (p ParsedInternalKey) LessBy(c comparator.Comparator, other ParsedInternalKey) bool {
+	if cmp := c.Compare(p.UserKey, other.UserKey); cmp != 0 {
+		return cmp < 0
+	}
+	return p.SeqNo > other.SeqNo
 }
 
 // / Represents a value in the LSM-tree
@@ -210,6 +223,11 @@ func (v Value) IsTombstone() bool {
 	return v.ValueType == Tombstone
 }
 
+// IsIndirection returns true if the value points into a blob file
+func (v Value) IsIndirection() bool {
+	return v.ValueType == Indirection
+}
+
 func (v Value) ToTombstone() error {
 	v.ValueType = Tombstone
 	return nil
@@ -224,12 +242,17 @@ func (v Value) String() string {
 	if len(v.Value) >= 64 {
 		valueStr = fmt.Sprintf("[ ... %d bytes ]", len(v.Value))
 	}
-	return fmt.Sprintf("%x:%d:%s => %s", v.Key, v.ValueType, valueStr)
+	return fmt.Sprintf("%x:%d:%d => %s", v.Key, v.SeqNo, v.ValueType, valueStr)
 }
 
 // Sorting interface for Value. Sort by key and then by sequence number.
 func (v Value) Less(other Value) bool {
-	if cmp := bytes.Compare(v.Key, other.Key); cmp != 0 {
+	return v.LessBy(comparator.Bytewise, other)
+}
+
+// LessBy is like Less, ordering keys by the comparator
+func (v Value) LessBy(c comparator.Comparator, other Value) bool {
+	if cmp := c.Compare(v.Key, other.Key); cmp != 0 {
 		return cmp < 0
 	}
 	return v.SeqNo > other.SeqNo
@@ -254,10 +277,7 @@ func ParsedInternalKeyFromValue(v Value) ParsedInternalKey {
 
 // ValueTypeFromUint8 converts a uint8 to a ValueType
 func ValueTypeFromUint8(v uint8) ValueType {
-	if v == 0 {
-		return Record
-	}
-	return Tombstone
+	return ValueTypeFromByte(v)
 }
 
 // Uint8FromValueType converts a ValueType to a uint8
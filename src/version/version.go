@@ -11,16 +11,25 @@ type Version uint16
 
 const (
 	VersionV0 Version = iota
+	// VersionV1 stores data blocks prefix-compressed with restart points
+	VersionV1
 )
 
 func (v Version) String() string {
-	return "0"
+	switch v {
+	case VersionV1:
+		return "1"
+	default:
+		return "0"
+	}
 }
 
 func VersionFromU16(value uint16) (Version, error) {
 	switch value {
 	case 0:
 		return VersionV0, nil
+	case 1:
+		return VersionV1, nil
 	default:
 		return 0, fmt.Errorf("invalid version: %d", value)
 	}
@@ -0,0 +1,706 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrInjected is returned by operations a FaultFS fails on purpose
+var ErrInjected = errors.New("injected fault")
+
+// ErrCrashed is returned by every operation of a FaultFS after Crash
+var ErrCrashed = errors.New("filesystem crashed")
+
+// Op is a kind of operation a FaultFS can fail
+type Op uint8
+
+const (
+	// OpWrite is File.Write and File.WriteAt
+	OpWrite Op = iota
+
+	// OpSync is File.Sync and FS.SyncDir
+	OpSync
+
+	// OpRename is FS.Rename
+	OpRename
+
+	opCount
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpWrite:
+		return "write"
+	case OpSync:
+		return "sync"
+	case OpRename:
+		return "rename"
+	}
+	return "unknown"
+}
+
+// CrashOptions control what survives a crash of a FaultFS
+type CrashOptions struct {
+	// Keep a random part of the unsynced data appended to each file,
+	// instead of dropping all of it
+	TornWrites bool
+}
+
+// FaultFS wraps a FS, failing chosen operations and simulating crashes
+//
+// Written data only becomes durable once its file is synced, Crash reverts
+// every file to its content as of the last sync. Creating, renaming, linking
+// and removing files, and creating directories, only becomes durable once
+// the parent directory is synced, Crash reverts the entries of every
+// directory as of its last sync. Removing directories is durable right away.
+type FaultFS struct {
+	inner FS
+
+	// Held for the duration of every operation, so a crash happens between them
+	mutex   sync.Mutex
+	rand    *rand.Rand
+	crashed bool
+
+	// Operations so far, and the operation to fail next (0 for none)
+	counts [opCount]int64
+	failAt [opCount]int64
+	tearAt int64
+
+	// Files written through this FS, by path
+	nodes map[string]*faultNode
+
+	// Durable entries of the directories changed since their last sync
+	dirs map[string]faultDir
+
+	// Open files of the inner FS, a crash closes them like a dying process
+	open map[*faultFile]struct{}
+}
+
+// faultNode is the durable state of a file
+type faultNode struct {
+	synced []byte
+	dirty  bool
+}
+
+// faultDir is the durable state of a directory, its files by name, nil for
+// subdirectories
+type faultDir map[string]*faultNode
+
+// NewFaultFS wraps inner, seed drives the random parts of torn writes
+func NewFaultFS(inner FS, seed int64) *FaultFS {
+	return &FaultFS{
+		inner: inner,
+		rand:  rand.New(rand.NewSource(seed)),
+		nodes: make(map[string]*faultNode),
+		dirs:  make(map[string]faultDir),
+		open:  make(map[*faultFile]struct{}),
+	}
+}
+
+// FailNth makes the nth operation of the kind from now on fail with ErrInjected
+func (fs *FaultFS) FailNth(op Op, n int64) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.failAt[op] = fs.counts[op] + n
+}
+
+// TearNthWrite makes the nth write from now on write only a part of its
+// data, and fail with ErrInjected
+func (fs *FaultFS) TearNthWrite(n int64) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.tearAt = fs.counts[OpWrite] + n
+}
+
+// Count returns how many operations of the kind were done
+func (fs *FaultFS) Count(op Op) int64 {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.counts[op]
+}
+
+// Crash reverts all files to their synced content, and all directories to
+// their synced entries, and makes every later operation fail with ErrCrashed
+//
+// Open files are closed, so locks are released. Wrap the inner FS in a new
+// FaultFS to continue after the crash.
+func (fs *FaultFS) Crash(opts CrashOptions) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.crashed {
+		return ErrCrashed
+	}
+	fs.crashed = true
+
+	var errs []error
+	for f := range fs.open {
+		errs = append(errs, f.File.Close())
+	}
+	fs.open = nil
+
+	for path, node := range fs.nodes {
+		if !node.dirty {
+			continue
+		}
+
+		content := node.synced
+		if opts.TornWrites {
+			current, err := ReadFile(fs.inner, path)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if len(current) > len(content) && string(current[:len(content)]) == string(content) {
+				content = current[:len(content)+fs.rand.Intn(len(current)-len(content)+1)]
+			}
+		}
+
+		errs = append(errs, WriteFile(fs.inner, path, content, 0644))
+	}
+
+	// Parents first, so unsynced directories are gone before their entries
+	dirs := make([]string, 0, len(fs.dirs))
+	for dir := range fs.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) < len(dirs[j]) })
+	for _, dir := range dirs {
+		errs = append(errs, fs.revertDir(dir, fs.dirs[dir]))
+	}
+	fs.nodes = nil
+	fs.dirs = nil
+
+	return errors.Join(errs...)
+}
+
+// revertDir restores the durable entries of a directory, the caller has to
+// hold the lock
+func (fs *FaultFS) revertDir(dir string, durable faultDir) error {
+	entries, err := fs.inner.ReadDir(dir)
+	if os.IsNotExist(err) {
+		// The directory itself was not durable
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		if _, ok := durable[entry.Name()]; !ok {
+			errs = append(errs, fs.inner.RemoveAll(filepath.Join(dir, entry.Name())))
+		}
+	}
+	for name, node := range durable {
+		path := filepath.Join(dir, name)
+		switch {
+		case node == nil:
+			errs = append(errs, fs.inner.MkdirAll(path, 0755))
+		case fs.nodes[path] != node:
+			// Removed, renamed or replaced since the last sync, the
+			// content of files still in place is reverted already
+			errs = append(errs, WriteFile(fs.inner, path, node.synced, 0644))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// begin checks an operation, the caller has to hold the lock
+func (fs *FaultFS) begin(op Op) error {
+	if fs.crashed {
+		return ErrCrashed
+	}
+	fs.counts[op]++
+	if fs.counts[op] == fs.failAt[op] {
+		return ErrInjected
+	}
+	return nil
+}
+
+// track returns the node of a file that is about to be written, the caller
+// has to hold the lock
+func (fs *FaultFS) track(name string) (*faultNode, error) {
+	name = filepath.Clean(name)
+	if node, ok := fs.nodes[name]; ok {
+		return node, nil
+	}
+
+	// Files that were not written through this FS are durable
+	content, err := ReadFile(fs.inner, name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	node := &faultNode{synced: content}
+	fs.nodes[name] = node
+	return node, nil
+}
+
+// unsynced records the durable entries of a directory that is about to
+// change, unless it changed since its last sync already, the caller has to
+// hold the lock
+func (fs *FaultFS) unsynced(dir string) error {
+	dir = filepath.Clean(dir)
+	if _, ok := fs.dirs[dir]; ok {
+		return nil
+	}
+
+	entries, err := fs.inner.ReadDir(dir)
+	if os.IsNotExist(err) {
+		// The change fails
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	durable := make(faultDir, len(entries))
+	for _, entry := range entries {
+		var node *faultNode
+		if !entry.IsDir() {
+			if node, err = fs.track(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+		durable[entry.Name()] = node
+	}
+	fs.dirs[dir] = durable
+	return nil
+}
+
+// creating records the parent of a file that may be created, the caller
+// has to hold the lock
+func (fs *FaultFS) creating(name string) error {
+	if _, err := fs.inner.Stat(name); !os.IsNotExist(err) {
+		return nil
+	}
+	return fs.unsynced(filepath.Dir(name))
+}
+
+// isDir returns true if name is an existing directory
+func (fs *FaultFS) isDir(name string) bool {
+	info, err := fs.inner.Stat(name)
+	return err == nil && info.IsDir()
+}
+
+// forgetDir drops the durable entries of a removed directory, which is
+// durable right away, the caller has to hold the lock
+func (fs *FaultFS) forgetDir(name string) {
+	name = filepath.Clean(name)
+	prefix := name + string(filepath.Separator)
+	for dir := range fs.dirs {
+		if dir == name || strings.HasPrefix(dir, prefix) {
+			delete(fs.dirs, dir)
+		}
+	}
+	if durable, ok := fs.dirs[filepath.Dir(name)]; ok {
+		delete(durable, filepath.Base(name))
+	}
+}
+
+// forget drops the nodes of a path and everything below it, the caller has to hold the lock
+func (fs *FaultFS) forget(name string) {
+	name = filepath.Clean(name)
+	prefix := name + string(filepath.Separator)
+	for path := range fs.nodes {
+		if path == name || strings.HasPrefix(path, prefix) {
+			delete(fs.nodes, path)
+		}
+	}
+}
+
+// wrap registers an open file of the inner FS, the caller has to hold the lock
+func (fs *FaultFS) wrap(f File, node *faultNode, readable bool) *faultFile {
+	file := &faultFile{File: f, fs: fs, node: node, readable: readable}
+	fs.open[file] = struct{}{}
+	return file
+}
+
+func (fs *FaultFS) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *FaultFS) Create(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.crashed {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrCrashed}
+	}
+
+	readable := flag&os.O_WRONLY == 0
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		f, err := fs.inner.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return fs.wrap(f, nil, readable), nil
+	}
+
+	if flag&os.O_CREATE != 0 {
+		if err := fs.creating(name); err != nil {
+			return nil, err
+		}
+	}
+	node, err := fs.track(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sync reads the content back, so write-only files are opened for reading as well
+	if !readable {
+		flag = flag&^os.O_WRONLY | os.O_RDWR
+	}
+	f, err := fs.inner.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_TRUNC != 0 {
+		node.dirty = true
+	}
+	return fs.wrap(f, node, readable), nil
+}
+
+func (fs *FaultFS) Rename(oldpath, newpath string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fs.begin(OpRename); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	if fs.isDir(oldpath) {
+		// Like removing a directory, renaming one is durable right away
+		fs.forgetDir(oldpath)
+	} else {
+		if err := fs.unsynced(filepath.Dir(oldpath)); err != nil {
+			return err
+		}
+		if err := fs.unsynced(filepath.Dir(newpath)); err != nil {
+			return err
+		}
+	}
+	if err := fs.inner.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	prefix := oldpath + string(filepath.Separator)
+
+	moved := make(map[string]*faultNode)
+	for path, node := range fs.nodes {
+		if path == oldpath || strings.HasPrefix(path, prefix) {
+			moved[newpath+strings.TrimPrefix(path, oldpath)] = node
+			delete(fs.nodes, path)
+		}
+	}
+	fs.forget(newpath)
+	for path, node := range moved {
+		fs.nodes[path] = node
+	}
+	return nil
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.crashed {
+		return &os.PathError{Op: "remove", Path: name, Err: ErrCrashed}
+	}
+	if err := fs.removing(name); err != nil {
+		return err
+	}
+	if err := fs.inner.Remove(name); err != nil {
+		return err
+	}
+	fs.forget(name)
+	return nil
+}
+
+func (fs *FaultFS) RemoveAll(path string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.crashed {
+		return &os.PathError{Op: "unlinkat", Path: path, Err: ErrCrashed}
+	}
+	if err := fs.removing(path); err != nil {
+		return err
+	}
+	if err := fs.inner.RemoveAll(path); err != nil {
+		return err
+	}
+	fs.forget(path)
+	return nil
+}
+
+// removing records the parent of a file that is about to be removed, the
+// caller has to hold the lock
+func (fs *FaultFS) removing(name string) error {
+	if fs.isDir(name) {
+		fs.forgetDir(name)
+		return nil
+	}
+	return fs.unsynced(filepath.Dir(name))
+}
+
+func (fs *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.crashed {
+		return &os.PathError{Op: "mkdir", Path: path, Err: ErrCrashed}
+	}
+
+	// The missing directories, outermost first, each changes its parent
+	var missing []string
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, err := fs.inner.Stat(dir); !os.IsNotExist(err) || dir == filepath.Dir(dir) {
+			break
+		}
+		missing = append(missing, dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := fs.unsynced(filepath.Dir(missing[i])); err != nil {
+			return err
+		}
+		if err := fs.inner.MkdirAll(missing[i], perm); err != nil {
+			return err
+		}
+	}
+	return fs.inner.MkdirAll(path, perm)
+}
+
+func (fs *FaultFS) ReadDir(name string) ([]os.DirEntry, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.crashed {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrCrashed}
+	}
+	return fs.inner.ReadDir(name)
+}
+
+func (fs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.crashed {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: ErrCrashed}
+	}
+	return fs.inner.Stat(name)
+}
+
+func (fs *FaultFS) Link(oldname, newname string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.crashed {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: ErrCrashed}
+	}
+	if err := fs.unsynced(filepath.Dir(newname)); err != nil {
+		return err
+	}
+	// The linked file has to be durable under its old name
+	if _, err := fs.track(oldname); err != nil {
+		return err
+	}
+	if err := fs.inner.Link(oldname, newname); err != nil {
+		return err
+	}
+	// Both names share the content, restoring either restores both
+	fs.nodes[filepath.Clean(newname)] = fs.nodes[filepath.Clean(oldname)]
+	return nil
+}
+
+func (fs *FaultFS) Lock(name string) (File, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.crashed {
+		return nil, &os.PathError{Op: "lock", Path: name, Err: ErrCrashed}
+	}
+
+	if err := fs.creating(name); err != nil {
+		return nil, err
+	}
+	node, err := fs.track(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.inner.Lock(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.wrap(f, node, true), nil
+}
+
+func (fs *FaultFS) SyncDir(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fs.begin(OpSync); err != nil {
+		return &os.PathError{Op: "sync", Path: name, Err: err}
+	}
+	if err := fs.inner.SyncDir(name); err != nil {
+		return err
+	}
+	delete(fs.dirs, filepath.Clean(name))
+	return nil
+}
+
+// faultFile is an open file of a FaultFS
+type faultFile struct {
+	File
+	fs *FaultFS
+
+	// nil if the file is read-only
+	node     *faultNode
+	readable bool
+}
+
+// check returns an error if the FS crashed, the caller has to hold the lock
+func (f *faultFile) check(op string, read bool) error {
+	switch {
+	case f.fs.crashed:
+		return &os.PathError{Op: op, Path: f.Name(), Err: ErrCrashed}
+	case read && !f.readable:
+		return &os.PathError{Op: op, Path: f.Name(), Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.check("read", true); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.check("read", true); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+// write injects faults into a write, the caller has to hold the lock
+func (f *faultFile) write(p []byte, write func([]byte) (int, error)) (int, error) {
+	if err := f.fs.begin(OpWrite); err != nil {
+		return 0, &os.PathError{Op: "write", Path: f.Name(), Err: err}
+	}
+	if f.node != nil {
+		f.node.dirty = true
+	}
+
+	if f.fs.counts[OpWrite] == f.fs.tearAt && len(p) > 0 {
+		n, err := write(p[:f.fs.rand.Intn(len(p))])
+		if err != nil {
+			return n, err
+		}
+		return n, &os.PathError{Op: "write", Path: f.Name(), Err: ErrInjected}
+	}
+	return write(p)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	return f.write(p, f.File.Write)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	return f.write(p, func(p []byte) (int, error) {
+		return f.File.WriteAt(p, off)
+	})
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.check("seek", false); err != nil {
+		return 0, err
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *faultFile) Close() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.check("close", false); err != nil {
+		return err
+	}
+	delete(f.fs.open, f)
+	return f.File.Close()
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.check("stat", false); err != nil {
+		return nil, err
+	}
+	return f.File.Stat()
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.fs.begin(OpSync); err != nil {
+		return &os.PathError{Op: "sync", Path: f.Name(), Err: err}
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	if f.node == nil || !f.node.dirty {
+		return nil
+	}
+
+	info, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	content := make([]byte, info.Size())
+	if _, err := f.File.ReadAt(content, 0); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	f.node.synced = content
+	f.node.dirty = false
+	return nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.check("truncate", false); err != nil {
+		return err
+	}
+	if f.node != nil {
+		f.node.dirty = true
+	}
+	return f.File.Truncate(size)
+}
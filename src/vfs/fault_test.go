@@ -0,0 +1,147 @@
+package vfs_test
+
+import (
+	"bagh/vfs"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultFSCrash(t *testing.T) {
+	mem := vfs.NewMemFS()
+	fs := vfs.NewFaultFS(mem, 1)
+
+	f, err := fs.Create("/synced")
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("durable"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Sync())
+	_, err = f.Write([]byte(" lost"))
+	assert.NoError(t, err)
+
+	g, err := fs.OpenFile("/unsynced", os.O_WRONLY|os.O_CREATE, 0644)
+	assert.NoError(t, err)
+	_, err = g.Write([]byte("lost"))
+	assert.NoError(t, err)
+
+	lock, err := fs.Lock("/LOCK")
+	assert.NoError(t, err)
+	assert.NoError(t, fs.SyncDir("/"))
+
+	assert.NoError(t, fs.Crash(vfs.CrashOptions{}))
+	_, err = f.Write([]byte("x"))
+	assert.ErrorIs(t, err, vfs.ErrCrashed)
+	_, err = fs.Stat("/synced")
+	assert.ErrorIs(t, err, vfs.ErrCrashed)
+
+	content, err := vfs.ReadFile(mem, "/synced")
+	assert.NoError(t, err)
+	assert.Equal(t, "durable", string(content))
+	content, err = vfs.ReadFile(mem, "/unsynced")
+	assert.NoError(t, err)
+	assert.Empty(t, content)
+
+	// The crash released the lock
+	assert.ErrorIs(t, lock.Close(), vfs.ErrCrashed)
+	lock, err = mem.Lock("/LOCK")
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Close())
+}
+
+func TestFaultFSTornWrites(t *testing.T) {
+	mem := vfs.NewMemFS()
+	fs := vfs.NewFaultFS(mem, 1)
+
+	f, err := fs.Create("/file")
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("synced"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Sync())
+	assert.NoError(t, fs.SyncDir("/"))
+	_, err = f.Write([]byte(strings.Repeat("x", 1000)))
+	assert.NoError(t, err)
+
+	assert.NoError(t, fs.Crash(vfs.CrashOptions{TornWrites: true}))
+
+	content, err := vfs.ReadFile(mem, "/file")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(content), "synced"))
+	assert.LessOrEqual(t, len(content), 1006)
+}
+
+func TestFaultFSCrashDirectories(t *testing.T) {
+	mem := vfs.NewMemFS()
+	fs := vfs.NewFaultFS(mem, 1)
+
+	write := func(name, content string) {
+		assert.NoError(t, vfs.WriteFile(fs, name, []byte(content), 0644))
+		f, err := fs.OpenFile(name, os.O_RDWR, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Sync())
+		assert.NoError(t, f.Close())
+	}
+
+	assert.NoError(t, fs.MkdirAll("/dir", 0755))
+	write("/dir/manifest", "old")
+	write("/dir/removed", "removed")
+	assert.NoError(t, fs.SyncDir("/"))
+	assert.NoError(t, fs.SyncDir("/dir"))
+
+	// Synced files, but none of their directory entries
+	write("/dir/manifest.tmp", "new")
+	assert.NoError(t, fs.Rename("/dir/manifest.tmp", "/dir/manifest"))
+	assert.NoError(t, fs.Remove("/dir/removed"))
+	assert.NoError(t, fs.MkdirAll("/dir/sub/deeper", 0755))
+	write("/dir/sub/deeper/file", "lost")
+	assert.NoError(t, fs.Link("/dir/manifest", "/linked"))
+
+	assert.NoError(t, fs.Crash(vfs.CrashOptions{}))
+
+	content, err := vfs.ReadFile(mem, "/dir/manifest")
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(content))
+	content, err = vfs.ReadFile(mem, "/dir/removed")
+	assert.NoError(t, err)
+	assert.Equal(t, "removed", string(content))
+	for _, name := range []string{"/dir/manifest.tmp", "/dir/sub", "/linked"} {
+		_, err = mem.Stat(name)
+		assert.True(t, os.IsNotExist(err), name)
+	}
+}
+
+func TestFaultFSFailNth(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.NewMemFS(), 1)
+
+	f, err := fs.Create("/file")
+	assert.NoError(t, err)
+
+	fs.FailNth(vfs.OpWrite, 2)
+	_, err = f.Write([]byte("a"))
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("b"))
+	assert.ErrorIs(t, err, vfs.ErrInjected)
+	_, err = f.Write([]byte("c"))
+	assert.NoError(t, err)
+
+	fs.FailNth(vfs.OpSync, 1)
+	assert.ErrorIs(t, f.Sync(), vfs.ErrInjected)
+	assert.NoError(t, f.Sync())
+
+	fs.FailNth(vfs.OpRename, 1)
+	assert.ErrorIs(t, fs.Rename("/file", "/other"), vfs.ErrInjected)
+	assert.NoError(t, fs.Rename("/file", "/other"))
+
+	// A torn write keeps only a part of its data
+	fs.TearNthWrite(1)
+	n, err := f.Write([]byte("0123456789"))
+	assert.ErrorIs(t, err, vfs.ErrInjected)
+	assert.Less(t, n, 10)
+	assert.Equal(t, int64(4), fs.Count(vfs.OpWrite))
+
+	assert.NoError(t, f.Close())
+	content, err := vfs.ReadFile(fs, "/other")
+	assert.NoError(t, err)
+	assert.Equal(t, "ac0123456789"[:2+n], string(content))
+}
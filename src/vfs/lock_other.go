@@ -0,0 +1,20 @@
+//go:build !unix
+
+package vfs
+
+import (
+	"errors"
+	"os"
+)
+
+var errWouldBlock = errors.New("lock is held")
+
+// lockFile fails where flock is not available, as a directory could otherwise
+// be opened by two processes at once
+func lockFile(f *os.File) error {
+	return ErrLockUnsupported
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,617 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemFS is a FS keeping all files in memory, e.g. for tests
+//
+// Like on unix, open files stay readable after they are removed or
+// replaced, and hard links share their content. Everything written is
+// durable right away, Sync and SyncDir only check their arguments.
+type MemFS struct {
+	// Guards the directory tree and the locks
+	mutex sync.Mutex
+	root  *memNode
+	locks map[*memNode]struct{}
+}
+
+// NewMemFS creates an empty in-memory FS, holding only the root directory
+func NewMemFS() *MemFS {
+	return &MemFS{
+		root:  newMemDir(0755),
+		locks: make(map[*memNode]struct{}),
+	}
+}
+
+type memNode struct {
+	mode     os.FileMode
+	modTime  time.Time
+	children map[string]*memNode
+
+	dataMutex sync.RWMutex
+	data      []byte
+}
+
+func newMemDir(perm os.FileMode) *memNode {
+	return &memNode{
+		mode:     os.ModeDir | perm.Perm(),
+		modTime:  time.Now(),
+		children: make(map[string]*memNode),
+	}
+}
+
+func (n *memNode) isDir() bool {
+	return n.mode.IsDir()
+}
+
+func (n *memNode) size() int64 {
+	n.dataMutex.RLock()
+	defer n.dataMutex.RUnlock()
+	return int64(len(n.data))
+}
+
+func (n *memNode) readAt(p []byte, off int64) (int, error) {
+	n.dataMutex.RLock()
+	defer n.dataMutex.RUnlock()
+
+	if off >= int64(len(n.data)) {
+		return 0, io.EOF
+	}
+	read := copy(p, n.data[off:])
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (n *memNode) writeAt(p []byte, off int64) int {
+	n.dataMutex.Lock()
+	defer n.dataMutex.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(n.data)) {
+		n.resize(end)
+	}
+	copy(n.data[off:], p)
+	n.modTime = time.Now()
+	return len(p)
+}
+
+func (n *memNode) truncate(size int64) {
+	n.dataMutex.Lock()
+	defer n.dataMutex.Unlock()
+
+	n.resize(size)
+	n.modTime = time.Now()
+}
+
+// resize grows (with zeroes) or shrinks the data, the caller has to hold the data lock
+func (n *memNode) resize(size int64) {
+	if size <= int64(len(n.data)) {
+		n.data = n.data[:size]
+		return
+	}
+	if size <= int64(cap(n.data)) {
+		old := len(n.data)
+		n.data = n.data[:size]
+		clear(n.data[old:])
+		return
+	}
+	data := make([]byte, size, max(size, 2*int64(cap(n.data))))
+	copy(data, n.data)
+	n.data = data
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	n.dataMutex.RLock()
+	defer n.dataMutex.RUnlock()
+
+	return &memFileInfo{
+		name:    name,
+		size:    int64(len(n.data)),
+		mode:    n.mode,
+		modTime: n.modTime,
+	}
+}
+
+// splitPath returns the names along a path, relative paths start at the root
+func splitPath(name string) []string {
+	var names []string
+	for _, part := range strings.Split(filepath.ToSlash(filepath.Clean(name)), "/") {
+		if part != "" && part != "." {
+			names = append(names, part)
+		}
+	}
+	return names
+}
+
+// lookup returns the node of a path, the caller has to hold the lock
+func (fs *MemFS) lookup(name string) (*memNode, error) {
+	node := fs.root
+	for _, part := range splitPath(name) {
+		if !node.isDir() {
+			return nil, syscall.ENOTDIR
+		}
+		child, ok := node.children[part]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// parent returns the directory a path is in and the name of the path in it,
+// the caller has to hold the lock
+func (fs *MemFS) parent(name string) (*memNode, string, error) {
+	names := splitPath(name)
+	if len(names) == 0 {
+		return nil, "", os.ErrInvalid
+	}
+
+	dir, err := fs.lookup(filepath.Join(names[:len(names)-1]...))
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.isDir() {
+		return nil, "", syscall.ENOTDIR
+	}
+	return dir, names[len(names)-1], nil
+}
+
+func (fs *MemFS) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *MemFS) Create(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	var node *memNode
+	if len(splitPath(name)) == 0 {
+		node = fs.root
+	} else {
+		dir, base, err := fs.parent(name)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		node = dir.children[base]
+		if node == nil {
+			if flag&os.O_CREATE == 0 {
+				return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+			}
+			node = &memNode{mode: perm.Perm(), modTime: time.Now()}
+			dir.children[base] = node
+			dir.modTime = node.modTime
+		} else if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if node.isDir() && writable {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	if writable && flag&os.O_TRUNC != 0 {
+		node.truncate(0)
+	}
+
+	return &memFile{
+		fs:       fs,
+		node:     node,
+		name:     name,
+		readable: flag&os.O_WRONLY == 0,
+		writable: writable,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (fs *MemFS) Rename(oldpath, newpath string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+
+	oldDir, oldBase, err := fs.parent(oldpath)
+	if err != nil {
+		return linkErr(err)
+	}
+	node, ok := oldDir.children[oldBase]
+	if !ok {
+		return linkErr(os.ErrNotExist)
+	}
+
+	newDir, newBase, err := fs.parent(newpath)
+	if err != nil {
+		return linkErr(err)
+	}
+
+	if target, ok := newDir.children[newBase]; ok {
+		if target == node {
+			return nil
+		}
+		switch {
+		case target.isDir() && !node.isDir():
+			return linkErr(syscall.EISDIR)
+		case !target.isDir() && node.isDir():
+			return linkErr(syscall.ENOTDIR)
+		case target.isDir() && len(target.children) > 0:
+			return linkErr(syscall.ENOTEMPTY)
+		}
+	}
+
+	// A directory cannot be moved into itself
+	if node.isDir() {
+		oldNames, newNames := splitPath(oldpath), splitPath(newpath)
+		if len(newNames) > len(oldNames) && slices.Equal(oldNames, newNames[:len(oldNames)]) {
+			return linkErr(os.ErrInvalid)
+		}
+	}
+
+	delete(oldDir.children, oldBase)
+	newDir.children[newBase] = node
+
+	now := time.Now()
+	oldDir.modTime, newDir.modTime = now, now
+	return nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	dir, base, err := fs.parent(name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	node, ok := dir.children[base]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if node.isDir() && len(node.children) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+
+	delete(dir.children, base)
+	dir.modTime = time.Now()
+	return nil
+}
+
+func (fs *MemFS) RemoveAll(path string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if len(splitPath(path)) == 0 {
+		fs.root.children = make(map[string]*memNode)
+		return nil
+	}
+
+	dir, base, err := fs.parent(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "unlinkat", Path: path, Err: err}
+	}
+
+	delete(dir.children, base)
+	dir.modTime = time.Now()
+	return nil
+}
+
+func (fs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	node := fs.root
+	for _, part := range splitPath(path) {
+		child, ok := node.children[part]
+		if !ok {
+			child = newMemDir(perm)
+			node.children[part] = child
+			node.modTime = child.modTime
+		} else if !child.isDir() {
+			return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+		}
+		node = child
+	}
+	return nil
+}
+
+func (fs *MemFS) ReadDir(name string) ([]os.DirEntry, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	node, err := fs.lookup(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	if !node.isDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	entries := make([]os.DirEntry, 0, len(node.children))
+	for childName, child := range node.children {
+		entries = append(entries, iofs.FileInfoToDirEntry(child.info(childName)))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	node, err := fs.lookup(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return node.info(filepath.Base(name)), nil
+}
+
+func (fs *MemFS) Link(oldname, newname string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+
+	node, err := fs.lookup(oldname)
+	if err != nil {
+		return linkErr(err)
+	}
+	if node.isDir() {
+		return linkErr(syscall.EPERM)
+	}
+
+	dir, base, err := fs.parent(newname)
+	if err != nil {
+		return linkErr(err)
+	}
+	if _, ok := dir.children[base]; ok {
+		return linkErr(os.ErrExist)
+	}
+
+	dir.children[base] = node
+	dir.modTime = time.Now()
+	return nil
+}
+
+func (fs *MemFS) Lock(name string) (File, error) {
+	f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	file := f.(*memFile)
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if _, ok := fs.locks[file.node]; ok {
+		return nil, &os.PathError{Op: "lock", Path: name, Err: ErrLocked}
+	}
+	fs.locks[file.node] = struct{}{}
+	file.locked = true
+	return file, nil
+}
+
+func (fs *MemFS) SyncDir(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	node, err := fs.lookup(name)
+	if err != nil {
+		return &os.PathError{Op: "sync", Path: name, Err: err}
+	}
+	if !node.isDir() {
+		return &os.PathError{Op: "sync", Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// memFile is an open file of a MemFS
+type memFile struct {
+	fs   *MemFS
+	node *memNode
+	name string
+
+	// Guards the position and closed
+	mutex  sync.Mutex
+	pos    int64
+	closed bool
+
+	readable bool
+	writable bool
+	append   bool
+	locked   bool
+}
+
+func (f *memFile) pathErr(op string, err error) error {
+	return &os.PathError{Op: op, Path: f.name, Err: err}
+}
+
+// check returns an error if the file is closed, or cannot be used for the
+// operation, the caller has to hold the lock
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return f.pathErr(op, os.ErrClosed)
+	case write && !f.writable, !write && !f.readable:
+		return f.pathErr(op, syscall.EBADF)
+	case f.node.isDir():
+		return f.pathErr(op, syscall.EISDIR)
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := f.node.readAt(p, f.pos)
+	f.pos += int64(n)
+	if n > 0 {
+		return n, nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	err := f.check("read", false)
+	f.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, f.pathErr("readat", errors.New("negative offset"))
+	}
+	return f.node.readAt(p, off)
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.append {
+		f.pos = f.node.size()
+	}
+	n := f.node.writeAt(p, f.pos)
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mutex.Lock()
+	err := f.check("write", true)
+	f.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if f.append {
+		return 0, errors.New("vfs: invalid use of WriteAt on file opened with O_APPEND")
+	}
+	if off < 0 {
+		return 0, f.pathErr("writeat", errors.New("negative offset"))
+	}
+	return f.node.writeAt(p, off), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return 0, f.pathErr("seek", os.ErrClosed)
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.node.size()
+	case io.SeekStart:
+	default:
+		return 0, f.pathErr("seek", os.ErrInvalid)
+	}
+	if offset < 0 {
+		return 0, f.pathErr("seek", os.ErrInvalid)
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.mutex.Lock()
+	if f.closed {
+		f.mutex.Unlock()
+		return f.pathErr("close", os.ErrClosed)
+	}
+	f.closed = true
+	f.mutex.Unlock()
+
+	if f.locked {
+		f.fs.mutex.Lock()
+		delete(f.fs.locks, f.node)
+		f.fs.mutex.Unlock()
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return nil, f.pathErr("stat", os.ErrClosed)
+	}
+	return f.node.info(filepath.Base(f.name)), nil
+}
+
+func (f *memFile) Sync() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return f.pathErr("sync", os.ErrClosed)
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return f.pathErr("truncate", os.ErrInvalid)
+	}
+	f.node.truncate(size)
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() any           { return nil }
@@ -0,0 +1,128 @@
+package vfs_test
+
+import (
+	"bagh/vfs"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemFSFiles(t *testing.T) {
+	fs := vfs.NewMemFS()
+	assert.NoError(t, fs.MkdirAll("/a/b", 0755))
+
+	f, err := fs.Create("/a/b/file")
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("hello world"))
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte("W"), 6)
+	assert.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = f.ReadAt(buf, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, "World", string(buf))
+	assert.NoError(t, f.Close())
+	assert.ErrorIs(t, f.Close(), os.ErrClosed)
+
+	content, err := vfs.ReadFile(fs, "/a/b/file")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello World", string(content))
+
+	// Appends go to the end of the file
+	f, err = fs.OpenFile("/a/b/file", os.O_WRONLY|os.O_APPEND, 0)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("!"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	info, err := fs.Stat("/a/b/file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12), info.Size())
+	assert.False(t, info.IsDir())
+
+	_, err = fs.Open("/a/b/missing")
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.OpenFile("/a/b/file", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	assert.True(t, os.IsExist(err))
+	_, err = fs.Create("/a/missing/file")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMemFSRenameAndRemove(t *testing.T) {
+	fs := vfs.NewMemFS()
+	assert.NoError(t, fs.MkdirAll("/dir", 0755))
+	assert.NoError(t, vfs.WriteFile(fs, "/dir/a", []byte("a"), 0644))
+	assert.NoError(t, vfs.WriteFile(fs, "/dir/b", []byte("b"), 0644))
+
+	// Open files stay readable after they are replaced
+	f, err := fs.Open("/dir/b")
+	assert.NoError(t, err)
+	assert.NoError(t, fs.Rename("/dir/a", "/dir/b"))
+	content, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(content))
+	assert.NoError(t, f.Close())
+
+	content, err = vfs.ReadFile(fs, "/dir/b")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+	_, err = fs.Stat("/dir/a")
+	assert.True(t, os.IsNotExist(err))
+
+	// Hard links share their content
+	assert.NoError(t, fs.Link("/dir/b", "/dir/c"))
+	assert.True(t, os.IsExist(fs.Link("/dir/b", "/dir/c")))
+	assert.NoError(t, fs.Remove("/dir/b"))
+	content, err = vfs.ReadFile(fs, "/dir/c")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+
+	assert.Error(t, fs.Remove("/dir"))
+	assert.NoError(t, fs.RemoveAll("/dir"))
+	assert.NoError(t, fs.RemoveAll("/dir"))
+	_, err = fs.Stat("/dir")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMemFSReadDirAndWalk(t *testing.T) {
+	fs := vfs.NewMemFS()
+	assert.NoError(t, fs.MkdirAll("/root/x", 0755))
+	assert.NoError(t, vfs.WriteFile(fs, "/root/b", nil, 0644))
+	assert.NoError(t, vfs.WriteFile(fs, "/root/a", nil, 0644))
+	assert.NoError(t, vfs.WriteFile(fs, "/root/x/c", nil, 0644))
+
+	entries, err := fs.ReadDir("/root")
+	assert.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"a", "b", "x"}, names)
+
+	var walked []string
+	err = vfs.Walk(fs, "/root", func(path string, info os.FileInfo, err error) error {
+		walked = append(walked, path)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/root", "/root/a", "/root/b", "/root/x", filepath.Join("/root/x", "c")}, walked)
+}
+
+func TestMemFSLock(t *testing.T) {
+	fs := vfs.NewMemFS()
+
+	lock, err := fs.Lock("/LOCK")
+	assert.NoError(t, err)
+
+	_, err = fs.Lock("/LOCK")
+	assert.ErrorIs(t, err, vfs.ErrLocked)
+
+	assert.NoError(t, lock.Close())
+	lock, err = fs.Lock("/LOCK")
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Close())
+}
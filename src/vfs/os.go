@@ -0,0 +1,96 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+)
+
+// OS is the FS of the operating system
+type OS struct{}
+
+func (OS) Open(name string) (File, error) {
+	return openOS(os.Open(name))
+}
+
+func (OS) Create(name string) (File, error) {
+	return openOS(os.Create(name))
+}
+
+func (OS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return openOS(os.OpenFile(name, flag, perm))
+}
+
+func (OS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (OS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (OS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (OS) Lock(name string) (File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, errWouldBlock) {
+			return nil, &os.PathError{Op: "lock", Path: name, Err: ErrLocked}
+		}
+		return nil, &os.PathError{Op: "lock", Path: name, Err: err}
+	}
+	return &lockedFile{File: f}, nil
+}
+
+func (OS) SyncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	// Directories cannot be synced on Windows
+	if err := dir.Sync(); err != nil && os.PathSeparator != '\\' {
+		return err
+	}
+	return nil
+}
+
+// openOS avoids returning a non-nil File holding a nil *os.File
+func openOS(f *os.File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// lockedFile releases its lock when closed
+type lockedFile struct {
+	*os.File
+}
+
+func (f *lockedFile) Close() error {
+	return errors.Join(unlockFile(f.File), f.File.Close())
+}
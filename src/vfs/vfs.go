@@ -0,0 +1,152 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked is returned by FS.Lock if the file is locked already
+var ErrLocked = errors.New("file is locked")
+
+// ErrLockUnsupported is returned by OS.Lock on platforms without file locking
+var ErrLockUnsupported = errors.New("file locking is not supported on this platform")
+
+// File is an open file of a FS
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS is the filesystem a tree stores its files in
+//
+// Paths use the separator of the OS, errors should be *os.PathError (or
+// *os.LinkError) wrapping os.ErrNotExist, os.ErrExist etc., so os.IsNotExist
+// and friends work for every implementation.
+type FS interface {
+	// Open opens a file for reading
+	Open(name string) (File, error)
+
+	// Create creates or truncates a file, and opens it for reading and writing
+	Create(name string) (File, error)
+
+	// OpenFile opens a file with the os.O_* flags
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// Rename moves a file or directory, replacing newpath if it is a file
+	Rename(oldpath, newpath string) error
+
+	// Remove deletes a file or an empty directory
+	Remove(name string) error
+
+	// RemoveAll deletes a path and everything below it, a missing path is no error
+	RemoveAll(path string) error
+
+	// MkdirAll creates a directory and its missing parents
+	MkdirAll(path string, perm os.FileMode) error
+
+	// ReadDir lists a directory, sorted by name
+	ReadDir(name string) ([]os.DirEntry, error)
+
+	// Stat describes a file or directory
+	Stat(name string) (os.FileInfo, error)
+
+	// Link creates a hard link newname of the file oldname
+	Link(oldname, newname string) error
+
+	// Lock creates (if needed) and exclusively locks a file without blocking,
+	// closing the returned file releases the lock, fails with ErrLocked
+	// if the lock is held
+	Lock(name string) (File, error)
+
+	// SyncDir makes the entries of a directory durable
+	SyncDir(name string) error
+}
+
+// Default is the FS of the operating system
+var Default FS = OS{}
+
+// OrDefault returns fs, or Default if fs is nil
+func OrDefault(fs FS) FS {
+	if fs == nil {
+		return Default
+	}
+	return fs
+}
+
+// ReadFile reads a whole file, like os.ReadFile
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// WriteFile writes a whole file, like os.WriteFile
+func WriteFile(fs FS, name string, data []byte, perm os.FileMode) error {
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return errors.Join(err, f.Close())
+}
+
+// Walk calls fn for the directory root and everything below it, in
+// lexical order, like filepath.Walk
+//
+// Returning filepath.SkipDir for a directory skips its entries.
+func Walk(fs FS, root string, fn filepath.WalkFunc) error {
+	info, err := fs.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walk(fs, root, info, fn)
+	}
+	if errors.Is(err, filepath.SkipDir) || errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+func walk(fs FS, path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	entries, err := fs.ReadDir(path)
+	err1 := fn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, entry := range entries {
+		name := filepath.Join(path, entry.Name())
+		info, err := fs.Stat(name)
+		if err != nil {
+			if err := fn(name, info, err); err != nil && !errors.Is(err, filepath.SkipDir) {
+				return err
+			}
+			continue
+		}
+		if err := walk(fs, name, info, fn); err != nil {
+			if !info.IsDir() || !errors.Is(err, filepath.SkipDir) {
+				return err
+			}
+		}
+	}
+	return nil
+}
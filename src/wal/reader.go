@@ -0,0 +1,89 @@
+package wal
+
+import (
+	"bagh/value"
+	"bagh/vfs"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Record is an item of a WAL file, and the offset of its line
+type Record struct {
+	Offset int64
+	Item   value.Value
+}
+
+// Corruption is the position in a WAL file where it stops being readable
+type Corruption struct {
+	Path   string
+	Offset int64
+	Reason string
+}
+
+func (c *Corruption) Error() string {
+	return fmt.Sprintf("%s: %s at offset %d", c.Path, c.Reason, c.Offset)
+}
+
+// ReadFile reads the records of a WAL file in order, calling fn for each one
+//
+// Recovery treats the first empty, malformed or incomplete line as the end
+// of the log. Reading stops there, and the returned Corruption describes
+// it (nil if the whole file was read). Errors of fn stop reading as well.
+func ReadFile(fs vfs.FS, path string, fn func(Record) error) (*Corruption, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			return nil, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		complete := err == nil
+
+		content := bytes.TrimSuffix(line, []byte("\n"))
+		if len(content) == 0 {
+			return &Corruption{Path: path, Offset: offset, Reason: "empty line"}, nil
+		}
+
+		item, decodeErr := decodeEntry(content)
+		if decodeErr != nil {
+			reason := fmt.Sprintf("malformed entry: %v", decodeErr)
+			if !complete {
+				reason = fmt.Sprintf("truncated entry of %d bytes", len(line))
+			}
+			return &Corruption{Path: path, Offset: offset, Reason: reason}, nil
+		}
+
+		if err := fn(Record{Offset: offset, Item: item}); err != nil {
+			return nil, err
+		}
+		offset += int64(len(line))
+	}
+}
+
+// Files returns the paths of the WAL files in the folder, oldest first
+func Files(fs vfs.FS, path string) ([]string, error) {
+	generations, err := listWalFiles(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, len(generations))
+	for i, generation := range generations {
+		paths[i] = filepath.Join(path, walFileName(generation))
+	}
+	return paths, nil
+}
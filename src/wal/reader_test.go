@@ -0,0 +1,103 @@
+package wal
+
+import (
+	"bagh/value"
+	"bagh/vfs"
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeWal(t *testing.T, fs vfs.FS, items int) string {
+	w, _, err := OpenWal(fs, "/wal", nil, nil)
+	require.NoError(t, err)
+	for i := 0; i < items; i++ {
+		require.NoError(t, w.Write(*value.NewValue([]byte{'a' + byte(i)}, []byte("value"), value.SeqNo(i), value.Record)))
+	}
+	require.NoError(t, w.Close())
+
+	paths, err := Files(fs, "/wal")
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+	return paths[0]
+}
+
+func readAll(t *testing.T, fs vfs.FS, path string) ([]Record, *Corruption) {
+	var records []Record
+	corruption, err := ReadFile(fs, path, func(record Record) error {
+		records = append(records, record)
+		return nil
+	})
+	require.NoError(t, err)
+	return records, corruption
+}
+
+func appendTo(t *testing.T, fs vfs.FS, path string, content []byte) {
+	f, err := fs.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestReadFile(t *testing.T) {
+	fs := vfs.NewMemFS()
+	path := writeWal(t, fs, 3)
+
+	records, corruption := readAll(t, fs, path)
+	assert.Nil(t, corruption)
+	require.Len(t, records, 3)
+	assert.Equal(t, int64(0), records[0].Offset)
+	assert.Equal(t, []byte("b"), records[1].Item.Key)
+	assert.Equal(t, value.SeqNo(2), records[2].Item.SeqNo)
+
+	size := records[2].Offset + (records[2].Offset - records[1].Offset)
+
+	// A torn write at the end
+	appendTo(t, fs, path, []byte(`{"k":"d","v":"val`))
+	records, corruption = readAll(t, fs, path)
+	assert.Len(t, records, 3)
+	require.NotNil(t, corruption)
+	assert.Equal(t, size, corruption.Offset)
+	assert.Contains(t, corruption.Reason, "truncated")
+	assert.Contains(t, corruption.Error(), path)
+}
+
+func TestReadFileMalformed(t *testing.T) {
+	fs := vfs.NewMemFS()
+	path := writeWal(t, fs, 2)
+	appendTo(t, fs, path, []byte("garbage\n"))
+	appendTo(t, fs, path, []byte(`{"k":"z","v":"1","s":9,"t":0}`+"\n"))
+
+	records, corruption := readAll(t, fs, path)
+	assert.Len(t, records, 2, "nothing after the malformed line is read")
+	require.NotNil(t, corruption)
+	assert.Contains(t, corruption.Reason, "malformed")
+
+	// Recovery stops at the same place, and cuts off the rest of the file
+	_, mt, err := OpenWal(fs, "/wal", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, mt.Len())
+
+	records, corruption = readAll(t, fs, path)
+	assert.Len(t, records, 2)
+	assert.Nil(t, corruption)
+}
+
+func TestReadFileLargeValue(t *testing.T) {
+	fs := vfs.NewMemFS()
+	w, _, err := OpenWal(fs, "/wal", nil, nil)
+	require.NoError(t, err)
+	large := bytes.Repeat([]byte("x"), 1024*1024)
+	require.NoError(t, w.Write(*value.NewValue([]byte("a"), large, 0, value.Record)))
+	require.NoError(t, w.Close())
+
+	_, mt, err := OpenWal(fs, "/wal", nil, nil)
+	require.NoError(t, err)
+	item := mt.Get([]byte("a"), nil)
+	require.NotNil(t, item)
+	assert.Len(t, item.Value, len(large))
+}
@@ -0,0 +1,130 @@
+package wal
+
+import (
+	"bagh/logging"
+	"bagh/memtable"
+	"bagh/vfs"
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Tailer follows the WAL files of a folder written by another process
+//
+// Only complete lines are applied, a partially written entry is picked up
+// by the next call to Tail. The files are never modified.
+type Tailer struct {
+	fs   vfs.FS
+	path string
+
+	// Read position in each WAL generation
+	offsets map[uint64]int64
+
+	logger *slog.Logger
+}
+
+// NewTailer creates a tailer for the WAL files in the folder, logger may be nil
+func NewTailer(fs vfs.FS, path string, logger *slog.Logger) *Tailer {
+	return &Tailer{
+		fs:      fs,
+		path:    path,
+		offsets: make(map[uint64]int64),
+		logger:  logging.OrDiscard(logger),
+	}
+}
+
+// Tail applies the entries written since the last call to the memtable
+//
+// It reports whether a WAL file that has been read before is gone, which
+// means the writer flushed its memtable to a segment in the meantime.
+func (t *Tailer) Tail(mt *memtable.MemTable) (bool, error) {
+	generations, err := listWalFiles(t.fs, t.path)
+	if err != nil {
+		return false, err
+	}
+
+	present := make(map[uint64]struct{}, len(generations))
+	for _, generation := range generations {
+		present[generation] = struct{}{}
+	}
+
+	removed := false
+	for generation := range t.offsets {
+		if _, ok := present[generation]; !ok {
+			delete(t.offsets, generation)
+			removed = true
+		}
+	}
+
+	for _, generation := range generations {
+		offset, err := t.tailFile(generation, t.offsets[generation], mt)
+		if os.IsNotExist(err) {
+			if _, ok := t.offsets[generation]; ok {
+				delete(t.offsets, generation)
+				removed = true
+			}
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		t.offsets[generation] = offset
+	}
+
+	return removed, nil
+}
+
+// Reset forgets the read positions, so the next Tail reads all files from the start
+func (t *Tailer) Reset() {
+	t.offsets = make(map[uint64]int64)
+}
+
+// tailFile applies the complete lines after offset, and returns the new offset
+func (t *Tailer) tailFile(generation uint64, offset int64, mt *memtable.MemTable) (int64, error) {
+	walPath := filepath.Join(t.path, walFileName(generation))
+
+	file, err := t.fs.Open(walPath)
+	if err != nil {
+		return offset, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	reader := bufio.NewReader(file)
+	cnt := 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// Incomplete lines are still being written
+			break
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		value, err := decodeEntry(bytes.TrimSuffix(line, []byte("\n")))
+		if err != nil {
+			t.logger.Warn("Stopped tailing WAL at malformed content", logging.Path(walPath), slog.Int64("offset", offset))
+			break
+		}
+		if _, _, err := mt.Insert(value); err != nil {
+			return offset, err
+		}
+
+		offset += int64(len(line))
+		cnt++
+	}
+
+	if cnt > 0 {
+		t.logger.Debug("Tailed items from WAL", logging.Path(walPath), slog.Int("count", cnt))
+	}
+	return offset, nil
+}
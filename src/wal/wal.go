@@ -1,13 +1,20 @@
 package wal
 
 import (
+	"bagh/comparator"
+	"bagh/file"
+	"bagh/logging"
 	"bagh/memtable"
 	"bagh/value"
-	"bufio"
+	"bagh/vfs"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -18,38 +25,138 @@ type WalEntry struct {
 	ValueType uint8       `json:"t"`
 }
 
+// Wal is a write-ahead log split into generations
+//
+// Every memtable gets its own WAL files, when the memtable is sealed the
+// WAL is rotated, and the sealed files are removed once the memtable has
+// been flushed to a durable segment.
 type Wal struct {
-	Writer *os.File
+	Writer vfs.File
 	mutex  *sync.Mutex
+
+	fs         vfs.FS
+	path       string
+	generation uint64
+
+	// Files holding the items of the active memtable
+	live []string
+
+	logger *slog.Logger
 }
 
-func OpenWal(path string) (*Wal, *memtable.MemTable, error) {
-	walPath := filepath.Join(path, ".wal.jsonl")
+const (
+	walFilePrefix = ".wal."
+	walFileSuffix = "jsonl"
+)
 
-	if _, err := os.Stat(walPath); err == nil {
-		memtable, err := recoverWal(walPath)
-		if err != nil {
-			return nil, nil, err
+// walFileName returns the file name of a WAL generation,
+// generation 0 is the legacy single WAL file ".wal.jsonl"
+func walFileName(generation uint64) string {
+	if generation == 0 {
+		return walFilePrefix + walFileSuffix
+	}
+	return fmt.Sprintf("%s%d.%s", walFilePrefix, generation, walFileSuffix)
+}
+
+// parseWalFileName returns the generation of a WAL file name
+func parseWalFileName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, walFilePrefix) || !strings.HasSuffix(name, walFileSuffix) {
+		return 0, false
+	}
+	middle := strings.TrimSuffix(strings.TrimPrefix(name, walFilePrefix), walFileSuffix)
+	if middle == "" {
+		return 0, true
+	}
+	generation, err := strconv.ParseUint(strings.TrimSuffix(middle, "."), 10, 64)
+	if err != nil || !strings.HasSuffix(middle, ".") {
+		return 0, false
+	}
+	return generation, true
+}
+
+// listWalFiles returns the WAL generations in the folder, oldest first
+func listWalFiles(fs vfs.FS, path string) ([]uint64, error) {
+	entries, err := fs.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
 		}
+		return nil, err
+	}
 
-		writer, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			return nil, nil, err
+	var generations []uint64
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if generation, ok := parseWalFileName(entry.Name()); ok {
+			generations = append(generations, generation)
 		}
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i] < generations[j] })
+	return generations, nil
+}
 
-		wal := &Wal{Writer: writer}
-		return wal, memtable, nil
-	} else if os.IsNotExist(err) {
-		writer, err := os.OpenFile(walPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
-		if err != nil {
+// OpenWal replays all WAL files in the folder into a memtable ordered by cmp,
+// and opens a new WAL generation for writing, logger and cmp may be nil
+func OpenWal(fs vfs.FS, path string, logger *slog.Logger, cmp comparator.Comparator) (*Wal, *memtable.MemTable, error) {
+	logger = logging.OrDiscard(logger)
+
+	if err := file.MkdirAllSynced(fs, path); err != nil {
+		return nil, nil, err
+	}
+
+	generations, err := listWalFiles(fs, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mt := memtable.NewMemTableWithComparator(cmp)
+	live := make([]string, 0, len(generations)+1)
+	next := uint64(1)
+
+	for _, generation := range generations {
+		walPath := filepath.Join(path, walFileName(generation))
+		if err := recoverWal(fs, walPath, mt, logger); err != nil {
 			return nil, nil, err
 		}
+		live = append(live, walPath)
+		next = generation + 1
+	}
 
-		wal := &Wal{Writer: writer}
-		return wal, &memtable.MemTable{}, nil
-	} else {
+	wal := &Wal{
+		mutex:  &sync.Mutex{},
+		fs:     fs,
+		path:   path,
+		live:   live,
+		logger: logger,
+	}
+	if err := wal.openGeneration(next); err != nil {
 		return nil, nil, err
 	}
+
+	return wal, mt, nil
+}
+
+// openGeneration starts writing into a new WAL file, the caller has to hold the lock
+func (w *Wal) openGeneration(generation uint64) error {
+	walPath := filepath.Join(w.path, walFileName(generation))
+
+	writer, err := w.fs.OpenFile(walPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	// Synced writes into the file are lost as well if its directory entry is
+	// lost in a crash
+	if err := w.fs.SyncDir(w.path); err != nil {
+		writer.Close()
+		return err
+	}
+
+	w.Writer = writer
+	w.generation = generation
+	w.live = append(w.live, walPath)
+	return nil
 }
 
 func (w *Wal) Write(value value.Value) error {
@@ -79,61 +186,128 @@ func (w *Wal) Sync() error {
 	return w.Writer.Sync()
 }
 
-func (w *Wal) Truncate() error {
+// Rotate seals the WAL files of the active memtable, and starts a new generation
+//
+// The returned files must only be removed once the memtable they belong
+// to has been flushed, see Remove.
+func (w *Wal) Rotate() ([]string, error) {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
-	if err := w.Writer.Truncate(0); err != nil {
-		return err
+	if err := w.Writer.Sync(); err != nil {
+		return nil, err
 	}
-	_, err := w.Writer.Seek(0, 0)
-	if err != nil {
-		return err
+	if err := w.Writer.Close(); err != nil {
+		return nil, err
 	}
-	return w.Writer.Sync()
-}
-
-func recoverWal(path string) (*memtable.MemTable, error) {
-	fmt.Println("Recovering WAL")
 
-	memtable := &memtable.MemTable{}
+	sealed := w.live
+	w.live = nil
 
-	file, err := os.Open(path)
-	if err != nil {
+	if err := w.openGeneration(w.generation + 1); err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	return sealed, nil
+}
 
-	scanner := bufio.NewScanner(file)
-	cnt := 0
+// Size returns the size of all WAL files in the folder in bytes,
+// including sealed files that have not been removed yet
+func (w *Wal) Size() (uint64, error) {
+	generations, err := listWalFiles(w.fs, w.path)
+	if err != nil {
+		return 0, err
+	}
 
-	for idx := 0; scanner.Scan(); idx++ {
-		line := scanner.Text()
-		if line == "" {
-			break
+	var size uint64
+	for _, generation := range generations {
+		info, err := w.fs.Stat(filepath.Join(w.path, walFileName(generation)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, err
 		}
+		size += uint64(info.Size())
+	}
+	return size, nil
+}
 
-		var entry WalEntry
-		if err := json.Unmarshal([]byte(line), &entry); err != nil {
-			fmt.Printf("Truncating WAL to line %d because of malformed content\n", idx)
-			break
+// Remove deletes sealed WAL files
+func Remove(fs vfs.FS, paths []string) error {
+	for _, path := range paths {
+		if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
 		}
+	}
+	return nil
+}
 
-		value := value.Value{
-			Key:       []byte(entry.Key),
-			Value:     []byte(entry.Value),
-			SeqNo:     entry.Seqno,
-			ValueType: value.ValueTypeFromByte(entry.ValueType),
+func (w *Wal) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.Writer.Sync(); err != nil {
+		return err
+	}
+	return w.Writer.Close()
+}
+
+func recoverWal(fs vfs.FS, path string, memtable *memtable.MemTable, logger *slog.Logger) error {
+	logger.Debug("Recovering WAL", logging.Path(path))
+
+	cnt := 0
+	corruption, err := ReadFile(fs, path, func(record Record) error {
+		if _, _, err := memtable.Insert(record.Item); err != nil {
+			return err
 		}
-		memtable.Insert(value)
 		cnt++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if corruption != nil {
+		logger.Warn("Truncating WAL because of malformed content", logging.Path(path),
+			slog.Int64("offset", corruption.Offset), slog.String("reason", corruption.Reason))
+		if err := truncateWal(fs, path, corruption.Offset); err != nil {
+			return err
+		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	logger.Info("Recovered items from WAL", logging.Path(path), slog.Int("count", cnt))
+
+	return nil
+}
+
+// truncateWal cuts off the unreadable tail of a WAL file, so it cannot hide
+// records of a later recovery
+func truncateWal(fs vfs.FS, path string, size int64) error {
+	f, err := fs.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
 	}
+	return f.Close()
+}
 
-	fmt.Printf("Recovered %d items from WAL\n", cnt)
+// decodeEntry parses a single line of a WAL file
+func decodeEntry(line []byte) (value.Value, error) {
+	var entry WalEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return value.Value{}, err
+	}
 
-	return memtable, nil
+	return value.Value{
+		Key:       []byte(entry.Key),
+		Value:     []byte(entry.Value),
+		SeqNo:     entry.Seqno,
+		ValueType: value.ValueTypeFromByte(entry.ValueType),
+	}, nil
 }
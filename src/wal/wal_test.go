@@ -0,0 +1,95 @@
+package wal
+
+import (
+	"bagh/memtable"
+	"bagh/value"
+	"bagh/vfs"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalRotateAndRecover(t *testing.T) {
+	dir := t.TempDir()
+
+	w, mt, err := OpenWal(vfs.Default, dir, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, mt.IsEmpty())
+
+	assert.NoError(t, w.Write(*value.NewValue([]byte("a"), []byte("1"), 0, value.Record)))
+
+	sealed, err := w.Rotate()
+	assert.NoError(t, err)
+	assert.Len(t, sealed, 1)
+
+	assert.NoError(t, w.Write(*value.NewValue([]byte("b"), []byte("2"), 1, value.Record)))
+	assert.NoError(t, w.Close())
+
+	// Sealed files are replayed until they are removed
+	_, mt, err = OpenWal(vfs.Default, dir, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, mt.Len())
+
+	assert.NoError(t, Remove(vfs.Default, sealed))
+	_, err = os.Stat(sealed[0])
+	assert.True(t, os.IsNotExist(err))
+
+	_, mt, err = OpenWal(vfs.Default, dir, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, mt.Len())
+	assert.NotNil(t, mt.Get([]byte("b"), nil))
+}
+
+func TestParseWalFileName(t *testing.T) {
+	generation, ok := parseWalFileName(".wal.jsonl")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0), generation)
+
+	generation, ok = parseWalFileName(walFileName(42))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(42), generation)
+
+	_, ok = parseWalFileName(".wal.x.jsonl")
+	assert.False(t, ok)
+}
+
+func TestTailer(t *testing.T) {
+	dir := t.TempDir()
+
+	w, _, err := OpenWal(vfs.Default, dir, nil, nil)
+	assert.NoError(t, err)
+	defer w.Close()
+
+	tailer := NewTailer(vfs.Default, dir, nil)
+	mt := memtable.NewMemTable()
+
+	assert.NoError(t, w.Write(*value.NewValue([]byte("a"), []byte("1"), 0, value.Record)))
+	flushed, err := tailer.Tail(mt)
+	assert.NoError(t, err)
+	assert.False(t, flushed)
+	assert.Equal(t, 1, mt.Len())
+
+	// Incomplete lines are picked up once they are finished
+	_, err = io.WriteString(w.Writer, `{"k":"b","v":"2",`)
+	assert.NoError(t, err)
+	_, err = tailer.Tail(mt)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, mt.Len())
+
+	_, err = io.WriteString(w.Writer, `"s":1,"t":0}`+"\n")
+	assert.NoError(t, err)
+	_, err = tailer.Tail(mt)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, mt.Len())
+	assert.NotNil(t, mt.Get([]byte("b"), nil))
+
+	sealed, err := w.Rotate()
+	assert.NoError(t, err)
+	assert.NoError(t, Remove(vfs.Default, sealed))
+
+	flushed, err = tailer.Tail(mt)
+	assert.NoError(t, err)
+	assert.True(t, flushed)
+}
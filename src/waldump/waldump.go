@@ -0,0 +1,155 @@
+// Package waldump inspects WAL files offline, and replays them into a new tree
+//
+// Files are parsed with wal.ReadFile, the code recovery uses, so a dump shows
+// exactly the records recovery would apply, and where it would stop.
+package waldump
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"bagh/codec"
+	"bagh/config"
+	"bagh/tree"
+	"bagh/value"
+	"bagh/vfs"
+	"bagh/wal"
+)
+
+// Filter selects records by seqno and key prefix, the zero value selects all
+type Filter struct {
+	// Inclusive seqno range, MaxSeqNo 0 means no upper bound
+	MinSeqNo value.SeqNo
+	MaxSeqNo value.SeqNo
+
+	Prefix []byte
+}
+
+// Match returns true if the filter selects the item
+func (f *Filter) Match(item *value.Value) bool {
+	if item.SeqNo < f.MinSeqNo || (f.MaxSeqNo != 0 && item.SeqNo > f.MaxSeqNo) {
+		return false
+	}
+	return bytes.HasPrefix(item.Key, f.Prefix)
+}
+
+// Paths resolves the arguments of a dump, a folder stands for all of its WAL
+// files, oldest first
+func Paths(fs vfs.FS, args []string) ([]string, error) {
+	fs = vfs.OrDefault(fs)
+
+	var paths []string
+	for _, arg := range args {
+		info, err := fs.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+
+		files, err := wal.Files(fs, arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no WAL files in %s", arg)
+		}
+		paths = append(paths, files...)
+	}
+	return paths, nil
+}
+
+// Summary counts the records of a dump or replay
+type Summary struct {
+	Records int
+	Matched int
+
+	// Files that stop before their end, recovery ignores the rest of them
+	Corruptions []*wal.Corruption
+}
+
+// Read calls fn for every record of the files the filter selects, in order
+func Read(fs vfs.FS, paths []string, filter Filter, fn func(path string, record wal.Record) error) (*Summary, error) {
+	fs = vfs.OrDefault(fs)
+
+	summary := &Summary{}
+	for _, path := range paths {
+		corruption, err := wal.ReadFile(fs, path, func(record wal.Record) error {
+			summary.Records++
+			if !filter.Match(&record.Item) {
+				return nil
+			}
+			summary.Matched++
+			return fn(path, record)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if corruption != nil {
+			summary.Corruptions = append(summary.Corruptions, corruption)
+		}
+	}
+	return summary, nil
+}
+
+// Write prints every selected record with its seqno, type, key and value
+// size, followed by the corruptions and a summary
+func Write(w io.Writer, fs vfs.FS, paths []string, filter Filter, format codec.KeyFormat) (*Summary, error) {
+	summary, err := Read(fs, paths, filter, func(path string, record wal.Record) error {
+		item := &record.Item
+		_, err := fmt.Fprintf(w, "%s:%d seqno=%d type=%s key=%s value_size=%d\n",
+			path, record.Offset, item.SeqNo, codec.TypeName(item.ValueType), format(item.Key), len(item.Value))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, corruption := range summary.Corruptions {
+		fmt.Fprintf(w, "%s: recovery stops at offset %d: %s\n", corruption.Path, corruption.Offset, corruption.Reason)
+	}
+	_, err = fmt.Fprintf(w, "%d records, %d selected, %d files cut short\n", summary.Records, summary.Matched, len(summary.Corruptions))
+	return summary, err
+}
+
+// Replay writes the selected records into a new tree at dest, with their
+// original seqnos, and flushes them to segments
+//
+// The tree can be opened by a store, fs is the filesystem of both the WAL
+// files and the tree.
+func Replay(fs vfs.FS, paths []string, filter Filter, dest string) (*Summary, error) {
+	fs = vfs.OrDefault(fs)
+	if _, err := fs.Stat(dest); !os.IsNotExist(err) {
+		return nil, fmt.Errorf("replay target %s must not exist yet", dest)
+	}
+
+	t, err := tree.Open(*config.NewConfig(dest).SetFS(fs))
+	if err != nil {
+		return nil, err
+	}
+
+	summary, err := Read(fs, paths, filter, func(_ string, record wal.Record) error {
+		_, size, err := t.AppendEntry(record.Item)
+		if err != nil {
+			return err
+		}
+		if maxSize := t.MaxMemtableSize(); maxSize > 0 && *size > maxSize {
+			_, err = t.FlushActiveMemtable()
+		}
+		return err
+	})
+	if err == nil {
+		_, err = t.FlushActiveMemtable()
+	}
+	if closeErr := t.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
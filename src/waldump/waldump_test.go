@@ -0,0 +1,98 @@
+package waldump
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"bagh/codec"
+	"bagh/config"
+	"bagh/tree"
+	"bagh/value"
+	"bagh/vfs"
+	"bagh/wal"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeWal writes user:0..4 and admin:0..4 with seqnos 0 to 9, removing user:2
+// at seqno 10, then rotates and writes a truncated entry
+func writeWal(t *testing.T, fs vfs.FS) {
+	w, _, err := wal.OpenWal(fs, "/wal", nil, nil)
+	require.NoError(t, err)
+
+	seqno := value.SeqNo(0)
+	for _, p := range []string{"user", "admin"} {
+		for i := 0; i < 5; i++ {
+			key := []byte(fmt.Sprintf("%s:%d", p, i))
+			require.NoError(t, w.Write(*value.NewValue(key, []byte("value"), seqno, value.Record)))
+			seqno++
+		}
+	}
+	require.NoError(t, w.Write(*value.NewValue([]byte("user:2"), []byte{}, seqno, value.Tombstone)))
+
+	_, err = w.Rotate()
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	paths, err := wal.Files(fs, "/wal")
+	require.NoError(t, err)
+	f, err := fs.OpenFile(paths[len(paths)-1], os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte(`{"k":"user:9"`))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestWrite(t *testing.T) {
+	fs := vfs.NewMemFS()
+	writeWal(t, fs)
+
+	paths, err := Paths(fs, []string{"/wal"})
+	require.NoError(t, err)
+	require.Len(t, paths, 2)
+
+	format := codec.String.Format
+
+	var out bytes.Buffer
+	summary, err := Write(&out, fs, paths, Filter{Prefix: []byte("user:"), MinSeqNo: 2}, format)
+	require.NoError(t, err)
+	assert.Equal(t, 11, summary.Records)
+	assert.Equal(t, 4, summary.Matched)
+	require.Len(t, summary.Corruptions, 1)
+	assert.Equal(t, int64(0), summary.Corruptions[0].Offset)
+
+	assert.Contains(t, out.String(), "seqno=2 type=record key=user:2 value_size=5\n")
+	assert.Contains(t, out.String(), "seqno=10 type=tombstone key=user:2 value_size=0\n")
+	assert.NotContains(t, out.String(), "admin")
+	assert.Contains(t, out.String(), "recovery stops at offset 0: truncated entry of 13 bytes")
+	assert.Contains(t, out.String(), "11 records, 4 selected, 1 files cut short")
+}
+
+func TestReplay(t *testing.T) {
+	fs := vfs.NewMemFS()
+	writeWal(t, fs)
+	paths, err := Paths(fs, []string{"/wal"})
+	require.NoError(t, err)
+
+	summary, err := Replay(fs, paths, Filter{Prefix: []byte("user:")}, "/replayed")
+	require.NoError(t, err)
+	assert.Equal(t, 6, summary.Matched)
+
+	_, err = Replay(fs, paths, Filter{}, "/replayed")
+	assert.Error(t, err, "the target exists")
+
+	replayed, err := tree.Open(*config.NewConfig("/replayed").SetFS(fs))
+	require.NoError(t, err)
+	defer replayed.Close()
+
+	assert.Equal(t, value.SeqNo(10), replayed.GetSegmentLSN())
+	var keys []string
+	iter := replayed.Iter().IntoIter()
+	for key, _, ok := iter.Next(); ok; key, _, ok = iter.Next() {
+		keys = append(keys, string(*key))
+	}
+	assert.Equal(t, []string{"user:0", "user:1", "user:3", "user:4"}, keys)
+}